@@ -0,0 +1,221 @@
+package cookie
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+const (
+	secretLength  = 32
+	versionLength = 4
+	// Cookies are 1 to 64 octets long (RFC 7296 - 2.6)
+	maxCookieLength = 64
+)
+
+type secret struct {
+	version uint32
+	value   []byte
+	created time.Time
+}
+
+// Generator computes and verifies the cookies of the IKE_SA_INIT requests
+// (RFC 7296 - 2.6):
+//
+//	Cookie = <VersionIDofSecret> | Hash(Ni | IPi | SPIi | <secret>)
+//
+// The secret is replaced every RotateInterval, and the cookies of the previous
+// secret are accepted for GracePeriod after it is replaced.
+type Generator struct {
+	// Number of half-open IKE SAs from which cookies are required
+	Threshold      int
+	RotateInterval time.Duration
+	GracePeriod    time.Duration
+
+	mu       sync.Mutex
+	current  *secret
+	previous *secret
+	// Time the previous secret is replaced at
+	retired time.Time
+
+	now func() time.Time
+}
+
+func NewGenerator(threshold int, rotateInterval, gracePeriod time.Duration) (*Generator, error) {
+	g := &Generator{
+		Threshold:      threshold,
+		RotateInterval: rotateInterval,
+		GracePeriod:    gracePeriod,
+		now:            time.Now,
+	}
+	if err := g.Rotate(); err != nil {
+		return nil, errors.Wrapf(err, "NewGenerator()")
+	}
+	return g, nil
+}
+
+// Required reports whether the IKE_SA_INIT requests must return a cookie,
+// given the number of half-open IKE SAs
+func (g *Generator) Required(halfOpen int) bool {
+	return halfOpen >= g.Threshold
+}
+
+// Rotate replaces the secret, the previous one is kept for the grace period
+func (g *Generator) Rotate() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rotate()
+}
+
+func (g *Generator) rotate() error {
+	value := make([]byte, secretLength)
+	if _, err := io.ReadFull(rand.Reader, value); err != nil {
+		return errors.Wrapf(err, "Rotate()")
+	}
+
+	now := g.now()
+	next := &secret{
+		value:   value,
+		created: now,
+	}
+	if g.current != nil {
+		next.version = g.current.version + 1
+	}
+	g.previous, g.current = g.current, next
+	g.retired = now
+	return nil
+}
+
+// Generate returns the cookie of the IKE_SA_INIT request with nonce ni, from
+// ipi and initiator SPI spii
+func (g *Generator) Generate(ni []byte, ipi netip.Addr, spii uint64) ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.now().Sub(g.current.created) >= g.RotateInterval {
+		if err := g.rotate(); err != nil {
+			return nil, errors.Wrapf(err, "Generate()")
+		}
+	}
+	return g.current.cookie(ni, ipi, spii), nil
+}
+
+// Verify checks a cookie returned in an IKE_SA_INIT request against the
+// current secret, or the previous one during the grace period
+func (g *Generator) Verify(cookie, ni []byte, ipi netip.Addr, spii uint64) error {
+	if len(cookie) < versionLength {
+		return errors.Errorf("Verify(): Cookie too short: %d", len(cookie))
+	}
+	version := binary.BigEndian.Uint32(cookie[:versionLength])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var s *secret
+	switch {
+	case version == g.current.version:
+		s = g.current
+	case g.previous != nil && version == g.previous.version:
+		if g.now().Sub(g.retired) > g.GracePeriod {
+			return errors.Errorf("Verify(): Cookie of secret %d is expired", version)
+		}
+		s = g.previous
+	default:
+		return errors.Errorf("Verify(): Unknown secret version %d", version)
+	}
+	if !hmac.Equal(cookie, s.cookie(ni, ipi, spii)) {
+		return errors.Errorf("Verify(): Cookie mismatch")
+	}
+	return nil
+}
+
+func (s *secret) cookie(ni []byte, ipi netip.Addr, spii uint64) []byte {
+	mac := hmac.New(sha256.New, s.value)
+	mac.Write(ni)
+	mac.Write(ipi.Unmap().AsSlice())
+	spi := make([]byte, 8)
+	binary.BigEndian.PutUint64(spi, spii)
+	mac.Write(spi)
+
+	cookie := make([]byte, versionLength, versionLength+sha256.Size)
+	binary.BigEndian.PutUint32(cookie, s.version)
+	return mac.Sum(cookie)
+}
+
+// CheckRequest decides whether an IKE_SA_INIT request from ipi may set up a
+// half-open IKE SA. If a cookie is required and the request does not return a
+// valid one, the stateless response carrying a new cookie is returned, and
+// the request is to be dropped. The cookie is returned as the first payload of
+// the request (RFC 7296 - 2.6), a request with a COOKIE notification anywhere
+// else is rejected.
+func (g *Generator) CheckRequest(
+	request *message.IKEMessage, ipi netip.Addr, halfOpen int,
+) (*message.IKEMessage, error) {
+	if !g.Required(halfOpen) {
+		return nil, nil
+	}
+
+	var cookie, ni []byte
+	for i, payload := range request.Payloads {
+		switch payload := payload.(type) {
+		case *message.Notification:
+			if payload.NotifyMessageType != message.COOKIE {
+				continue
+			}
+			if i != 0 {
+				return nil, errors.Errorf("CheckRequest(): COOKIE notification is payload %d, not the first one", i)
+			}
+			cookie = payload.NotificationData
+		case *message.Nonce:
+			ni = payload.NonceData
+		}
+	}
+	if ni == nil {
+		return nil, errors.Errorf("CheckRequest(): Missing Nonce payload")
+	}
+
+	// A stale or invalid cookie is answered with a new one
+	if cookie != nil && g.Verify(cookie, ni, ipi, request.InitiatorSPI) == nil {
+		return nil, nil
+	}
+	newCookie, err := g.Generate(ni, ipi, request.InitiatorSPI)
+	if err != nil {
+		return nil, errors.Wrapf(err, "CheckRequest()")
+	}
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNotification(message.TypeNone, message.COOKIE, nil, newCookie)
+	return message.NewMessage(request.InitiatorSPI, 0, message.IKE_SA_INIT,
+		true, false, request.MessageID, payloads), nil
+}
+
+// WithCookie returns the payloads of an IKE_SA_INIT request sent again with
+// cookie as the first payload, replacing the cookie sent before
+func WithCookie(payloads message.IKEPayloadContainer, cookie []byte) (message.IKEPayloadContainer, error) {
+	if len(cookie) == 0 || len(cookie) > maxCookieLength {
+		return nil, errors.Errorf("WithCookie(): Invalid cookie length %d", len(cookie))
+	}
+
+	var withCookie message.IKEPayloadContainer
+	withCookie.BuildNotification(message.TypeNone, message.COOKIE, nil, cookie)
+	for _, payload := range payloads {
+		if notification, ok := payload.(*message.Notification); ok &&
+			notification.NotifyMessageType == message.COOKIE {
+			if bytes.Equal(notification.NotificationData, cookie) {
+				return nil, errors.Errorf("WithCookie(): Cookie is asked for again")
+			}
+			continue
+		}
+		withCookie = append(withCookie, payload)
+	}
+	return withCookie, nil
+}
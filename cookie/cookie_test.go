@@ -0,0 +1,150 @@
+package cookie
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+func TestGenerator(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g, err := NewGenerator(10, time.Minute, 10*time.Second)
+	require.NoError(t, err)
+	g.now = func() time.Time { return now }
+	require.NoError(t, g.Rotate())
+
+	ni := []byte("initiator nonce")
+	ipi := netip.MustParseAddr("203.0.113.7")
+	const spii = 0x000000000006f708
+
+	cookie, err := g.Generate(ni, ipi, spii)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(cookie), maxCookieLength)
+	require.NoError(t, g.Verify(cookie, ni, ipi, spii))
+	require.NoError(t, g.Verify(cookie, ni, netip.MustParseAddr("::ffff:203.0.113.7"), spii))
+	require.Error(t, g.Verify(cookie, []byte("other nonce"), ipi, spii))
+	require.Error(t, g.Verify(cookie, ni, netip.MustParseAddr("203.0.113.8"), spii))
+	require.Error(t, g.Verify(cookie, ni, ipi, spii+1))
+	require.Error(t, g.Verify(cookie[:versionLength-1], ni, ipi, spii))
+
+	// The secret is replaced after the interval, the cookie of the previous one
+	// is accepted for the grace period
+	now = now.Add(time.Minute)
+	newCookie, err := g.Generate(ni, ipi, spii)
+	require.NoError(t, err)
+	require.NotEqual(t, cookie, newCookie)
+	require.NoError(t, g.Verify(newCookie, ni, ipi, spii))
+	now = now.Add(10 * time.Second)
+	require.NoError(t, g.Verify(cookie, ni, ipi, spii))
+	now = now.Add(time.Second)
+	require.Error(t, g.Verify(cookie, ni, ipi, spii))
+	require.NoError(t, g.Verify(newCookie, ni, ipi, spii))
+
+	// Two rotations drop the secret
+	require.NoError(t, g.Rotate())
+	require.NoError(t, g.Rotate())
+	require.Error(t, g.Verify(newCookie, ni, ipi, spii))
+}
+
+func TestCheckRequest(t *testing.T) {
+	g, err := NewGenerator(2, time.Minute, 10*time.Second)
+	require.NoError(t, err)
+	ipi := netip.MustParseAddr("203.0.113.7")
+
+	var payloads message.IKEPayloadContainer
+	payloads.BuildSecurityAssociation()
+	payloads.BuildNonce([]byte("initiator nonce"))
+	request := message.NewMessage(0x000000000006f708, 0, message.IKE_SA_INIT, false, true, 0, payloads)
+
+	response, err := g.CheckRequest(request, ipi, 1)
+	require.NoError(t, err)
+	require.Nil(t, response)
+
+	response, err = g.CheckRequest(request, ipi, 2)
+	require.NoError(t, err)
+	require.NotNil(t, response)
+	require.True(t, response.IsResponse())
+	require.Equal(t, request.InitiatorSPI, response.InitiatorSPI)
+	require.Zero(t, response.ResponderSPI)
+	require.Len(t, response.Payloads, 1)
+	notification := response.Payloads[0].(*message.Notification)
+	require.Equal(t, uint16(message.COOKIE), notification.NotifyMessageType)
+
+	testcases := []struct {
+		description string
+		cookie      []byte
+		ipi         netip.Addr
+		expectNew   bool
+	}{
+		{
+			description: "Valid cookie",
+			cookie:      notification.NotificationData,
+			ipi:         ipi,
+		},
+		{
+			description: "Cookie of another address",
+			cookie:      notification.NotificationData,
+			ipi:         netip.MustParseAddr("203.0.113.8"),
+			expectNew:   true,
+		},
+		{
+			description: "Invalid cookie",
+			cookie:      []byte{0x01},
+			ipi:         ipi,
+			expectNew:   true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			withCookie, err := WithCookie(request.Payloads, tc.cookie)
+			require.NoError(t, err)
+			retry := message.NewMessage(request.InitiatorSPI, 0, message.IKE_SA_INIT, false, true, 0, withCookie)
+
+			response, err := g.CheckRequest(retry, tc.ipi, 2)
+			require.NoError(t, err)
+			if !tc.expectNew {
+				require.Nil(t, response)
+				return
+			}
+			require.NotNil(t, response)
+			require.NotEqual(t, tc.cookie, response.Payloads[0].(*message.Notification).NotificationData)
+		})
+	}
+
+	_, err = g.CheckRequest(message.NewMessage(request.InitiatorSPI, 0, message.IKE_SA_INIT,
+		false, true, 0, nil), ipi, 2)
+	require.Error(t, err)
+
+	// A valid cookie which is not the first payload
+	misplaced := append(message.IKEPayloadContainer{}, request.Payloads...)
+	misplaced.BuildNotification(message.TypeNone, message.COOKIE, nil, notification.NotificationData)
+	response, err = g.CheckRequest(message.NewMessage(request.InitiatorSPI, 0, message.IKE_SA_INIT,
+		false, true, 0, misplaced), ipi, 2)
+	require.Error(t, err)
+	require.Nil(t, response)
+}
+
+func TestWithCookie(t *testing.T) {
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNotification(message.TypeNone, message.COOKIE, nil, []byte("old cookie"))
+	payloads.BuildSecurityAssociation()
+	payloads.BuildNonce([]byte("initiator nonce"))
+
+	withCookie, err := WithCookie(payloads, []byte("new cookie"))
+	require.NoError(t, err)
+	require.Len(t, withCookie, 3)
+	require.Equal(t, []byte("new cookie"), withCookie[0].(*message.Notification).NotificationData)
+	require.Equal(t, payloads[1:], withCookie[1:])
+
+	_, err = WithCookie(payloads, []byte("old cookie"))
+	require.Error(t, err)
+	_, err = WithCookie(payloads, nil)
+	require.Error(t, err)
+	_, err = WithCookie(payloads, make([]byte, maxCookieLength+1))
+	require.Error(t, err)
+}
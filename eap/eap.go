@@ -23,7 +23,7 @@ const (
 	EapTypeMD5
 	EapTypeOTP
 	EapTypeGTC
-	EapTypeAKA              = 23
+	EapTypeAKA      EapType = 23
 	EapTypeAkaPrime EapType = 50
 	EapTypeExpanded EapType = 254
 )
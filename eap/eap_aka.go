@@ -2,17 +2,19 @@ package eap
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
-	"io"
+	"math/bits"
 	"sort"
 
 	"github.com/pkg/errors"
 )
 
-// Type definition for EAP-AKA (Type 23)
-
+// Attribute Types for EAP-AKA (RFC 4187 - 11)
 type EapAkaAttrType uint8
 
 const (
@@ -20,241 +22,533 @@ const (
 	AKA_AT_AUTN              EapAkaAttrType = 2
 	AKA_AT_RES               EapAkaAttrType = 3
 	AKA_AT_AUTS              EapAkaAttrType = 4
+	AKA_AT_PADDING           EapAkaAttrType = 6
+	AKA_AT_PERMANENT_ID_REQ  EapAkaAttrType = 10
 	AKA_AT_MAC               EapAkaAttrType = 11
 	AKA_AT_NOTIFICATION      EapAkaAttrType = 12
 	AKA_AT_ANY_ID_REQ        EapAkaAttrType = 13
 	AKA_AT_IDENTITY          EapAkaAttrType = 14
+	AKA_AT_FULLAUTH_ID_REQ   EapAkaAttrType = 17
+	AKA_AT_COUNTER           EapAkaAttrType = 19
+	AKA_AT_COUNTER_TOO_SMALL EapAkaAttrType = 20
+	AKA_AT_NONCE_S           EapAkaAttrType = 21
 	AKA_AT_CLIENT_ERROR_CODE EapAkaAttrType = 22
+	AKA_AT_IV                EapAkaAttrType = 129
+	AKA_AT_ENCR_DATA         EapAkaAttrType = 130
+	AKA_AT_NEXT_PSEUDONYM    EapAkaAttrType = 132
+	AKA_AT_NEXT_REAUTH_ID    EapAkaAttrType = 133
+	AKA_AT_CHECKCODE         EapAkaAttrType = 134
+	AKA_AT_RESULT_IND        EapAkaAttrType = 135
 )
 
+var akaAttrTypeStr map[EapAkaAttrType]string = map[EapAkaAttrType]string{
+	AKA_AT_RAND:              "AT_RAND",
+	AKA_AT_AUTN:              "AT_AUTN",
+	AKA_AT_RES:               "AT_RES",
+	AKA_AT_AUTS:              "AT_AUTS",
+	AKA_AT_PADDING:           "AT_PADDING",
+	AKA_AT_PERMANENT_ID_REQ:  "AT_PERMANENT_ID_REQ",
+	AKA_AT_MAC:               "AT_MAC",
+	AKA_AT_NOTIFICATION:      "AT_NOTIFICATION",
+	AKA_AT_ANY_ID_REQ:        "AT_ANY_ID_REQ",
+	AKA_AT_IDENTITY:          "AT_IDENTITY",
+	AKA_AT_FULLAUTH_ID_REQ:   "AT_FULLAUTH_ID_REQ",
+	AKA_AT_COUNTER:           "AT_COUNTER",
+	AKA_AT_COUNTER_TOO_SMALL: "AT_COUNTER_TOO_SMALL",
+	AKA_AT_NONCE_S:           "AT_NONCE_S",
+	AKA_AT_CLIENT_ERROR_CODE: "AT_CLIENT_ERROR_CODE",
+	AKA_AT_IV:                "AT_IV",
+	AKA_AT_ENCR_DATA:         "AT_ENCR_DATA",
+	AKA_AT_NEXT_PSEUDONYM:    "AT_NEXT_PSEUDONYM",
+	AKA_AT_NEXT_REAUTH_ID:    "AT_NEXT_REAUTH_ID",
+	AKA_AT_CHECKCODE:         "AT_CHECKCODE",
+	AKA_AT_RESULT_IND:        "AT_RESULT_IND",
+}
+
+func (t EapAkaAttrType) String() string {
+	s, ok := akaAttrTypeStr[t]
+	if !ok {
+		return fmt.Sprintf("EAP-AKA attribute type[%d] is not supported", t.Value())
+	}
+	return s
+}
+
+func (t EapAkaAttrType) Value() uint8 { return uint8(t) }
+
+// Length of the values of EAP-AKA attributes (in bytes)
 const (
-	EAPAKASubTypeChallenge = 1
-	EAPAKASubTypeIdentity  = 5
+	EapAkaRANDLen      = 16
+	EapAkaAUTNLen      = 16
+	EapAkaAUTSLen      = 14
+	EapAkaMACLen       = 16
+	EapAkaIVLen        = 16
+	EapAkaNonceSLen    = 16
+	EapAkaCheckcodeLen = 20
 )
 
+// Definition of EAP-AKA
+
 var _ EapTypeData = &EapAka{}
 
 type EapAka struct {
-	SubType    EapAkaSubtype
-	Reserved   uint16
-	Attributes map[EapAkaAttrType]*EapAkaAttr
-}
-
-type EapAkaAttr struct {
-	AttrType            EapAkaAttrType
-	Length              uint8
-	Reserved            uint16
-	Value               []byte
-	Identity            string
-	Identity_actual_len uint8
-	Padding             string
+	subType    EapAkaSubtype
+	reserved   uint16
+	attributes map[EapAkaAttrType]*EapAkaAttr
 }
 
 func NewEapAka(subType EapAkaSubtype) *EapAka {
 	return &EapAka{
-		SubType:    subType,
-		Attributes: make(map[EapAkaAttrType]*EapAkaAttr),
+		subType:    subType,
+		attributes: make(map[EapAkaAttrType]*EapAkaAttr),
 	}
 }
 
 func (eapAka *EapAka) Type() EapType { return EapTypeAKA }
 
+func (eapAka *EapAka) SubType() EapAkaSubtype { return eapAka.subType }
+
 func (eapAka *EapAka) SetAttr(attrType EapAkaAttrType, value []byte) error {
-	if eapAka.Attributes == nil {
-		eapAka.Attributes = make(map[EapAkaAttrType]*EapAkaAttr)
+	if eapAka.attributes == nil {
+		eapAka.attributes = make(map[EapAkaAttrType]*EapAkaAttr)
 	}
+
 	attr := new(EapAkaAttr)
-	attr.AttrType = attrType
-	attr.Value = make([]byte, len(value))
-	copy(attr.Value, value)
 
-	switch attrType {
-	case AKA_AT_RAND, AKA_AT_AUTN, AKA_AT_MAC:
-		if len(value) != 16 {
-			return fmt.Errorf("attribute %v requires 16 bytes, got %d", attrType, len(value))
-		}
-		attr.Length = 5
-	case AKA_AT_AUTS:
-		if len(value) != 14 {
-			return fmt.Errorf("attribute %v requires 14 bytes, got %d", attrType, len(value))
-		}
-		attr.Length = 4
-	case AKA_AT_RES:
-		bitLen := len(value) * 8
-		if bitLen < 32 || bitLen > 128 {
-			return fmt.Errorf("RES must be between 32 and 128 bits, got %d", bitLen)
-		}
-		attr.Reserved = uint16(bitLen)
-		padding := (4 - (len(value)+4)%4) % 4
-		attr.Length = uint8((len(value) + 4 + padding) / 4)
-		padded := make([]byte, len(value)+padding)
-		copy(padded, value)
-		attr.Value = padded
-	case AKA_AT_NOTIFICATION, AKA_AT_CLIENT_ERROR_CODE:
-		if len(value) != 2 {
-			return fmt.Errorf("attribute %v requires 2 bytes, got %d", attrType, len(value))
-		}
-		attr.Length = 1
-		attr.Reserved = binary.BigEndian.Uint16(value)
-		attr.Value = nil
-	case AKA_AT_IDENTITY:
-		attr.Length = uint8((len(value) + 4 + 3) / 4)
-	default:
-		return fmt.Errorf("unsupported attribute type: %v", attrType)
+	err := attr.setAttr(attrType, value)
+	if err != nil {
+		return errors.Wrapf(err, "EAP-AKA SetAttr failed")
 	}
-	eapAka.Attributes[attrType] = attr
+
+	eapAka.attributes[attr.attrType] = attr
 	return nil
 }
 
 func (eapAka *EapAka) GetAttr(attrType EapAkaAttrType) (EapAkaAttr, error) {
-	if eapAka.Attributes == nil {
-		return EapAkaAttr{}, errors.Errorf("EAP-AKA Attributes map is nil")
+	if eapAka.attributes == nil {
+		return EapAkaAttr{}, errors.Errorf("EAP-AKA attributes map is nil")
 	}
-	for _, attr := range eapAka.Attributes {
-		if attr.AttrType == attrType {
-			return *attr, nil
-		}
+
+	attr, ok := eapAka.attributes[attrType]
+	if !ok {
+		return EapAkaAttr{}, errors.Errorf("EAP-AKA attribute[%s] is not found", attrType)
 	}
-	return EapAkaAttr{}, errors.Errorf("EAP-AKA attribute[%d] not found", attrType)
+	return *attr, nil
 }
 
-// 这里是写结果的，其中Reserved，subType都是可以在这里写了
 func (eapAka *EapAka) Marshal() ([]byte, error) {
 	buffer := new(bytes.Buffer)
+
 	buffer.WriteByte(byte(EapTypeAKA))
-	buffer.WriteByte(byte(eapAka.SubType))
-	binary.Write(buffer, binary.BigEndian, eapAka.Reserved)
+	buffer.WriteByte(byte(eapAka.subType))
+	err := binary.Write(buffer, binary.BigEndian, eapAka.reserved)
+	if err != nil {
+		return nil, errors.Wrapf(err, "EAP-AKA Marshal(): write reserved failed")
+	}
+
+	buffer.Write(eapAka.marshalAttrs())
+	return buffer.Bytes(), nil
+}
+
+// marshalAttrs encodes the attributes in ascending type order
+func (eapAka *EapAka) marshalAttrs() []byte {
+	buffer := new(bytes.Buffer)
 
 	for _, key := range eapAka.getAttrsKeys() {
-		attr := eapAka.Attributes[key]
-		if err := binary.Write(buffer, binary.BigEndian, byte(attr.AttrType)); err != nil {
-			return nil, err
-		}
+		attr := eapAka.attributes[key]
 
-		if err := binary.Write(buffer, binary.BigEndian, attr.Length); err != nil {
-			return nil, err
-		}
-		if attr.AttrType == AKA_AT_IDENTITY {
-			// 写 2 字节大端的 Identity 实际长度（54 -> 0x00 0x36）
-			if err := binary.Write(buffer, binary.BigEndian, uint16(len(attr.Identity))); err != nil {
-				return nil, err
-			}
-			if _, err := buffer.Write([]byte(attr.Identity)); err != nil {
-				return nil, err
-			}
-			// 写 Padding（把十六进制字符串转成字节再写，比如 "0000" -> 0x00 0x00）
-			if attr.Padding != "" {
-				p, err := hex.DecodeString(attr.Padding) // 需要：import "encoding/hex"
-				if err != nil {
-					return nil, err
-				}
-				if _, err := buffer.Write(p); err != nil {
-					return nil, err
-				}
-			}
+		buffer.WriteByte(attr.attrType.Value())
+		buffer.WriteByte(attr.length)
+
+		// AT_AUTS has no reserved field
+		headerLen := EapAkaAttrTypeLen + EapAkaAttrLengthLen
+		if attr.attrType != AKA_AT_AUTS {
+			_ = binary.Write(buffer, binary.BigEndian, attr.reserved)
+			headerLen += EapAkaAttrReservedLen
 		}
-		if err := binary.Write(buffer, binary.BigEndian, attr.Value); err != nil {
-			return nil, err
+		buffer.Write(attr.value)
+
+		// Pad the values of variable length to the attribute length
+		if paddingLen := 4*int(attr.length) - headerLen - len(attr.value); paddingLen > 0 {
+			buffer.Write(make([]byte, paddingLen))
 		}
 	}
-	return buffer.Bytes(), nil
+
+	return buffer.Bytes()
 }
 
 func (eapAka *EapAka) Unmarshal(rawData []byte) error {
 	if len(rawData) < 4 {
-		return errors.New("EAP-AKA Unmarshal(): insufficient bytes")
-	}
-	buf := bytes.NewReader(rawData)
-	typeCode, _ := buf.ReadByte()
-	if EapType(typeCode) != EapTypeAKA {
-		return fmt.Errorf("unexpected EAP type: %d", typeCode)
-	}
-	subtype, _ := buf.ReadByte()
-	eapAka.SubType = EapAkaSubtype(subtype)
-	reserved := make([]byte, 2)
-	io.ReadFull(buf, reserved)
-	eapAka.Reserved = binary.BigEndian.Uint16(reserved)
-	eapAka.Attributes = map[EapAkaAttrType]*EapAkaAttr{}
-
-	for buf.Len() > 0 {
-		// 读 Type / Length
-		t, _ := buf.ReadByte()
-		attrType := EapAkaAttrType(t)
-		l, _ := buf.ReadByte()
-		attr := &EapAkaAttr{AttrType: attrType, Length: l}
-
-		totalLen := int(attr.Length) * 4
-
-		// 读 Reserved（除 AUTS 外都有）
-		consumed := 2 // 已消费：Type(1)+Length(1)
-		if attrType != AKA_AT_AUTS {
-			r := make([]byte, 2)
-			if _, err := buf.Read(r); err != nil {
-				return fmt.Errorf("read reserved failed: %w", err)
-			}
-			attr.Reserved = binary.BigEndian.Uint16(r)
-			consumed += 2
-		}
+		return errors.New("EAP-AKA Unmarshal(): no sufficient bytes to decode the EAP-AKA type")
+	}
 
-		// 计算 Value 长度
-		valLen := totalLen - consumed
+	typeCode := EapType(rawData[0])
+	if typeCode != EapTypeAKA {
+		return errors.Errorf("EAP-AKA Unmarshal(): expect EAP type is %d but got %d", EapTypeAKA, typeCode)
+	}
+	eapAka.subType = EapAkaSubtype(rawData[1])
+	eapAka.reserved = binary.BigEndian.Uint16(rawData[2:4])
 
-		// 按类型修正/校验
-		switch attrType {
-		case AKA_AT_RAND:
-			// Length 应为 5，总 20；Value 应为 16B
-			if valLen != 16 {
-				return fmt.Errorf("AT_RAND: invalid value len=%d, want 16", valLen)
-			}
-		case AKA_AT_AUTN:
-			if valLen != 16 {
-				return fmt.Errorf("AT_AUTN: invalid value len=%d, want 16", valLen)
-			}
-		case AKA_AT_MAC:
-			if valLen != 16 {
-				return fmt.Errorf("AT_MAC: invalid value len=%d, want 16", valLen)
-			}
-		case AKA_AT_ANY_ID_REQ:
-			// Length=1，总长=4，只读 Reserved，无 Value
-			if attr.Reserved != 0 {
-				return fmt.Errorf("AT_ANY_ID_REQ: reserved must be 0x0000, got 0x%04x", attr.Reserved)
-			}
-			valLen = 0
-		default:
-			// 其他类型保持原样
-		}
+	err := eapAka.unmarshalAttrs(rawData[4:])
+	if err != nil {
+		return errors.Wrapf(err, "EAP-AKA Unmarshal()")
+	}
+	return nil
+}
 
-		if valLen < 0 || valLen > buf.Len() {
-			return fmt.Errorf("EAP-AKA Unmarshal(): invalid attribute length=%d for type=%v", attr.Length, attrType)
+// unmarshalAttrs decodes the attributes. Unrecognized non-skippable
+// attributes fail the message, skippable ones (128 and above) are ignored
+// (RFC 4187 - 8.1). AT_PADDING is dropped.
+func (eapAka *EapAka) unmarshalAttrs(b []byte) error {
+	eapAka.attributes = make(map[EapAkaAttrType]*EapAkaAttr)
+
+	for len(b) > 0 {
+		if len(b) < EapAkaAttrTypeLen+EapAkaAttrLengthLen {
+			return errors.New("incomplete attribute header")
+		}
+		attrType := EapAkaAttrType(b[0])
+		length := b[1]
+		if length == 0 || 4*int(length) > len(b) {
+			return errors.Errorf("%s attribute length %d is invalid", attrType, length)
 		}
+		data := b[EapAkaAttrTypeLen+EapAkaAttrLengthLen : 4*int(length)]
+		b = b[4*int(length):]
 
-		// 读 Value
-		if valLen > 0 {
-			attr.Value = make([]byte, valLen)
-			if _, err := buf.Read(attr.Value); err != nil {
-				return fmt.Errorf("read value failed: %w", err)
+		if _, ok := akaAttrTypeStr[attrType]; !ok {
+			if attrType.Value() < 128 {
+				return errors.Errorf("unsupported non-skippable attribute %d", attrType.Value())
 			}
+			continue
 		}
 
-		eapAka.Attributes[attrType] = attr
+		attr := &EapAkaAttr{attrType: attrType, length: length}
+		if attrType == AKA_AT_AUTS {
+			attr.value = append([]byte{}, data...)
+		} else {
+			attr.reserved = binary.BigEndian.Uint16(data)
+			if len(data) > EapAkaAttrReservedLen {
+				attr.value = append([]byte{}, data[EapAkaAttrReservedLen:]...)
+			}
+		}
+		if err := attr.validate(); err != nil {
+			return err
+		}
+		if attrType == AKA_AT_PADDING {
+			continue
+		}
+		eapAka.attributes[attrType] = attr
 	}
+
 	return nil
 }
 
 func (eapAka *EapAka) initMAC() error {
-	zeros := make([]byte, 16)
+	zeros := make([]byte, EapAkaMACLen)
 	return eapAka.SetAttr(AKA_AT_MAC, zeros)
 }
 
 func (eapAka *EapAka) getAttrsKeys() []EapAkaAttrType {
-	result := make([]EapAkaAttrType, 0, len(eapAka.Attributes))
-	for key := range eapAka.Attributes {
+	result := make([]EapAkaAttrType, 0, len(eapAka.attributes))
+
+	for key := range eapAka.attributes {
 		result = append(result, key)
 	}
+
 	sort.Slice(result, func(i, j int) bool {
-		return result[i] < result[j]
+		return uint8(result[i]) < uint8(result[j])
 	})
+
 	return result
 }
 
-// HMAC-SHA1 (128-bit truncated) for EAP-AKA
+// SetEncrData encrypts the attributes of encrAttrs with AES-CBC under K_encr
+// into AT_ENCR_DATA, with a random AT_IV. AT_PADDING is added to align the
+// plaintext to the AES block size (RFC 4187 - 10.12).
+func (eapAka *EapAka) SetEncrData(kEncr []byte, encrAttrs *EapAka) error {
+	block, err := aes.NewCipher(kEncr)
+	if err != nil {
+		return errors.Wrapf(err, "EAP-AKA SetEncrData()")
+	}
+
+	plaintext := encrAttrs.marshalAttrs()
+	if paddingLen := (aes.BlockSize - len(plaintext)%aes.BlockSize) % aes.BlockSize; paddingLen > 0 {
+		padding := make([]byte, paddingLen)
+		padding[0] = AKA_AT_PADDING.Value()
+		padding[1] = uint8(paddingLen / 4)
+		plaintext = append(plaintext, padding...)
+	}
+	if len(plaintext) == 0 {
+		return errors.New("EAP-AKA SetEncrData(): no attribute to encrypt")
+	}
+
+	iv := make([]byte, EapAkaIVLen)
+	if _, err = rand.Read(iv); err != nil {
+		return errors.Wrapf(err, "EAP-AKA SetEncrData()")
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(plaintext, plaintext)
+
+	if err = eapAka.SetAttr(AKA_AT_IV, iv); err != nil {
+		return errors.Wrapf(err, "EAP-AKA SetEncrData()")
+	}
+	if err = eapAka.SetAttr(AKA_AT_ENCR_DATA, plaintext); err != nil {
+		return errors.Wrapf(err, "EAP-AKA SetEncrData()")
+	}
+	return nil
+}
+
+// GetEncrData decrypts AT_ENCR_DATA with AT_IV under K_encr, and returns the
+// encrypted attributes
+func (eapAka *EapAka) GetEncrData(kEncr []byte) (*EapAka, error) {
+	ivAttr, err := eapAka.GetAttr(AKA_AT_IV)
+	if err != nil {
+		return nil, errors.Wrapf(err, "EAP-AKA GetEncrData()")
+	}
+	encrDataAttr, err := eapAka.GetAttr(AKA_AT_ENCR_DATA)
+	if err != nil {
+		return nil, errors.Wrapf(err, "EAP-AKA GetEncrData()")
+	}
+	block, err := aes.NewCipher(kEncr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "EAP-AKA GetEncrData()")
+	}
+
+	plaintext := encrDataAttr.GetValue()
+	cipher.NewCBCDecrypter(block, ivAttr.GetValue()).CryptBlocks(plaintext, plaintext)
+
+	encrAttrs := NewEapAka(eapAka.subType)
+	if err = encrAttrs.unmarshalAttrs(plaintext); err != nil {
+		return nil, errors.Wrapf(err, "EAP-AKA GetEncrData()")
+	}
+	return encrAttrs, nil
+}
+
+// Len(EapAkaAttr) = EapAkaAttr.length * 4
+type EapAkaAttr struct {
+	attrType EapAkaAttrType
+	length   uint8
+	reserved uint16
+	value    []byte
+}
+
+func (attr *EapAkaAttr) setAttr(attrType EapAkaAttrType, value []byte) error {
+	attr.attrType = attrType
+	attr.reserved = 0
+	attr.value = nil
+	valLen := len(value)
+	if EapAkaAttrTypeLen+EapAkaAttrLengthLen+EapAkaAttrReservedLen+valLen > 0xff*4 {
+		return errors.Errorf("%s value of %d bytes is too long", attrType, valLen)
+	}
+
+	switch attrType {
+	case AKA_AT_RAND, AKA_AT_AUTN, AKA_AT_MAC, AKA_AT_IV, AKA_AT_NONCE_S, AKA_AT_ENCR_DATA, AKA_AT_CHECKCODE:
+		// RFC 4187 - 10.6, 10.7, 10.15, 10.12, 10.18, 10.13:
+		// Two reserved bytes followed by the value
+		// 0                   1                   2                   3
+		// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		// |   Attribute   | Length        |           Reserved            |
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		// .                             Value                             .
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		attr.value = append([]byte{}, value...)
+		attr.length = uint8((EapAkaAttrTypeLen + EapAkaAttrLengthLen + EapAkaAttrReservedLen + valLen) / 4)
+	case AKA_AT_AUTS:
+		// RFC 4187 - 10.9: AUTS follows the length, without reserved bytes
+		attr.value = append([]byte{}, value...)
+		attr.length = 4
+	case AKA_AT_RES:
+		// RFC 4187 - 10.8: The reserved bytes are the RES length in bits,
+		// and the RES is padded with zero bits
+		attr.reserved = uint16(8 * valLen)
+		attr.value = append([]byte{}, value...)
+		attr.length = paddedAttrLength(valLen)
+	case AKA_AT_IDENTITY, AKA_AT_NEXT_PSEUDONYM, AKA_AT_NEXT_REAUTH_ID:
+		// RFC 4187 - 10.5, 10.10, 10.11: The reserved bytes are the actual
+		// identity length in bytes, and the identity is padded with zero
+		// bytes
+		if valLen == 0 {
+			return errors.Errorf("%s is empty", attrType)
+		}
+		attr.reserved = uint16(valLen)
+		attr.value = append([]byte{}, value...)
+		attr.length = paddedAttrLength(valLen)
+	case AKA_AT_NOTIFICATION, AKA_AT_CLIENT_ERROR_CODE, AKA_AT_COUNTER:
+		// RFC 4187 - 10.19, 10.20, 10.16: The 2-byte value takes the place
+		// of the reserved bytes
+		if valLen != 2 {
+			return errors.Errorf("%s needs exactly 2 bytes, but got %d bytes", attrType, valLen)
+		}
+		attr.reserved = binary.BigEndian.Uint16(value)
+		attr.length = 1
+	case AKA_AT_PERMANENT_ID_REQ, AKA_AT_ANY_ID_REQ, AKA_AT_FULLAUTH_ID_REQ,
+		AKA_AT_COUNTER_TOO_SMALL, AKA_AT_RESULT_IND:
+		// RFC 4187 - 10.2, 10.3, 10.4, 10.17, 10.14: Flags with only two
+		// reserved bytes
+		if valLen != 0 {
+			return errors.Errorf("%s has no value, but got %d bytes", attrType, valLen)
+		}
+		attr.length = 1
+	default:
+		return errors.Errorf("%s is not supported", attrType)
+	}
+
+	return attr.validate()
+}
+
+// validate checks the value length of the attribute type
+func (attr *EapAkaAttr) validate() error {
+	valLen := len(attr.value)
+
+	switch attr.attrType {
+	case AKA_AT_RAND, AKA_AT_AUTN, AKA_AT_MAC, AKA_AT_IV, AKA_AT_NONCE_S:
+		if valLen != 16 {
+			return errors.Errorf("%s needs 16 bytes, but got %d bytes", attr.attrType, valLen)
+		}
+	case AKA_AT_AUTS:
+		if valLen != EapAkaAUTSLen {
+			return errors.Errorf("%s needs %d bytes, but got %d bytes", attr.attrType, EapAkaAUTSLen, valLen)
+		}
+	case AKA_AT_RES:
+		if attr.reserved < 32 || attr.reserved > 128 || int(attr.reserved+7)/8 > valLen {
+			return errors.Errorf("%s needs between 32 and 128 bits, but got %d bits", attr.attrType, attr.reserved)
+		}
+	case AKA_AT_IDENTITY, AKA_AT_NEXT_PSEUDONYM, AKA_AT_NEXT_REAUTH_ID:
+		if int(attr.reserved) > valLen {
+			return errors.Errorf("%s actual length %d exceeds the attribute", attr.attrType, attr.reserved)
+		}
+	case AKA_AT_ENCR_DATA:
+		if valLen == 0 || valLen%aes.BlockSize != 0 {
+			return errors.Errorf("%s needs a multiple of %d bytes, but got %d bytes",
+				attr.attrType, aes.BlockSize, valLen)
+		}
+	case AKA_AT_CHECKCODE:
+		if valLen != 0 && valLen != EapAkaCheckcodeLen {
+			return errors.Errorf("%s needs 0 or %d bytes, but got %d bytes", attr.attrType, EapAkaCheckcodeLen, valLen)
+		}
+	case AKA_AT_PADDING:
+		// RFC 4187 - 10.12: 4, 8 or 12 bytes of zeros
+		if attr.length > 3 || attr.reserved != 0 || !bytes.Equal(attr.value, make([]byte, valLen)) {
+			return errors.Errorf("%s is invalid", attr.attrType)
+		}
+	default:
+		// Flags and 2-byte values
+		if attr.length != 1 {
+			return errors.Errorf("%s attribute length must be 1", attr.attrType)
+		}
+	}
+	return nil
+}
+
+// paddedAttrLength returns the length of the attribute with the reserved
+// bytes and the value padded to a multiple of 4 bytes
+func paddedAttrLength(valLen int) uint8 {
+	return uint8((EapAkaAttrTypeLen + EapAkaAttrLengthLen + EapAkaAttrReservedLen + valLen + 3) / 4)
+}
+
+func (attr *EapAkaAttr) GetAttrType() EapAkaAttrType { return attr.attrType }
+
+func (attr *EapAkaAttr) GetValue() []byte {
+	var b []byte
+	switch attr.attrType {
+	case AKA_AT_NOTIFICATION, AKA_AT_CLIENT_ERROR_CODE, AKA_AT_COUNTER:
+		b = make([]byte, EapAkaAttrReservedLen)
+		binary.BigEndian.PutUint16(b, attr.reserved)
+	case AKA_AT_RES:
+		// Without the padding
+		b = append([]byte{}, attr.value[:(attr.reserved+7)/8]...)
+	case AKA_AT_IDENTITY, AKA_AT_NEXT_PSEUDONYM, AKA_AT_NEXT_REAUTH_ID:
+		b = append([]byte{}, attr.value[:attr.reserved]...)
+	default:
+		b = append([]byte{}, attr.value...)
+	}
+	return b
+}
+
+// RFC 4187 - 7. Key Generation
+func EapAkaPRF(ik, ck []byte, identity string) (k_encr, k_aut, msk, emsk []byte, err error) {
+	if len(ik) == 0 || len(ck) == 0 {
+		return nil, nil, nil, nil, errors.New("EAP-AKA PRF: invalid input key length")
+	}
+
+	// MK = SHA1(Identity|IK|CK)
+	h := sha1.New()
+	h.Write([]byte(identity))
+	h.Write(ik)
+	h.Write(ck)
+	mk := h.Sum(nil)
+
+	key := fips186PRF(mk, 160)
+	k_encr = key[0:16] // K_encr = 128 bits
+	k_aut = key[16:32] // K_aut  = 128 bits
+	msk = key[32:96]   // MSK    = 512 bits
+	emsk = key[96:160] // EMSK   = 512 bits
+
+	return k_encr, k_aut, msk, emsk, nil
+}
+
+// fips186PRF is the pseudo-random number generator of FIPS 186-2 Change
+// Notice 1 - Appendix 3.1, with XSEED_j = 0 and G built on the SHA-1
+// compression function (RFC 4187 - Appendix A)
+func fips186PRF(xkey []byte, outLen int) []byte {
+	xkey = append([]byte{}, xkey...)
+	out := make([]byte, 0, outLen+sha1.Size)
+
+	for len(out) < outLen {
+		w := fips186G(xkey)
+		out = append(out, w...)
+
+		// XKEY = (1 + XKEY + w_i) mod 2^160
+		carry := uint16(1)
+		for i := sha1.Size - 1; i >= 0; i-- {
+			sum := uint16(xkey[i]) + uint16(w[i]) + carry
+			xkey[i] = byte(sum)
+			carry = sum >> 8
+		}
+	}
+
+	return out[:outLen]
+}
+
+// fips186G runs the SHA-1 compression function over the 160-bit value
+// padded with zeros to 512 bits, without the padding of SHA-1 (FIPS 186-2 -
+// Appendix 3.3)
+func fips186G(xval []byte) []byte {
+	h := [5]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476, 0xc3d2e1f0}
+
+	var block [64]byte
+	copy(block[:], xval)
+	var w [80]uint32
+	for i := 0; i < 16; i++ {
+		w[i] = binary.BigEndian.Uint32(block[4*i:])
+	}
+	for i := 16; i < 80; i++ {
+		w[i] = bits.RotateLeft32(w[i-3]^w[i-8]^w[i-14]^w[i-16], 1)
+	}
+
+	a, b, c, d, e := h[0], h[1], h[2], h[3], h[4]
+	for i := 0; i < 80; i++ {
+		var f, k uint32
+		switch {
+		case i < 20:
+			f, k = b&c|^b&d, 0x5a827999
+		case i < 40:
+			f, k = b^c^d, 0x6ed9eba1
+		case i < 60:
+			f, k = b&c|b&d|c&d, 0x8f1bbcdc
+		default:
+			f, k = b^c^d, 0xca62c1d6
+		}
+		t := bits.RotateLeft32(a, 5) + f + e + k + w[i]
+		a, b, c, d, e = t, a, bits.RotateLeft32(b, 30), c, d
+	}
+	h[0] += a
+	h[1] += b
+	h[2] += c
+	h[3] += d
+	h[4] += e
+
+	out := make([]byte, sha1.Size)
+	for i := range h {
+		binary.BigEndian.PutUint32(out[4*i:], h[i])
+	}
+	return out
+}
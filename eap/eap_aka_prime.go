@@ -86,6 +86,9 @@ type EapAkaPrime struct {
 	subType    EapAkaSubtype
 	reserved   uint16
 	attributes map[EapAkaPrimeAttrType]*EapAkaPrimeAttr
+	// AT_KDF may be repeated, in the order of preference of the server
+	// (RFC 5448 - 3.2). The first one is also in attributes.
+	kdfs []uint16
 }
 
 func NewEapAkaPrime(subType EapAkaSubtype) *EapAkaPrime {
@@ -112,9 +115,31 @@ func (eapAkaPrime *EapAkaPrime) SetAttr(attrType EapAkaPrimeAttrType, value []by
 	}
 
 	eapAkaPrime.attributes[attr.attrType] = attr
+	if attr.attrType == AT_KDF {
+		eapAkaPrime.kdfs = []uint16{attr.reserved}
+	}
+	return nil
+}
+
+// SetKDFs sets one AT_KDF for each key derivation function, in order of
+// preference
+func (eapAkaPrime *EapAkaPrime) SetKDFs(kdfs []uint16) error {
+	if len(kdfs) == 0 {
+		return errors.Errorf("EAP-AKA' SetKDFs(): no key derivation function")
+	}
+	if err := eapAkaPrime.SetAttr(AT_KDF, binary.BigEndian.AppendUint16(nil, kdfs[0])); err != nil {
+		return errors.Wrapf(err, "EAP-AKA' SetKDFs()")
+	}
+	eapAkaPrime.kdfs = append([]uint16{}, kdfs...)
 	return nil
 }
 
+// GetKDFs returns the key derivation functions of all the AT_KDF, in the
+// order of the message
+func (eapAkaPrime *EapAkaPrime) GetKDFs() []uint16 {
+	return append([]uint16{}, eapAkaPrime.kdfs...)
+}
+
 func (eapAkaPrime *EapAkaPrime) GetAttr(attrType EapAkaPrimeAttrType) (EapAkaPrimeAttr, error) {
 	if eapAkaPrime.attributes == nil {
 		return EapAkaPrimeAttr{}, errors.Errorf("EAP-AKA' attributes map is nil")
@@ -148,6 +173,18 @@ func (eapAkaPrime *EapAkaPrime) Marshal() ([]byte, error) {
 	for _, key := range eapAkaPrime.getAttrsKeys() {
 		attr := eapAkaPrime.attributes[key]
 
+		// Every AT_KDF in order
+		if key == AT_KDF && len(eapAkaPrime.kdfs) > 1 {
+			for _, kdf := range eapAkaPrime.kdfs {
+				buffer.Write([]byte{attr.attrType.Value(), attr.length})
+				err = binary.Write(buffer, binary.BigEndian, kdf)
+				if err != nil {
+					return nil, errors.Wrapf(err, "EAP-AKA' Marshal(): write attribute/reserved failed")
+				}
+			}
+			continue
+		}
+
 		err = binary.Write(buffer, binary.BigEndian, attr.attrType.Value())
 		if err != nil {
 			return nil, errors.Wrapf(err, "EAP-AKA' Marshal(): write attribute/type failed")
@@ -170,6 +207,15 @@ func (eapAkaPrime *EapAkaPrime) Marshal() ([]byte, error) {
 		if err != nil {
 			return nil, errors.Wrapf(err, "EAP-AKA' Marshal(): write attribute/value failed")
 		}
+
+		// Pad the decoded values of variable length to the attribute length
+		headerLen := EapAkaAttrTypeLen + EapAkaAttrLengthLen
+		if attr.attrType != AT_AUTS {
+			headerLen += EapAkaAttrReservedLen
+		}
+		if paddingLen := 4*int(attr.length) - headerLen - len(attr.value); paddingLen > 0 {
+			buffer.Write(make([]byte, paddingLen))
+		}
 	}
 
 	return buffer.Bytes(), nil
@@ -212,6 +258,7 @@ func (eapAkaPrime *EapAkaPrime) Unmarshal(rawData []byte) error {
 	if eapAkaPrime.attributes == nil {
 		eapAkaPrime.attributes = map[EapAkaPrimeAttrType]*EapAkaPrimeAttr{}
 	}
+	eapAkaPrime.kdfs = nil
 
 	for {
 		attr := new(EapAkaPrimeAttr)
@@ -280,12 +327,12 @@ func (eapAkaPrime *EapAkaPrime) Unmarshal(rawData []byte) error {
 				}
 				return errors.Wrapf(err, "EAP-AKA' Unmarshal(): read %s attribute/value failed", attr.attrType)
 			}
-		case AT_KDF_INPUT:
-			fallthrough
-		case AT_RES:
-			// In this case, reserved will contains the actual length of value
+		case AT_KDF_INPUT, AT_RES:
+			// In this case, reserved will contains the actual length of value:
+			// in bits for AT_RES (RFC 4187 - 10.8), in bytes for AT_KDF_INPUT
+			// (RFC 5448 - 3.1)
 
-			reserved := make([]byte, EapAkaAttrReservedLen) // The reserved field is the length of the RES in bits
+			reserved := make([]byte, EapAkaAttrReservedLen)
 			n, err = io.ReadFull(bufReader, reserved)
 			if n != EapAkaAttrReservedLen {
 				return errors.Errorf("EAP-AKA' Unmarshal(): incomplete reserved bytes for %s", attr.attrType)
@@ -297,12 +344,17 @@ func (eapAkaPrime *EapAkaPrime) Unmarshal(rawData []byte) error {
 				return errors.Wrapf(err, "EAP-AKA' Unmarshal(): read %s attribute/reserved failed", attr.attrType)
 			}
 
-			valBitsLen := binary.BigEndian.Uint16(reserved)
-			attr.reserved = valBitsLen
-
-			valBytesLen := valBitsLen / 8
-			totalLen := uint16(attr.length * 4)
-			paddingLen := totalLen - valBytesLen - EapAkaAttrTypeLen - EapAkaAttrLengthLen - EapAkaAttrReservedLen
+			attr.reserved = binary.BigEndian.Uint16(reserved)
+			valBytesLen := attr.reserved
+			if attr.attrType == AT_RES {
+				valBytesLen = attr.reserved / 8
+			}
+			maxValLen := uint16(attr.length)*4 - EapAkaAttrTypeLen - EapAkaAttrLengthLen - EapAkaAttrReservedLen
+			if attr.length == 0 || valBytesLen > maxValLen {
+				return errors.Errorf("EAP-AKA' Unmarshal(): %s actual length %d exceeds the attribute",
+					attr.attrType, attr.reserved)
+			}
+			paddingLen := maxValLen - valBytesLen
 
 			attr.value = make([]byte, valBytesLen)
 			n, err = io.ReadFull(bufReader, attr.value)
@@ -342,6 +394,12 @@ func (eapAkaPrime *EapAkaPrime) Unmarshal(rawData []byte) error {
 			}
 			attr.reserved = binary.BigEndian.Uint16(reserved)
 			attr.value = nil
+
+			// The first AT_KDF is the attribute, all are kept in order
+			eapAkaPrime.kdfs = append(eapAkaPrime.kdfs, attr.reserved)
+			if len(eapAkaPrime.kdfs) > 1 {
+				continue
+			}
 		case AT_CHECKCODE:
 			reserved := make([]byte, EapAkaAttrReservedLen)
 			n, err = io.ReadFull(bufReader, reserved)
@@ -370,7 +428,7 @@ func (eapAkaPrime *EapAkaPrime) Unmarshal(rawData []byte) error {
 				}
 				return errors.Wrapf(err, "EAP-AKA' Unmarshal(): read %s attribute/value failed", attr.attrType)
 			}
-		case AT_NOTIFICATION:
+		case AT_NOTIFICATION, AT_CLIENT_ERROR_CODE:
 			// 2 bytes reserved, no value
 			reserved := make([]byte, EapAkaAttrReservedLen)
 			n, err = io.ReadFull(bufReader, reserved)
@@ -404,6 +462,18 @@ func (eapAkaPrime *EapAkaPrime) Unmarshal(rawData []byte) error {
 				}
 				return errors.Wrapf(err, "EAP-AKA' Unmarshal(): read %s attribute/value failed", attr.attrType)
 			}
+		default:
+			// RFC 4187 - 8.1: Unrecognized non-skippable attributes fail the
+			// message, skippable ones (128 and above) are ignored
+			if attrType < 128 || attr.length == 0 {
+				return errors.Errorf("EAP-AKA' Unmarshal(): unsupported non-skippable attribute %d", attrType)
+			}
+			skipLen := 4*int(attr.length) - EapAkaAttrTypeLen - EapAkaAttrLengthLen
+			n, err = io.ReadFull(bufReader, make([]byte, skipLen))
+			if n != skipLen {
+				return errors.Errorf("EAP-AKA' Unmarshal(): incomplete bytes for skippable attribute %d", attrType)
+			}
+			continue
 		}
 
 		// Set attribute
@@ -534,7 +604,17 @@ func (attr *EapAkaPrimeAttr) setAttr(attrType EapAkaPrimeAttrType, value []byte)
 		// .                                                               .
 		// |                                                               |
 		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-		fallthrough
+		// RFC 5448 - 3.1: The actual network name length is in bytes, and
+		// the network name is padded with zero bytes
+		valBytesLen := len(value)
+		totalLen := EapAkaAttrTypeLen + EapAkaAttrLengthLen + EapAkaAttrReservedLen + valBytesLen
+		if valBytesLen == 0 || totalLen > 0xff*4 {
+			return errors.Errorf("%s network name length %d is invalid", attrType, valBytesLen)
+		}
+		attr.reserved = uint16(valBytesLen)
+		attr.length = uint8((totalLen + 3) / 4)
+		attr.value = make([]byte, valBytesLen)
+		copy(attr.value, value)
 	case AT_RES:
 		// RFC 4187:
 		//    The value field of this attribute begins with the 2-byte RES Length,
@@ -558,10 +638,8 @@ func (attr *EapAkaPrimeAttr) setAttr(attrType EapAkaPrimeAttrType, value []byte)
 		valBytesLen := len(value)
 		valBitsLen := valBytesLen * 8
 
-		if attrType == AT_RES {
-			if valBitsLen > 128 || valBitsLen < 32 {
-				return errors.Errorf("%s needs between 32 and 128 bits, but got %d bits", attrType, valBitsLen)
-			}
+		if valBitsLen > 128 || valBitsLen < 32 {
+			return errors.Errorf("%s needs between 32 and 128 bits, but got %d bits", attrType, valBitsLen)
 		}
 
 		// Calculate padding bytes needed to make total length multiple of 4
@@ -616,6 +694,14 @@ func (attr *EapAkaPrimeAttr) setAttr(attrType EapAkaPrimeAttrType, value []byte)
 		attr.length = uint8((EapAkaAttrTypeLen + EapAkaAttrTypeLen + EapAkaAttrReservedLen + valLen) / 4)
 		attr.value = make([]byte, valLen)
 		copy(attr.value, value)
+	case AT_CLIENT_ERROR_CODE:
+		// RFC 4187 Section 10.20:
+		// 0                   1                   2                   3
+		// 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		// |AT_CLIENT_ERR..| Length = 1    |      Client Error Code        |
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		fallthrough
 	case AT_NOTIFICATION:
 		// RFC 4187 Section 10.19:
 		// 0                   1                   2                   3
@@ -641,10 +727,19 @@ func (attr *EapAkaPrimeAttr) GetAttrType() EapAkaPrimeAttrType { return attr.att
 
 func (attr *EapAkaPrimeAttr) GetValue() []byte {
 	var b []byte
-	if attr.attrType == AT_KDF || attr.attrType == AT_NOTIFICATION {
+	if attr.attrType == AT_KDF || attr.attrType == AT_NOTIFICATION || attr.attrType == AT_CLIENT_ERROR_CODE {
 		b = make([]byte, EapAkaAttrReservedLen)
 		binary.BigEndian.PutUint16(b, attr.reserved)
 		return b
+	} else if attr.attrType == AT_RES || attr.attrType == AT_KDF_INPUT {
+		// Without the padding
+		valLen := int(attr.reserved)
+		if attr.attrType == AT_RES {
+			valLen = int(attr.reserved / 8)
+		}
+		valLen = min(valLen, len(attr.value))
+		b = make([]byte, valLen)
+		copy(b, attr.value[:valLen])
 	} else {
 		b = make([]byte, len(attr.value))
 		copy(b, attr.value)
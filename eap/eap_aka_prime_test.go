@@ -297,7 +297,7 @@ func TestEapAkaPrimeAttrLength(t *testing.T) {
 			attrType:         AT_KDF_INPUT,
 			value:            []byte("test.free5gc.org"),
 			expectedLen:      5,
-			expectedReserved: uint16(len("test.free5gc.org") * 8),
+			expectedReserved: uint16(len("test.free5gc.org")), // bytes
 		},
 	}
 
@@ -375,7 +375,7 @@ func TestEapAkaPrimeMarshal(t *testing.T) {
 				byte(SubtypeAkaIdentity), // Subtype
 				0x00, 0x00,               // Reserved
 				0x17, 0x04, // AT_KDF_INPUT header (type=23, length=4)
-				0x00, 0x58, // AT_KDF_INPUT reserved (88 bits)
+				0x00, 0x0b, // AT_KDF_INPUT actual network name length (11 bytes)
 				'f', 'r', 'e', 'e', '5', 'g', 'c', '.', 'o', 'r', 'g', // AT_KDF_INPUT value
 				0x00,                   // Padding
 				0x18, 0x01, 0x00, 0x01, // AT_KDF (type=24, length=1)
@@ -530,7 +530,7 @@ func TestEapAkaPrimeUnmarshal(t *testing.T) {
 				byte(SubtypeAkaIdentity), // Subtype
 				0x00, 0x00,               // Reserved
 				0x17, 0x04, // AT_KDF_INPUT header (type=23, length=4)
-				0x00, 0x58, // AT_KDF_INPUT reserved (88 bits)
+				0x00, 0x0b, // AT_KDF_INPUT actual network name length (11 bytes)
 				'f', 'r', 'e', 'e', '5', 'g', 'c', '.', 'o', 'r', 'g', // AT_KDF_INPUT value
 				0x00,                   // Padding
 				0x18, 0x01, 0x00, 0x01, // AT_KDF (type=24, length=1, value=1)
@@ -591,6 +591,43 @@ func TestEapAkaPrimeUnmarshal(t *testing.T) {
 			},
 			expectErr: false,
 		},
+		{
+			name: "AT_CLIENT_ERROR_CODE basic",
+			rawData: []byte{
+				byte(EapTypeAkaPrime),
+				byte(SubtypeAkaClientError),
+				0x00, 0x00,
+				0x16, 0x01, 0x00, 0x01, // AT_CLIENT_ERROR_CODE (type=22, length=1, value=1)
+			},
+			expectedAttrs: map[EapAkaPrimeAttrType][]byte{
+				AT_CLIENT_ERROR_CODE: {0x00, 0x01},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Skippable attribute ignored",
+			rawData: []byte{
+				byte(EapTypeAkaPrime),
+				byte(SubtypeAkaNotification),
+				0x00, 0x00,
+				0x87, 0x02, 0x00, 0x00, 0xaa, 0xbb, 0xcc, 0xdd, // Unknown skippable attribute (type=135, length=2)
+				0x0c, 0x01, 0x12, 0x34, // AT_NOTIFICATION (type=12, length=1, value=0x12 0x34)
+			},
+			expectedAttrs: map[EapAkaPrimeAttrType][]byte{
+				AT_NOTIFICATION: {0x12, 0x34},
+			},
+			expectErr: false,
+		},
+		{
+			name: "Non-skippable unknown attribute",
+			rawData: []byte{
+				byte(EapTypeAkaPrime),
+				byte(SubtypeAkaNotification),
+				0x00, 0x00,
+				0x7f, 0x01, 0x00, 0x00, // Unknown non-skippable attribute (type=127, length=1)
+			},
+			expectErr: true,
+		},
 		{
 			name: "AT_AUTS basic",
 			rawData: []byte{
@@ -638,3 +675,114 @@ func TestEapAkaPrimeUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestEapAkaPrimeUnmarshalMarshal(t *testing.T) {
+	// Values decoded without their padding are marshaled back padded
+	rawData := []byte{
+		byte(EapTypeAkaPrime),     // EAP-AKA' type
+		byte(SubtypeAkaChallenge), // Subtype
+		0x00, 0x00,                // Reserved
+		0x03, 0x03, // AT_RES type and length
+		0x00, 0x28, // RES Length (40 bits)
+		0x01, 0x02, 0x03, 0x04, 0x05, // RES value
+		0x00, 0x00, 0x00, // Padding
+		0x17, 0x04, // AT_KDF_INPUT header (type=23, length=4)
+		0x00, 0x0b, // AT_KDF_INPUT actual network name length (11 bytes)
+		'f', 'r', 'e', 'e', '5', 'g', 'c', '.', 'o', 'r', 'g', // AT_KDF_INPUT value
+		0x00, // Padding
+	}
+
+	eapAka := new(EapAkaPrime)
+	require.NoError(t, eapAka.Unmarshal(rawData))
+	result, err := eapAka.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, rawData, result)
+
+	// Values set with padding are read back without it
+	eapAka = NewEapAkaPrime(SubtypeAkaChallenge)
+	require.NoError(t, eapAka.SetAttr(AT_RES, []byte{0x01, 0x02, 0x03, 0x04, 0x05}))
+	attr, err := eapAka.GetAttr(AT_RES)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x01, 0x02, 0x03, 0x04, 0x05}, attr.GetValue())
+}
+
+// The actual network name length of AT_KDF_INPUT is in bytes (RFC 5448 -
+// 3.1), as sent by the servers
+func TestEapAkaPrimeKDFInputNetworkName(t *testing.T) {
+	testCases := []struct {
+		name        string
+		networkName string
+		rawAttr     []byte
+	}{
+		{
+			name:        "RFC 5448 - Appendix C",
+			networkName: "WLAN",
+			rawAttr:     []byte{0x17, 0x02, 0x00, 0x04, 'W', 'L', 'A', 'N'},
+		},
+		{
+			name:        "5G serving network name",
+			networkName: "5G:mnc093.mcc208.3gppnetwork.org",
+			rawAttr: append([]byte{0x17, 0x09, 0x00, 0x20},
+				[]byte("5G:mnc093.mcc208.3gppnetwork.org")...),
+		},
+		{
+			name:        "Padded network name",
+			networkName: "free5gc.org",
+			rawAttr: append(append([]byte{0x17, 0x04, 0x00, 0x0b},
+				[]byte("free5gc.org")...), 0x00),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rawData := append([]byte{byte(EapTypeAkaPrime), byte(SubtypeAkaChallenge), 0x00, 0x00},
+				tc.rawAttr...)
+
+			eapAka := new(EapAkaPrime)
+			require.NoError(t, eapAka.Unmarshal(rawData))
+			attr, err := eapAka.GetAttr(AT_KDF_INPUT)
+			require.NoError(t, err)
+			require.Equal(t, []byte(tc.networkName), attr.GetValue())
+
+			eapAka = NewEapAkaPrime(SubtypeAkaChallenge)
+			require.NoError(t, eapAka.SetAttr(AT_KDF_INPUT, []byte(tc.networkName)))
+			result, err := eapAka.Marshal()
+			require.NoError(t, err)
+			require.Equal(t, rawData, result)
+		})
+	}
+
+	// The actual length exceeds the attribute
+	eapAka := new(EapAkaPrime)
+	require.Error(t, eapAka.Unmarshal([]byte{
+		byte(EapTypeAkaPrime), byte(SubtypeAkaChallenge), 0x00, 0x00,
+		0x17, 0x02, 0x00, 0x05, 'W', 'L', 'A', 'N',
+	}))
+}
+
+func TestEapAkaPrimeKDFs(t *testing.T) {
+	rawData := []byte{
+		byte(EapTypeAkaPrime), byte(SubtypeAkaChallenge), 0x00, 0x00,
+		0x18, 0x01, 0x00, 0x02, // AT_KDF 2
+		0x18, 0x01, 0x00, 0x01, // AT_KDF 1
+	}
+
+	eapAka := NewEapAkaPrime(SubtypeAkaChallenge)
+	require.NoError(t, eapAka.SetKDFs([]uint16{2, 1}))
+	result, err := eapAka.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, rawData, result)
+
+	eapAka = new(EapAkaPrime)
+	require.NoError(t, eapAka.Unmarshal(rawData))
+	require.Equal(t, []uint16{2, 1}, eapAka.GetKDFs())
+	attr, err := eapAka.GetAttr(AT_KDF)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0x02}, attr.GetValue())
+
+	// SetAttr replaces the whole list
+	require.NoError(t, eapAka.SetAttr(AT_KDF, []byte{0x00, 0x01}))
+	require.Equal(t, []uint16{1}, eapAka.GetKDFs())
+
+	require.Error(t, eapAka.SetKDFs(nil))
+}
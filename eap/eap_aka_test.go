@@ -0,0 +1,306 @@
+package eap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// RFC 4186 - Appendix A.5: K_encr, K_aut, MSK and EMSK from MK, with the
+// PRF shared by EAP-AKA
+func TestEapAkaFIPS186PRF(t *testing.T) {
+	mk, err := hex.DecodeString("e576d5ca332e9930018bf1baee2763c795b3c712")
+	require.NoError(t, err)
+	expected, err := hex.DecodeString(
+		"536e5ebc4465582aa6a8ec9986ebb620" +
+			"25af1942efcbf4bc72b3943421f2a974" +
+			"39d45aeaf4e30601983e972b6cfd46d1c363773365690d09cd44976b525f47d3" +
+			"a60a985e955c53b090b2e4b73719196a402542968fd14a888f46b9a7886e4488" +
+			"5949eab0fff69d52315c6c634fd14a7f0d52023d56f79698fa6596abeed4f93f" +
+			"bb48eb534d985414ceed0d9a8ed33c387c9dfdab92ffbdf240fcecf65a2c93b9")
+	require.NoError(t, err)
+	require.Equal(t, expected, fips186PRF(mk, 160))
+}
+
+func TestEapAkaPrf(t *testing.T) {
+	ik := bytes.Repeat([]byte{0x11}, 16)
+	ck := bytes.Repeat([]byte{0x22}, 16)
+
+	k_encr, k_aut, msk, emsk, err := EapAkaPRF(ik, ck, "0208930000000001")
+	require.NoError(t, err)
+	require.Len(t, k_encr, 16)
+	require.Len(t, k_aut, 16)
+	require.Len(t, msk, 64)
+	require.Len(t, emsk, 64)
+
+	// Bound to the identity
+	_, otherKAut, _, _, err := EapAkaPRF(ik, ck, "0208930000000002")
+	require.NoError(t, err)
+	require.NotEqual(t, k_aut, otherKAut)
+
+	_, _, _, _, err = EapAkaPRF(nil, ck, "0208930000000001")
+	require.Error(t, err)
+}
+
+func TestEapAkaSetGetAttr(t *testing.T) {
+	tcs := []struct {
+		name      string
+		attrType  EapAkaAttrType
+		value     []byte
+		expectErr bool
+	}{
+		{"Set AT_RAND", AKA_AT_RAND, bytes.Repeat([]byte{0x01}, 16), false},
+		{"Set AT_RAND with wrong length", AKA_AT_RAND, bytes.Repeat([]byte{0x01}, 15), true},
+		{"Set AT_AUTN", AKA_AT_AUTN, bytes.Repeat([]byte{0x02}, 16), false},
+		{"Set AT_AUTS", AKA_AT_AUTS, bytes.Repeat([]byte{0x03}, 14), false},
+		{"Set AT_AUTS with wrong length", AKA_AT_AUTS, bytes.Repeat([]byte{0x03}, 16), true},
+		{"Set AT_RES", AKA_AT_RES, bytes.Repeat([]byte{0x04}, 8), false},
+		{"Set AT_RES too short", AKA_AT_RES, bytes.Repeat([]byte{0x04}, 3), true},
+		{"Set AT_RES too long", AKA_AT_RES, bytes.Repeat([]byte{0x04}, 17), true},
+		{"Set AT_MAC", AKA_AT_MAC, bytes.Repeat([]byte{0x05}, 16), false},
+		{"Set AT_IV", AKA_AT_IV, bytes.Repeat([]byte{0x06}, 16), false},
+		{"Set AT_NONCE_S", AKA_AT_NONCE_S, bytes.Repeat([]byte{0x07}, 16), false},
+		{"Set AT_ENCR_DATA", AKA_AT_ENCR_DATA, bytes.Repeat([]byte{0x08}, 32), false},
+		{"Set AT_ENCR_DATA not aligned", AKA_AT_ENCR_DATA, bytes.Repeat([]byte{0x08}, 20), true},
+		{"Set AT_ENCR_DATA too long", AKA_AT_ENCR_DATA, bytes.Repeat([]byte{0x08}, 1024), true},
+		{"Set AT_CHECKCODE", AKA_AT_CHECKCODE, bytes.Repeat([]byte{0x09}, 20), false},
+		{"Set empty AT_CHECKCODE", AKA_AT_CHECKCODE, nil, false},
+		{"Set AT_CHECKCODE with wrong length", AKA_AT_CHECKCODE, bytes.Repeat([]byte{0x09}, 32), true},
+		{"Set AT_IDENTITY", AKA_AT_IDENTITY, []byte("0208930000000001@wlan.mnc093.mcc208.3gppnetwork.org"), false},
+		{"Set empty AT_IDENTITY", AKA_AT_IDENTITY, nil, true},
+		{"Set AT_NEXT_REAUTH_ID", AKA_AT_NEXT_REAUTH_ID, []byte("reauth@example.org"), false},
+		{"Set AT_NEXT_PSEUDONYM", AKA_AT_NEXT_PSEUDONYM, []byte("pseudonym"), false},
+		{"Set AT_NOTIFICATION", AKA_AT_NOTIFICATION, []byte{0x40, 0x00}, false},
+		{"Set AT_CLIENT_ERROR_CODE", AKA_AT_CLIENT_ERROR_CODE, []byte{0x00, 0x00}, false},
+		{"Set AT_COUNTER", AKA_AT_COUNTER, []byte{0x00, 0x05}, false},
+		{"Set AT_COUNTER with wrong length", AKA_AT_COUNTER, []byte{0x05}, true},
+		{"Set AT_PERMANENT_ID_REQ", AKA_AT_PERMANENT_ID_REQ, nil, false},
+		{"Set AT_ANY_ID_REQ", AKA_AT_ANY_ID_REQ, nil, false},
+		{"Set AT_FULLAUTH_ID_REQ", AKA_AT_FULLAUTH_ID_REQ, nil, false},
+		{"Set AT_COUNTER_TOO_SMALL", AKA_AT_COUNTER_TOO_SMALL, nil, false},
+		{"Set AT_RESULT_IND", AKA_AT_RESULT_IND, nil, false},
+		{"Set AT_RESULT_IND with value", AKA_AT_RESULT_IND, []byte{0x00, 0x00}, true},
+		{"Set AT_PADDING", AKA_AT_PADDING, make([]byte, 2), true},
+		{"Set unknown attribute", EapAkaAttrType(200), nil, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			eapAka := NewEapAka(SubtypeAkaChallenge)
+			err := eapAka.SetAttr(tc.attrType, tc.value)
+			if tc.expectErr {
+				require.Error(t, err)
+				_, err = eapAka.GetAttr(tc.attrType)
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			attr, err := eapAka.GetAttr(tc.attrType)
+			require.NoError(t, err)
+			require.Equal(t, tc.attrType, attr.GetAttrType())
+			if len(tc.value) == 0 {
+				require.Empty(t, attr.GetValue())
+			} else {
+				require.Equal(t, tc.value, attr.GetValue())
+			}
+		})
+	}
+}
+
+func TestEapAkaMarshalUnmarshal(t *testing.T) {
+	tcs := []struct {
+		name    string
+		subType EapAkaSubtype
+		attrs   map[EapAkaAttrType][]byte
+		raw     []byte
+	}{
+		{
+			name:    "AKA-Identity request",
+			subType: SubtypeAkaIdentity,
+			attrs:   map[EapAkaAttrType][]byte{AKA_AT_PERMANENT_ID_REQ: nil},
+			raw:     []byte{0x17, 0x05, 0x00, 0x00, 0x0a, 0x01, 0x00, 0x00},
+		},
+		{
+			name:    "AKA-Identity response",
+			subType: SubtypeAkaIdentity,
+			attrs:   map[EapAkaAttrType][]byte{AKA_AT_IDENTITY: []byte("abcde")},
+			raw: []byte{
+				0x17, 0x05, 0x00, 0x00,
+				0x0e, 0x03, 0x00, 0x05, 'a', 'b', 'c', 'd', 'e', 0x00, 0x00, 0x00,
+			},
+		},
+		{
+			name:    "AKA-Challenge response",
+			subType: SubtypeAkaChallenge,
+			attrs: map[EapAkaAttrType][]byte{
+				AKA_AT_RES:        {0x01, 0x02, 0x03, 0x04, 0x05},
+				AKA_AT_MAC:        make([]byte, 16),
+				AKA_AT_CHECKCODE:  nil,
+				AKA_AT_RESULT_IND: nil,
+			},
+			raw: append(append([]byte{
+				0x17, 0x01, 0x00, 0x00,
+				0x03, 0x03, 0x00, 0x28, 0x01, 0x02, 0x03, 0x04, 0x05, 0x00, 0x00, 0x00,
+				0x0b, 0x05, 0x00, 0x00,
+			}, make([]byte, 16)...),
+				0x86, 0x01, 0x00, 0x00,
+				0x87, 0x01, 0x00, 0x00,
+			),
+		},
+		{
+			name:    "AKA-Synchronization-Failure",
+			subType: SubtypeAkaSynchronizationFailure,
+			attrs:   map[EapAkaAttrType][]byte{AKA_AT_AUTS: bytes.Repeat([]byte{0xaa}, 14)},
+			raw: append([]byte{
+				0x17, 0x04, 0x00, 0x00,
+				0x04, 0x04,
+			}, bytes.Repeat([]byte{0xaa}, 14)...),
+		},
+		{
+			name:    "AKA-Client-Error",
+			subType: SubtypeAkaClientError,
+			attrs:   map[EapAkaAttrType][]byte{AKA_AT_CLIENT_ERROR_CODE: {0x00, 0x00}},
+			raw:     []byte{0x17, 0x0e, 0x00, 0x00, 0x16, 0x01, 0x00, 0x00},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			eapAka := NewEapAka(tc.subType)
+			for attrType, value := range tc.attrs {
+				require.NoError(t, eapAka.SetAttr(attrType, value))
+			}
+			raw, err := eapAka.Marshal()
+			require.NoError(t, err)
+			require.Equal(t, tc.raw, raw)
+
+			decoded := new(EapAka)
+			require.NoError(t, decoded.Unmarshal(raw))
+			require.Equal(t, tc.subType, decoded.SubType())
+			for attrType, value := range tc.attrs {
+				attr, err := decoded.GetAttr(attrType)
+				require.NoError(t, err)
+				if len(value) == 0 {
+					require.Empty(t, attr.GetValue())
+				} else {
+					require.Equal(t, value, attr.GetValue())
+				}
+			}
+
+			// Decoded messages marshal back to the same bytes
+			remarshaled, err := decoded.Marshal()
+			require.NoError(t, err)
+			require.Equal(t, raw, remarshaled)
+		})
+	}
+}
+
+func TestEapAkaUnmarshalErrors(t *testing.T) {
+	tcs := []struct {
+		name string
+		raw  []byte
+	}{
+		{"too short", []byte{0x17, 0x01, 0x00}},
+		{"wrong type", []byte{0x32, 0x01, 0x00, 0x00}},
+		{"incomplete attribute header", []byte{0x17, 0x01, 0x00, 0x00, 0x01}},
+		{"zero attribute length", []byte{0x17, 0x01, 0x00, 0x00, 0x87, 0x00, 0x00, 0x00}},
+		{"attribute exceeds message", []byte{0x17, 0x01, 0x00, 0x00, 0x01, 0x05, 0x00, 0x00}},
+		{"AT_RAND wrong length", []byte{0x17, 0x01, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00}},
+		{"AT_RES length too long", []byte{0x17, 0x01, 0x00, 0x00, 0x03, 0x02, 0x00, 0x40, 0x01, 0x02, 0x03, 0x04}},
+		{"AT_IDENTITY length too long", []byte{0x17, 0x05, 0x00, 0x00, 0x0e, 0x02, 0x00, 0x05, 'a', 'b', 'c', 'd'}},
+		{"AT_RESULT_IND with value", []byte{0x17, 0x01, 0x00, 0x00, 0x87, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"non-skippable unknown attribute", []byte{0x17, 0x01, 0x00, 0x00, 0x05, 0x01, 0x00, 0x00}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			eapAka := new(EapAka)
+			require.Error(t, eapAka.Unmarshal(tc.raw))
+		})
+	}
+}
+
+func TestEapAkaUnmarshalSkippable(t *testing.T) {
+	eapAka := new(EapAka)
+	require.NoError(t, eapAka.Unmarshal([]byte{
+		0x17, 0x01, 0x00, 0x00,
+		0xc8, 0x02, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+		0x87, 0x01, 0x00, 0x00,
+	}))
+	_, err := eapAka.GetAttr(AKA_AT_RESULT_IND)
+	require.NoError(t, err)
+	_, err = eapAka.GetAttr(EapAkaAttrType(200))
+	require.Error(t, err)
+}
+
+func TestEapAkaEncrData(t *testing.T) {
+	kEncr := bytes.Repeat([]byte{0x5a}, 16)
+
+	encrAttrs := NewEapAka(SubtypeAkaChallenge)
+	require.NoError(t, encrAttrs.SetAttr(AKA_AT_COUNTER, []byte{0x00, 0x01}))
+	require.NoError(t, encrAttrs.SetAttr(AKA_AT_NEXT_REAUTH_ID, []byte("reauth@example.org")))
+
+	eapAka := NewEapAka(SubtypeAkaChallenge)
+	require.NoError(t, eapAka.SetEncrData(kEncr, encrAttrs))
+
+	encrDataAttr, err := eapAka.GetAttr(AKA_AT_ENCR_DATA)
+	require.NoError(t, err)
+	// 4 + 24 bytes of attributes, padded by AT_PADDING to 32 bytes
+	require.Len(t, encrDataAttr.GetValue(), 32)
+	ivAttr, err := eapAka.GetAttr(AKA_AT_IV)
+	require.NoError(t, err)
+	require.Len(t, ivAttr.GetValue(), EapAkaIVLen)
+
+	raw, err := eapAka.Marshal()
+	require.NoError(t, err)
+	decoded := new(EapAka)
+	require.NoError(t, decoded.Unmarshal(raw))
+
+	decrypted, err := decoded.GetEncrData(kEncr)
+	require.NoError(t, err)
+	counterAttr, err := decrypted.GetAttr(AKA_AT_COUNTER)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0x01}, counterAttr.GetValue())
+	reauthIDAttr, err := decrypted.GetAttr(AKA_AT_NEXT_REAUTH_ID)
+	require.NoError(t, err)
+	require.Equal(t, []byte("reauth@example.org"), reauthIDAttr.GetValue())
+	_, err = decrypted.GetAttr(AKA_AT_PADDING)
+	require.Error(t, err)
+
+	_, err = NewEapAka(SubtypeAkaChallenge).GetEncrData(kEncr)
+	require.Error(t, err)
+	require.Error(t, eapAka.SetEncrData(kEncr[:15], encrAttrs))
+	require.Error(t, eapAka.SetEncrData(kEncr, NewEapAka(SubtypeAkaChallenge)))
+}
+
+func TestCalcEapAkaAtMAC(t *testing.T) {
+	kAut := bytes.Repeat([]byte{0x3c}, 16)
+
+	eapAka := NewEapAka(SubtypeAkaChallenge)
+	require.NoError(t, eapAka.SetAttr(AKA_AT_RES, bytes.Repeat([]byte{0x01}, 8)))
+	eap := &EAP{Code: EapCodeResponse, Identifier: 7, EapTypeData: eapAka}
+
+	mac, err := eap.CalcEapAkaAtMAC(kAut)
+	require.NoError(t, err)
+	require.Len(t, mac, 16)
+	require.NoError(t, eapAka.SetAttr(AKA_AT_MAC, mac))
+
+	raw, err := eap.Marshal()
+	require.NoError(t, err)
+	decoded := new(EAP)
+	require.NoError(t, decoded.Unmarshal(raw))
+	macAttr, err := decoded.EapTypeData.(*EapAka).GetAttr(AKA_AT_MAC)
+	require.NoError(t, err)
+
+	// The receiver computes the same MAC over the decoded message
+	expected, err := decoded.CalcEapAkaAtMAC(kAut)
+	require.NoError(t, err)
+	require.Equal(t, expected, macAttr.GetValue())
+
+	eap.EapTypeData = NewEapAkaPrime(SubtypeAkaChallenge)
+	_, err = eap.CalcEapAkaAtMAC(kAut)
+	require.Error(t, err)
+}
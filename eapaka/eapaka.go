@@ -0,0 +1,154 @@
+package eapaka
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+)
+
+type State int
+
+const (
+	StateIdle      State = iota
+	StateChallenge       // server: challenge sent, peer: challenge answered
+	StateSuccess         // server: RES verified
+	StateFailure
+)
+
+var stateString = map[State]string{
+	StateIdle:      "Idle",
+	StateChallenge: "Challenge",
+	StateSuccess:   "Success",
+	StateFailure:   "Failure",
+}
+
+func (s State) String() string {
+	if str, ok := stateString[s]; ok {
+		return str
+	}
+	return "Unknown"
+}
+
+// Key derivation function of AT_KDF, the only one defined (RFC 5448 - 3.1)
+const KDFPrimeWithSHA256 uint16 = 1
+
+// Client error codes of AT_CLIENT_ERROR_CODE (RFC 4187 - 10.20)
+const (
+	ClientErrorUnableToProcess uint16 = 0
+)
+
+var (
+	// ErrMACFailure is returned by the USIM if the MAC of AUTN is wrong
+	ErrMACFailure = errors.New("AUTN MAC failure")
+	// ErrSyncFailure is returned by the USIM with AUTS if the SQN of AUTN is
+	// out of range
+	ErrSyncFailure = errors.New("SQN synchronization failure")
+)
+
+// USIM runs AKA on the peer side (3GPP TS 33.102 - 6.3.3), and derives CK'
+// and IK' for the network name (3GPP TS 33.402 - A.2)
+type USIM interface {
+	// Authenticate verifies AUTN, and returns RES, CK' and IK'. On
+	// ErrSyncFailure, auts is returned to resynchronize the SQN.
+	Authenticate(rand, autn []byte, networkName string) (res, ckPrime, ikPrime, auts []byte, err error)
+}
+
+// AuthenticationVector is an EAP-AKA' authentication vector, whose CK' and
+// IK' are derived for the network name of the server
+type AuthenticationVector struct {
+	RAND    []byte
+	AUTN    []byte
+	XRES    []byte
+	CKPrime []byte
+	IKPrime []byte
+}
+
+// AuC provides the authentication vectors on the server side
+type AuC interface {
+	// AuthenticationVector returns a fresh authentication vector of the
+	// identity
+	AuthenticationVector(identity, networkName string) (*AuthenticationVector, error)
+	// Resynchronize updates the SQN of the identity from the AUTS returned
+	// for RAND, before a new authentication vector is requested
+	Resynchronize(identity string, rand, auts []byte) error
+}
+
+// keys are the keys derived from CK' and IK' (RFC 5448 - 3.3)
+type keys struct {
+	kAut []byte
+	msk  []byte
+	emsk []byte
+}
+
+func deriveKeys(ckPrime, ikPrime []byte, identity string) (*keys, error) {
+	_, kAut, _, msk, emsk, err := eap_message.EapAkaPrimePRF(ikPrime, ckPrime, identity)
+	if err != nil {
+		return nil, errors.Wrapf(err, "deriveKeys()")
+	}
+	return &keys{kAut: kAut, msk: msk, emsk: emsk}, nil
+}
+
+// newMessage returns an EAP-AKA' message with the attributes, and sets
+// AT_MAC if kAut is not nil
+func newMessage(code eap_message.EapCode, identifier uint8, subType eap_message.EapAkaSubtype,
+	attrs map[eap_message.EapAkaPrimeAttrType][]byte, kAut []byte,
+) (*eap_message.EAP, error) {
+	eapAkaPrime := eap_message.NewEapAkaPrime(subType)
+	for attrType, value := range attrs {
+		if err := eapAkaPrime.SetAttr(attrType, value); err != nil {
+			return nil, errors.Wrapf(err, "newMessage()")
+		}
+	}
+	eap := &eap_message.EAP{
+		Code:        code,
+		Identifier:  identifier,
+		EapTypeData: eapAkaPrime,
+	}
+	if kAut != nil {
+		mac, err := eap.CalcEapAkaPrimeAtMAC(kAut)
+		if err != nil {
+			return nil, errors.Wrapf(err, "newMessage()")
+		}
+		if err = eapAkaPrime.SetAttr(eap_message.AT_MAC, mac); err != nil {
+			return nil, errors.Wrapf(err, "newMessage()")
+		}
+	}
+	return eap, nil
+}
+
+// verifyMAC checks the AT_MAC of the EAP-AKA' message, which is restored
+// afterwards
+func verifyMAC(eap *eap_message.EAP, kAut []byte) error {
+	eapAkaPrime := eap.EapTypeData.(*eap_message.EapAkaPrime)
+	attr, err := eapAkaPrime.GetAttr(eap_message.AT_MAC)
+	if err != nil {
+		return errors.Wrapf(err, "verifyMAC()")
+	}
+	received := attr.GetValue()
+	mac, err := eap.CalcEapAkaPrimeAtMAC(kAut)
+	if err != nil {
+		return errors.Wrapf(err, "verifyMAC()")
+	}
+	if err = eapAkaPrime.SetAttr(eap_message.AT_MAC, received); err != nil {
+		return errors.Wrapf(err, "verifyMAC()")
+	}
+	if !hmac.Equal(mac, received) {
+		return errors.Errorf("verifyMAC(): AT_MAC mismatch")
+	}
+	return nil
+}
+
+func getUint16Attr(eapAkaPrime *eap_message.EapAkaPrime, attrType eap_message.EapAkaPrimeAttrType) (uint16, bool) {
+	attr, err := eapAkaPrime.GetAttr(attrType)
+	if err != nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(attr.GetValue()), true
+}
+
+func uint16Value(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
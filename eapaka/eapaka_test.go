@@ -0,0 +1,528 @@
+package eapaka
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+	"github.com/guoweifk/n3iwue_ike_gw/ikesa"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+var (
+	_ ikesa.EAPPeer   = &Peer{}
+	_ ikesa.EAPServer = &Server{}
+)
+
+const (
+	testIdentity    = "0208930000000001@nai.5gc.mnc093.mcc208.3gppnetwork.org"
+	testNetworkName = "5G:mnc093.mcc208.3gppnetwork.org"
+)
+
+// fakeF computes the functions of the fake AKA, keyed by the subscriber key
+func fakeF(key []byte, label string, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func sqnBytes(sqn uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, sqn)[2:]
+}
+
+// fakeAuC issues vectors whose AUTN is the SQN and a MAC over RAND and SQN
+type fakeAuC struct {
+	key    []byte
+	sqn    uint64
+	rounds int
+}
+
+func (a *fakeAuC) AuthenticationVector(identity, networkName string) (*AuthenticationVector, error) {
+	a.rounds++
+	a.sqn++
+	rand := fakeF(a.key, "rand", sqnBytes(a.sqn))[:16]
+	return &AuthenticationVector{
+		RAND:    rand,
+		AUTN:    append(sqnBytes(a.sqn), fakeF(a.key, "mac", rand, sqnBytes(a.sqn))[:10]...),
+		XRES:    fakeF(a.key, "res", rand)[:8],
+		CKPrime: fakeF(a.key, "ck", rand, []byte(networkName))[:16],
+		IKPrime: fakeF(a.key, "ik", rand, []byte(networkName))[:16],
+	}, nil
+}
+
+func (a *fakeAuC) Resynchronize(identity string, rand, auts []byte) error {
+	if !bytes.Equal(auts[6:], fakeF(a.key, "auts", rand, auts[:6])[:8]) {
+		return errors.Errorf("AUTS MAC failure")
+	}
+	a.sqn = binary.BigEndian.Uint64(append([]byte{0, 0}, auts[:6]...))
+	return nil
+}
+
+// fakeUSIM accepts the AUTN of fakeAuC with a SQN larger than the last one
+type fakeUSIM struct {
+	key []byte
+	sqn uint64
+}
+
+func (u *fakeUSIM) Authenticate(rand, autn []byte, networkName string) (res, ckPrime, ikPrime, auts []byte, err error) {
+	if !bytes.Equal(autn[6:], fakeF(u.key, "mac", rand, autn[:6])[:10]) {
+		return nil, nil, nil, nil, ErrMACFailure
+	}
+	sqn := binary.BigEndian.Uint64(append([]byte{0, 0}, autn[:6]...))
+	if sqn <= u.sqn {
+		auts = append(sqnBytes(u.sqn), fakeF(u.key, "auts", rand, sqnBytes(u.sqn))[:8]...)
+		return nil, nil, nil, auts, ErrSyncFailure
+	}
+	u.sqn = sqn
+	return fakeF(u.key, "res", rand)[:8], fakeF(u.key, "ck", rand, []byte(networkName))[:16],
+		fakeF(u.key, "ik", rand, []byte(networkName))[:16], nil, nil
+}
+
+// transfer encodes and decodes the EAP message, as sent in an EAP payload
+func transfer(t *testing.T, eap *eap_message.EAP) *eap_message.EAP {
+	b, err := eap.Marshal()
+	require.NoError(t, err)
+	received := new(eap_message.EAP)
+	require.NoError(t, received.Unmarshal(b))
+	return received
+}
+
+func requireSubtype(t *testing.T, eap *eap_message.EAP, subType eap_message.EapAkaSubtype) {
+	eapAkaPrime, ok := eap.EapTypeData.(*eap_message.EapAkaPrime)
+	require.True(t, ok)
+	require.Equal(t, subType, eapAkaPrime.SubType())
+}
+
+func newTestPair(t *testing.T, usim *fakeUSIM, auc *fakeAuC, networkName string) (*Peer, *Server) {
+	peer, err := NewPeer(PeerConfig{Identity: testIdentity, NetworkName: networkName, USIM: usim})
+	require.NoError(t, err)
+	server, err := NewServer(ServerConfig{NetworkName: testNetworkName, AuC: auc})
+	require.NoError(t, err)
+	return peer, server
+}
+
+func start(t *testing.T, server *Server) *eap_message.EAP {
+	request, err := server.Start(&message.IdentificationInitiator{
+		IDType: message.ID_RFC822_ADDR,
+		IDData: []byte(testIdentity),
+	})
+	require.NoError(t, err)
+	return transfer(t, request)
+}
+
+func TestEAPAKAPrime(t *testing.T) {
+	key := []byte("subscriber key")
+	peer, server := newTestPair(t, &fakeUSIM{key: key}, &fakeAuC{key: key}, testNetworkName)
+
+	request := start(t, server)
+	requireSubtype(t, request, eap_message.SubtypeAkaChallenge)
+	require.Equal(t, StateChallenge, server.State())
+	require.Nil(t, server.MSK())
+
+	response, err := peer.HandleRequest(request)
+	require.NoError(t, err)
+	require.Equal(t, request.Identifier, response.Identifier)
+	requireSubtype(t, response, eap_message.SubtypeAkaChallenge)
+	require.Equal(t, StateChallenge, peer.State())
+
+	result, err := server.HandleResponse(transfer(t, response))
+	require.NoError(t, err)
+	require.Equal(t, eap_message.EapCodeSuccess, result.Code)
+	require.Equal(t, request.Identifier, result.Identifier)
+	require.Equal(t, StateSuccess, server.State())
+	require.Len(t, server.MSK(), 64)
+	require.Equal(t, server.MSK(), peer.MSK())
+	require.Len(t, server.EMSK(), 64)
+	require.Equal(t, server.EMSK(), peer.EMSK())
+
+	// The authentication is over
+	_, err = server.HandleResponse(transfer(t, response))
+	require.Error(t, err)
+	_, err = server.Start(&message.IdentificationInitiator{IDData: []byte(testIdentity)})
+	require.Error(t, err)
+}
+
+// The network name of AT_KDF_INPUT is encoded with its length in bytes
+// (RFC 5448 - 3.1), so that the peer accepts the challenges of real servers
+func TestEAPAKAPrimeKDFInputEncoding(t *testing.T) {
+	key := []byte("subscriber key")
+	peer, server := newTestPair(t, &fakeUSIM{key: key}, &fakeAuC{key: key}, testNetworkName)
+
+	request, err := server.Start(&message.IdentificationInitiator{
+		IDType: message.ID_RFC822_ADDR,
+		IDData: []byte(testIdentity),
+	})
+	require.NoError(t, err)
+	b, err := request.Marshal()
+	require.NoError(t, err)
+	kdfInput := append([]byte{
+		byte(eap_message.AT_KDF_INPUT), byte((4 + len(testNetworkName) + 3) / 4),
+		0x00, byte(len(testNetworkName)),
+	}, testNetworkName...)
+	require.True(t, bytes.Contains(b, kdfInput))
+
+	received := new(eap_message.EAP)
+	require.NoError(t, received.Unmarshal(b))
+	response, err := peer.HandleRequest(received)
+	require.NoError(t, err)
+	requireSubtype(t, response, eap_message.SubtypeAkaChallenge)
+	require.Equal(t, StateChallenge, peer.State())
+}
+
+func TestEAPAKAPrimeResynchronization(t *testing.T) {
+	key := []byte("subscriber key")
+	auc := &fakeAuC{key: key}
+	peer, server := newTestPair(t, &fakeUSIM{key: key, sqn: 32}, auc, testNetworkName)
+
+	request := start(t, server)
+	response, err := peer.HandleRequest(request)
+	require.NoError(t, err)
+	requireSubtype(t, response, eap_message.SubtypeAkaSynchronizationFailure)
+	require.Equal(t, StateIdle, peer.State())
+
+	// A new challenge after the SQN is resynchronized
+	next, err := server.HandleResponse(transfer(t, response))
+	require.NoError(t, err)
+	require.Equal(t, eap_message.EapCodeRequest, next.Code)
+	require.Equal(t, request.Identifier+1, next.Identifier)
+	require.Equal(t, 2, auc.rounds)
+	require.Equal(t, uint64(33), auc.sqn)
+
+	response, err = peer.HandleRequest(transfer(t, next))
+	require.NoError(t, err)
+	requireSubtype(t, response, eap_message.SubtypeAkaChallenge)
+	result, err := server.HandleResponse(transfer(t, response))
+	require.NoError(t, err)
+	require.Equal(t, eap_message.EapCodeSuccess, result.Code)
+	require.Equal(t, server.MSK(), peer.MSK())
+
+	// The SQN is resynchronized once
+	peer, server = newTestPair(t, &fakeUSIM{key: key, sqn: 32}, &fakeAuC{key: key}, testNetworkName)
+	response, err = peer.HandleRequest(start(t, server))
+	require.NoError(t, err)
+	next, err = server.HandleResponse(transfer(t, response))
+	require.NoError(t, err)
+	peer.config.USIM = &fakeUSIM{key: key, sqn: 64}
+	response, err = peer.HandleRequest(transfer(t, next))
+	require.NoError(t, err)
+	requireSubtype(t, response, eap_message.SubtypeAkaSynchronizationFailure)
+	result, err = server.HandleResponse(transfer(t, response))
+	require.NoError(t, err)
+	require.Equal(t, eap_message.EapCodeFailure, result.Code)
+	require.Equal(t, StateFailure, server.State())
+}
+
+// withKDFs replaces the AT_KDF list of the challenge, whose AT_MAC is
+// computed again if kAut is not nil
+func withKDFs(t *testing.T, request *eap_message.EAP, kdfs []uint16, kAut []byte) *eap_message.EAP {
+	eapAkaPrime := request.EapTypeData.(*eap_message.EapAkaPrime)
+	require.NoError(t, eapAkaPrime.SetKDFs(kdfs))
+	if kAut != nil {
+		mac, err := request.CalcEapAkaPrimeAtMAC(kAut)
+		require.NoError(t, err)
+		require.NoError(t, eapAkaPrime.SetAttr(eap_message.AT_MAC, mac))
+	}
+	return transfer(t, request)
+}
+
+func TestPeerKDFNegotiation(t *testing.T) {
+	key := []byte("subscriber key")
+
+	testcases := []struct {
+		description     string
+		secondKDFs      []uint16
+		expPeerResponse eap_message.EapAkaSubtype
+	}{
+		{
+			description:     "KDF 1 first, followed by the list unchanged",
+			secondKDFs:      []uint16{1, 2, 1},
+			expPeerResponse: eap_message.SubtypeAkaChallenge,
+		},
+		{
+			description:     "List changed",
+			secondKDFs:      []uint16{1, 2},
+			expPeerResponse: eap_message.SubtypeAkaClientError,
+		},
+		{
+			description:     "Selection ignored",
+			secondKDFs:      []uint16{2, 1},
+			expPeerResponse: eap_message.SubtypeAkaAuthenticationReject,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			peer, server := newTestPair(t, &fakeUSIM{key: key}, &fakeAuC{key: key}, testNetworkName)
+
+			// KDF 2 is preferred, KDF 1 is selected without running AKA
+			response, err := peer.HandleRequest(withKDFs(t, start(t, server), []uint16{2, 1}, nil))
+			require.NoError(t, err)
+			requireSubtype(t, response, eap_message.SubtypeAkaChallenge)
+			selection := transfer(t, response).EapTypeData.(*eap_message.EapAkaPrime)
+			require.Equal(t, []uint16{KDFPrimeWithSHA256}, selection.GetKDFs())
+			_, err = selection.GetAttr(eap_message.AT_RES)
+			require.Error(t, err)
+			_, err = selection.GetAttr(eap_message.AT_MAC)
+			require.Error(t, err)
+			require.Equal(t, StateIdle, peer.State())
+
+			// New challenge with the selected KDF
+			request, err := server.challenge()
+			require.NoError(t, err)
+			response, err = peer.HandleRequest(withKDFs(t, request, tc.secondKDFs, server.keys.kAut))
+			require.NoError(t, err)
+			requireSubtype(t, response, tc.expPeerResponse)
+			if tc.expPeerResponse != eap_message.SubtypeAkaChallenge {
+				require.Equal(t, StateFailure, peer.State())
+				return
+			}
+
+			result, err := server.HandleResponse(transfer(t, response))
+			require.NoError(t, err)
+			require.Equal(t, eap_message.EapCodeSuccess, result.Code)
+			require.Equal(t, server.MSK(), peer.MSK())
+		})
+	}
+
+	// No supported KDF in the list
+	peer, server := newTestPair(t, &fakeUSIM{key: key}, &fakeAuC{key: key}, testNetworkName)
+	response, err := peer.HandleRequest(withKDFs(t, start(t, server), []uint16{2, 3}, nil))
+	require.NoError(t, err)
+	requireSubtype(t, response, eap_message.SubtypeAkaAuthenticationReject)
+
+	// The server offers only KDF 1, so any selection fails
+	peer, server = newTestPair(t, &fakeUSIM{key: key}, &fakeAuC{key: key}, testNetworkName)
+	request := start(t, server)
+	_, err = peer.HandleRequest(request)
+	require.NoError(t, err)
+	selection, err := newMessage(eap_message.EapCodeResponse, request.Identifier,
+		eap_message.SubtypeAkaChallenge,
+		map[eap_message.EapAkaPrimeAttrType][]byte{eap_message.AT_KDF: uint16Value(KDFPrimeWithSHA256)}, nil)
+	require.NoError(t, err)
+	result, err := server.HandleResponse(transfer(t, selection))
+	require.NoError(t, err)
+	require.Equal(t, eap_message.EapCodeFailure, result.Code)
+}
+
+func TestEAPAKAPrimeFailure(t *testing.T) {
+	key := []byte("subscriber key")
+
+	testcases := []struct {
+		description     string
+		usimKey         []byte
+		networkName     string
+		tamper          func(request *eap_message.EAP)
+		expPeerResponse eap_message.EapAkaSubtype
+	}{
+		{
+			description:     "AUTN MAC failure",
+			usimKey:         []byte("other key"),
+			networkName:     testNetworkName,
+			expPeerResponse: eap_message.SubtypeAkaAuthenticationReject,
+		},
+		{
+			description:     "Unexpected network name",
+			usimKey:         key,
+			networkName:     "5G:mnc001.mcc001.3gppnetwork.org",
+			expPeerResponse: eap_message.SubtypeAkaAuthenticationReject,
+		},
+		{
+			description: "Unsupported KDF",
+			usimKey:     key,
+			tamper: func(request *eap_message.EAP) {
+				eapAkaPrime := request.EapTypeData.(*eap_message.EapAkaPrime)
+				require.NoError(t, eapAkaPrime.SetAttr(eap_message.AT_KDF, uint16Value(2)))
+			},
+			expPeerResponse: eap_message.SubtypeAkaAuthenticationReject,
+		},
+		{
+			description: "AT_MAC mismatch",
+			usimKey:     key,
+			tamper: func(request *eap_message.EAP) {
+				eapAkaPrime := request.EapTypeData.(*eap_message.EapAkaPrime)
+				require.NoError(t, eapAkaPrime.SetAttr(eap_message.AT_MAC, make([]byte, 16)))
+			},
+			expPeerResponse: eap_message.SubtypeAkaClientError,
+		},
+		{
+			description: "Missing AT_AUTN",
+			usimKey:     key,
+			tamper: func(request *eap_message.EAP) {
+				eapAkaPrime := eap_message.NewEapAkaPrime(eap_message.SubtypeAkaChallenge)
+				attr, err := request.EapTypeData.(*eap_message.EapAkaPrime).GetAttr(eap_message.AT_RAND)
+				require.NoError(t, err)
+				require.NoError(t, eapAkaPrime.SetAttr(eap_message.AT_RAND, attr.GetValue()))
+				request.EapTypeData = eapAkaPrime
+			},
+			expPeerResponse: eap_message.SubtypeAkaClientError,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			peer, server := newTestPair(t, &fakeUSIM{key: tc.usimKey}, &fakeAuC{key: key}, tc.networkName)
+			request := start(t, server)
+			if tc.tamper != nil {
+				tc.tamper(request)
+			}
+			response, err := peer.HandleRequest(request)
+			require.NoError(t, err)
+			requireSubtype(t, response, tc.expPeerResponse)
+			require.Equal(t, StateFailure, peer.State())
+			require.Nil(t, peer.MSK())
+
+			result, err := server.HandleResponse(transfer(t, response))
+			require.NoError(t, err)
+			require.Equal(t, eap_message.EapCodeFailure, result.Code)
+			require.Equal(t, StateFailure, server.State())
+			require.Nil(t, server.MSK())
+		})
+	}
+}
+
+func TestServerHandleResponse(t *testing.T) {
+	key := []byte("subscriber key")
+
+	testcases := []struct {
+		description string
+		usimKey     []byte
+		tamper      func(response *eap_message.EAP)
+		expErr      bool
+	}{
+		{
+			description: "Wrong RES",
+			usimKey:     key,
+			tamper: func(response *eap_message.EAP) {
+				eapAkaPrime := response.EapTypeData.(*eap_message.EapAkaPrime)
+				require.NoError(t, eapAkaPrime.SetAttr(eap_message.AT_RES, make([]byte, 8)))
+			},
+		},
+		{
+			description: "AT_MAC mismatch",
+			usimKey:     key,
+			tamper: func(response *eap_message.EAP) {
+				eapAkaPrime := response.EapTypeData.(*eap_message.EapAkaPrime)
+				require.NoError(t, eapAkaPrime.SetAttr(eap_message.AT_MAC, make([]byte, 16)))
+			},
+		},
+		{
+			description: "KDF negotiation",
+			usimKey:     key,
+			tamper: func(response *eap_message.EAP) {
+				eapAkaPrime := response.EapTypeData.(*eap_message.EapAkaPrime)
+				require.NoError(t, eapAkaPrime.SetAttr(eap_message.AT_KDF, uint16Value(2)))
+			},
+		},
+		{
+			description: "Not EAP-AKA'",
+			usimKey:     key,
+			tamper: func(response *eap_message.EAP) {
+				response.EapTypeData = &eap_message.EapNak{NakData: []byte{byte(eap_message.EapTypeMD5)}}
+			},
+		},
+		{
+			description: "Identifier mismatch",
+			usimKey:     key,
+			tamper: func(response *eap_message.EAP) {
+				response.Identifier++
+			},
+			expErr: true,
+		},
+		{
+			description: "Not a response",
+			usimKey:     key,
+			tamper: func(response *eap_message.EAP) {
+				response.Code = eap_message.EapCodeRequest
+			},
+			expErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			peer, server := newTestPair(t, &fakeUSIM{key: tc.usimKey}, &fakeAuC{key: key}, testNetworkName)
+			response, err := peer.HandleRequest(start(t, server))
+			require.NoError(t, err)
+			tc.tamper(response)
+
+			result, err := server.HandleResponse(response)
+			if tc.expErr {
+				require.Error(t, err)
+				require.Equal(t, StateChallenge, server.State())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, eap_message.EapCodeFailure, result.Code)
+			require.Equal(t, StateFailure, server.State())
+		})
+	}
+}
+
+func TestPeerHandleRequest(t *testing.T) {
+	key := []byte("subscriber key")
+	peer, server := newTestPair(t, &fakeUSIM{key: key}, &fakeAuC{key: key}, "")
+
+	// Identity and other methods
+	response, err := peer.HandleRequest(&eap_message.EAP{
+		Code:        eap_message.EapCodeRequest,
+		Identifier:  1,
+		EapTypeData: &eap_message.EapIdentity{},
+	})
+	require.NoError(t, err)
+	require.Equal(t, &eap_message.EapIdentity{IdentityData: []byte(testIdentity)}, response.EapTypeData)
+	response, err = peer.HandleRequest(&eap_message.EAP{
+		Code:        eap_message.EapCodeRequest,
+		Identifier:  2,
+		EapTypeData: &eap_message.EapMD5{},
+	})
+	require.NoError(t, err)
+	require.Equal(t, &eap_message.EapNak{NakData: []byte{byte(eap_message.EapTypeAkaPrime)}}, response.EapTypeData)
+	_, err = peer.HandleRequest(&eap_message.EAP{Code: eap_message.EapCodeSuccess})
+	require.Error(t, err)
+
+	// Any network name is accepted
+	response, err = peer.HandleRequest(start(t, server))
+	require.NoError(t, err)
+	requireSubtype(t, response, eap_message.SubtypeAkaChallenge)
+
+	// Notification after the challenge is protected
+	notification, err := newMessage(eap_message.EapCodeRequest, 3, eap_message.SubtypeAkaNotification,
+		map[eap_message.EapAkaPrimeAttrType][]byte{eap_message.AT_NOTIFICATION: uint16Value(0x8000)},
+		server.keys.kAut)
+	require.NoError(t, err)
+	response, err = peer.HandleRequest(transfer(t, notification))
+	require.NoError(t, err)
+	requireSubtype(t, response, eap_message.SubtypeAkaNotification)
+	require.NoError(t, verifyMAC(response, server.keys.kAut))
+	require.Equal(t, StateChallenge, peer.State())
+
+	// Failure notification
+	notification, err = newMessage(eap_message.EapCodeRequest, 4, eap_message.SubtypeAkaNotification,
+		map[eap_message.EapAkaPrimeAttrType][]byte{eap_message.AT_NOTIFICATION: uint16Value(0x4000)}, nil)
+	require.NoError(t, err)
+	response, err = peer.HandleRequest(transfer(t, notification))
+	require.NoError(t, err)
+	requireSubtype(t, response, eap_message.SubtypeAkaNotification)
+	require.Equal(t, StateFailure, peer.State())
+	require.Nil(t, peer.MSK())
+}
+
+func TestNewPeerServer(t *testing.T) {
+	_, err := NewPeer(PeerConfig{USIM: &fakeUSIM{}})
+	require.Error(t, err)
+	_, err = NewPeer(PeerConfig{Identity: testIdentity})
+	require.Error(t, err)
+	_, err = NewServer(ServerConfig{AuC: &fakeAuC{}})
+	require.Error(t, err)
+	_, err = NewServer(ServerConfig{NetworkName: testNetworkName})
+	require.Error(t, err)
+}
@@ -0,0 +1,219 @@
+package eapaka
+
+import (
+	"slices"
+
+	"github.com/pkg/errors"
+
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+)
+
+// Bits of AT_NOTIFICATION (RFC 4187 - 10.19)
+const (
+	notificationBitSuccess      uint16 = 0x8000
+	notificationBitPreChallenge uint16 = 0x4000
+)
+
+type PeerConfig struct {
+	// Identity answered to EAP-Request/Identity, and used in the key
+	// derivation
+	Identity string
+	// Network name expected in AT_KDF_INPUT, any name is accepted if empty
+	NetworkName string
+	USIM        USIM
+}
+
+// Peer runs EAP-AKA' on the peer side (RFC 5448)
+type Peer struct {
+	config PeerConfig
+	state  State
+	keys   *keys
+	// AT_KDF list of the challenge, whose KDF was not supported, answered
+	// with the selection of KDF 1
+	offeredKDFs []uint16
+}
+
+func NewPeer(config PeerConfig) (*Peer, error) {
+	if config.Identity == "" || config.USIM == nil {
+		return nil, errors.Errorf("NewPeer(): Identity or USIM is missing")
+	}
+	return &Peer{config: config}, nil
+}
+
+func (p *Peer) State() State {
+	return p.state
+}
+
+// MSK returns the master session key once the challenge is answered
+func (p *Peer) MSK() []byte {
+	if p.state != StateChallenge {
+		return nil
+	}
+	return p.keys.msk
+}
+
+// EMSK returns the extended master session key once the challenge is
+// answered
+func (p *Peer) EMSK() []byte {
+	if p.state != StateChallenge {
+		return nil
+	}
+	return p.keys.emsk
+}
+
+// HandleRequest returns the response to an EAP request. EAP-AKA' messages
+// which cannot be processed are answered with AKA'-Client-Error, the
+// challenges failing the authentication with AKA'-Authentication-Reject.
+func (p *Peer) HandleRequest(request *eap_message.EAP) (*eap_message.EAP, error) {
+	if request == nil || request.Code != eap_message.EapCodeRequest {
+		return nil, errors.Errorf("HandleRequest(): Not an EAP request")
+	}
+
+	switch typeData := request.EapTypeData.(type) {
+	case *eap_message.EapIdentity:
+		return &eap_message.EAP{
+			Code:        eap_message.EapCodeResponse,
+			Identifier:  request.Identifier,
+			EapTypeData: &eap_message.EapIdentity{IdentityData: []byte(p.config.Identity)},
+		}, nil
+	case *eap_message.EapAkaPrime:
+		switch typeData.SubType() {
+		case eap_message.SubtypeAkaChallenge:
+			return p.handleChallenge(request, typeData)
+		case eap_message.SubtypeAkaNotification:
+			return p.handleNotification(request, typeData)
+		default:
+			return p.clientError(request.Identifier)
+		}
+	default:
+		// Ask for EAP-AKA' instead
+		return &eap_message.EAP{
+			Code:        eap_message.EapCodeResponse,
+			Identifier:  request.Identifier,
+			EapTypeData: &eap_message.EapNak{NakData: []byte{byte(eap_message.EapTypeAkaPrime)}},
+		}, nil
+	}
+}
+
+// handleChallenge answers AKA'-Challenge (RFC 5448 - 3.1, 3.2). KDF 1 is the
+// only key derivation function supported, selected if the server prefers
+// another one.
+func (p *Peer) handleChallenge(
+	request *eap_message.EAP, challenge *eap_message.EapAkaPrime,
+) (*eap_message.EAP, error) {
+	randAttr, errRand := challenge.GetAttr(eap_message.AT_RAND)
+	autnAttr, errAutn := challenge.GetAttr(eap_message.AT_AUTN)
+	kdfInputAttr, errKDFInput := challenge.GetAttr(eap_message.AT_KDF_INPUT)
+	kdfs := challenge.GetKDFs()
+	_, errMAC := challenge.GetAttr(eap_message.AT_MAC)
+	if errRand != nil || errAutn != nil || errKDFInput != nil || errMAC != nil || len(kdfs) == 0 {
+		return p.clientError(request.Identifier)
+	}
+
+	if kdfs[0] != KDFPrimeWithSHA256 {
+		return p.selectKDF(request.Identifier, kdfs)
+	}
+	// After the selection, the server puts KDF 1 first and repeats its list
+	// unchanged (RFC 5448 - 3.2)
+	if p.offeredKDFs != nil && !slices.Equal(kdfs[1:], p.offeredKDFs) {
+		return p.clientError(request.Identifier)
+	}
+
+	// The network is not the expected one
+	networkName := string(kdfInputAttr.GetValue())
+	if networkName == "" || p.config.NetworkName != "" && networkName != p.config.NetworkName {
+		return p.authenticationReject(request.Identifier)
+	}
+
+	res, ckPrime, ikPrime, auts, err := p.config.USIM.Authenticate(
+		randAttr.GetValue(), autnAttr.GetValue(), networkName)
+	switch {
+	case errors.Is(err, ErrSyncFailure):
+		return newMessage(eap_message.EapCodeResponse, request.Identifier,
+			eap_message.SubtypeAkaSynchronizationFailure,
+			map[eap_message.EapAkaPrimeAttrType][]byte{eap_message.AT_AUTS: auts}, nil)
+	case errors.Is(err, ErrMACFailure):
+		return p.authenticationReject(request.Identifier)
+	case err != nil:
+		return nil, errors.Wrapf(err, "handleChallenge()")
+	}
+
+	keys, err := deriveKeys(ckPrime, ikPrime, p.config.Identity)
+	if err != nil {
+		return nil, errors.Wrapf(err, "handleChallenge()")
+	}
+	if err = verifyMAC(request, keys.kAut); err != nil {
+		return p.clientError(request.Identifier)
+	}
+
+	response, err := newMessage(eap_message.EapCodeResponse, request.Identifier,
+		eap_message.SubtypeAkaChallenge,
+		map[eap_message.EapAkaPrimeAttrType][]byte{eap_message.AT_RES: res}, keys.kAut)
+	if err != nil {
+		return nil, errors.Wrapf(err, "handleChallenge()")
+	}
+	p.keys = keys
+	p.state = StateChallenge
+	return response, nil
+}
+
+// selectKDF answers the challenge whose first AT_KDF is not supported with
+// KDF 1, if offered further in the list. It is selected only once per
+// authentication (RFC 5448 - 3.2).
+func (p *Peer) selectKDF(identifier uint8, kdfs []uint16) (*eap_message.EAP, error) {
+	if p.offeredKDFs != nil || !slices.Contains(kdfs[1:], KDFPrimeWithSHA256) {
+		return p.authenticationReject(identifier)
+	}
+	p.offeredKDFs = kdfs
+
+	eapAkaPrime := eap_message.NewEapAkaPrime(eap_message.SubtypeAkaChallenge)
+	if err := eapAkaPrime.SetKDFs([]uint16{KDFPrimeWithSHA256}); err != nil {
+		return nil, errors.Wrapf(err, "selectKDF()")
+	}
+	return &eap_message.EAP{
+		Code:        eap_message.EapCodeResponse,
+		Identifier:  identifier,
+		EapTypeData: eapAkaPrime,
+	}, nil
+}
+
+// handleNotification acknowledges AKA'-Notification, which is protected by
+// AT_MAC after the challenge (RFC 4187 - 6.1)
+func (p *Peer) handleNotification(
+	request *eap_message.EAP, notification *eap_message.EapAkaPrime,
+) (*eap_message.EAP, error) {
+	code, ok := getUint16Attr(notification, eap_message.AT_NOTIFICATION)
+	if !ok {
+		return p.clientError(request.Identifier)
+	}
+
+	var kAut []byte
+	if code&notificationBitPreChallenge == 0 {
+		if p.state != StateChallenge {
+			return p.clientError(request.Identifier)
+		}
+		if err := verifyMAC(request, p.keys.kAut); err != nil {
+			return p.clientError(request.Identifier)
+		}
+		kAut = p.keys.kAut
+	}
+	if code&notificationBitSuccess == 0 {
+		p.state = StateFailure
+	}
+	return newMessage(eap_message.EapCodeResponse, request.Identifier,
+		eap_message.SubtypeAkaNotification, nil, kAut)
+}
+
+func (p *Peer) authenticationReject(identifier uint8) (*eap_message.EAP, error) {
+	p.state = StateFailure
+	return newMessage(eap_message.EapCodeResponse, identifier,
+		eap_message.SubtypeAkaAuthenticationReject, nil, nil)
+}
+
+func (p *Peer) clientError(identifier uint8) (*eap_message.EAP, error) {
+	p.state = StateFailure
+	return newMessage(eap_message.EapCodeResponse, identifier, eap_message.SubtypeAkaClientError,
+		map[eap_message.EapAkaPrimeAttrType][]byte{
+			eap_message.AT_CLIENT_ERROR_CODE: uint16Value(ClientErrorUnableToProcess),
+		}, nil)
+}
@@ -0,0 +1,185 @@
+package eapaka
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+
+	"github.com/pkg/errors"
+
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+type ServerConfig struct {
+	// Network name sent in AT_KDF_INPUT, for which CK' and IK' are derived
+	NetworkName string
+	AuC         AuC
+}
+
+// Server runs EAP-AKA' on the server side (RFC 5448), for one
+// authentication
+type Server struct {
+	config ServerConfig
+
+	identity   string
+	identifier uint8
+	state      State
+	vector     *AuthenticationVector
+	keys       *keys
+	// The SQN is resynchronized once per authentication
+	resynchronized bool
+}
+
+func NewServer(config ServerConfig) (*Server, error) {
+	if config.NetworkName == "" || config.AuC == nil {
+		return nil, errors.Errorf("NewServer(): Network name or AuC is missing")
+	}
+	return &Server{config: config}, nil
+}
+
+func (s *Server) State() State {
+	return s.state
+}
+
+// MSK returns the master session key after EAP Success
+func (s *Server) MSK() []byte {
+	if s.state != StateSuccess {
+		return nil
+	}
+	return s.keys.msk
+}
+
+// EMSK returns the extended master session key after EAP Success
+func (s *Server) EMSK() []byte {
+	if s.state != StateSuccess {
+		return nil
+	}
+	return s.keys.emsk
+}
+
+// Start returns the AKA'-Challenge for the identity of the IDi payload
+func (s *Server) Start(identity *message.IdentificationInitiator) (*eap_message.EAP, error) {
+	if s.state != StateIdle {
+		return nil, errors.Errorf("Start(): Authentication already started")
+	}
+	if identity == nil || len(identity.IDData) == 0 {
+		return nil, errors.Errorf("Start(): Identity is missing")
+	}
+	s.identity = string(identity.IDData)
+
+	var identifier [1]byte
+	if _, err := rand.Read(identifier[:]); err != nil {
+		return nil, errors.Wrapf(err, "Start()")
+	}
+	s.identifier = identifier[0]
+
+	request, err := s.challenge()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Start()")
+	}
+	return request, nil
+}
+
+// HandleResponse returns the next AKA'-Challenge after a resynchronization,
+// or the EAP Success or EAP Failure ending the authentication. Responses
+// which are not to the last request are discarded with an error.
+func (s *Server) HandleResponse(response *eap_message.EAP) (*eap_message.EAP, error) {
+	if s.state != StateChallenge {
+		return nil, errors.Errorf("HandleResponse(): Unexpected response in state %s", s.state)
+	}
+	if response == nil || response.Code != eap_message.EapCodeResponse {
+		return nil, errors.Errorf("HandleResponse(): Not an EAP response")
+	}
+	if response.Identifier != s.identifier {
+		return nil, errors.Errorf("HandleResponse(): Identifier %d mismatches request %d",
+			response.Identifier, s.identifier)
+	}
+
+	eapAkaPrime, ok := response.EapTypeData.(*eap_message.EapAkaPrime)
+	if !ok {
+		return s.failure(), nil
+	}
+	switch eapAkaPrime.SubType() {
+	case eap_message.SubtypeAkaChallenge:
+		return s.handleChallenge(response, eapAkaPrime), nil
+	case eap_message.SubtypeAkaSynchronizationFailure:
+		return s.handleSynchronizationFailure(eapAkaPrime)
+	default:
+		// Authentication-Reject, Client-Error or unexpected
+		return s.failure(), nil
+	}
+}
+
+// challenge fetches a new authentication vector, and returns the
+// AKA'-Challenge of the current identifier
+func (s *Server) challenge() (*eap_message.EAP, error) {
+	vector, err := s.config.AuC.AuthenticationVector(s.identity, s.config.NetworkName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "challenge()")
+	}
+	keys, err := deriveKeys(vector.CKPrime, vector.IKPrime, s.identity)
+	if err != nil {
+		return nil, errors.Wrapf(err, "challenge()")
+	}
+
+	request, err := newMessage(eap_message.EapCodeRequest, s.identifier, eap_message.SubtypeAkaChallenge,
+		map[eap_message.EapAkaPrimeAttrType][]byte{
+			eap_message.AT_RAND:      vector.RAND,
+			eap_message.AT_AUTN:      vector.AUTN,
+			eap_message.AT_KDF:       uint16Value(KDFPrimeWithSHA256),
+			eap_message.AT_KDF_INPUT: []byte(s.config.NetworkName),
+		}, keys.kAut)
+	if err != nil {
+		return nil, errors.Wrapf(err, "challenge()")
+	}
+	s.vector, s.keys = vector, keys
+	s.state = StateChallenge
+	return request, nil
+}
+
+// handleChallenge verifies AT_MAC and AT_RES of the AKA'-Challenge response.
+// AT_KDF asks for another KDF than the only one offered, which fails the
+// authentication (RFC 5448 - 3.2).
+func (s *Server) handleChallenge(response *eap_message.EAP, challenge *eap_message.EapAkaPrime) *eap_message.EAP {
+	if _, hasKDF := getUint16Attr(challenge, eap_message.AT_KDF); hasKDF {
+		return s.failure()
+	}
+	if err := verifyMAC(response, s.keys.kAut); err != nil {
+		return s.failure()
+	}
+	resAttr, err := challenge.GetAttr(eap_message.AT_RES)
+	if err != nil || !hmac.Equal(resAttr.GetValue(), s.vector.XRES) {
+		return s.failure()
+	}
+
+	s.state = StateSuccess
+	return &eap_message.EAP{Code: eap_message.EapCodeSuccess, Identifier: s.identifier}
+}
+
+// handleSynchronizationFailure resynchronizes the SQN with AT_AUTS, and
+// challenges the peer again with a new authentication vector
+func (s *Server) handleSynchronizationFailure(syncFailure *eap_message.EapAkaPrime) (*eap_message.EAP, error) {
+	autsAttr, err := syncFailure.GetAttr(eap_message.AT_AUTS)
+	if err != nil || s.resynchronized {
+		return s.failure(), nil
+	}
+	if err = s.config.AuC.Resynchronize(s.identity, s.vector.RAND, autsAttr.GetValue()); err != nil {
+		s.failure()
+		return nil, errors.Wrapf(err, "handleSynchronizationFailure()")
+	}
+	s.resynchronized = true
+
+	s.identifier++
+	request, err := s.challenge()
+	if err != nil {
+		s.failure()
+		return nil, errors.Wrapf(err, "handleSynchronizationFailure()")
+	}
+	return request, nil
+}
+
+func (s *Server) failure() *eap_message.EAP {
+	s.state = StateFailure
+	s.keys = nil
+	return &eap_message.EAP{Code: eap_message.EapCodeFailure, Identifier: s.identifier}
+}
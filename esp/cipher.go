@@ -0,0 +1,144 @@
+package esp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
+)
+
+// Length of the explicit IV of AES-CTR (RFC 3686 - 3) and AES-GCM
+// (RFC 4106 - 3.1), which is the sequence number of the packet
+const counterIVLength = 8
+
+// espCipher protects the plain text of an ESP packet, which is the payload
+// followed by the ESP trailer
+type espCipher interface {
+	ivLength() int
+	// Length of the ICV of a combined mode cipher, zero otherwise
+	icvLength() int
+	// The plain text is a multiple of blockSize octets long
+	blockSize() int
+	// seal returns IV | cipher text | ICV. The associated data is only used
+	// by combined mode ciphers.
+	seal(seq uint64, plainText, associatedData []byte) ([]byte, error)
+	// open takes IV | cipher text | ICV
+	open(data, associatedData []byte) ([]byte, error)
+}
+
+// newCipher keys the cipher of an encryption transform of a Child SA. The
+// keying material is split as for IKE, so the block, nonce and salt are taken
+// from the IKE crypto of the transform.
+func newCipher(encrKInfo encr.ENCRKType, key []byte) (espCipher, error) {
+	encrInfo, ok := encrKInfo.(encr.ENCRType)
+	if !ok {
+		return nil, errors.Errorf("newCipher(): Unsupported encryption transform %d", encrKInfo.TransformID())
+	}
+	ikeCrypto, err := encrInfo.NewCrypto(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "newCipher()")
+	}
+
+	switch c := ikeCrypto.(type) {
+	case *encr.EncrAesCbcCrypto:
+		return &cbcCipher{block: c.Block}, nil
+	case *encr.EncrAesCtrCrypto:
+		return &ctrCipher{block: c.Block, nonce: c.Nonce}, nil
+	case *encr.EncrAesGcmCrypto:
+		return &gcmCipher{aead: c.Aead, salt: c.Salt}, nil
+	default:
+		return nil, errors.Errorf("newCipher(): Unsupported encryption transform %d", encrKInfo.TransformID())
+	}
+}
+
+// cbcCipher is AES-CBC with a random IV (RFC 3602)
+type cbcCipher struct {
+	block cipher.Block
+}
+
+func (c *cbcCipher) ivLength() int  { return aes.BlockSize }
+func (c *cbcCipher) icvLength() int { return 0 }
+func (c *cbcCipher) blockSize() int { return aes.BlockSize }
+
+func (c *cbcCipher) seal(seq uint64, plainText, associatedData []byte) ([]byte, error) {
+	data := make([]byte, aes.BlockSize+len(plainText))
+	if _, err := io.ReadFull(rand.Reader, data[:aes.BlockSize]); err != nil {
+		return nil, errors.Errorf("Read random initialization vector failed")
+	}
+	cipher.NewCBCEncrypter(c.block, data[:aes.BlockSize]).CryptBlocks(data[aes.BlockSize:], plainText) // #nosec G407
+	return data, nil
+}
+
+func (c *cbcCipher) open(data, associatedData []byte) ([]byte, error) {
+	cipherText := data[aes.BlockSize:]
+	if len(cipherText)%aes.BlockSize != 0 {
+		return nil, errors.Errorf("Cipher text is not a multiple of block size")
+	}
+	plainText := make([]byte, len(cipherText))
+	cipher.NewCBCDecrypter(c.block, data[:aes.BlockSize]).CryptBlocks(plainText, cipherText) // #nosec G407
+	return plainText, nil
+}
+
+// ctrCipher is AES-CTR (RFC 3686)
+type ctrCipher struct {
+	block cipher.Block
+	nonce []byte
+}
+
+func (c *ctrCipher) ivLength() int  { return counterIVLength }
+func (c *ctrCipher) icvLength() int { return 0 }
+func (c *ctrCipher) blockSize() int { return 4 }
+
+func (c *ctrCipher) stream(iv []byte) cipher.Stream {
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, c.nonce)
+	copy(counter[len(c.nonce):], iv)
+	binary.BigEndian.PutUint32(counter[aes.BlockSize-4:], 1)
+	return cipher.NewCTR(c.block, counter)
+}
+
+func (c *ctrCipher) seal(seq uint64, plainText, associatedData []byte) ([]byte, error) {
+	data := make([]byte, counterIVLength+len(plainText))
+	binary.BigEndian.PutUint64(data, seq)
+	c.stream(data[:counterIVLength]).XORKeyStream(data[counterIVLength:], plainText)
+	return data, nil
+}
+
+func (c *ctrCipher) open(data, associatedData []byte) ([]byte, error) {
+	plainText := make([]byte, len(data)-counterIVLength)
+	c.stream(data[:counterIVLength]).XORKeyStream(plainText, data[counterIVLength:])
+	return plainText, nil
+}
+
+// gcmCipher is AES-GCM (RFC 4106)
+type gcmCipher struct {
+	aead cipher.AEAD
+	salt []byte
+}
+
+func (c *gcmCipher) ivLength() int  { return counterIVLength }
+func (c *gcmCipher) icvLength() int { return c.aead.Overhead() }
+func (c *gcmCipher) blockSize() int { return 4 }
+
+func (c *gcmCipher) nonce(iv []byte) []byte {
+	return append(append(make([]byte, 0, len(c.salt)+len(iv)), c.salt...), iv...)
+}
+
+func (c *gcmCipher) seal(seq uint64, plainText, associatedData []byte) ([]byte, error) {
+	data := make([]byte, counterIVLength, counterIVLength+len(plainText)+c.aead.Overhead())
+	binary.BigEndian.PutUint64(data, seq)
+	return c.aead.Seal(data, c.nonce(data), plainText, associatedData), nil
+}
+
+func (c *gcmCipher) open(data, associatedData []byte) ([]byte, error) {
+	plainText, err := c.aead.Open(nil, c.nonce(data[:counterIVLength]), data[counterIVLength:], associatedData)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open()")
+	}
+	return plainText, nil
+}
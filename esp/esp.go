@@ -0,0 +1,410 @@
+package esp
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"hash"
+	"math"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+)
+
+// IP protocol numbers carried in the Next Header field
+const (
+	ProtocolIPv4   = 4
+	ProtocolIPv6   = 41
+	ProtocolESP    = 50
+	ProtocolNoNext = 59 // dummy packet (RFC 4303 - 2.6)
+)
+
+const (
+	espHeaderLength = 8
+	// Pad Length and Next Header
+	espTrailerLength = 2
+	ipv4MinHeaderLen = 20
+	ipv6HeaderLen    = 40
+)
+
+type Mode int
+
+const (
+	// The whole IP packet is the payload of ESP, the outer IP header is added
+	// when sending the ESP packet
+	ModeTunnel Mode = iota
+	// ESP is inserted between the IP header and the upper layer protocol
+	ModeTransport
+)
+
+type Config struct {
+	Mode Mode
+	// Anti-replay window size of the inbound SA, DefaultReplayWindow if zero
+	ReplayWindow int
+	// Tunnel mode: the inner packets of the outbound SA are padded to a
+	// multiple of TFCPadding octets to hide their length (RFC 4303 - 2.4)
+	TFCPadding int
+}
+
+// SA is one direction of an ESP Child SA
+type SA struct {
+	SPI        uint32
+	Mode       Mode
+	TFCPadding int
+
+	esn         bool
+	cipher      espCipher
+	integ       hash.Hash
+	integLength int
+
+	// Outbound: sequence number of the last packet sent
+	seq uint64
+	// Inbound: nil for an outbound SA
+	replay *ReplayWindow
+}
+
+// NewSAPair returns the inbound and outbound SAs of a Child SA, whose keys
+// are generated by GenerateKeyForChildSA. role is the role of this end in the
+// IKE SA.
+func NewSAPair(
+	childSAKey *security.ChildSAKey,
+	role message.Role,
+	inboundSPI, outboundSPI uint32,
+	config Config,
+) (*SA, *SA, error) {
+	if childSAKey == nil || childSAKey.EncrKInfo == nil {
+		return nil, nil, errors.Errorf("NewSAPair(): No encryption algorithm specified")
+	}
+	if !childSAKey.EncrKInfo.IsAEAD() && childSAKey.IntegKInfo == nil {
+		return nil, nil, errors.Errorf("NewSAPair(): No integrity algorithm specified")
+	}
+
+	inEncr, inInteg := childSAKey.ResponderToInitiatorEncryptionKey, childSAKey.ResponderToInitiatorIntegrityKey
+	outEncr, outInteg := childSAKey.InitiatorToResponderEncryptionKey, childSAKey.InitiatorToResponderIntegrityKey
+	if role == message.Role_Responder {
+		inEncr, outEncr = outEncr, inEncr
+		inInteg, outInteg = outInteg, inInteg
+	}
+
+	inbound, err := newSA(childSAKey, inboundSPI, inEncr, inInteg, config)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "NewSAPair(): Inbound SA")
+	}
+	inbound.replay = NewReplayWindow(config.ReplayWindow)
+	outbound, err := newSA(childSAKey, outboundSPI, outEncr, outInteg, config)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "NewSAPair(): Outbound SA")
+	}
+	return inbound, outbound, nil
+}
+
+func newSA(childSAKey *security.ChildSAKey, spi uint32, encrKey, integKey []byte, config Config) (*SA, error) {
+	sa := &SA{
+		SPI:        spi,
+		Mode:       config.Mode,
+		TFCPadding: config.TFCPadding,
+		esn:        childSAKey.EsnInfo.GetNeedESN(),
+	}
+
+	var err error
+	if sa.cipher, err = newCipher(childSAKey.EncrKInfo, encrKey); err != nil {
+		return nil, err
+	}
+	if sa.cipher.icvLength() == 0 {
+		integInfo, ok := childSAKey.IntegKInfo.(integ.INTEGType)
+		if !ok {
+			return nil, errors.Errorf("Unsupported integrity transform %d", childSAKey.IntegKInfo.TransformID())
+		}
+		if sa.integ = integInfo.Init(integKey); sa.integ == nil {
+			return nil, errors.Errorf("Unexpected integrity key length %d", len(integKey))
+		}
+		sa.integLength = integInfo.GetOutputLength()
+	}
+	return sa, nil
+}
+
+// Encrypt protects an IP packet sent on an outbound SA. In tunnel mode, the
+// ESP packet is returned. In transport mode, the IP packet carrying ESP is
+// returned, the ESP header follows the IPv4 header or the fixed IPv6 header.
+func (sa *SA) Encrypt(packet []byte) ([]byte, error) {
+	if sa.replay != nil {
+		return nil, errors.Errorf("Encrypt(): Inbound SA")
+	}
+	if sa.esn && sa.seq == math.MaxUint64 || !sa.esn && sa.seq == math.MaxUint32 {
+		return nil, errors.Errorf("Encrypt(): Sequence number exhausted, the SA is to be rekeyed")
+	}
+
+	var header, payload []byte
+	var nextHeader uint8
+	var tfcLength int
+	switch sa.Mode {
+	case ModeTunnel:
+		version, err := ipVersion(packet)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Encrypt()")
+		}
+		nextHeader = ProtocolIPv4
+		if version == 6 {
+			nextHeader = ProtocolIPv6
+		}
+		payload = packet
+		if sa.TFCPadding > 0 && len(packet)%sa.TFCPadding != 0 {
+			tfcLength = sa.TFCPadding - len(packet)%sa.TFCPadding
+		}
+	case ModeTransport:
+		var err error
+		if header, payload, nextHeader, err = splitIPHeader(packet); err != nil {
+			return nil, errors.Wrapf(err, "Encrypt()")
+		}
+	default:
+		return nil, errors.Errorf("Encrypt(): Unknown mode %d", sa.Mode)
+	}
+
+	sa.seq++
+	plainText := espPlainText(payload, tfcLength, nextHeader, sa.cipher.blockSize())
+	esp := make([]byte, espHeaderLength, espHeaderLength+sa.cipher.ivLength()+len(plainText)+
+		sa.cipher.icvLength()+sa.integLength)
+	binary.BigEndian.PutUint32(esp[0:4], sa.SPI)
+	binary.BigEndian.PutUint32(esp[4:8], uint32(sa.seq))
+
+	sealed, err := sa.cipher.seal(sa.seq, plainText, sa.associatedData(esp[:espHeaderLength], sa.seq))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Encrypt()")
+	}
+	esp = append(esp, sealed...)
+	if sa.integ != nil {
+		esp = append(esp, sa.icv(esp, sa.seq)...)
+	}
+
+	if sa.Mode == ModeTransport {
+		return joinIPHeader(header, ProtocolESP, esp)
+	}
+	return esp, nil
+}
+
+// Decrypt verifies and decrypts a packet received on an inbound SA, which is
+// an ESP packet in tunnel mode and an IP packet carrying ESP in transport
+// mode, and returns the original IP packet. A dummy packet returns nil.
+func (sa *SA) Decrypt(packet []byte) ([]byte, error) {
+	if sa.replay == nil {
+		return nil, errors.Errorf("Decrypt(): Outbound SA")
+	}
+
+	var header []byte
+	esp := packet
+	if sa.Mode == ModeTransport {
+		var protocol uint8
+		var err error
+		if header, esp, protocol, err = splitIPHeader(packet); err != nil {
+			return nil, errors.Wrapf(err, "Decrypt()")
+		}
+		if protocol != ProtocolESP {
+			return nil, errors.Errorf("Decrypt(): Unexpected protocol %d", protocol)
+		}
+	}
+
+	icvLength := sa.cipher.icvLength() + sa.integLength
+	if len(esp) < espHeaderLength+sa.cipher.ivLength()+espTrailerLength+icvLength {
+		return nil, errors.Errorf("Decrypt(): ESP packet too short: %d", len(esp))
+	}
+	if spi := binary.BigEndian.Uint32(esp[0:4]); spi != sa.SPI {
+		return nil, errors.Errorf("Decrypt(): Unexpected SPI %08x", spi)
+	}
+	seq := uint64(binary.BigEndian.Uint32(esp[4:8]))
+	if sa.esn {
+		seq = sa.replay.Infer(uint32(seq))
+	}
+	if err := sa.replay.Check(seq); err != nil {
+		return nil, errors.Wrapf(err, "Decrypt()")
+	}
+
+	// The ICV is verified before decryption (RFC 4303 - 3.4.4)
+	if sa.integ != nil {
+		icv := esp[len(esp)-sa.integLength:]
+		esp = esp[:len(esp)-sa.integLength]
+		if !hmac.Equal(icv, sa.icv(esp, seq)) {
+			return nil, errors.Errorf("Decrypt(): Integrity check failed")
+		}
+	}
+	plainText, err := sa.cipher.open(esp[espHeaderLength:], sa.associatedData(esp[:espHeaderLength], seq))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Decrypt()")
+	}
+	sa.replay.Update(seq)
+
+	payload, nextHeader, err := parsePlainText(plainText)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Decrypt()")
+	}
+	if nextHeader == ProtocolNoNext {
+		return nil, nil
+	}
+
+	if sa.Mode == ModeTransport {
+		return joinIPHeader(header, nextHeader, payload)
+	}
+	if nextHeader != ProtocolIPv4 && nextHeader != ProtocolIPv6 {
+		return nil, errors.Errorf("Decrypt(): Unexpected next header %d in tunnel mode", nextHeader)
+	}
+	// The TFC padding follows the inner packet
+	length, err := ipLength(payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Decrypt()")
+	}
+	if length > len(payload) {
+		return nil, errors.Errorf("Decrypt(): Truncated inner packet")
+	}
+	return payload[:length], nil
+}
+
+// associatedData returns the AAD of a combined mode cipher, which is the SPI
+// and the 32 or 64 bits sequence number (RFC 4106 - 5)
+func (sa *SA) associatedData(espHeader []byte, seq uint64) []byte {
+	if sa.cipher.icvLength() == 0 {
+		return nil
+	}
+	if !sa.esn {
+		return espHeader
+	}
+	aad := make([]byte, 12)
+	copy(aad[0:4], espHeader[0:4])
+	binary.BigEndian.PutUint64(aad[4:12], seq)
+	return aad
+}
+
+// icv computes the ICV of the ESP packet, with the high order 32 bits of the
+// extended sequence number appended (RFC 4303 - 2.2.1)
+func (sa *SA) icv(esp []byte, seq uint64) []byte {
+	sa.integ.Reset()
+	sa.integ.Write(esp)
+	if sa.esn {
+		high := make([]byte, 4)
+		binary.BigEndian.PutUint32(high, uint32(seq>>32))
+		sa.integ.Write(high)
+	}
+	return sa.integ.Sum(nil)[:sa.integLength]
+}
+
+// espPlainText appends the TFC padding and the ESP trailer to the payload.
+// The padding octets are 1, 2, 3... (RFC 4303 - 2.4).
+func espPlainText(payload []byte, tfcLength int, nextHeader uint8, blockSize int) []byte {
+	length := len(payload) + tfcLength + espTrailerLength
+	padLength := (blockSize - length%blockSize) % blockSize
+
+	plainText := make([]byte, len(payload)+tfcLength, length+padLength)
+	copy(plainText, payload)
+	for i := 1; i <= padLength; i++ {
+		plainText = append(plainText, byte(i))
+	}
+	return append(plainText, byte(padLength), nextHeader)
+}
+
+func parsePlainText(plainText []byte) ([]byte, uint8, error) {
+	if len(plainText) < espTrailerLength {
+		return nil, 0, errors.Errorf("Plain text too short: %d", len(plainText))
+	}
+	nextHeader := plainText[len(plainText)-1]
+	padLength := int(plainText[len(plainText)-2])
+	end := len(plainText) - espTrailerLength - padLength
+	if end < 0 {
+		return nil, 0, errors.Errorf("Pad length %d exceeds plain text length", padLength)
+	}
+	for i := 0; i < padLength; i++ {
+		if plainText[end+i] != byte(i+1) {
+			return nil, 0, errors.Errorf("Invalid padding")
+		}
+	}
+	return plainText[:end], nextHeader, nil
+}
+
+func ipVersion(packet []byte) (int, error) {
+	if len(packet) == 0 {
+		return 0, errors.Errorf("Empty IP packet")
+	}
+	version := int(packet[0] >> 4)
+	if version != 4 && version != 6 {
+		return 0, errors.Errorf("Unsupported IP version %d", version)
+	}
+	return version, nil
+}
+
+// ipLength returns the length of the IP packet given by its header
+func ipLength(packet []byte) (int, error) {
+	version, err := ipVersion(packet)
+	if err != nil {
+		return 0, err
+	}
+	if version == 4 {
+		if len(packet) < ipv4MinHeaderLen {
+			return 0, errors.Errorf("IPv4 packet too short: %d", len(packet))
+		}
+		return int(binary.BigEndian.Uint16(packet[2:4])), nil
+	}
+	if len(packet) < ipv6HeaderLen {
+		return 0, errors.Errorf("IPv6 packet too short: %d", len(packet))
+	}
+	return ipv6HeaderLen + int(binary.BigEndian.Uint16(packet[4:6])), nil
+}
+
+// splitIPHeader returns the IP header of the packet, its payload and the
+// protocol of the payload
+func splitIPHeader(packet []byte) ([]byte, []byte, uint8, error) {
+	version, err := ipVersion(packet)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	length, err := ipLength(packet)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if length > len(packet) {
+		return nil, nil, 0, errors.Errorf("Truncated IP packet")
+	}
+
+	if version == 4 {
+		headerLength := int(packet[0]&0x0F) * 4
+		if headerLength < ipv4MinHeaderLen || headerLength > length {
+			return nil, nil, 0, errors.Errorf("Invalid IPv4 header length %d", headerLength)
+		}
+		return packet[:headerLength], packet[headerLength:length], packet[9], nil
+	}
+	return packet[:ipv6HeaderLen], packet[ipv6HeaderLen:length], packet[6], nil
+}
+
+// joinIPHeader returns a copy of the IP header with the protocol and the
+// length of the payload, followed by the payload
+func joinIPHeader(header []byte, protocol uint8, payload []byte) ([]byte, error) {
+	packet := make([]byte, len(header), len(header)+len(payload))
+	copy(packet, header)
+	packet = append(packet, payload...)
+
+	if packet[0]>>4 == 4 {
+		if len(packet) > math.MaxUint16 {
+			return nil, errors.Errorf("IPv4 packet too long: %d", len(packet))
+		}
+		packet[9] = protocol
+		binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+		binary.BigEndian.PutUint16(packet[10:12], 0)
+		binary.BigEndian.PutUint16(packet[10:12], ipv4Checksum(packet[:len(header)]))
+		return packet, nil
+	}
+	if len(payload) > math.MaxUint16 {
+		return nil, errors.Errorf("IPv6 payload too long: %d", len(payload))
+	}
+	packet[6] = protocol
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(payload)))
+	return packet, nil
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,255 @@
+package esp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
+	"github.com/guoweifk/n3iwue_ike_gw/security/esn"
+	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+)
+
+func randomKey(t *testing.T, length int) []byte {
+	key := make([]byte, length)
+	_, err := io.ReadFull(rand.Reader, key)
+	require.NoError(t, err)
+	return key
+}
+
+func newTestChildSAKey(t *testing.T, encrName, integName, esnName string) *security.ChildSAKey {
+	esnInfo, err := esn.StrToType(esnName)
+	require.NoError(t, err)
+	key := &security.ChildSAKey{
+		EncrKInfo: encr.StrToKType(encrName),
+		EsnInfo:   esnInfo,
+	}
+	key.InitiatorToResponderEncryptionKey = randomKey(t, key.EncrKInfo.GetKeyLength())
+	key.ResponderToInitiatorEncryptionKey = randomKey(t, key.EncrKInfo.GetKeyLength())
+	if integName != "" {
+		key.IntegKInfo = integ.StrToKType(integName)
+		key.InitiatorToResponderIntegrityKey = randomKey(t, key.IntegKInfo.GetKeyLength())
+		key.ResponderToInitiatorIntegrityKey = randomKey(t, key.IntegKInfo.GetKeyLength())
+	}
+	return key
+}
+
+func ipv4Packet(payload []byte) []byte {
+	packet := []byte{
+		0x45, 0x00, 0x00, 0x00, 0x12, 0x34, 0x40, 0x00,
+		0x40, 0x11, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x01,
+		0x0a, 0x00, 0x00, 0x02,
+	}
+	packet = append(packet, payload...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[10:12], ipv4Checksum(packet[:ipv4MinHeaderLen]))
+	return packet
+}
+
+func ipv6Packet(payload []byte) []byte {
+	packet := make([]byte, ipv6HeaderLen, ipv6HeaderLen+len(payload))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(payload)))
+	packet[6] = 0x11
+	packet[7] = 64
+	packet[8], packet[23] = 0x20, 0x01
+	packet[24], packet[39] = 0x20, 0x02
+	return append(packet, payload...)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	payload := []byte("NAS message over TCP, carried by the NWu user plane")
+
+	testcases := []struct {
+		description string
+		encrName    string
+		integName   string
+		esnName     string
+		config      Config
+		packet      []byte
+		// Length of the ESP packet of tunnel mode
+		espLength int
+	}{
+		{
+			description: "AES-CBC with HMAC-SHA1 in tunnel mode",
+			encrName:    encr.ENCR_AES_CBC_128,
+			integName:   integ.AUTH_HMAC_SHA1_96,
+			esnName:     esn.String_ESN_DISABLE,
+			packet:      ipv4Packet(payload),
+			// Header, IV, 71 octets of packet padded to 80 octets, ICV
+			espLength: 8 + 16 + 80 + 12,
+		},
+		{
+			description: "AES-CTR with HMAC-SHA2-256 and ESN",
+			encrName:    encr.ENCR_AES_CTR_256,
+			integName:   integ.AUTH_HMAC_SHA2_256_128,
+			esnName:     esn.String_ESN_ENABLE,
+			packet:      ipv4Packet(payload),
+			espLength:   8 + 8 + 76 + 16,
+		},
+		{
+			description: "AES-GCM with ESN",
+			encrName:    encr.ENCR_AES_GCM_16_256,
+			esnName:     esn.String_ESN_ENABLE,
+			packet:      ipv6Packet(payload),
+			espLength:   8 + 8 + 96 + 16,
+		},
+		{
+			description: "AES-GCM with 8 octets ICV",
+			encrName:    encr.ENCR_AES_GCM_8_128,
+			esnName:     esn.String_ESN_DISABLE,
+			packet:      ipv4Packet(payload),
+			espLength:   8 + 8 + 76 + 8,
+		},
+		{
+			description: "TFC padding",
+			encrName:    encr.ENCR_AES_GCM_16_128,
+			esnName:     esn.String_ESN_DISABLE,
+			config:      Config{TFCPadding: 256},
+			packet:      ipv4Packet(payload),
+			espLength:   8 + 8 + 260 + 16,
+		},
+		{
+			description: "Transport mode over IPv4",
+			encrName:    encr.ENCR_AES_CBC_256,
+			integName:   integ.AUTH_HMAC_SHA2_512_256,
+			esnName:     esn.String_ESN_DISABLE,
+			config:      Config{Mode: ModeTransport},
+			packet:      ipv4Packet(payload),
+		},
+		{
+			description: "Transport mode over IPv6",
+			encrName:    encr.ENCR_AES_GCM_12_128,
+			esnName:     esn.String_ESN_ENABLE,
+			config:      Config{Mode: ModeTransport},
+			packet:      ipv6Packet(payload),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			key := newTestChildSAKey(t, tc.encrName, tc.integName, tc.esnName)
+			initiatorIn, initiatorOut, err := NewSAPair(key, message.Role_Initiator, 0x1001, 0x2002, tc.config)
+			require.NoError(t, err)
+			responderIn, responderOut, err := NewSAPair(key, message.Role_Responder, 0x2002, 0x1001, tc.config)
+			require.NoError(t, err)
+
+			var sent [][]byte
+			for i := 1; i <= 3; i++ {
+				protected, encryptErr := initiatorOut.Encrypt(tc.packet)
+				require.NoError(t, encryptErr)
+				sent = append(sent, protected)
+
+				esp := protected
+				if tc.config.Mode == ModeTransport {
+					header, espPayload, protocol, splitErr := splitIPHeader(protected)
+					require.NoError(t, splitErr)
+					require.Equal(t, uint8(ProtocolESP), protocol)
+					// Same addresses, and a valid IPv4 checksum
+					require.Equal(t, tc.packet[len(header)-8:len(header)], header[len(header)-8:])
+					if header[0]>>4 == 4 {
+						require.Zero(t, ipv4Checksum(header))
+					}
+					esp = espPayload
+				} else {
+					require.Len(t, protected, tc.espLength)
+				}
+				require.Equal(t, uint32(0x2002), binary.BigEndian.Uint32(esp[0:4]))
+				require.Equal(t, uint32(i), binary.BigEndian.Uint32(esp[4:8]))
+			}
+
+			// Out of order, then replayed
+			for _, i := range []int{1, 0, 2} {
+				packet, decryptErr := responderIn.Decrypt(sent[i])
+				require.NoError(t, decryptErr)
+				require.Equal(t, tc.packet, packet)
+			}
+			_, err = responderIn.Decrypt(sent[1])
+			require.Error(t, err)
+
+			// Tampered packet
+			protected, err := initiatorOut.Encrypt(tc.packet)
+			require.NoError(t, err)
+			tampered := append([]byte{}, protected...)
+			tampered[len(tampered)-20] ^= 0x01
+			_, err = responderIn.Decrypt(tampered)
+			require.Error(t, err)
+			packet, err := responderIn.Decrypt(protected)
+			require.NoError(t, err)
+			require.Equal(t, tc.packet, packet)
+
+			// Other direction
+			protected, err = responderOut.Encrypt(tc.packet)
+			require.NoError(t, err)
+			packet, err = initiatorIn.Decrypt(protected)
+			require.NoError(t, err)
+			require.Equal(t, tc.packet, packet)
+
+			_, err = initiatorIn.Encrypt(tc.packet)
+			require.Error(t, err)
+			_, err = initiatorOut.Decrypt(protected)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestSequenceNumber(t *testing.T) {
+	packet := ipv4Packet([]byte("payload"))
+
+	t.Run("Extended sequence number", func(t *testing.T) {
+		key := newTestChildSAKey(t, encr.ENCR_AES_CBC_128, integ.AUTH_HMAC_SHA1_96, esn.String_ESN_ENABLE)
+		in, _, err := NewSAPair(key, message.Role_Responder, 0x1001, 0x2002, Config{})
+		require.NoError(t, err)
+		_, out, err := NewSAPair(key, message.Role_Initiator, 0x2002, 0x1001, Config{})
+		require.NoError(t, err)
+
+		// The high order bits are not sent, but covered by the ICV
+		out.seq = math.MaxUint32 - 1
+		for i := 0; i < 3; i++ {
+			protected, encryptErr := out.Encrypt(packet)
+			require.NoError(t, encryptErr)
+			decrypted, decryptErr := in.Decrypt(protected)
+			require.NoError(t, decryptErr)
+			require.Equal(t, packet, decrypted)
+		}
+		require.Equal(t, uint64(math.MaxUint32+2), in.replay.top)
+	})
+
+	t.Run("Sequence number exhausted", func(t *testing.T) {
+		key := newTestChildSAKey(t, encr.ENCR_AES_CBC_128, integ.AUTH_HMAC_SHA1_96, esn.String_ESN_DISABLE)
+		_, out, err := NewSAPair(key, message.Role_Initiator, 0x2002, 0x1001, Config{})
+		require.NoError(t, err)
+		out.seq = math.MaxUint32 - 1
+		_, err = out.Encrypt(packet)
+		require.NoError(t, err)
+		_, err = out.Encrypt(packet)
+		require.Error(t, err)
+	})
+}
+
+func TestPlainText(t *testing.T) {
+	payload := []byte{0xaa, 0xbb, 0xcc}
+	plainText := espPlainText(payload, 2, ProtocolIPv4, 16)
+	require.Equal(t, []byte{
+		0xaa, 0xbb, 0xcc, 0x00, 0x00, 0x01, 0x02, 0x03,
+		0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x09, ProtocolIPv4,
+	}, plainText)
+
+	parsed, nextHeader, err := parsePlainText(plainText)
+	require.NoError(t, err)
+	require.Equal(t, uint8(ProtocolIPv4), nextHeader)
+	require.True(t, bytes.Equal(append(payload, 0x00, 0x00), parsed))
+
+	plainText[7] = 0xff
+	_, _, err = parsePlainText(plainText)
+	require.Error(t, err)
+	_, _, err = parsePlainText([]byte{0x05, ProtocolIPv4})
+	require.Error(t, err)
+}
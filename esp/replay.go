@@ -0,0 +1,95 @@
+package esp
+
+import (
+	"github.com/pkg/errors"
+)
+
+// DefaultReplayWindow is the anti-replay window size of inbound SAs
+// (RFC 4303 - 3.4.3)
+const DefaultReplayWindow = 64
+
+// ReplayWindow is the sliding anti-replay window of an inbound SA
+// (RFC 4303 - Appendix A). A sequence number is checked before the integrity
+// check of its packet, and the window is updated after it.
+type ReplayWindow struct {
+	size uint64
+	// Highest sequence number received, zero before the first packet
+	top uint64
+	// Bit seq % size is set if seq in (top - size, top] is received
+	bitmap []uint64
+}
+
+// NewReplayWindow returns a window of at least size sequence numbers, rounded
+// up to a multiple of 64
+func NewReplayWindow(size int) *ReplayWindow {
+	if size <= 0 {
+		size = DefaultReplayWindow
+	}
+	words := (size + 63) / 64
+	return &ReplayWindow{
+		size:   uint64(words * 64),
+		bitmap: make([]uint64, words),
+	}
+}
+
+// Infer returns the 64-bit extended sequence number of the low order 32 bits
+// received (RFC 4303 - Appendix A2.2)
+func (w *ReplayWindow) Infer(low uint32) uint64 {
+	topLow, topHigh := uint32(w.top), uint32(w.top>>32)
+	// Lowest sequence number of the window, modulo 2^32
+	bottom := topLow - uint32(w.size) + 1
+
+	high := topHigh
+	if uint64(topLow) >= w.size-1 {
+		// The window does not span two subspaces
+		if low < bottom {
+			high++
+		}
+	} else if low >= bottom && topHigh > 0 {
+		// The window spans two subspaces, and low is in the lower one
+		high--
+	}
+	return uint64(high)<<32 | uint64(low)
+}
+
+// Check returns an error if seq is replayed or on the left of the window
+func (w *ReplayWindow) Check(seq uint64) error {
+	if seq == 0 {
+		return errors.Errorf("Check(): Invalid sequence number 0")
+	}
+	if seq > w.top {
+		return nil
+	}
+	if w.top-seq >= w.size {
+		return errors.Errorf("Check(): Sequence number %d is on the left of the window", seq)
+	}
+	if w.bitmap[w.word(seq)]&w.bit(seq) != 0 {
+		return errors.Errorf("Check(): Sequence number %d is replayed", seq)
+	}
+	return nil
+}
+
+// Update marks seq as received, the window slides if seq is on its right
+func (w *ReplayWindow) Update(seq uint64) {
+	if seq > w.top {
+		if seq-w.top >= w.size {
+			for i := range w.bitmap {
+				w.bitmap[i] = 0
+			}
+		} else {
+			for s := w.top + 1; s <= seq; s++ {
+				w.bitmap[w.word(s)] &^= w.bit(s)
+			}
+		}
+		w.top = seq
+	}
+	w.bitmap[w.word(seq)] |= w.bit(seq)
+}
+
+func (w *ReplayWindow) word(seq uint64) int {
+	return int((seq % w.size) / 64)
+}
+
+func (w *ReplayWindow) bit(seq uint64) uint64 {
+	return 1 << (seq % 64)
+}
@@ -0,0 +1,92 @@
+package esp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := NewReplayWindow(100)
+	require.Equal(t, uint64(128), w.size)
+
+	testcases := []struct {
+		description string
+		seq         uint64
+		expectErr   bool
+	}{
+		{description: "First packet", seq: 1},
+		{description: "Zero", seq: 0, expectErr: true},
+		{description: "Replayed", seq: 1, expectErr: true},
+		{description: "Ahead", seq: 100},
+		{description: "Late in window", seq: 50},
+		{description: "Late replayed", seq: 50, expectErr: true},
+		{description: "Slides the window", seq: 200},
+		{description: "Left of the window", seq: 72, expectErr: true},
+		{description: "Left edge", seq: 73},
+		{description: "Received before the slide", seq: 100, expectErr: true},
+		{description: "Far ahead", seq: 10000},
+		{description: "Cleared by the jump", seq: 9999},
+		{description: "Top replayed", seq: 10000, expectErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := w.Check(tc.seq)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			w.Update(tc.seq)
+		})
+	}
+}
+
+func TestInfer(t *testing.T) {
+	testcases := []struct {
+		description string
+		top         uint64
+		low         uint32
+		expected    uint64
+	}{
+		{
+			description: "Start of the space",
+			top:         0,
+			low:         1,
+			expected:    1,
+		},
+		{
+			description: "In the window",
+			top:         0x1_0000_1000,
+			low:         0x0000_0fc1,
+			expected:    0x1_0000_0fc1,
+		},
+		{
+			description: "Next subspace",
+			top:         0x1_ffff_fff0,
+			low:         0x0000_0002,
+			expected:    0x2_0000_0002,
+		},
+		{
+			description: "Previous subspace",
+			top:         0x2_0000_0010,
+			low:         0xffff_fff0,
+			expected:    0x1_ffff_fff0,
+		},
+		{
+			description: "Ahead in the subspace of a window spanning two",
+			top:         0x2_0000_0010,
+			low:         0x0000_0100,
+			expected:    0x2_0000_0100,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			w := NewReplayWindow(DefaultReplayWindow)
+			w.top = tc.top
+			require.Equal(t, tc.expected, w.Infer(tc.low))
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package ike
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+)
+
+// Length of the IKE header and of the Encrypted Fragment payload up to the
+// Encrypted Data field
+const fragmentHeaderLength = message.IKE_HEADER_LEN + 8
+
+// EncodeEncryptFragments encodes ikeMsg in Encrypted Fragment messages of at
+// most maxLength octets (RFC 7383 - 2.5). The payloads are encoded and split
+// into fragments, each protected as the SK payload of EncodeEncrypt.
+func EncodeEncryptFragments(
+	ikeMsg *message.IKEMessage,
+	ikesaKey *security.IKESAKey,
+	role message.Role,
+	maxLength int,
+) ([][]byte, error) {
+	if ikeMsg == nil || ikeMsg.IKEHeader == nil {
+		return nil, errors.Errorf("EncodeEncryptFragments(): IKE message is nil")
+	}
+	if ikesaKey == nil || ikesaKey.EncrInfo == nil {
+		return nil, errors.Errorf("EncodeEncryptFragments(): No encryption algorithm specified")
+	}
+	if !ikesaKey.EncrInfo.IsAEAD() && ikesaKey.IntegInfo == nil {
+		return nil, errors.Errorf("EncodeEncryptFragments(): No integrity algorithm specified")
+	}
+
+	plainText, err := ikeMsg.Payloads.Encode()
+	if err != nil {
+		return nil, errors.Wrapf(err, "EncodeEncryptFragments(): Encoding IKE payload failed")
+	}
+	nextPayload := message.NoNext
+	if len(ikeMsg.Payloads) != 0 {
+		nextPayload = ikeMsg.Payloads[0].Type()
+	}
+
+	chunkLength, err := fragmentChunkLength(ikeMsg.IKEHeader, ikesaKey, role, maxLength)
+	if err != nil {
+		return nil, errors.Wrapf(err, "EncodeEncryptFragments()")
+	}
+	totalFragments := (len(plainText) + chunkLength - 1) / chunkLength
+	if totalFragments == 0 {
+		totalFragments = 1
+	}
+	if totalFragments > 0xFFFF {
+		return nil, errors.Errorf("EncodeEncryptFragments(): Too many fragments %d", totalFragments)
+	}
+
+	fragments := make([][]byte, 0, totalFragments)
+	for number := 1; number <= totalFragments; number++ {
+		start := (number - 1) * chunkLength
+		end := start + chunkLength
+		if end > len(plainText) {
+			end = len(plainText)
+		}
+		// Only the first fragment tells the type of the first payload
+		fragmentNextPayload := message.NoNext
+		if number == 1 {
+			fragmentNextPayload = nextPayload
+		}
+
+		// The capacity is limited, since the padding is appended to the chunk
+		fragment, err := encodeFragment(ikeMsg.IKEHeader, plainText[start:end:end], fragmentNextPayload,
+			uint16(number), uint16(totalFragments), ikesaKey, role)
+		if err != nil {
+			return nil, errors.Wrapf(err, "EncodeEncryptFragments(): Fragment %d", number)
+		}
+		fragments = append(fragments, fragment)
+	}
+	return fragments, nil
+}
+
+// fragmentChunkLength returns the length of plain text fitting in a fragment
+// of maxLength octets, with the IV, the padding and the ICV of the algorithms
+// of the IKE SA
+func fragmentChunkLength(
+	ikeHeader *message.IKEHeader,
+	ikesaKey *security.IKESAKey,
+	role message.Role,
+	maxLength int,
+) (int, error) {
+	chunkLength := maxLength - fragmentHeaderLength
+	for chunkLength > 0 {
+		fragment, err := encodeFragment(ikeHeader, make([]byte, chunkLength), message.NoNext, 1, 1, ikesaKey, role)
+		if err != nil {
+			return 0, err
+		}
+		if len(fragment) <= maxLength {
+			return chunkLength, nil
+		}
+		chunkLength -= len(fragment) - maxLength
+	}
+	return 0, errors.Errorf("Maximum fragment length %d is too short", maxLength)
+}
+
+func encodeFragment(
+	ikeHeader *message.IKEHeader,
+	plainText []byte,
+	nextPayload message.IkePayloadType,
+	fragmentNumber uint16,
+	totalFragments uint16,
+	ikesaKey *security.IKESAKey,
+	role message.Role,
+) ([]byte, error) {
+	fragmentHeader := *ikeHeader
+	fragmentHeader.PayloadBytes = nil
+	fragmentMsg := &message.IKEMessage{IKEHeader: &fragmentHeader}
+
+	err := protectPayload(fragmentMsg, plainText, ikesaKey, role, func(encryptedData []byte) []byte {
+		return fragmentMsg.Payloads.BuildEncryptedFragment(nextPayload,
+			fragmentNumber, totalFragments, encryptedData).EncryptedData
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fragmentMsg.Encode()
+}
+
+type fragmentKey struct {
+	messageID uint32
+	response  bool
+}
+
+// fragmentBuffer holds the verified fragments of a message
+type fragmentBuffer struct {
+	ikeHeader      *message.IKEHeader
+	nextPayload    uint8
+	totalFragments uint16
+	plainTexts     map[uint16][]byte
+	firstReceived  time.Time
+}
+
+// Reassembler rebuilds the messages of the peer sent in Encrypted Fragment
+// payloads (RFC 7383 - 2.6). Each fragment is verified before being kept, and
+// the fragments of a message not complete in Timeout are dropped.
+type Reassembler struct {
+	Timeout time.Duration
+
+	buffers map[fragmentKey]*fragmentBuffer
+	now     func() time.Time
+}
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		Timeout: timeout,
+		buffers: make(map[fragmentKey]*fragmentBuffer),
+		now:     time.Now,
+	}
+}
+
+// DecodeDecryptFragment verifies and decrypts an Encrypted Fragment message.
+// It returns the reassembled message once every fragment is received, and nil
+// before. A duplicated fragment is ignored.
+func (r *Reassembler) DecodeDecryptFragment(
+	msg []byte,
+	ikeHeader *message.IKEHeader,
+	ikesaKey *security.IKESAKey,
+	role message.Role,
+) (*message.IKEMessage, error) {
+	if ikesaKey == nil || ikesaKey.EncrInfo == nil {
+		return nil, errors.Errorf("DecodeDecryptFragment(): No encryption algorithm specified")
+	}
+	if !ikesaKey.EncrInfo.IsAEAD() && ikesaKey.IntegInfo == nil {
+		return nil, errors.Errorf("DecodeDecryptFragment(): No integrity algorithm specified")
+	}
+
+	ikeMsg := new(message.IKEMessage)
+	if ikeHeader == nil {
+		if err := ikeMsg.Decode(msg); err != nil {
+			return nil, errors.Wrapf(err, "DecodeDecryptFragment()")
+		}
+	} else {
+		ikeMsg.IKEHeader = ikeHeader
+		if err := ikeMsg.DecodePayload(msg[message.IKE_HEADER_LEN:]); err != nil {
+			return nil, errors.Wrapf(err, "DecodeDecryptFragment()")
+		}
+	}
+	if len(ikeMsg.Payloads) != 1 || ikeMsg.Payloads[0].Type() != message.TypeSKF {
+		return nil, errors.Errorf("DecodeDecryptFragment(): Expect a single Encrypted Fragment payload")
+	}
+	fragment := ikeMsg.Payloads[0].(*message.EncryptedFragment)
+	if (fragment.FragmentNumber == 1) != (fragment.NextPayload != uint8(message.NoNext)) {
+		return nil, errors.Errorf("DecodeDecryptFragment(): Unexpected next payload %d in fragment %d",
+			fragment.NextPayload, fragment.FragmentNumber)
+	}
+
+	// Fragments are authenticated before they are used in any way
+	plainText, err := openPayload(msg, fragment.EncryptedData, ikesaKey, role)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DecodeDecryptFragment()")
+	}
+
+	r.Expire()
+	key := fragmentKey{
+		messageID: ikeMsg.MessageID,
+		response:  ikeMsg.IsResponse(),
+	}
+	buffer := r.buffers[key]
+	if buffer != nil && fragment.TotalFragments < buffer.totalFragments {
+		return nil, errors.Errorf("DecodeDecryptFragment(): Stale fragment of %d fragments, expect %d",
+			fragment.TotalFragments, buffer.totalFragments)
+	}
+	// More fragments means the message is sent again with smaller fragments
+	if buffer == nil || fragment.TotalFragments > buffer.totalFragments {
+		buffer = &fragmentBuffer{
+			totalFragments: fragment.TotalFragments,
+			plainTexts:     make(map[uint16][]byte),
+			firstReceived:  r.now(),
+		}
+		r.buffers[key] = buffer
+	}
+	if _, ok := buffer.plainTexts[fragment.FragmentNumber]; ok {
+		return nil, nil
+	}
+	buffer.plainTexts[fragment.FragmentNumber] = plainText
+	if fragment.FragmentNumber == 1 {
+		buffer.ikeHeader = ikeMsg.IKEHeader
+		buffer.nextPayload = fragment.NextPayload
+	}
+	if len(buffer.plainTexts) < int(buffer.totalFragments) {
+		return nil, nil
+	}
+
+	delete(r.buffers, key)
+	var reassembled []byte
+	for number := uint16(1); number <= buffer.totalFragments; number++ {
+		reassembled = append(reassembled, buffer.plainTexts[number]...)
+	}
+
+	result := &message.IKEMessage{IKEHeader: buffer.ikeHeader}
+	if err := result.Payloads.Decode(buffer.nextPayload, reassembled); err != nil {
+		return nil, errors.Wrapf(err, "DecodeDecryptFragment(): Decoding reassembled payload failed")
+	}
+	return result, nil
+}
+
+// Expire drops the fragments of the messages not complete in time
+func (r *Reassembler) Expire() {
+	now := r.now()
+	for key, buffer := range r.buffers {
+		if now.Sub(buffer.firstReceived) > r.Timeout {
+			delete(r.buffers, key)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package ike
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
+	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+)
+
+func newFragmentTestKey(t *testing.T, encrName, integName string) *security.IKESAKey {
+	ikeSAKey := &security.IKESAKey{
+		EncrInfo:  encr.StrToType(encrName),
+		IntegInfo: integ.StrToType(integName),
+	}
+
+	var err error
+	ikeSAKey.SK_ei = bytes.Repeat([]byte{0x01}, ikeSAKey.EncrInfo.GetKeyLength())
+	ikeSAKey.Encr_i, err = ikeSAKey.EncrInfo.NewCrypto(ikeSAKey.SK_ei)
+	require.NoError(t, err)
+	ikeSAKey.SK_er = bytes.Repeat([]byte{0x02}, ikeSAKey.EncrInfo.GetKeyLength())
+	ikeSAKey.Encr_r, err = ikeSAKey.EncrInfo.NewCrypto(ikeSAKey.SK_er)
+	require.NoError(t, err)
+
+	if ikeSAKey.IntegInfo != nil {
+		ikeSAKey.SK_ai = bytes.Repeat([]byte{0x03}, ikeSAKey.IntegInfo.GetKeyLength())
+		ikeSAKey.Integ_i = ikeSAKey.IntegInfo.Init(ikeSAKey.SK_ai)
+		ikeSAKey.SK_ar = bytes.Repeat([]byte{0x04}, ikeSAKey.IntegInfo.GetKeyLength())
+		ikeSAKey.Integ_r = ikeSAKey.IntegInfo.Init(ikeSAKey.SK_ar)
+	}
+	return ikeSAKey
+}
+
+func newFragmentTestMessage() *message.IKEMessage {
+	var payloads message.IKEPayloadContainer
+	payloads.BuildIdentificationInitiator(message.ID_FQDN, []byte("ue.example.com"))
+	payloads.BuildCertificate(message.X509CertificateSignature, bytes.Repeat([]byte{0x30, 0x82}, 1500))
+	payloads.BuildCertificate(message.X509CertificateSignature, bytes.Repeat([]byte{0x5a}, 700))
+	payloads.BuildNotification(message.TypeNone, message.INITIAL_CONTACT, nil, nil)
+	return message.NewMessage(0x000000000006f708, 0xc9e2e31f8b64053d,
+		message.IKE_AUTH, false, true, 0x01, payloads)
+}
+
+func TestEncodeEncryptFragments(t *testing.T) {
+	testcases := []struct {
+		description string
+		encrName    string
+		integName   string
+		maxLength   int
+	}{
+		{
+			description: "AES-CBC with HMAC-SHA1",
+			encrName:    encr.ENCR_AES_CBC_256,
+			integName:   integ.AUTH_HMAC_SHA1_96,
+			maxLength:   576,
+		},
+		{
+			description: "AES-GCM",
+			encrName:    encr.ENCR_AES_GCM_16_128,
+			maxLength:   1280,
+		},
+		{
+			description: "AES-CTR with HMAC-SHA2-256",
+			encrName:    encr.ENCR_AES_CTR_128,
+			integName:   integ.AUTH_HMAC_SHA2_256_128,
+			maxLength:   333,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			ikeSAKey := newFragmentTestKey(t, tc.encrName, tc.integName)
+			ikeMsg := newFragmentTestMessage()
+			expPayloads := newFragmentTestMessage().Payloads
+
+			fragments, err := EncodeEncryptFragments(ikeMsg, ikeSAKey, message.Role_Initiator, tc.maxLength)
+			require.NoError(t, err)
+			require.Greater(t, len(fragments), 1)
+			for _, fragment := range fragments {
+				require.LessOrEqual(t, len(fragment), tc.maxLength)
+				_, err = DecodeDecrypt(fragment, nil, ikeSAKey, message.Role_Responder)
+				require.Error(t, err)
+			}
+
+			// Fragments in reverse order, with a duplicate
+			reassembler := NewReassembler(time.Second)
+			var reassembled *message.IKEMessage
+			for i := len(fragments) - 1; i >= 0; i-- {
+				if i == len(fragments)-2 {
+					result, dupErr := reassembler.DecodeDecryptFragment(fragments[i+1], nil,
+						ikeSAKey, message.Role_Responder)
+					require.NoError(t, dupErr)
+					require.Nil(t, result)
+				}
+				reassembled, err = reassembler.DecodeDecryptFragment(fragments[i], nil,
+					ikeSAKey, message.Role_Responder)
+				require.NoError(t, err)
+				if i != 0 {
+					require.Nil(t, reassembled)
+				}
+			}
+			require.NotNil(t, reassembled)
+			require.Equal(t, expPayloads, reassembled.Payloads)
+			require.Equal(t, uint32(0x01), reassembled.MessageID)
+			require.Empty(t, reassembler.buffers)
+		})
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	ikeSAKey := newFragmentTestKey(t, encr.ENCR_AES_CBC_128, integ.AUTH_HMAC_SHA2_256_128)
+	fragments, err := EncodeEncryptFragments(newFragmentTestMessage(), ikeSAKey, message.Role_Initiator, 1280)
+	require.NoError(t, err)
+	smallFragments, err := EncodeEncryptFragments(newFragmentTestMessage(), ikeSAKey, message.Role_Initiator, 576)
+	require.NoError(t, err)
+	require.Greater(t, len(smallFragments), len(fragments))
+
+	now := time.Unix(1700000000, 0)
+	reassembler := NewReassembler(5 * time.Second)
+	reassembler.now = func() time.Time { return now }
+	add := func(fragment []byte) (*message.IKEMessage, error) {
+		return reassembler.DecodeDecryptFragment(fragment, nil, ikeSAKey, message.Role_Responder)
+	}
+
+	// The message is sent again with smaller fragments
+	result, err := add(fragments[0])
+	require.NoError(t, err)
+	require.Nil(t, result)
+	for _, fragment := range smallFragments[:len(smallFragments)-1] {
+		result, err = add(fragment)
+		require.NoError(t, err)
+		require.Nil(t, result)
+	}
+	// Late fragment of the first transmission
+	_, err = add(fragments[1])
+	require.Error(t, err)
+	result, err = add(smallFragments[len(smallFragments)-1])
+	require.NoError(t, err)
+	require.NotNil(t, result)
+
+	// Incomplete message expires
+	result, err = add(fragments[0])
+	require.NoError(t, err)
+	require.Nil(t, result)
+	now = now.Add(6 * time.Second)
+	for _, fragment := range fragments[1:] {
+		result, err = add(fragment)
+		require.NoError(t, err)
+		require.Nil(t, result)
+	}
+	reassembler.Expire()
+	require.Len(t, reassembler.buffers, 1)
+	now = now.Add(6 * time.Second)
+	reassembler.Expire()
+	require.Empty(t, reassembler.buffers)
+
+	// Tampered fragment
+	tampered := append([]byte{}, fragments[0]...)
+	tampered[len(tampered)-1] ^= 0x01
+	_, err = add(tampered)
+	require.Error(t, err)
+	require.Empty(t, reassembler.buffers)
+}
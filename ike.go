@@ -7,6 +7,7 @@ import (
 
 	"github.com/guoweifk/n3iwue_ike_gw/message"
 	"github.com/guoweifk/n3iwue_ike_gw/security"
+	ikeCrypto "github.com/guoweifk/n3iwue_ike_gw/security/IKECrypto"
 )
 
 func EncodeEncrypt(
@@ -50,7 +51,10 @@ func DecodeDecrypt(
 		}
 	}
 
-	if ikeMsg.Payloads[0].Type() == message.TypeSK {
+	if len(ikeMsg.Payloads) > 0 && ikeMsg.Payloads[0].Type() == message.TypeSKF {
+		return nil, errors.Errorf("DecodeDecrypt(): Encrypted fragment is to be reassembled")
+	}
+	if len(ikeMsg.Payloads) > 0 && ikeMsg.Payloads[0].Type() == message.TypeSK {
 		if ikesaKey == nil {
 			return nil, errors.Errorf("IKE decode decrypt: need ikesaKey to decrypt")
 		}
@@ -155,6 +159,23 @@ func decryptPayload(
 	return plainText, nil
 }
 
+// aeadCrypto returns the combined mode crypto used by the given role for
+// encrypting
+func aeadCrypto(ikesaKey *security.IKESAKey, role message.Role) (ikeCrypto.IKEAEADCrypto, error) {
+	var crypto ikeCrypto.IKECrypto
+	if role == message.Role_Initiator {
+		crypto = ikesaKey.Encr_i
+	} else {
+		crypto = ikesaKey.Encr_r
+	}
+
+	aead, ok := crypto.(ikeCrypto.IKEAEADCrypto)
+	if !ok {
+		return nil, errors.Errorf("aeadCrypto(): Encryption key of IKE SA is not AEAD")
+	}
+	return aead, nil
+}
+
 func decryptMsg(
 	msg []byte,
 	ikeMsg *message.IKEMessage,
@@ -173,14 +194,15 @@ func decryptMsg(
 	}
 
 	// Check if the context contain needed data
-	if ikesaKey.IntegInfo == nil {
-		return nil, errors.Errorf("decryptMsg(): No integrity algorithm specified")
-	}
 	if ikesaKey.EncrInfo == nil {
 		return nil, errors.Errorf("decryptMsg(): No encryption algorithm specified")
 	}
+	isAEAD := ikesaKey.EncrInfo.IsAEAD()
+	if !isAEAD && ikesaKey.IntegInfo == nil {
+		return nil, errors.Errorf("decryptMsg(): No integrity algorithm specified")
+	}
 
-	if ikesaKey.Integ_i == nil {
+	if !isAEAD && ikesaKey.Integ_i == nil {
 		return nil, errors.Errorf("decryptMsg(): No initiator's integrity key")
 	}
 	if ikesaKey.Encr_i == nil {
@@ -199,20 +221,12 @@ func decryptMsg(
 		}
 	}
 
-	checksumLength := ikesaKey.IntegInfo.GetOutputLength()
-	// Checksum
-	checksum := encryptedPayload.EncryptedData[len(encryptedPayload.EncryptedData)-checksumLength:]
-
-	err := verifyIntegrity(msg[:len(msg)-checksumLength], checksum, ikesaKey, !role)
-	if err != nil {
-		return nil, errors.Wrapf(err, "decryptMsg(): verify integrity")
+	if encryptedPayload == nil {
+		return nil, errors.Errorf("decryptMsg(): No encrypted payload")
 	}
-
-	// Decrypt
-	encryptedData := encryptedPayload.EncryptedData[:len(encryptedPayload.EncryptedData)-checksumLength]
-	plainText, err := decryptPayload(encryptedData, ikesaKey, role)
+	plainText, err := openPayload(msg, encryptedPayload.EncryptedData, ikesaKey, role)
 	if err != nil {
-		return nil, errors.Wrapf(err, "decryptMsg(): Error decrypting message")
+		return nil, errors.Wrapf(err, "decryptMsg()")
 	}
 
 	var decryptedPayloads message.IKEPayloadContainer
@@ -226,6 +240,54 @@ func decryptMsg(
 	return ikeMsg, nil
 }
 
+// openPayload verifies and decrypts the Encrypted Data field of the SK or the
+// SKF payload ending msg
+func openPayload(
+	msg []byte,
+	encryptedData []byte,
+	ikesaKey *security.IKESAKey,
+	role message.Role,
+) ([]byte, error) {
+	var plainText []byte
+	isAEAD := ikesaKey.EncrInfo.IsAEAD()
+	if isAEAD {
+		// RFC 5282 - 5.1: the associated data is the IKE header and the
+		// unencrypted payload headers, and the ICV is verified on decrypting
+		aead, err := aeadCrypto(ikesaKey, !role)
+		if err != nil {
+			return nil, errors.Wrapf(err, "openPayload()")
+		}
+		if len(msg) < len(encryptedData) {
+			return nil, errors.Errorf("openPayload(): Encrypted payload exceeds message length")
+		}
+		associatedData := msg[:len(msg)-len(encryptedData)]
+		plainText, err = aead.DecryptWithAD(encryptedData, associatedData)
+		if err != nil {
+			return nil, errors.Wrapf(err, "openPayload(): Error decrypting message")
+		}
+	} else {
+		checksumLength := ikesaKey.IntegInfo.GetOutputLength()
+		if len(encryptedData) < checksumLength {
+			return nil, errors.Errorf("openPayload(): Encrypted data is shorter than checksum")
+		}
+		// Checksum
+		checksum := encryptedData[len(encryptedData)-checksumLength:]
+
+		err := verifyIntegrity(msg[:len(msg)-checksumLength], checksum, ikesaKey, !role)
+		if err != nil {
+			return nil, errors.Wrapf(err, "openPayload(): verify integrity")
+		}
+
+		// Decrypt
+		plainText, err = decryptPayload(encryptedData[:len(encryptedData)-checksumLength], ikesaKey, role)
+		if err != nil {
+			return nil, errors.Wrapf(err, "openPayload(): Error decrypting message")
+		}
+	}
+
+	return plainText, nil
+}
+
 func encryptMsg(
 	ikeMsg *message.IKEMessage,
 	ikesaKey *security.IKESAKey,
@@ -240,56 +302,120 @@ func encryptMsg(
 	ikePayloads := ikeMsg.Payloads
 
 	// Check if the context contain needed data
-	if ikesaKey.IntegInfo == nil {
-		return errors.Errorf("encryptMsg(): No integrity algorithm specified")
-	}
 	if ikesaKey.EncrInfo == nil {
 		return errors.Errorf("encryptMsg(): No encryption algorithm specified")
 	}
+	isAEAD := ikesaKey.EncrInfo.IsAEAD()
+	if !isAEAD && ikesaKey.IntegInfo == nil {
+		return errors.Errorf("encryptMsg(): No integrity algorithm specified")
+	}
 
-	if ikesaKey.Integ_r == nil {
+	if !isAEAD && ikesaKey.Integ_r == nil {
 		return errors.Errorf("encryptMsg(): No responder's integrity key")
 	}
 	if ikesaKey.Encr_r == nil {
 		return errors.Errorf("encryptMsg(): No responder's encryption key")
 	}
 
-	checksumLength := ikesaKey.IntegInfo.GetOutputLength()
-
 	plainTextPayload, err := ikePayloads.Encode()
 	if err != nil {
 		return errors.Wrapf(err, "encryptMsg(): Encoding IKE payload failed.")
 	}
 
-	// Encrypting
-	encryptedData, err := encryptPayload(plainTextPayload, ikesaKey, role)
-	if err != nil {
-		return errors.Wrapf(err, "encryptMsg(): Error encrypting message")
-	}
-
-	encryptedData = append(encryptedData, make([]byte, checksumLength)...)
-	ikeMsg.Payloads.Reset()
-
 	var encrNextPayloadType message.IkePayloadType
 	if len(ikePayloads) == 0 {
 		encrNextPayloadType = message.NoNext
 	} else {
 		encrNextPayloadType = ikePayloads[0].Type()
 	}
-	sk := ikeMsg.Payloads.BuildEncrypted(encrNextPayloadType, encryptedData)
+	ikeMsg.Payloads.Reset()
+
+	err = protectPayload(ikeMsg, plainTextPayload, ikesaKey, role, func(encryptedData []byte) []byte {
+		return ikeMsg.Payloads.BuildEncrypted(encrNextPayloadType, encryptedData).EncryptedData
+	})
+	if err != nil {
+		return errors.Wrapf(err, "encryptMsg()")
+	}
+	return nil
+}
+
+// protectPayload encrypts plainText into the encrypted payload appended to
+// ikeMsg by buildPayload, which returns its Encrypted Data field, and protects
+// the integrity of the whole message. It is shared by the SK and the SKF
+// payloads, which end the message.
+func protectPayload(
+	ikeMsg *message.IKEMessage,
+	plainText []byte,
+	ikesaKey *security.IKESAKey,
+	role message.Role,
+	buildPayload func(encryptedData []byte) []byte,
+) error {
+	if ikesaKey.EncrInfo.IsAEAD() {
+		return encryptMsgAEAD(ikeMsg, plainText, ikesaKey, role, buildPayload)
+	}
+
+	checksumLength := ikesaKey.IntegInfo.GetOutputLength()
+
+	// Encrypting
+	encryptedData, err := encryptPayload(plainText, ikesaKey, role)
+	if err != nil {
+		return errors.Wrapf(err, "protectPayload(): Error encrypting message")
+	}
+
+	encryptedData = append(encryptedData, make([]byte, checksumLength)...)
+	encryptedField := buildPayload(encryptedData)
 
 	// Calculate checksum
 	ikeMsgData, err := ikeMsg.Encode()
 	if err != nil {
-		return errors.Wrapf(err, "encryptMsg(): Encoding IKE message error")
+		return errors.Wrapf(err, "protectPayload(): Encoding IKE message error")
 	}
 	checksumOfMessage, err := calculateIntegrity(ikesaKey, role,
 		ikeMsgData[:len(ikeMsgData)-checksumLength])
 	if err != nil {
-		return errors.Wrapf(err, "encryptMsg(): Error calculating checksum")
+		return errors.Wrapf(err, "protectPayload(): Error calculating checksum")
 	}
-	checksumField := sk.EncryptedData[len(sk.EncryptedData)-checksumLength:]
+	checksumField := encryptedField[len(encryptedField)-checksumLength:]
 	copy(checksumField, checksumOfMessage)
 
 	return nil
 }
+
+// encryptMsgAEAD builds the encrypted payload with a combined mode algorithm.
+// The length of the cipher text must be known before encrypting, since the
+// IKE header and the encrypted payload header are authenticated as associated
+// data.
+func encryptMsgAEAD(
+	ikeMsg *message.IKEMessage,
+	plainTextPayload []byte,
+	ikesaKey *security.IKESAKey,
+	role message.Role,
+	buildPayload func(encryptedData []byte) []byte,
+) error {
+	aead, err := aeadCrypto(ikesaKey, role)
+	if err != nil {
+		return errors.Wrapf(err, "encryptMsgAEAD()")
+	}
+
+	// Plain text is followed by the Pad Length octet
+	cipherTextLength := aead.Overhead() + len(plainTextPayload) + 1
+	encryptedField := buildPayload(make([]byte, cipherTextLength))
+
+	ikeMsgData, err := ikeMsg.Encode()
+	if err != nil {
+		return errors.Wrapf(err, "encryptMsgAEAD(): Encoding IKE message error")
+	}
+	associatedData := ikeMsgData[:len(ikeMsgData)-cipherTextLength]
+
+	encryptedData, err := aead.EncryptWithAD(plainTextPayload, associatedData)
+	if err != nil {
+		return errors.Wrapf(err, "encryptMsgAEAD(): Error encrypting message")
+	}
+	if len(encryptedData) != cipherTextLength {
+		return errors.Errorf("encryptMsgAEAD(): Unexpected cipher text length %d, expect %d",
+			len(encryptedData), cipherTextLength)
+	}
+	copy(encryptedField, encryptedData)
+
+	return nil
+}
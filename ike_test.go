@@ -1,6 +1,7 @@
 package ike
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/hex"
@@ -165,6 +166,47 @@ func TestEncodeDecode(t *testing.T) {
 	require.Equal(t, expIkePayloads, ikeMsg.Payloads)
 }
 
+func TestEncodeDecodeAEAD(t *testing.T) {
+	for _, algo := range []string{
+		encr.ENCR_AES_GCM_8_128,
+		encr.ENCR_AES_GCM_12_192,
+		encr.ENCR_AES_GCM_16_256,
+	} {
+		t.Run(algo, func(t *testing.T) {
+			ikeSAKey := &security.IKESAKey{
+				EncrInfo: encr.StrToType(algo),
+			}
+
+			var err error
+			ikeSAKey.SK_ei = bytes.Repeat([]byte{0x01}, ikeSAKey.EncrInfo.GetKeyLength())
+			ikeSAKey.Encr_i, err = ikeSAKey.EncrInfo.NewCrypto(ikeSAKey.SK_ei)
+			require.NoError(t, err)
+			ikeSAKey.SK_er = bytes.Repeat([]byte{0x02}, ikeSAKey.EncrInfo.GetKeyLength())
+			ikeSAKey.Encr_r, err = ikeSAKey.EncrInfo.NewCrypto(ikeSAKey.SK_er)
+			require.NoError(t, err)
+
+			ikeMsg := message.NewMessage(0x000000000006f708, 0xc9e2e31f8b64053d,
+				message.IKE_AUTH, false, true, 0x03, nil)
+			ikeMsg.Payloads = append(ikeMsg.Payloads, eapIkeMsg.Payloads...)
+
+			b, err := EncodeEncrypt(ikeMsg, ikeSAKey, message.Role_Initiator)
+			require.NoError(t, err)
+
+			ikehdr, err := message.ParseHeader(b)
+			require.NoError(t, err)
+
+			decodedMsg, err := DecodeDecrypt(b, ikehdr, ikeSAKey, message.Role_Responder)
+			require.NoError(t, err)
+			require.Equal(t, eapIkeMsg.Payloads, decodedMsg.Payloads)
+
+			// IKE header is authenticated as associated data
+			b[23] ^= 0x01
+			_, err = DecodeDecrypt(b, nil, ikeSAKey, message.Role_Responder)
+			require.Error(t, err)
+		})
+	}
+}
+
 func TestDecodeDecrypt(t *testing.T) {
 	testcases := []struct {
 		description                string
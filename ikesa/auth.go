@@ -0,0 +1,71 @@
+package ikesa
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// signedOctets returns the octets authenticated by the AUTH payload of role
+// with its identification payload body
+func (ikesa *IKESA) signedOctets(role message.Role, idType uint8, idData []byte) ([]byte, error) {
+	if role == message.Role_Initiator {
+		return ikesa.Key.SignedOctets(role, ikesa.initRequest, ikesa.NonceResponder, idType, idData)
+	}
+	return ikesa.Key.SignedOctets(role, ikesa.initResponse, ikesa.NonceInitiator, idType, idData)
+}
+
+// sharedSecret returns the secret of the AUTH payload of role, which is the
+// PSK before EAP, and the key generated by EAP after it
+func (ikesa *IKESA) sharedSecret(role message.Role) []byte {
+	if ikesa.eapSuccess {
+		return ikesa.Key.EAPSharedSecret(role, ikesa.msk)
+	}
+	return ikesa.config.PSK
+}
+
+// buildAuthentication appends the AUTH payload of this side
+func (ikesa *IKESA) buildAuthentication(payloads *message.IKEPayloadContainer) error {
+	signedOctets, err := ikesa.signedOctets(ikesa.Role, ikesa.config.LocalIDType, ikesa.config.LocalID)
+	if err != nil {
+		return errors.Wrapf(err, "buildAuthentication()")
+	}
+	authentication, err := ikesa.Key.PSKAuthentication(ikesa.sharedSecret(ikesa.Role), signedOctets)
+	if err != nil {
+		return errors.Wrapf(err, "buildAuthentication()")
+	}
+	*payloads = append(*payloads, authentication)
+	return nil
+}
+
+// verifyAuthentication checks the AUTH payload of the peer with its
+// identification payload body
+func (ikesa *IKESA) verifyAuthentication(
+	authentication *message.Authentication, idType uint8, idData []byte,
+) error {
+	if authentication == nil {
+		return errors.Errorf("verifyAuthentication(): No AUTH payload")
+	}
+	signedOctets, err := ikesa.signedOctets(!ikesa.Role, idType, idData)
+	if err != nil {
+		return errors.Wrapf(err, "verifyAuthentication()")
+	}
+	err = ikesa.Key.VerifyPSKAuthentication(authentication, ikesa.sharedSecret(!ikesa.Role), signedOctets)
+	if err != nil {
+		return errors.Wrapf(err, "verifyAuthentication()")
+	}
+	return nil
+}
+
+// checkRemoteID checks the identity of the peer against the configured one
+func (ikesa *IKESA) checkRemoteID(idType uint8, idData []byte) error {
+	if len(ikesa.config.RemoteID) == 0 {
+		return nil
+	}
+	if idType != ikesa.config.RemoteIDType || !bytes.Equal(idData, ikesa.config.RemoteID) {
+		return errors.Errorf("checkRemoteID(): Unexpected identity of type %d", idType)
+	}
+	return nil
+}
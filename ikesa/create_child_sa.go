@@ -0,0 +1,635 @@
+package ikesa
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+	"github.com/guoweifk/n3iwue_ike_gw/security/dh"
+)
+
+// createChildSARequest is the CREATE_CHILD_SA request of this side, creating
+// or rekeying a Child SA, or rekeying the IKE SA
+type createChildSARequest struct {
+	rekeyIKESA bool
+	// Child SA being rekeyed, nil for a new Child SA
+	rekeyed *ChildSA
+
+	inboundSPI uint32 // Child SA
+	spi        uint64 // IKE SA rekey: SPI of this side in the new IKE SA
+	tsi        message.IndividualTrafficSelectorContainer
+	tsr        message.IndividualTrafficSelectorContainer
+
+	nonce []byte
+	// Diffie-Hellman secret of the KE payload, nil without PFS
+	dhType   dh.DHType
+	dhSecret dh.Secret
+
+	// SA created for the request of the peer rekeying the same SA at the
+	// same time, with the nonces of its exchange
+	collisionChildSA *ChildSA
+	collisionIKESA   *IKESA
+	collisionNonces  [2][]byte
+}
+
+// createChildSAPayloads collects the payloads of a CREATE_CHILD_SA message
+type createChildSAPayloads struct {
+	sa    *message.SecurityAssociation
+	ke    *message.KeyExchange
+	nonce *message.Nonce
+	tsi   *message.TrafficSelectorInitiator
+	tsr   *message.TrafficSelectorResponder
+	rekey *message.Notification
+	// First error notification
+	err *message.Notification
+}
+
+func parseCreateChildSAPayloads(ikeMsg *message.IKEMessage) *createChildSAPayloads {
+	p := new(createChildSAPayloads)
+	for _, payload := range ikeMsg.Payloads {
+		switch payload := payload.(type) {
+		case *message.SecurityAssociation:
+			p.sa = payload
+		case *message.KeyExchange:
+			p.ke = payload
+		case *message.Nonce:
+			p.nonce = payload
+		case *message.TrafficSelectorInitiator:
+			p.tsi = payload
+		case *message.TrafficSelectorResponder:
+			p.tsr = payload
+		case *message.Notification:
+			if payload.NotifyMessageType == message.REKEY_SA {
+				p.rekey = payload
+			} else if payload.NotifyMessageType < message.INITIAL_CONTACT && p.err == nil {
+				p.err = payload
+			}
+		}
+	}
+	return p
+}
+
+// group returns the Diffie-Hellman group of the KE payload, DH_NONE without
+func (p *createChildSAPayloads) group() uint16 {
+	if p.ke == nil {
+		return message.DH_NONE
+	}
+	return p.ke.DiffieHellmanGroup
+}
+
+// CreateChildSA returns a CREATE_CHILD_SA request for a new Child SA with the
+// traffic selectors, with a KE payload if the Child SA policy asks for PFS
+func (ikesa *IKESA) CreateChildSA(tsi, tsr message.IndividualTrafficSelectorContainer) ([]byte, error) {
+	return ikesa.startCreateChildSA(&createChildSARequest{tsi: tsi, tsr: tsr})
+}
+
+// RekeyChildSA returns a CREATE_CHILD_SA request rekeying the Child SA. The
+// Child SA is deleted once the new one is created (RFC 7296 - 2.8).
+func (ikesa *IKESA) RekeyChildSA(childSA *ChildSA) ([]byte, error) {
+	if ikesa.findChildSA(childSA.OutboundSPI) != childSA {
+		return nil, errors.Errorf("RekeyChildSA(): Child SA is not part of the IKE SA")
+	}
+	return ikesa.startCreateChildSA(&createChildSARequest{rekeyed: childSA, tsi: childSA.TSi, tsr: childSA.TSr})
+}
+
+// RekeyIKESA returns a CREATE_CHILD_SA request rekeying the IKE SA. The IKE
+// SA is deleted once its Successor is created (RFC 7296 - 2.18).
+func (ikesa *IKESA) RekeyIKESA() ([]byte, error) {
+	return ikesa.startCreateChildSA(&createChildSARequest{rekeyIKESA: true})
+}
+
+func (ikesa *IKESA) startCreateChildSA(request *createChildSARequest) ([]byte, error) {
+	if ikesa.State != StateEstablished {
+		return nil, errors.Errorf("startCreateChildSA(): IKE SA is not established")
+	}
+	if ikesa.busy() {
+		return nil, errors.Errorf("startCreateChildSA(): A request is waiting for its response")
+	}
+
+	var err error
+	if request.rekeyIKESA {
+		request.dhType = ikesa.Key.DhInfo
+		if request.spi, err = ikesa.config.newSPI(); err != nil {
+			return nil, errors.Wrapf(err, "startCreateChildSA()")
+		}
+	} else {
+		if len(ikesa.config.ChildPolicy) == 0 {
+			return nil, errors.Errorf("startCreateChildSA(): No Child SA policy")
+		}
+		request.dhType = ikesa.config.ChildPolicy[0].DhInfo
+		if request.inboundSPI, err = ikesa.config.newChildSPI(); err != nil {
+			return nil, errors.Wrapf(err, "startCreateChildSA()")
+		}
+	}
+
+	ikeMsg, err := ikesa.buildCreateChildSARequest(request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "startCreateChildSA()")
+	}
+	msg, err := ikesa.encode(ikeMsg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "startCreateChildSA()")
+	}
+	ikesa.pending = request
+	return msg, nil
+}
+
+// buildCreateChildSARequest offers every suite of the policy, with a KE
+// payload of the group of the request
+func (ikesa *IKESA) buildCreateChildSARequest(request *createChildSARequest) (*message.IKEMessage, error) {
+	var err error
+	if request.nonce, err = randomNonce(); err != nil {
+		return nil, err
+	}
+
+	var payloads message.IKEPayloadContainer
+	if request.rekeyed != nil {
+		// The SA is identified by the SPI of its inbound packets
+		payloads.BuildNotification(message.TypeESP, message.REKEY_SA, childSPI(request.rekeyed.InboundSPI), nil)
+	}
+
+	sa := payloads.BuildSecurityAssociation()
+	if request.rekeyIKESA {
+		spi := make([]byte, 8)
+		binary.BigEndian.PutUint64(spi, request.spi)
+		for i, suite := range ikesa.config.IKEPolicy {
+			proposal, proposalErr := suite.ToProposal(uint8(i+1), spi)
+			if proposalErr != nil {
+				return nil, proposalErr
+			}
+			sa.Proposals = append(sa.Proposals, proposal)
+		}
+	} else {
+		for i, suite := range ikesa.config.ChildPolicy {
+			proposal, proposalErr := suite.ToProposal(uint8(i+1), childSPI(request.inboundSPI))
+			if proposalErr != nil {
+				return nil, proposalErr
+			}
+			sa.Proposals = append(sa.Proposals, proposal)
+		}
+	}
+	payloads.BuildNonce(request.nonce)
+
+	if request.dhType != nil {
+		if request.dhSecret, err = dh.GenerateSecret(request.dhType); err != nil {
+			return nil, err
+		}
+		publicValue, publicErr := request.dhType.GetPublicValue(request.dhSecret)
+		if publicErr != nil {
+			return nil, publicErr
+		}
+		payloads.BuildKeyExchange(request.dhType.TransformID(), publicValue)
+	}
+
+	if !request.rekeyIKESA {
+		payloads.BuildTrafficSelectorInitiator().TrafficSelectors = request.tsi
+		payloads.BuildTrafficSelectorResponder().TrafficSelectors = request.tsr
+	}
+	return ikesa.newRequest(message.CREATE_CHILD_SA, payloads), nil
+}
+
+func (ikesa *IKESA) handleCreateChildSARequest(request *message.IKEMessage) (*message.IKEMessage, Event, error) {
+	p := parseCreateChildSAPayloads(request)
+	if p.sa == nil || p.nonce == nil || len(p.sa.Proposals) == 0 {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventNone,
+			errors.Errorf("handleCreateChildSARequest(): Missing SA or Nonce payload")
+	}
+
+	// Child SAs are not created or rekeyed while the IKE SA is being rekeyed
+	// (RFC 7296 - 2.25), only simultaneous IKE SA rekeys are resolved
+	rekeyIKESA := p.sa.Proposals[0].ProtocolID == message.TypeIKE
+	pendingRekeyIKESA := ikesa.pending != nil && ikesa.pending.rekeyIKESA
+	pendingChildSA := ikesa.pending != nil && !ikesa.pending.rekeyIKESA
+	if ikesa.State == StateRekeyed || pendingRekeyIKESA && !rekeyIKESA || pendingChildSA && rekeyIKESA {
+		return ikesa.errorNotify(request, message.TEMPORARY_FAILURE), EventNone,
+			errors.Errorf("handleCreateChildSARequest(): IKE SA is being rekeyed")
+	}
+
+	if rekeyIKESA {
+		return ikesa.handleRekeyIKESARequest(request, p)
+	}
+	return ikesa.handleChildSARequest(request, p)
+}
+
+// handleChildSARequest creates the Child SA requested by the peer, and
+// replaces the one of the REKEY_SA notification if any
+func (ikesa *IKESA) handleChildSARequest(
+	request *message.IKEMessage, p *createChildSAPayloads,
+) (*message.IKEMessage, Event, error) {
+	if p.tsi == nil || p.tsr == nil {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventNone,
+			errors.Errorf("handleChildSARequest(): Missing TSi or TSr payload")
+	}
+
+	var rekeyed *ChildSA
+	if p.rekey != nil {
+		if p.rekey.ProtocolID != message.TypeESP || len(p.rekey.SPI) != 4 {
+			return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventNone,
+				errors.Errorf("handleChildSARequest(): Invalid REKEY_SA notification")
+		}
+		if rekeyed = ikesa.findChildSA(binary.BigEndian.Uint32(p.rekey.SPI)); rekeyed == nil {
+			var payloads message.IKEPayloadContainer
+			payloads.BuildNotification(message.TypeESP, message.CHILD_SA_NOT_FOUND, p.rekey.SPI, nil)
+			return ikesa.newResponse(request, payloads), EventNone,
+				errors.Errorf("handleChildSARequest(): No Child SA of SPI %x to rekey", p.rekey.SPI)
+		}
+	}
+
+	chosen, err := security.SelectChildSAProposal(ikesa.config.ChildPolicy, p.sa, p.group())
+	if err != nil {
+		return ikesa.proposalErrorNotify(request, err), EventNone, errors.Wrapf(err, "handleChildSARequest()")
+	}
+	nonce, err := randomNonce()
+	if err != nil {
+		return nil, EventNone, errors.Wrapf(err, "handleChildSARequest()")
+	}
+
+	var payloads message.IKEPayloadContainer
+	sharedKey, err := ikesa.respondKeyExchange(&payloads, chosen, p.ke)
+	if err != nil {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventNone,
+			errors.Wrapf(err, "handleChildSARequest()")
+	}
+
+	concatenatedNonce := append(append([]byte{}, p.nonce.NonceData...), nonce...)
+	childSA, err := ikesa.newChildSA(chosen, p.tsi.TrafficSelectors, p.tsr.TrafficSelectors,
+		message.Role_Responder, sharedKey, concatenatedNonce)
+	if err != nil {
+		return ikesa.errorNotify(request, message.NO_PROPOSAL_CHOSEN), EventNone,
+			errors.Wrapf(err, "handleChildSARequest()")
+	}
+	childSA.OutboundSPI = binary.BigEndian.Uint32(chosen.SPI)
+	if childSA.InboundSPI, err = ikesa.config.newChildSPI(); err != nil {
+		return nil, EventNone, errors.Wrapf(err, "handleChildSARequest()")
+	}
+	childSA.Key.SPI = childSA.InboundSPI
+	chosen.SPI = childSPI(childSA.InboundSPI)
+
+	if pending := ikesa.pending; rekeyed != nil && pending != nil && pending.rekeyed == rekeyed {
+		pending.collisionChildSA = childSA
+		pending.collisionNonces = [2][]byte{p.nonce.NonceData, nonce}
+	}
+	ikesa.ChildSAs = append(ikesa.ChildSAs, childSA)
+
+	payloads = append(message.IKEPayloadContainer{&message.SecurityAssociation{
+		Proposals: message.ProposalContainer{chosen},
+	}}, payloads...)
+	payloads.BuildNonce(nonce)
+	payloads.BuildTrafficSelectorInitiator().TrafficSelectors = childSA.TSi
+	payloads.BuildTrafficSelectorResponder().TrafficSelectors = childSA.TSr
+
+	event := EventChildSACreated
+	if rekeyed != nil {
+		event = EventChildSARekeyed
+	}
+	return ikesa.newResponse(request, payloads), event, nil
+}
+
+// handleRekeyIKESARequest creates the IKE SA replacing this one. If this side
+// rekeys the IKE SA at the same time, the Successor is chosen once its own
+// rekey is done, or is the IKE SA of the peer once the peer rejects the
+// request of this side or deletes this IKE SA.
+func (ikesa *IKESA) handleRekeyIKESARequest(
+	request *message.IKEMessage, p *createChildSAPayloads,
+) (*message.IKEMessage, Event, error) {
+	if p.ke == nil {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventNone,
+			errors.Errorf("handleRekeyIKESARequest(): Missing KE payload")
+	}
+	chosen, err := security.SelectIKESAProposal(ikesa.config.IKEPolicy, p.sa, p.ke.DiffieHellmanGroup)
+	if err != nil {
+		return ikesa.proposalErrorNotify(request, err), EventNone, errors.Wrapf(err, "handleRekeyIKESARequest()")
+	}
+	if len(chosen.SPI) != 8 {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventNone,
+			errors.Errorf("handleRekeyIKESARequest(): Invalid SPI length %d", len(chosen.SPI))
+	}
+	nonce, err := randomNonce()
+	if err != nil {
+		return nil, EventNone, errors.Wrapf(err, "handleRekeyIKESARequest()")
+	}
+	spi, err := ikesa.config.newSPI()
+	if err != nil {
+		return nil, EventNone, errors.Wrapf(err, "handleRekeyIKESARequest()")
+	}
+
+	var payloads message.IKEPayloadContainer
+	sharedKey, err := ikesa.respondKeyExchange(&payloads, chosen, p.ke)
+	if err != nil {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventNone,
+			errors.Wrapf(err, "handleRekeyIKESARequest()")
+	}
+	successor, err := ikesa.newRekeyedIKESA(chosen, message.Role_Responder, binary.BigEndian.Uint64(chosen.SPI), spi,
+		p.nonce.NonceData, nonce, sharedKey)
+	if err != nil {
+		return ikesa.errorNotify(request, message.NO_PROPOSAL_CHOSEN), EventNone,
+			errors.Wrapf(err, "handleRekeyIKESARequest()")
+	}
+	binary.BigEndian.PutUint64(chosen.SPI, spi)
+
+	payloads = append(message.IKEPayloadContainer{&message.SecurityAssociation{
+		Proposals: message.ProposalContainer{chosen},
+	}}, payloads...)
+	payloads.BuildNonce(nonce)
+	response := ikesa.newResponse(request, payloads)
+
+	if pending := ikesa.pending; pending != nil && pending.rekeyIKESA {
+		pending.collisionIKESA = successor
+		pending.collisionNonces = [2][]byte{p.nonce.NonceData, nonce}
+		return response, EventNone, nil
+	}
+	ikesa.succeed(successor)
+	return response, EventIKESARekeyed, nil
+}
+
+func (ikesa *IKESA) handleCreateChildSAResponse(
+	response *message.IKEMessage,
+) (reply *message.IKEMessage, event Event, err error) {
+	request := ikesa.pending
+	if request == nil {
+		return nil, EventNone, errors.Errorf("handleCreateChildSAResponse(): No CREATE_CHILD_SA request sent")
+	}
+	ikesa.pending = nil
+	// The SPI of this side in the IKE SA of a failed rekey is not used
+	defer func() {
+		if request.rekeyIKESA && err != nil {
+			ikesa.config.releaseSPI(request.spi)
+		}
+	}()
+
+	p := parseCreateChildSAPayloads(response)
+	if p.err != nil {
+		// The peer has rekeyed the IKE SA with the request this side has
+		// answered, and rejects the colliding request of this side
+		if request.collisionIKESA != nil {
+			ikesa.config.releaseSPI(request.spi)
+			ikesa.succeed(request.collisionIKESA)
+			return nil, EventIKESARekeyed, nil
+		}
+		if p.err.NotifyMessageType == message.INVALID_KE_PAYLOAD {
+			return ikesa.retryCreateChildSA(request, p.err)
+		}
+		return nil, EventNone, errors.Errorf("handleCreateChildSAResponse(): Error notification %d",
+			p.err.NotifyMessageType)
+	}
+	if p.sa == nil || p.nonce == nil {
+		return nil, EventNone, errors.Errorf("handleCreateChildSAResponse(): Missing SA or Nonce payload")
+	}
+	if len(p.sa.Proposals) != 1 {
+		return nil, EventNone, errors.Errorf("handleCreateChildSAResponse(): Expect one proposal, got %d",
+			len(p.sa.Proposals))
+	}
+
+	// The responder must answer with the group of the KE payload sent
+	var sharedKey []byte
+	if request.dhType == nil {
+		if p.ke != nil {
+			return nil, EventNone, errors.Errorf("handleCreateChildSAResponse(): Unexpected KE payload")
+		}
+	} else {
+		if p.group() != request.dhType.TransformID() {
+			return nil, EventNone, errors.Errorf("handleCreateChildSAResponse(): Unexpected Diffie-Hellman group %d",
+				p.group())
+		}
+		if sharedKey, err = request.dhType.GetSharedKey(request.dhSecret, p.ke.KeyExchangeData); err != nil {
+			return nil, EventNone, errors.Wrapf(err, "handleCreateChildSAResponse()")
+		}
+	}
+
+	if request.rekeyIKESA {
+		return ikesa.completeRekeyIKESA(request, p, sharedKey)
+	}
+	return ikesa.completeCreateChildSA(request, p, sharedKey)
+}
+
+// completeCreateChildSA sets up the Child SA accepted by the peer. After a
+// rekey, this side deletes the replaced Child SA, or the redundant one if
+// both sides have rekeyed it at the same time (RFC 7296 - 2.8.1).
+func (ikesa *IKESA) completeCreateChildSA(
+	request *createChildSARequest, p *createChildSAPayloads, sharedKey []byte,
+) (*message.IKEMessage, Event, error) {
+	if p.tsi == nil || p.tsr == nil {
+		return nil, EventNone, errors.Errorf("completeCreateChildSA(): Missing TSi or TSr payload")
+	}
+	chosen, err := security.SelectChildSAProposal(ikesa.config.ChildPolicy, p.sa, p.group())
+	if err != nil {
+		return nil, EventNone, errors.Wrapf(err, "completeCreateChildSA()")
+	}
+
+	concatenatedNonce := append(append([]byte{}, request.nonce...), p.nonce.NonceData...)
+	childSA, err := ikesa.newChildSA(chosen, p.tsi.TrafficSelectors, p.tsr.TrafficSelectors,
+		message.Role_Initiator, sharedKey, concatenatedNonce)
+	if err != nil {
+		return nil, EventNone, errors.Wrapf(err, "completeCreateChildSA()")
+	}
+	childSA.InboundSPI = request.inboundSPI
+	childSA.OutboundSPI = binary.BigEndian.Uint32(chosen.SPI)
+	childSA.Key.SPI = childSA.InboundSPI
+	ikesa.ChildSAs = append(ikesa.ChildSAs, childSA)
+
+	if request.rekeyed == nil {
+		return nil, EventChildSACreated, nil
+	}
+	if request.collisionChildSA != nil &&
+		redundant([2][]byte{request.nonce, p.nonce.NonceData}, request.collisionNonces) {
+		// The Child SA of the peer replaces the rekeyed one, which the peer
+		// deletes
+		ikesa.removeChildSA(childSA)
+		ikesa.removeChildSA(request.collisionChildSA)
+		ikesa.ChildSAs = append(ikesa.ChildSAs, request.collisionChildSA)
+		return ikesa.newDeleteChildSARequest(childSA), EventChildSARekeyed, nil
+	}
+	return ikesa.newDeleteChildSARequest(request.rekeyed), EventChildSARekeyed, nil
+}
+
+// completeRekeyIKESA sets up the IKE SA accepted by the peer, and deletes this
+// IKE SA. If both sides have rekeyed it at the same time, the redundant IKE SA
+// is deleted instead by the side which has created it (RFC 7296 - 2.8.2). It
+// is kept on both sides until then.
+func (ikesa *IKESA) completeRekeyIKESA(
+	request *createChildSARequest, p *createChildSAPayloads, sharedKey []byte,
+) (*message.IKEMessage, Event, error) {
+	chosen, err := security.SelectIKESAProposal(ikesa.config.IKEPolicy, p.sa, p.group())
+	if err != nil {
+		return nil, EventNone, errors.Wrapf(err, "completeRekeyIKESA()")
+	}
+	if len(chosen.SPI) != 8 {
+		return nil, EventNone, errors.Errorf("completeRekeyIKESA(): Invalid SPI length %d", len(chosen.SPI))
+	}
+	successor, err := ikesa.newRekeyedIKESA(chosen, message.Role_Initiator, request.spi,
+		binary.BigEndian.Uint64(chosen.SPI), request.nonce, p.nonce.NonceData, sharedKey)
+	if err != nil {
+		return nil, EventNone, errors.Wrapf(err, "completeRekeyIKESA()")
+	}
+
+	if request.collisionIKESA != nil &&
+		redundant([2][]byte{request.nonce, p.nonce.NonceData}, request.collisionNonces) {
+		// The peer deletes this IKE SA
+		ikesa.succeed(request.collisionIKESA)
+		successor.State = StateRekeyed
+		ikesa.redundant = successor
+		return successor.newDeleteIKESARequest(), EventIKESARekeyed, nil
+	}
+	if request.collisionIKESA != nil {
+		// The peer deletes the IKE SA it has created
+		request.collisionIKESA.State = StateRekeyed
+		ikesa.redundant = request.collisionIKESA
+	}
+	ikesa.succeed(successor)
+	return ikesa.newDeleteIKESARequest(), EventIKESARekeyed, nil
+}
+
+// retryCreateChildSA sends the request again with the group asked for by the
+// responder
+func (ikesa *IKESA) retryCreateChildSA(
+	request *createChildSARequest, notification *message.Notification,
+) (*message.IKEMessage, Event, error) {
+	if len(notification.NotificationData) != 2 {
+		return nil, EventNone, errors.Errorf("retryCreateChildSA(): Invalid INVALID_KE_PAYLOAD notification")
+	}
+	group := binary.BigEndian.Uint16(notification.NotificationData)
+	if request.dhType != nil && group == request.dhType.TransformID() {
+		return nil, EventNone, errors.Errorf("retryCreateChildSA(): Group %d is asked for again", group)
+	}
+
+	var groups []dh.DHType
+	if request.rekeyIKESA {
+		for _, suite := range ikesa.config.IKEPolicy {
+			groups = append(groups, suite.DhInfo)
+		}
+	} else {
+		for _, suite := range ikesa.config.ChildPolicy {
+			groups = append(groups, suite.DhInfo)
+		}
+	}
+	for _, dhType := range groups {
+		if dhType == nil || dhType.TransformID() != group {
+			continue
+		}
+		request.dhType = dhType
+		request.collisionChildSA, request.collisionIKESA = nil, nil
+		retry, err := ikesa.buildCreateChildSARequest(request)
+		if err != nil {
+			return nil, EventNone, errors.Wrapf(err, "retryCreateChildSA()")
+		}
+		ikesa.pending = request
+		return retry, EventNone, nil
+	}
+	return nil, EventNone, errors.Errorf("retryCreateChildSA(): Group %d is not acceptable", group)
+}
+
+// respondKeyExchange appends the KE payload of the responder if the chosen
+// proposal uses a Diffie-Hellman group, and returns the shared key
+func (ikesa *IKESA) respondKeyExchange(
+	payloads *message.IKEPayloadContainer, chosen *message.Proposal, ke *message.KeyExchange,
+) ([]byte, error) {
+	if len(chosen.DiffieHellmanGroup) == 0 || chosen.DiffieHellmanGroup[0].TransformID == message.DH_NONE {
+		return nil, nil
+	}
+	dhType := dh.DecodeTransform(chosen.DiffieHellmanGroup[0])
+	if dhType == nil || ke == nil {
+		return nil, errors.Errorf("respondKeyExchange(): Missing KE payload")
+	}
+	secret, err := dh.GenerateSecret(dhType)
+	if err != nil {
+		return nil, errors.Wrapf(err, "respondKeyExchange()")
+	}
+	publicValue, err := dhType.GetPublicValue(secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "respondKeyExchange()")
+	}
+	sharedKey, err := dhType.GetSharedKey(secret, ke.KeyExchangeData)
+	if err != nil {
+		return nil, errors.Wrapf(err, "respondKeyExchange()")
+	}
+	payloads.BuildKeyExchange(dhType.TransformID(), publicValue)
+	return sharedKey, nil
+}
+
+// newRekeyedIKESA returns the IKE SA replacing this one, which is initiated
+// by the side which has sent the CREATE_CHILD_SA request
+func (ikesa *IKESA) newRekeyedIKESA(
+	proposal *message.Proposal, role message.Role,
+	initiatorSPI, responderSPI uint64,
+	initiatorNonce, responderNonce, sharedKey []byte,
+) (*IKESA, error) {
+	key, err := security.NewIKESAKeyByProposal(proposal)
+	if err != nil {
+		return nil, errors.Wrapf(err, "newRekeyedIKESA()")
+	}
+	err = key.GenerateKeyForRekeyIKESA(ikesa.Key, initiatorNonce, responderNonce, sharedKey,
+		initiatorSPI, responderSPI)
+	if err != nil {
+		return nil, errors.Wrapf(err, "newRekeyedIKESA()")
+	}
+	return &IKESA{
+		Role:           role,
+		State:          StateEstablished,
+		config:         ikesa.config,
+		InitiatorSPI:   initiatorSPI,
+		ResponderSPI:   responderSPI,
+		LocalAddr:      ikesa.LocalAddr,
+		RemoteAddr:     ikesa.RemoteAddr,
+		NAT:            ikesa.NAT,
+		Fragmentation:  ikesa.Fragmentation,
+		NonceInitiator: append([]byte{}, initiatorNonce...),
+		NonceResponder: append([]byte{}, responderNonce...),
+		Key:            key,
+		peerIDType:     ikesa.peerIDType,
+		peerID:         ikesa.peerID,
+		PeerWindowSize: 1,
+	}, nil
+}
+
+// succeed hands the Child SAs over to the Successor of the IKE SA
+func (ikesa *IKESA) succeed(successor *IKESA) {
+	successor.ChildSAs = ikesa.ChildSAs
+	ikesa.ChildSAs = nil
+	ikesa.Successor = successor
+	ikesa.State = StateRekeyed
+}
+
+// proposalErrorNotify returns the response notifying the peer of a failed
+// negotiation
+func (ikesa *IKESA) proposalErrorNotify(request *message.IKEMessage, err error) *message.IKEMessage {
+	var proposalErr *security.ProposalError
+	if !errors.As(err, &proposalErr) {
+		return ikesa.errorNotify(request, message.NO_PROPOSAL_CHOSEN)
+	}
+	var payloads message.IKEPayloadContainer
+	proposalErr.BuildNotification(&payloads)
+	return ikesa.newResponse(request, payloads)
+}
+
+// findChildSA returns the Child SA of the outbound SPI, which the peer uses to
+// identify it
+func (ikesa *IKESA) findChildSA(outboundSPI uint32) *ChildSA {
+	for _, childSA := range ikesa.ChildSAs {
+		if childSA.OutboundSPI == outboundSPI {
+			return childSA
+		}
+	}
+	return nil
+}
+
+// redundant reports whether the SA created with the nonces of this side is
+// redundant with the one created with the nonces of the peer, which is the
+// case if the lowest of the four nonces is in this side's exchange
+func redundant(local, remote [2][]byte) bool {
+	lowest := func(nonces [2][]byte) []byte {
+		if bytes.Compare(nonces[0], nonces[1]) < 0 {
+			return nonces[0]
+		}
+		return nonces[1]
+	}
+	return bytes.Compare(lowest(local), lowest(remote)) < 0
+}
+
+func childSPI(spi uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, spi)
+	return b
+}
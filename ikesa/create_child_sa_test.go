@@ -0,0 +1,416 @@
+package ikesa
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	ike "github.com/guoweifk/n3iwue_ike_gw"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+	"github.com/guoweifk/n3iwue_ike_gw/security/dh"
+	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
+	"github.com/guoweifk/n3iwue_ike_gw/security/esn"
+	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+	"github.com/guoweifk/n3iwue_ike_gw/security/prf"
+)
+
+func newEstablishedIKESAs(t *testing.T, initiatorConfig, responderConfig *Config) (*IKESA, *IKESA) {
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+	initiatorEvent, responderEvent, err := runExchanges(t, initiator, responder)
+	require.NoError(t, err)
+	require.Equal(t, EventEstablished, initiatorEvent)
+	require.Equal(t, EventEstablished, responderEvent)
+	return initiator, responder
+}
+
+// exchange passes the request of from to the peer, and its response back
+func exchange(t *testing.T, from, to *IKESA, request []byte) (fromEvent, toEvent Event, next []byte) {
+	response, toEvent, err := to.HandleMessage(request)
+	require.NoError(t, err)
+	require.NotNil(t, response)
+	next, fromEvent, err = from.HandleMessage(response)
+	require.NoError(t, err)
+	return fromEvent, toEvent, next
+}
+
+func TestIKESACreateChildSA(t *testing.T) {
+	testcases := []struct {
+		description string
+		// The responder of the IKE SA creates the Child SA
+		fromResponder bool
+		initiatorDH   string
+		responderDH   string
+	}{
+		{
+			description: "Without PFS",
+		},
+		{
+			description: "With PFS",
+			initiatorDH: dh.DH_2048_BIT_MODP,
+			responderDH: dh.DH_2048_BIT_MODP,
+		},
+		{
+			description:   "With PFS from the responder of the IKE SA",
+			fromResponder: true,
+			initiatorDH:   dh.DH_256_BIT_RANDOM_ECP,
+			responderDH:   dh.DH_256_BIT_RANDOM_ECP,
+		},
+		{
+			description: "INVALID_KE_PAYLOAD retry",
+			initiatorDH: dh.DH_CURVE25519,
+			responderDH: dh.DH_256_BIT_RANDOM_ECP,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			initiatorConfig, responderConfig := newTestConfigs(t)
+			childSuite := func(dhName string) *security.ChildSASuite {
+				suite, err := security.NewChildSASuite(encr.ENCR_AES_CBC_128, integ.AUTH_HMAC_SHA1_96, dhName,
+					esn.String_ESN_DISABLE)
+				require.NoError(t, err)
+				return suite
+			}
+			initiatorConfig.ChildPolicy = []*security.ChildSASuite{childSuite(tc.initiatorDH)}
+			if tc.initiatorDH != tc.responderDH {
+				initiatorConfig.ChildPolicy = append(initiatorConfig.ChildPolicy, childSuite(tc.responderDH))
+			}
+			responderConfig.ChildPolicy = []*security.ChildSASuite{childSuite(tc.responderDH)}
+			initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+			from, to := initiator, responder
+			if tc.fromResponder {
+				from, to = responder, initiator
+			}
+			request, err := from.CreateChildSA(initiatorConfig.TSr, initiatorConfig.TSi)
+			require.NoError(t, err)
+			_, err = from.CreateChildSA(initiatorConfig.TSr, initiatorConfig.TSi)
+			require.Error(t, err)
+
+			if tc.initiatorDH != tc.responderDH {
+				response, event, handleErr := to.HandleMessage(request)
+				require.Error(t, handleErr)
+				require.Equal(t, EventNone, event)
+				request, event, handleErr = from.HandleMessage(response)
+				require.NoError(t, handleErr)
+				require.Equal(t, EventNone, event)
+			}
+
+			fromEvent, toEvent, next := exchange(t, from, to, request)
+			require.Equal(t, EventChildSACreated, fromEvent)
+			require.Equal(t, EventChildSACreated, toEvent)
+			require.Nil(t, next)
+			require.Len(t, from.ChildSAs, 2)
+			require.Len(t, to.ChildSAs, 2)
+
+			fromChildSA, toChildSA := from.ChildSAs[1], to.ChildSAs[1]
+			requireChildSAsPaired(t, fromChildSA, toChildSA)
+			require.Equal(t, message.Role_Initiator, fromChildSA.Role)
+			require.Equal(t, message.Role_Responder, toChildSA.Role)
+			require.Equal(t, initiatorConfig.TSr, fromChildSA.TSi)
+			if tc.responderDH != "" {
+				require.Equal(t, dh.StrToType(tc.responderDH), fromChildSA.Key.DhInfo)
+			} else {
+				require.Nil(t, fromChildSA.Key.DhInfo)
+			}
+			require.NotEqual(t, from.ChildSAs[0].Key.InitiatorToResponderEncryptionKey,
+				fromChildSA.Key.InitiatorToResponderEncryptionKey)
+		})
+	}
+
+	t.Run("No proposal chosen", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+		responderConfig.ChildPolicy = []*security.ChildSASuite{
+			mustChildSASuite(t, encr.ENCR_AES_GCM_16_128, ""),
+		}
+
+		request, err := initiator.CreateChildSA(initiatorConfig.TSi, initiatorConfig.TSr)
+		require.NoError(t, err)
+		response, event, err := responder.HandleMessage(request)
+		require.Error(t, err)
+		require.Equal(t, EventNone, event)
+		_, event, err = initiator.HandleMessage(response)
+		require.Error(t, err)
+		require.Equal(t, EventNone, event)
+
+		// Only the Child SA fails
+		require.Equal(t, StateEstablished, initiator.State)
+		require.Equal(t, StateEstablished, responder.State)
+		requireChildSAPaired(t, initiator, responder)
+		_, err = initiator.CreateChildSA(initiatorConfig.TSi, initiatorConfig.TSr)
+		require.NoError(t, err)
+	})
+}
+
+func TestIKESARekeyChildSA(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+	rekeyed := initiator.ChildSAs[0]
+
+	request, err := initiator.RekeyChildSA(rekeyed)
+	require.NoError(t, err)
+	initiatorEvent, responderEvent, deleteRequest := exchange(t, initiator, responder, request)
+	require.Equal(t, EventChildSARekeyed, initiatorEvent)
+	require.Equal(t, EventChildSARekeyed, responderEvent)
+	requireChildSAsPaired(t, initiator.ChildSAs[1], responder.ChildSAs[1])
+
+	// The replaced Child SA is deleted by the initiator of the rekey
+	require.NotNil(t, deleteRequest)
+	deleteMsg := decodeMessage(t, deleteRequest, responder)
+	require.Equal(t, uint8(message.INFORMATIONAL), deleteMsg.ExchangeType)
+	d, ok := deleteMsg.Payloads[0].(*message.Delete)
+	require.True(t, ok)
+	require.Equal(t, [][]byte{childSPI(rekeyed.InboundSPI)}, d.SPIs)
+	initiatorEvent, responderEvent, next := exchange(t, initiator, responder, deleteRequest)
+	require.Nil(t, next)
+	require.Equal(t, EventChildSADeleted, initiatorEvent)
+	require.Equal(t, EventChildSADeleted, responderEvent)
+	require.Equal(t, []*ChildSA{rekeyed}, initiator.DeletedChildSAs)
+	requireChildSAPaired(t, initiator, responder)
+
+	// Unknown Child SA
+	_, err = initiator.RekeyChildSA(rekeyed)
+	require.Error(t, err)
+	initiator.removeChildSA(initiator.ChildSAs[0])
+	request, err = responder.RekeyChildSA(responder.ChildSAs[0])
+	require.NoError(t, err)
+	response, event, err := initiator.HandleMessage(request)
+	require.Error(t, err)
+	require.Equal(t, EventNone, event)
+	_, _, err = responder.HandleMessage(response)
+	require.Error(t, err)
+}
+
+func TestIKESARekeyIKESA(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiatorConfig.IKEPolicy = append(initiatorConfig.IKEPolicy,
+		mustIKESASuite(t, encr.ENCR_AES_GCM_16_256, "", prf.PRF_HMAC_SHA2_384, dh.DH_CURVE25519))
+	responderConfig.IKEPolicy = initiatorConfig.IKEPolicy[1:]
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	// The first IKE SA is set up with the group of both policies
+	initiatorConfig.IKEPolicy = []*security.IKESASuite{initiatorConfig.IKEPolicy[1], initiatorConfig.IKEPolicy[0]}
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+	_, _, err = runExchanges(t, initiator, responder)
+	require.NoError(t, err)
+	childSA := initiator.ChildSAs[0]
+
+	// The responder of the IKE SA rekeys it, and becomes the initiator of the
+	// new one
+	request, err := responder.RekeyIKESA()
+	require.NoError(t, err)
+	responderEvent, initiatorEvent, deleteRequest := exchange(t, responder, initiator, request)
+	require.Equal(t, EventIKESARekeyed, responderEvent)
+	require.Equal(t, EventIKESARekeyed, initiatorEvent)
+	require.Equal(t, StateRekeyed, responder.State)
+	require.Equal(t, StateRekeyed, initiator.State)
+
+	newInitiator, newResponder := responder.Successor, initiator.Successor
+	require.NotNil(t, newInitiator)
+	require.NotNil(t, newResponder)
+	require.Equal(t, message.Role_Initiator, newInitiator.Role)
+	require.Equal(t, message.Role_Responder, newResponder.Role)
+	require.Equal(t, newInitiator.InitiatorSPI, newResponder.InitiatorSPI)
+	require.Equal(t, newInitiator.ResponderSPI, newResponder.ResponderSPI)
+	require.NotEqual(t, initiator.InitiatorSPI, newResponder.InitiatorSPI)
+	require.Equal(t, newInitiator.Key.SK_d, newResponder.Key.SK_d)
+	require.NotEqual(t, initiator.Key.SK_d, newResponder.Key.SK_d)
+	require.Equal(t, dh.StrToType(dh.DH_CURVE25519), newResponder.Key.DhInfo)
+
+	// The Child SAs are moved to the new IKE SA
+	require.Empty(t, initiator.ChildSAs)
+	require.Equal(t, []*ChildSA{childSA}, newResponder.ChildSAs)
+	requireChildSAPaired(t, newResponder, newInitiator)
+
+	// No Child SA is created on the old IKE SA
+	_, err = initiator.CreateChildSA(initiatorConfig.TSi, initiatorConfig.TSr)
+	require.Error(t, err)
+
+	// The old IKE SA is deleted by the initiator of the rekey
+	responderEvent, initiatorEvent, next := exchange(t, responder, initiator, deleteRequest)
+	require.Nil(t, next)
+	require.Equal(t, EventDeleted, responderEvent)
+	require.Equal(t, EventDeleted, initiatorEvent)
+	require.Equal(t, StateDeleted, responder.State)
+	require.Equal(t, StateDeleted, initiator.State)
+
+	// The new IKE SA protects the next exchanges
+	request, err = newResponder.CreateChildSA(initiatorConfig.TSi, initiatorConfig.TSr)
+	require.NoError(t, err)
+	newResponderEvent, newInitiatorEvent, _ := exchange(t, newResponder, newInitiator, request)
+	require.Equal(t, EventChildSACreated, newResponderEvent)
+	require.Equal(t, EventChildSACreated, newInitiatorEvent)
+	requireChildSAsPaired(t, newResponder.ChildSAs[1], newInitiator.ChildSAs[1])
+}
+
+func TestIKESARekeyCollision(t *testing.T) {
+	t.Run("Child SA", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+		initiatorRequest, err := initiator.RekeyChildSA(initiator.ChildSAs[0])
+		require.NoError(t, err)
+		responderRequest, err := responder.RekeyChildSA(responder.ChildSAs[0])
+		require.NoError(t, err)
+
+		initiatorResponse, event, err := responder.HandleMessage(initiatorRequest)
+		require.NoError(t, err)
+		require.Equal(t, EventChildSARekeyed, event)
+		responderResponse, event, err := initiator.HandleMessage(responderRequest)
+		require.NoError(t, err)
+		require.Equal(t, EventChildSARekeyed, event)
+
+		initiatorDelete, event, err := initiator.HandleMessage(initiatorResponse)
+		require.NoError(t, err)
+		require.Equal(t, EventChildSARekeyed, event)
+		responderDelete, event, err := responder.HandleMessage(responderResponse)
+		require.NoError(t, err)
+		require.Equal(t, EventChildSARekeyed, event)
+		require.NotNil(t, initiatorDelete)
+		require.NotNil(t, responderDelete)
+
+		// Both sides keep the same Child SA, created with the highest nonces,
+		// once the replaced and the redundant ones are deleted
+		requireChildSAsPaired(t, initiator.ChildSAs[len(initiator.ChildSAs)-1],
+			responder.ChildSAs[len(responder.ChildSAs)-1])
+		initiatorDeleteResponse, _, err := responder.HandleMessage(initiatorDelete)
+		require.NoError(t, err)
+		responderDeleteResponse, _, err := initiator.HandleMessage(responderDelete)
+		require.NoError(t, err)
+		_, _, err = initiator.HandleMessage(initiatorDeleteResponse)
+		require.NoError(t, err)
+		_, _, err = responder.HandleMessage(responderDeleteResponse)
+		require.NoError(t, err)
+		requireChildSAPaired(t, initiator, responder)
+	})
+
+	t.Run("IKE SA", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+		responderRequest, err := responder.RekeyIKESA()
+		require.NoError(t, err)
+
+		// A Child SA is not created while the IKE SA is rekeyed
+		request, err := initiator.CreateChildSA(initiatorConfig.TSi, initiatorConfig.TSr)
+		require.NoError(t, err)
+		response, event, err := responder.HandleMessage(request)
+		require.Error(t, err)
+		require.Equal(t, EventNone, event)
+		responseMsg := decodeMessage(t, response, initiator)
+		notification, ok := responseMsg.Payloads[0].(*message.Notification)
+		require.True(t, ok)
+		require.Equal(t, uint16(message.TEMPORARY_FAILURE), notification.NotifyMessageType)
+		_, event, err = initiator.HandleMessage(response)
+		require.Error(t, err)
+		require.Equal(t, EventNone, event)
+
+		initiatorRequest, err := initiator.RekeyIKESA()
+		require.NoError(t, err)
+
+		initiatorResponse, event, err := responder.HandleMessage(initiatorRequest)
+		require.NoError(t, err)
+		require.Equal(t, EventNone, event)
+		responderResponse, event, err := initiator.HandleMessage(responderRequest)
+		require.NoError(t, err)
+		require.Equal(t, EventNone, event)
+
+		initiatorNext, event, err := initiator.HandleMessage(initiatorResponse)
+		require.NoError(t, err)
+		require.Equal(t, EventIKESARekeyed, event)
+		responderNext, event, err := responder.HandleMessage(responderResponse)
+		require.NoError(t, err)
+		require.Equal(t, EventIKESARekeyed, event)
+
+		// Both sides keep the same IKE SA
+		require.Equal(t, initiator.Successor.InitiatorSPI, responder.Successor.InitiatorSPI)
+		require.Equal(t, initiator.Successor.ResponderSPI, responder.Successor.ResponderSPI)
+		require.Equal(t, initiator.Successor.Key.SK_d, responder.Successor.Key.SK_d)
+		require.NotEqual(t, initiator.Successor.Role, responder.Successor.Role)
+		requireChildSAPaired(t, initiator.Successor, responder.Successor)
+
+		// One side deletes its redundant IKE SA, the other one the old IKE SA
+		from, to, oldDelete := initiator, responder, initiatorNext
+		header, err := message.ParseHeader(initiatorNext)
+		require.NoError(t, err)
+		if header.InitiatorSPI != initiator.InitiatorSPI {
+			from, to, oldDelete = responder, initiator, responderNext
+		}
+		for _, next := range [][]byte{initiatorNext, responderNext} {
+			header, err = message.ParseHeader(next)
+			require.NoError(t, err)
+			require.NotEqual(t, initiator.Successor.InitiatorSPI, header.InitiatorSPI)
+		}
+		header, err = message.ParseHeader(oldDelete)
+		require.NoError(t, err)
+		require.Equal(t, initiator.InitiatorSPI, header.InitiatorSPI)
+		fromEvent, toEvent, _ := exchange(t, from, to, oldDelete)
+		require.Equal(t, EventDeleted, fromEvent)
+		require.Equal(t, EventDeleted, toEvent)
+	})
+
+	// The request of the responder is retransmitted after the initiator has
+	// completed its rekey, and is rejected
+	testcases := []struct {
+		description string
+		deleteFirst bool
+	}{
+		{"IKE SA rekey of the responder rejected", false},
+		{"IKE SA deleted before the rejection", true},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			initiatorConfig, responderConfig := newTestConfigs(t)
+			initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+			responderRequest, err := responder.RekeyIKESA()
+			require.NoError(t, err)
+			initiatorRequest, err := initiator.RekeyIKESA()
+			require.NoError(t, err)
+
+			initiatorResponse, event, err := responder.HandleMessage(initiatorRequest)
+			require.NoError(t, err)
+			require.Equal(t, EventNone, event)
+			deleteRequest, event, err := initiator.HandleMessage(initiatorResponse)
+			require.NoError(t, err)
+			require.Equal(t, EventIKESARekeyed, event)
+			responderResponse, _, err := initiator.HandleMessage(responderRequest)
+			require.Error(t, err)
+
+			if tc.deleteFirst {
+				initiatorEvent, responderEvent, _ := exchange(t, initiator, responder, deleteRequest)
+				require.Equal(t, EventDeleted, initiatorEvent)
+				require.Equal(t, EventDeleted, responderEvent)
+				_, _, err = responder.HandleMessage(responderResponse)
+				require.Error(t, err)
+			} else {
+				_, event, err = responder.HandleMessage(responderResponse)
+				require.NoError(t, err)
+				require.Equal(t, EventIKESARekeyed, event)
+				initiatorEvent, responderEvent, _ := exchange(t, initiator, responder, deleteRequest)
+				require.Equal(t, EventDeleted, initiatorEvent)
+				require.Equal(t, EventDeleted, responderEvent)
+			}
+
+			// The responder takes the IKE SA it has created for the initiator
+			require.NotNil(t, responder.Successor)
+			require.Equal(t, initiator.Successor.InitiatorSPI, responder.Successor.InitiatorSPI)
+			require.Equal(t, initiator.Successor.ResponderSPI, responder.Successor.ResponderSPI)
+			require.Equal(t, initiator.Successor.Key.SK_d, responder.Successor.Key.SK_d)
+			requireChildSAPaired(t, initiator.Successor, responder.Successor)
+		})
+	}
+}
+
+// decodeMessage decodes a message received by the IKE SA
+func decodeMessage(t *testing.T, msg []byte, receiver *IKESA) *message.IKEMessage {
+	ikeMsg, err := ike.DecodeDecrypt(msg, nil, receiver.Key, receiver.Role)
+	require.NoError(t, err)
+	return ikeMsg
+}
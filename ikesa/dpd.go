@@ -0,0 +1,112 @@
+package ikesa
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPeerDead is returned by DPD once a liveness check stays unanswered
+var ErrPeerDead = errors.New("Peer is not responding")
+
+// DPDConfig sets when the liveness checks of an IKE SA are sent
+type DPDConfig struct {
+	// Time without any message from the peer before a liveness check
+	Interval time.Duration
+	// Time to wait for the response before retransmitting the request
+	Timeout time.Duration
+	// Retransmissions of an unanswered request before the peer is dead
+	Retries int
+}
+
+// DPD detects the death of the peer of an IKE SA with liveness checks
+// (RFC 7296 - 2.4). It does no I/O: Received is called for each message of
+// the peer handled by the IKE SA, and Poll at the time returned by Next.
+type DPD struct {
+	ikesa  *IKESA
+	config DPDConfig
+	next   time.Time
+
+	// Liveness check waiting for its response, and how many times it is sent
+	probe   []byte
+	request *informationalRequest
+	sent    int
+}
+
+// NewDPD returns the liveness checks of the IKE SA, the first one is due an
+// interval after now
+func NewDPD(ikesa *IKESA, config DPDConfig, now time.Time) (*DPD, error) {
+	if ikesa == nil {
+		return nil, errors.Errorf("NewDPD(): IKE SA is nil")
+	}
+	if config.Interval <= 0 || config.Timeout <= 0 || config.Retries < 0 {
+		return nil, errors.Errorf("NewDPD(): Invalid interval %s, timeout %s or retries %d",
+			config.Interval, config.Timeout, config.Retries)
+	}
+	return &DPD{
+		ikesa:  ikesa,
+		config: config,
+		next:   now.Add(config.Interval),
+	}, nil
+}
+
+// Received records that a message of the peer is handled at now, which
+// postpones the next liveness check
+func (d *DPD) Received(now time.Time) {
+	d.checkAnswered()
+	if d.probe == nil {
+		d.next = now.Add(d.config.Interval)
+	}
+}
+
+// Next returns the time Poll is to be called at
+func (d *DPD) Next() time.Time {
+	return d.next
+}
+
+// Poll returns the message to send at now: a liveness check once nothing is
+// received from the peer for the interval, or the retransmission of the
+// unanswered one. Once the retransmissions are exhausted, the IKE SA is
+// deleted and ErrPeerDead is returned.
+func (d *DPD) Poll(now time.Time) ([]byte, error) {
+	if d.checkAnswered() {
+		d.next = now.Add(d.config.Interval)
+	}
+	if now.Before(d.next) {
+		return nil, nil
+	}
+
+	if d.probe != nil {
+		if d.sent > d.config.Retries {
+			d.probe = nil
+			d.ikesa.State = StateDeleted
+			return nil, ErrPeerDead
+		}
+		d.sent++
+		d.next = now.Add(d.config.Timeout)
+		return d.probe, nil
+	}
+
+	// The response to the request in progress shows the peer is alive
+	if d.ikesa.busy() {
+		d.next = now.Add(d.config.Interval)
+		return nil, nil
+	}
+	probe, err := d.ikesa.LivenessCheck()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Poll()")
+	}
+	d.probe, d.request, d.sent = probe, d.ikesa.informational, 1
+	d.next = now.Add(d.config.Timeout)
+	return probe, nil
+}
+
+// checkAnswered reports whether the response to the liveness check has just
+// been handled by the IKE SA
+func (d *DPD) checkAnswered() bool {
+	if d.probe == nil || d.ikesa.informational == d.request {
+		return false
+	}
+	d.probe, d.request = nil, nil
+	return true
+}
@@ -0,0 +1,136 @@
+package ikesa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDPD(t *testing.T) {
+	testcases := []struct {
+		description string
+		config      DPDConfig
+		expectErr   bool
+	}{
+		{
+			description: "Valid",
+			config:      DPDConfig{Interval: time.Minute, Timeout: time.Second, Retries: 3},
+		},
+		{
+			description: "No retransmission",
+			config:      DPDConfig{Interval: time.Minute, Timeout: time.Second},
+		},
+		{
+			description: "No interval",
+			config:      DPDConfig{Timeout: time.Second, Retries: 3},
+			expectErr:   true,
+		},
+		{
+			description: "No timeout",
+			config:      DPDConfig{Interval: time.Minute, Retries: 3},
+			expectErr:   true,
+		},
+		{
+			description: "Negative retries",
+			config:      DPDConfig{Interval: time.Minute, Timeout: time.Second, Retries: -1},
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := NewDPD(&IKESA{}, tc.config, time.Now())
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDPD(t *testing.T) {
+	config := DPDConfig{Interval: 30 * time.Second, Timeout: 2 * time.Second, Retries: 2}
+	start := time.Unix(1700000000, 0)
+
+	t.Run("Peer alive", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+		dpd, err := NewDPD(initiator, config, start)
+		require.NoError(t, err)
+		require.Equal(t, start.Add(config.Interval), dpd.Next())
+
+		// Messages of the peer postpone the liveness check
+		probe, err := dpd.Poll(start.Add(10 * time.Second))
+		require.NoError(t, err)
+		require.Nil(t, probe)
+		dpd.Received(start.Add(20 * time.Second))
+		require.Equal(t, start.Add(50*time.Second), dpd.Next())
+		probe, err = dpd.Poll(start.Add(40 * time.Second))
+		require.NoError(t, err)
+		require.Nil(t, probe)
+
+		now := dpd.Next()
+		probe, err = dpd.Poll(now)
+		require.NoError(t, err)
+		require.NotNil(t, probe)
+		require.Equal(t, now.Add(config.Timeout), dpd.Next())
+
+		// The response is lost, and the request retransmitted
+		now = dpd.Next()
+		retransmission, err := dpd.Poll(now)
+		require.NoError(t, err)
+		require.Equal(t, probe, retransmission)
+		response, _, err := responder.HandleMessage(probe)
+		require.NoError(t, err)
+		_, _, err = initiator.HandleMessage(response)
+		require.NoError(t, err)
+		dpd.Received(now.Add(time.Second))
+		require.Equal(t, now.Add(time.Second+config.Interval), dpd.Next())
+
+		// The next liveness check is a new request
+		now = dpd.Next()
+		next, err := dpd.Poll(now)
+		require.NoError(t, err)
+		require.NotNil(t, next)
+		require.NotEqual(t, probe, next)
+	})
+
+	t.Run("Request in progress", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, _ := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+		dpd, err := NewDPD(initiator, config, start)
+		require.NoError(t, err)
+
+		_, err = initiator.CreateChildSA(initiatorConfig.TSi, initiatorConfig.TSr)
+		require.NoError(t, err)
+		now := dpd.Next()
+		probe, err := dpd.Poll(now)
+		require.NoError(t, err)
+		require.Nil(t, probe)
+		require.Equal(t, now.Add(config.Interval), dpd.Next())
+	})
+
+	t.Run("Peer dead", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, _ := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+		dpd, err := NewDPD(initiator, config, start)
+		require.NoError(t, err)
+
+		var sent [][]byte
+		for i := 0; i <= config.Retries; i++ {
+			probe, pollErr := dpd.Poll(dpd.Next())
+			require.NoError(t, pollErr)
+			require.NotNil(t, probe)
+			sent = append(sent, probe)
+		}
+		require.Equal(t, sent[0], sent[config.Retries])
+
+		// Messages of the peer do not answer the liveness check
+		dpd.Received(dpd.Next().Add(-time.Second))
+		_, err = dpd.Poll(dpd.Next())
+		require.ErrorIs(t, err, ErrPeerDead)
+		require.Equal(t, StateDeleted, initiator.State)
+	})
+}
@@ -0,0 +1,122 @@
+package ikesa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+
+	ike "github.com/guoweifk/n3iwue_ike_gw"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+)
+
+const (
+	// Default length of the fragments, which fit in the IPv6 minimum MTU of
+	// 1280 octets with the IPv6 and UDP headers and the non-ESP marker
+	// (RFC 7383 - 2.5.1)
+	defaultFragmentLength = 1280 - 40 - 8 - 4
+	// Time the fragments of a message of the peer are kept until they are all
+	// received
+	fragmentTimeout = 30 * time.Second
+)
+
+// fragmentationOffered reports whether IKEV2_FRAGMENTATION_SUPPORTED is sent
+// in IKE_SA_INIT
+func (ikesa *IKESA) fragmentationOffered() bool {
+	return ikesa.config != nil && ikesa.config.FragmentLength >= 0
+}
+
+func (ikesa *IKESA) fragmentLength() int {
+	if ikesa.config == nil || ikesa.config.FragmentLength <= 0 {
+		return defaultFragmentLength
+	}
+	return ikesa.config.FragmentLength
+}
+
+// setFragmentation records whether both sides support IKE fragmentation, from
+// the IKE_SA_INIT message of the peer (RFC 7383 - 2.3)
+func (ikesa *IKESA) setFragmentation(payloads message.IKEPayloadContainer) {
+	ikesa.Fragmentation = ikesa.fragmentationOffered() &&
+		payloads.FindNotification(message.IKEV2_FRAGMENTATION_SUPPORTED) != nil
+}
+
+// encodeDatagrams encodes the message, and returns also its Encrypted
+// Fragment messages if it is to be fragmented. Every message after
+// IKE_SA_INIT longer than the fragment length is fragmented once both sides
+// support it (RFC 7383 - 2.5).
+func (ikesa *IKESA) encodeDatagrams(ikeMsg *message.IKEMessage) ([]byte, [][]byte, error) {
+	// The payloads are replaced by the SK payload once encoded
+	payloads := append(message.IKEPayloadContainer{}, ikeMsg.Payloads...)
+
+	var key *security.IKESAKey
+	if ikeMsg.ExchangeType != message.IKE_SA_INIT {
+		key = ikesa.Key
+	}
+	msg, err := ike.EncodeEncrypt(ikeMsg, key, ikesa.Role)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fragments [][]byte
+	if key != nil && ikesa.Fragmentation && len(msg) > ikesa.fragmentLength() {
+		fragmentMsg := &message.IKEMessage{IKEHeader: ikeMsg.IKEHeader, Payloads: payloads}
+		fragments, err = ike.EncodeEncryptFragments(fragmentMsg, key, ikesa.Role, ikesa.fragmentLength())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if ikeMsg.ExchangeType == message.IKE_SA_INIT {
+		if ikesa.Role == message.Role_Initiator {
+			ikesa.initRequest = msg
+		} else {
+			ikesa.initResponse = msg
+		}
+	}
+	if !ikeMsg.IsResponse() {
+		ikesa.outstanding = msg
+		ikesa.outstandingFragments = fragments
+	}
+	return msg, fragments, nil
+}
+
+// Datagrams returns the datagrams a message returned by the IKE SA is sent
+// in, which are its Encrypted Fragment messages if it is fragmented, or the
+// message itself. The fragments are kept for the retransmissions of the
+// message (RFC 7383 - 2.6.1).
+func (ikesa *IKESA) Datagrams(msg []byte) [][]byte {
+	if ikesa.outstandingFragments != nil && bytes.Equal(msg, ikesa.outstanding) {
+		return ikesa.outstandingFragments
+	}
+	for _, cached := range ikesa.responses {
+		if cached.fragments != nil && bytes.Equal(msg, cached.response) {
+			return cached.fragments
+		}
+	}
+	return [][]byte{msg}
+}
+
+// reassemble verifies an Encrypted Fragment message of the peer, and returns
+// the message once all its fragments are received, or nil before
+func (ikesa *IKESA) reassemble(msg []byte, ikeHeader *message.IKEHeader) (*message.IKEMessage, error) {
+	if !ikesa.Fragmentation {
+		return nil, errors.Errorf("reassemble(): IKE fragmentation is not negotiated")
+	}
+	if ikesa.reassembler == nil {
+		ikesa.reassembler = ike.NewReassembler(fragmentTimeout)
+	}
+	return ikesa.reassembler.DecodeDecryptFragment(msg, ikeHeader, ikesa.Key, ikesa.Role)
+}
+
+// fragmentNumber returns the Fragment Number of an Encrypted Fragment message,
+// or 0 if it is too short
+func fragmentNumber(msg []byte) uint16 {
+	// The Fragment Number follows the generic payload header
+	offset := message.IKE_HEADER_LEN + 4
+	if len(msg) < offset+2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(msg[offset : offset+2])
+}
@@ -0,0 +1,117 @@
+package ikesa
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// sendDatagrams passes the datagrams of msg from sender to receiver, and
+// returns the reply to the last one
+func sendDatagrams(t *testing.T, sender, receiver *IKESA, msg []byte) ([]byte, Event, error) {
+	datagrams := sender.Datagrams(msg)
+	for _, datagram := range datagrams[:len(datagrams)-1] {
+		reply, event, err := receiver.HandleMessage(datagram)
+		require.NoError(t, err)
+		require.Nil(t, reply)
+		require.Equal(t, EventNone, event)
+	}
+	return receiver.HandleMessage(datagrams[len(datagrams)-1])
+}
+
+func TestIKESAFragmentation(t *testing.T) {
+	const fragmentLength = 128
+	msk := bytes.Repeat([]byte{0x5a}, 64)
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiatorConfig.EAPPeer = &fakeEAPMethod{identity: []byte("user"), msk: msk}
+	responderConfig.EAPServer = &fakeEAPMethod{identity: []byte("user"), msk: msk}
+	initiatorConfig.FragmentLength = fragmentLength
+	responderConfig.FragmentLength = fragmentLength
+
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+
+	request, err := initiator.Initiate()
+	require.NoError(t, err)
+	require.Len(t, initiator.Datagrams(request), 1)
+	response, _, err := responder.HandleMessage(request)
+	require.NoError(t, err)
+	require.True(t, responder.Fragmentation)
+	require.Len(t, responder.Datagrams(response), 1)
+
+	// First IKE_AUTH request
+	request, _, err = initiator.HandleMessage(response)
+	require.NoError(t, err)
+	require.True(t, initiator.Fragmentation)
+	fragments := initiator.Datagrams(request)
+	require.Greater(t, len(fragments), 1)
+	for _, fragment := range fragments {
+		require.LessOrEqual(t, len(fragment), fragmentLength)
+		header, headerErr := message.ParseHeader(fragment)
+		require.NoError(t, headerErr)
+		require.Equal(t, uint8(message.TypeSKF), header.NextPayload)
+	}
+
+	response, event, err := sendDatagrams(t, initiator, responder, request)
+	require.NoError(t, err)
+	require.Equal(t, EventEAP, event)
+	require.Greater(t, len(responder.Datagrams(response)), 1)
+
+	// The response is sent again for the first fragment only
+	retransmitted, _, err := responder.HandleMessage(fragments[1])
+	require.NoError(t, err)
+	require.Nil(t, retransmitted)
+	retransmitted, _, err = responder.HandleMessage(fragments[0])
+	require.NoError(t, err)
+	require.Equal(t, response, retransmitted)
+
+	var initiatorEvent, responderEvent Event
+	for response != nil {
+		request, initiatorEvent, err = sendDatagrams(t, responder, initiator, response)
+		require.NoError(t, err)
+		if request == nil {
+			break
+		}
+		response, responderEvent, err = sendDatagrams(t, initiator, responder, request)
+		require.NoError(t, err)
+	}
+	require.Equal(t, EventEstablished, initiatorEvent)
+	require.Equal(t, EventEstablished, responderEvent)
+	requireChildSAPaired(t, initiator, responder)
+}
+
+func TestIKESAFragmentationNotNegotiated(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiatorConfig.FragmentLength = 128
+	responderConfig.FragmentLength = -1
+
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+
+	request, err := initiator.Initiate()
+	require.NoError(t, err)
+	response, _, err := responder.HandleMessage(request)
+	require.NoError(t, err)
+	require.False(t, responder.Fragmentation)
+	responseMsg := new(message.IKEMessage)
+	require.NoError(t, responseMsg.Decode(response))
+	require.Nil(t, responseMsg.Payloads.FindNotification(message.IKEV2_FRAGMENTATION_SUPPORTED))
+
+	request, _, err = initiator.HandleMessage(response)
+	require.NoError(t, err)
+	require.False(t, initiator.Fragmentation)
+	require.Greater(t, len(request), 128)
+	require.Equal(t, [][]byte{request}, initiator.Datagrams(request))
+
+	initiatorEvent, responderEvent, err := continueExchanges(request, initiator, responder)
+	require.NoError(t, err)
+	require.Equal(t, EventEstablished, initiatorEvent)
+	require.Equal(t, EventEstablished, responderEvent)
+}
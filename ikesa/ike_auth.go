@@ -0,0 +1,424 @@
+package ikesa
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+)
+
+// childSARequest is the Child SA carried by the first IKE_AUTH request
+type childSARequest struct {
+	inboundSPI uint32 // initiator only
+	sa         *message.SecurityAssociation
+	tsi        message.IndividualTrafficSelectorContainer
+	tsr        message.IndividualTrafficSelectorContainer
+}
+
+// ikeAuthPayloads collects the payloads of an IKE_AUTH message
+type ikeAuthPayloads struct {
+	idi           *message.IdentificationInitiator
+	idr           *message.IdentificationResponder
+	auth          *message.Authentication
+	eap           *eap_message.EAP
+	sa            *message.SecurityAssociation
+	tsi           *message.TrafficSelectorInitiator
+	tsr           *message.TrafficSelectorResponder
+	notifications []*message.Notification
+}
+
+func parseIKEAuthPayloads(ikeMsg *message.IKEMessage) *ikeAuthPayloads {
+	p := new(ikeAuthPayloads)
+	for _, payload := range ikeMsg.Payloads {
+		switch payload := payload.(type) {
+		case *message.IdentificationInitiator:
+			p.idi = payload
+		case *message.IdentificationResponder:
+			p.idr = payload
+		case *message.Authentication:
+			p.auth = payload
+		case *message.PayloadEap:
+			p.eap = payload.EAP
+		case *message.SecurityAssociation:
+			p.sa = payload
+		case *message.TrafficSelectorInitiator:
+			p.tsi = payload
+		case *message.TrafficSelectorResponder:
+			p.tsr = payload
+		case *message.Notification:
+			p.notifications = append(p.notifications, payload)
+		}
+	}
+	return p
+}
+
+// Error notifications which only fail the Child SA of IKE_AUTH (RFC 7296 - 1.2)
+var childSAErrors = map[uint16]bool{
+	message.NO_PROPOSAL_CHOSEN:       true,
+	message.SINGLE_PAIR_REQUIRED:     true,
+	message.INTERNAL_ADDRESS_FAILURE: true,
+	message.FAILED_CP_REQUIRED:       true,
+	message.TS_UNACCEPTABLE:          true,
+}
+
+// buildIKEAuthRequest returns the first IKE_AUTH request. The AUTH payload is
+// omitted when authenticating with EAP.
+func (ikesa *IKESA) buildIKEAuthRequest() (*message.IKEMessage, error) {
+	if len(ikesa.config.ChildPolicy) == 0 {
+		return nil, errors.Errorf("buildIKEAuthRequest(): No Child SA policy")
+	}
+	inboundSPI, err := ikesa.config.newChildSPI()
+	if err != nil {
+		return nil, errors.Wrapf(err, "buildIKEAuthRequest()")
+	}
+	spi := make([]byte, 4)
+	binary.BigEndian.PutUint32(spi, inboundSPI)
+
+	var payloads message.IKEPayloadContainer
+	payloads.BuildIdentificationInitiator(ikesa.config.LocalIDType, ikesa.config.LocalID)
+	if len(ikesa.config.RemoteID) != 0 {
+		payloads.BuildIdentificationResponder(ikesa.config.RemoteIDType, ikesa.config.RemoteID)
+	}
+	if ikesa.config.EAPPeer == nil {
+		if err = ikesa.buildAuthentication(&payloads); err != nil {
+			return nil, errors.Wrapf(err, "buildIKEAuthRequest()")
+		}
+	}
+
+	sa := payloads.BuildSecurityAssociation()
+	for i, suite := range ikesa.authChildPolicy() {
+		proposal, proposalErr := suite.ToProposal(uint8(i+1), spi)
+		if proposalErr != nil {
+			return nil, errors.Wrapf(proposalErr, "buildIKEAuthRequest()")
+		}
+		sa.Proposals = append(sa.Proposals, proposal)
+	}
+	payloads.BuildTrafficSelectorInitiator().TrafficSelectors = ikesa.config.TSi
+	payloads.BuildTrafficSelectorResponder().TrafficSelectors = ikesa.config.TSr
+	ikesa.buildWindowSize(&payloads)
+
+	ikesa.childSARequest = &childSARequest{
+		inboundSPI: inboundSPI,
+		sa:         sa,
+		tsi:        ikesa.config.TSi,
+		tsr:        ikesa.config.TSr,
+	}
+	return ikesa.newRequest(message.IKE_AUTH, payloads), nil
+}
+
+func (ikesa *IKESA) handleIKEAuthResponse(response *message.IKEMessage) (*message.IKEMessage, Event, error) {
+	p := parseIKEAuthPayloads(response)
+
+	var childSAError uint16
+	for _, notification := range p.notifications {
+		if notification.NotifyMessageType >= message.INITIAL_CONTACT {
+			continue
+		}
+		if !childSAErrors[notification.NotifyMessageType] {
+			return nil, EventFailed, errors.Errorf("handleIKEAuthResponse(): Error notification %d",
+				notification.NotifyMessageType)
+		}
+		childSAError = notification.NotifyMessageType
+	}
+
+	// The responder authenticates itself in its first response, even with EAP
+	if p.auth != nil && !ikesa.eapSuccess {
+		if p.idr == nil {
+			return ikesa.errorRequest(message.INVALID_SYNTAX), EventFailed,
+				errors.Errorf("handleIKEAuthResponse(): Missing IDr payload")
+		}
+		if err := ikesa.checkRemoteID(p.idr.IDType, p.idr.IDData); err != nil {
+			return ikesa.errorRequest(message.AUTHENTICATION_FAILED), EventFailed,
+				errors.Wrapf(err, "handleIKEAuthResponse()")
+		}
+		if err := ikesa.verifyAuthentication(p.auth, p.idr.IDType, p.idr.IDData); err != nil {
+			return ikesa.errorRequest(message.AUTHENTICATION_FAILED), EventFailed,
+				errors.Wrapf(err, "handleIKEAuthResponse()")
+		}
+		ikesa.peerIDType, ikesa.peerID = p.idr.IDType, append([]byte{}, p.idr.IDData...)
+		if err := ikesa.setPeerWindowSize(p.notifications); err != nil {
+			return ikesa.errorRequest(message.INVALID_SYNTAX), EventFailed,
+				errors.Wrapf(err, "handleIKEAuthResponse()")
+		}
+	} else if ikesa.peerID == nil {
+		return ikesa.errorRequest(message.INVALID_SYNTAX), EventFailed,
+			errors.Errorf("handleIKEAuthResponse(): Missing AUTH payload")
+	}
+
+	if p.eap != nil {
+		return ikesa.handleEAPRequest(p.eap)
+	}
+
+	if ikesa.config.EAPPeer != nil {
+		// The last response carries the AUTH payload computed with the MSK
+		if !ikesa.eapSuccess {
+			return ikesa.errorRequest(message.INVALID_SYNTAX), EventFailed,
+				errors.Errorf("handleIKEAuthResponse(): Missing EAP payload")
+		}
+		if err := ikesa.verifyAuthentication(p.auth, ikesa.peerIDType, ikesa.peerID); err != nil {
+			return ikesa.errorRequest(message.AUTHENTICATION_FAILED), EventFailed,
+				errors.Wrapf(err, "handleIKEAuthResponse()")
+		}
+	}
+
+	if childSAError == 0 {
+		if err := ikesa.completeChildSA(p); err != nil {
+			return nil, EventFailed, errors.Wrapf(err, "handleIKEAuthResponse()")
+		}
+	}
+	ikesa.childSARequest = nil
+	ikesa.State = StateEstablished
+	if childSAError != 0 {
+		return nil, EventEstablished, errors.Errorf("handleIKEAuthResponse(): Child SA is not created: notification %d",
+			childSAError)
+	}
+	return nil, EventEstablished, nil
+}
+
+// handleEAPRequest answers an EAP request of the responder, or sends the AUTH
+// payload computed with the MSK after EAP Success
+func (ikesa *IKESA) handleEAPRequest(eap *eap_message.EAP) (*message.IKEMessage, Event, error) {
+	if ikesa.config.EAPPeer == nil {
+		return nil, EventFailed, errors.Errorf("handleEAPRequest(): EAP is not configured")
+	}
+
+	var payloads message.IKEPayloadContainer
+	switch eap.Code {
+	case eap_message.EapCodeRequest:
+		eapResponse, err := ikesa.config.EAPPeer.HandleRequest(eap)
+		if err != nil {
+			return nil, EventFailed, errors.Wrapf(err, "handleEAPRequest()")
+		}
+		payloads = append(payloads, &message.PayloadEap{EAP: eapResponse})
+	case eap_message.EapCodeSuccess:
+		ikesa.eapSuccess = true
+		ikesa.msk = ikesa.config.EAPPeer.MSK()
+		if err := ikesa.buildAuthentication(&payloads); err != nil {
+			return nil, EventFailed, errors.Wrapf(err, "handleEAPRequest()")
+		}
+	default:
+		return nil, EventFailed, errors.Errorf("handleEAPRequest(): EAP failure")
+	}
+	return ikesa.newRequest(message.IKE_AUTH, payloads), EventEAP, nil
+}
+
+func (ikesa *IKESA) handleIKEAuthRequest(request *message.IKEMessage) (*message.IKEMessage, Event, error) {
+	p := parseIKEAuthPayloads(request)
+	if p.idi == nil || p.sa == nil || p.tsi == nil || p.tsr == nil {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventFailed,
+			errors.Errorf("handleIKEAuthRequest(): Missing IDi, SA, TSi or TSr payload")
+	}
+	if err := ikesa.checkRemoteID(p.idi.IDType, p.idi.IDData); err != nil {
+		return ikesa.errorNotify(request, message.AUTHENTICATION_FAILED), EventFailed,
+			errors.Wrapf(err, "handleIKEAuthRequest()")
+	}
+	ikesa.peerIDType, ikesa.peerID = p.idi.IDType, append([]byte{}, p.idi.IDData...)
+	if err := ikesa.setPeerWindowSize(p.notifications); err != nil {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventFailed,
+			errors.Wrapf(err, "handleIKEAuthRequest()")
+	}
+	ikesa.childSARequest = &childSARequest{
+		sa:  p.sa,
+		tsi: p.tsi.TrafficSelectors,
+		tsr: p.tsr.TrafficSelectors,
+	}
+
+	var payloads message.IKEPayloadContainer
+	payloads.BuildIdentificationResponder(ikesa.config.LocalIDType, ikesa.config.LocalID)
+	if err := ikesa.buildAuthentication(&payloads); err != nil {
+		return ikesa.errorNotify(request, message.AUTHENTICATION_FAILED), EventFailed,
+			errors.Wrapf(err, "handleIKEAuthRequest()")
+	}
+	ikesa.buildWindowSize(&payloads)
+
+	if p.auth == nil {
+		// Without AUTH payload, the initiator asks for EAP (RFC 7296 - 2.16)
+		if ikesa.config.EAPServer == nil {
+			return ikesa.errorNotify(request, message.AUTHENTICATION_FAILED), EventFailed,
+				errors.Errorf("handleIKEAuthRequest(): Missing AUTH payload")
+		}
+		eapRequest, err := ikesa.config.EAPServer.Start(p.idi)
+		if err != nil {
+			return ikesa.errorNotify(request, message.AUTHENTICATION_FAILED), EventFailed,
+				errors.Wrapf(err, "handleIKEAuthRequest()")
+		}
+		payloads = append(payloads, &message.PayloadEap{EAP: eapRequest})
+		ikesa.State = StateEAP
+		return ikesa.newResponse(request, payloads), EventEAP, nil
+	}
+
+	if err := ikesa.verifyAuthentication(p.auth, ikesa.peerIDType, ikesa.peerID); err != nil {
+		return ikesa.errorNotify(request, message.AUTHENTICATION_FAILED), EventFailed,
+			errors.Wrapf(err, "handleIKEAuthRequest()")
+	}
+	return ikesa.establish(request, payloads)
+}
+
+func (ikesa *IKESA) handleIKEAuthEAPRequest(request *message.IKEMessage) (*message.IKEMessage, Event, error) {
+	p := parseIKEAuthPayloads(request)
+
+	if ikesa.eapSuccess {
+		// The last request carries the AUTH payload computed with the MSK
+		if err := ikesa.verifyAuthentication(p.auth, ikesa.peerIDType, ikesa.peerID); err != nil {
+			return ikesa.errorNotify(request, message.AUTHENTICATION_FAILED), EventFailed,
+				errors.Wrapf(err, "handleIKEAuthEAPRequest()")
+		}
+		var payloads message.IKEPayloadContainer
+		if err := ikesa.buildAuthentication(&payloads); err != nil {
+			return ikesa.errorNotify(request, message.AUTHENTICATION_FAILED), EventFailed,
+				errors.Wrapf(err, "handleIKEAuthEAPRequest()")
+		}
+		return ikesa.establish(request, payloads)
+	}
+
+	if p.eap == nil {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventFailed,
+			errors.Errorf("handleIKEAuthEAPRequest(): Missing EAP payload")
+	}
+	eapRequest, err := ikesa.config.EAPServer.HandleResponse(p.eap)
+	if err != nil {
+		return ikesa.errorNotify(request, message.AUTHENTICATION_FAILED), EventFailed,
+			errors.Wrapf(err, "handleIKEAuthEAPRequest()")
+	}
+
+	var payloads message.IKEPayloadContainer
+	payloads = append(payloads, &message.PayloadEap{EAP: eapRequest})
+	switch eapRequest.Code {
+	case eap_message.EapCodeRequest:
+	case eap_message.EapCodeSuccess:
+		ikesa.eapSuccess = true
+		ikesa.msk = ikesa.config.EAPServer.MSK()
+	default:
+		return ikesa.newResponse(request, payloads), EventFailed,
+			errors.Errorf("handleIKEAuthEAPRequest(): EAP failure")
+	}
+	return ikesa.newResponse(request, payloads), EventEAP, nil
+}
+
+// establish answers the last IKE_AUTH request with the Child SA
+func (ikesa *IKESA) establish(
+	request *message.IKEMessage, payloads message.IKEPayloadContainer,
+) (*message.IKEMessage, Event, error) {
+	err := ikesa.respondChildSA(&payloads)
+	ikesa.childSARequest = nil
+	if err != nil {
+		return ikesa.errorNotify(request, message.NO_PROPOSAL_CHOSEN), EventFailed,
+			errors.Wrapf(err, "establish()")
+	}
+	ikesa.State = StateEstablished
+	return ikesa.newResponse(request, payloads), EventEstablished, nil
+}
+
+// authChildPolicy returns the Child SA policy without PFS, since the Child SA
+// of IKE_AUTH uses the keys of IKE_SA_INIT (RFC 7296 - 1.2)
+func (ikesa *IKESA) authChildPolicy() []*security.ChildSASuite {
+	policy := make([]*security.ChildSASuite, 0, len(ikesa.config.ChildPolicy))
+	for _, suite := range ikesa.config.ChildPolicy {
+		withoutDH := *suite
+		withoutDH.DhInfo = nil
+		policy = append(policy, &withoutDH)
+	}
+	return policy
+}
+
+// respondChildSA selects the Child SA requested in IKE_AUTH, and appends the
+// payloads of the response. The Child SA failing to be negotiated is reported
+// in a notification and does not fail the IKE SA.
+func (ikesa *IKESA) respondChildSA(payloads *message.IKEPayloadContainer) error {
+	request := ikesa.childSARequest
+	if request == nil {
+		return errors.Errorf("respondChildSA(): No Child SA requested")
+	}
+
+	// KE payload is not sent in IKE_AUTH, so the groups proposed are ignored
+	sa := &message.SecurityAssociation{}
+	for _, proposal := range request.sa.Proposals {
+		withoutDH := *proposal
+		withoutDH.DiffieHellmanGroup = nil
+		sa.Proposals = append(sa.Proposals, &withoutDH)
+	}
+
+	chosen, err := security.SelectChildSAProposal(ikesa.authChildPolicy(), sa, message.DH_NONE)
+	if err != nil {
+		var proposalErr *security.ProposalError
+		if errors.As(err, &proposalErr) {
+			proposalErr.BuildNotification(payloads)
+			return nil
+		}
+		return errors.Wrapf(err, "respondChildSA()")
+	}
+
+	childSA, err := ikesa.newChildSA(chosen, request.tsi, request.tsr, ikesa.Role, nil, ikesa.concatenatedNonce())
+	if err != nil {
+		return errors.Wrapf(err, "respondChildSA()")
+	}
+	childSA.OutboundSPI = binary.BigEndian.Uint32(chosen.SPI)
+	if childSA.InboundSPI, err = ikesa.config.newChildSPI(); err != nil {
+		return errors.Wrapf(err, "respondChildSA()")
+	}
+	childSA.Key.SPI = childSA.InboundSPI
+	chosen.SPI = make([]byte, 4)
+	binary.BigEndian.PutUint32(chosen.SPI, childSA.InboundSPI)
+
+	payloads.BuildSecurityAssociation().Proposals = append(message.ProposalContainer{}, chosen)
+	payloads.BuildTrafficSelectorInitiator().TrafficSelectors = childSA.TSi
+	payloads.BuildTrafficSelectorResponder().TrafficSelectors = childSA.TSr
+	ikesa.ChildSAs = append(ikesa.ChildSAs, childSA)
+	return nil
+}
+
+// completeChildSA sets up the Child SA accepted in the last IKE_AUTH response
+func (ikesa *IKESA) completeChildSA(p *ikeAuthPayloads) error {
+	request := ikesa.childSARequest
+	if request == nil {
+		return errors.Errorf("completeChildSA(): No Child SA requested")
+	}
+	if p.sa == nil || p.tsi == nil || p.tsr == nil {
+		return errors.Errorf("completeChildSA(): Missing SA, TSi or TSr payload")
+	}
+	if len(p.sa.Proposals) != 1 {
+		return errors.Errorf("completeChildSA(): Expect one proposal, got %d", len(p.sa.Proposals))
+	}
+
+	// The responder must choose one of the suites offered
+	chosen, err := security.SelectChildSAProposal(ikesa.authChildPolicy(), p.sa, message.DH_NONE)
+	if err != nil {
+		return errors.Wrapf(err, "completeChildSA()")
+	}
+
+	childSA, err := ikesa.newChildSA(chosen, p.tsi.TrafficSelectors, p.tsr.TrafficSelectors,
+		ikesa.Role, nil, ikesa.concatenatedNonce())
+	if err != nil {
+		return errors.Wrapf(err, "completeChildSA()")
+	}
+	childSA.InboundSPI = request.inboundSPI
+	childSA.OutboundSPI = binary.BigEndian.Uint32(chosen.SPI)
+	childSA.Key.SPI = childSA.InboundSPI
+	ikesa.ChildSAs = append(ikesa.ChildSAs, childSA)
+	return nil
+}
+
+// newChildSA derives the keys of the Child SA of proposal from SK_d, the
+// nonces of the exchange and, with PFS, the shared key of its KE payloads
+func (ikesa *IKESA) newChildSA(
+	proposal *message.Proposal, tsi, tsr message.IndividualTrafficSelectorContainer,
+	role message.Role, sharedKey, concatenatedNonce []byte,
+) (*ChildSA, error) {
+	key, err := security.NewChildSAKeyByProposal(proposal)
+	if err != nil {
+		return nil, errors.Wrapf(err, "newChildSA()")
+	}
+	if err = key.GenerateKeyForChildSAWithPFS(ikesa.Key, sharedKey, concatenatedNonce); err != nil {
+		return nil, errors.Wrapf(err, "newChildSA()")
+	}
+	return &ChildSA{
+		Key:               key,
+		Role:              role,
+		TSi:               tsi,
+		TSr:               tsr,
+		EnableEncapsulate: ikesa.NAT.Detected(),
+	}, nil
+}
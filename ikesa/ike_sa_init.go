@@ -0,0 +1,280 @@
+package ikesa
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/cookie"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/nat"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+	"github.com/guoweifk/n3iwue_ike_gw/security/dh"
+)
+
+// buildIKESAInitRequest offers every suite of the policy, with a KE payload
+// of the given group
+func (ikesa *IKESA) buildIKESAInitRequest(dhType dh.DHType) (*message.IKEMessage, error) {
+	// The nonce is kept when IKE_SA_INIT is sent again, since the cookie of
+	// the responder covers it (RFC 7296 - 2.6)
+	var err error
+	if ikesa.NonceInitiator == nil {
+		if ikesa.NonceInitiator, err = randomNonce(); err != nil {
+			return nil, err
+		}
+	}
+	if ikesa.dhSecret, err = dh.GenerateSecret(dhType); err != nil {
+		return nil, err
+	}
+	ikesa.dhType = dhType
+	publicValue, err := dhType.GetPublicValue(ikesa.dhSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	var payloads message.IKEPayloadContainer
+	// The cookie of the responder is still sent after INVALID_KE_PAYLOAD
+	if ikesa.cookie != nil {
+		payloads.BuildNotification(message.TypeNone, message.COOKIE, nil, ikesa.cookie)
+	}
+	sa := payloads.BuildSecurityAssociation()
+	for i, suite := range ikesa.config.IKEPolicy {
+		proposal, proposalErr := suite.ToProposal(uint8(i+1), nil)
+		if proposalErr != nil {
+			return nil, proposalErr
+		}
+		sa.Proposals = append(sa.Proposals, proposal)
+	}
+	payloads.BuildKeyExchange(dhType.TransformID(), publicValue)
+	payloads.BuildNonce(ikesa.NonceInitiator)
+	if ikesa.natDetection() {
+		nat.BuildDetection(&payloads, ikesa.InitiatorSPI, 0, ikesa.LocalAddr, ikesa.RemoteAddr)
+	}
+	if ikesa.fragmentationOffered() {
+		payloads.BuildNotifyIKEV2_FRAGMENTATION_SUPPORTED()
+	}
+
+	ikesa.localMessageID = 0
+	return ikesa.newRequest(message.IKE_SA_INIT, payloads), nil
+}
+
+func (ikesa *IKESA) handleIKESAInitRequest(request *message.IKEMessage) (*message.IKEMessage, Event, error) {
+	ikesa.InitiatorSPI = request.InitiatorSPI
+
+	var sa *message.SecurityAssociation
+	var ke *message.KeyExchange
+	var nonce *message.Nonce
+	for _, payload := range request.Payloads {
+		switch payload := payload.(type) {
+		case *message.SecurityAssociation:
+			sa = payload
+		case *message.KeyExchange:
+			ke = payload
+		case *message.Nonce:
+			nonce = payload
+		}
+	}
+	if sa == nil || ke == nil || nonce == nil {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventFailed,
+			errors.Errorf("handleIKESAInitRequest(): Missing SA, KE or Nonce payload")
+	}
+
+	if ikesa.natDetection() {
+		natResult, natErr := nat.CheckDetection(request.Payloads, request.InitiatorSPI, request.ResponderSPI,
+			ikesa.LocalAddr, ikesa.RemoteAddr)
+		if natErr != nil {
+			return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventFailed,
+				errors.Wrapf(natErr, "handleIKESAInitRequest()")
+		}
+		ikesa.NAT = natResult
+	}
+
+	chosen, err := security.SelectIKESAProposal(ikesa.config.IKEPolicy, sa, ke.DiffieHellmanGroup)
+	if err != nil {
+		var proposalErr *security.ProposalError
+		if errors.As(err, &proposalErr) {
+			var payloads message.IKEPayloadContainer
+			proposalErr.BuildNotification(&payloads)
+			return ikesa.newResponse(request, payloads), EventFailed,
+				errors.Wrapf(err, "handleIKESAInitRequest()")
+		}
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitRequest()")
+	}
+
+	if ikesa.Key, err = security.NewIKESAKeyByProposal(chosen); err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitRequest()")
+	}
+	if ikesa.ResponderSPI, err = ikesa.config.newSPI(); err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitRequest()")
+	}
+	ikesa.NonceInitiator = append([]byte{}, nonce.NonceData...)
+	if ikesa.NonceResponder, err = randomNonce(); err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitRequest()")
+	}
+
+	secret, err := dh.GenerateSecret(ikesa.Key.DhInfo)
+	if err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitRequest()")
+	}
+	publicValue, err := ikesa.Key.DhInfo.GetPublicValue(secret)
+	if err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitRequest()")
+	}
+	sharedKey, err := ikesa.Key.DhInfo.GetSharedKey(secret, ke.KeyExchangeData)
+	if err != nil {
+		return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventFailed,
+			errors.Wrapf(err, "handleIKESAInitRequest()")
+	}
+	err = ikesa.Key.GenerateKeyForIKESAByNonces(ikesa.NonceInitiator, ikesa.NonceResponder,
+		sharedKey, ikesa.InitiatorSPI, ikesa.ResponderSPI)
+	if err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitRequest()")
+	}
+
+	var payloads message.IKEPayloadContainer
+	payloads.BuildSecurityAssociation().Proposals = append(message.ProposalContainer{}, chosen)
+	payloads.BuildKeyExchange(ikesa.Key.DhInfo.TransformID(), publicValue)
+	payloads.BuildNonce(ikesa.NonceResponder)
+	if ikesa.NAT.Supported {
+		nat.BuildDetection(&payloads, ikesa.InitiatorSPI, ikesa.ResponderSPI, ikesa.LocalAddr, ikesa.RemoteAddr)
+	}
+	// Fragmentation support is only sent back to an initiator supporting it
+	ikesa.setFragmentation(request.Payloads)
+	if ikesa.Fragmentation {
+		payloads.BuildNotifyIKEV2_FRAGMENTATION_SUPPORTED()
+	}
+
+	ikesa.State = StateIKESAInitDone
+	return ikesa.newResponse(request, payloads), EventNone, nil
+}
+
+func (ikesa *IKESA) handleIKESAInitResponse(response *message.IKEMessage) (*message.IKEMessage, Event, error) {
+	var sa *message.SecurityAssociation
+	var ke *message.KeyExchange
+	var nonce *message.Nonce
+	for _, payload := range response.Payloads {
+		switch payload := payload.(type) {
+		case *message.SecurityAssociation:
+			sa = payload
+		case *message.KeyExchange:
+			ke = payload
+		case *message.Nonce:
+			nonce = payload
+		case *message.Notification:
+			if payload.NotifyMessageType == message.COOKIE {
+				return ikesa.retryIKESAInitWithCookie(payload)
+			}
+			if payload.NotifyMessageType == message.INVALID_KE_PAYLOAD {
+				return ikesa.retryIKESAInit(payload)
+			}
+			if payload.NotifyMessageType < message.INITIAL_CONTACT {
+				return nil, EventFailed, errors.Errorf("handleIKESAInitResponse(): Error notification %d",
+					payload.NotifyMessageType)
+			}
+		}
+	}
+	if sa == nil || ke == nil || nonce == nil {
+		return nil, EventFailed, errors.Errorf("handleIKESAInitResponse(): Missing SA, KE or Nonce payload")
+	}
+	if len(sa.Proposals) != 1 {
+		return nil, EventFailed, errors.Errorf("handleIKESAInitResponse(): Expect one proposal, got %d",
+			len(sa.Proposals))
+	}
+
+	// The responder must choose one of the suites offered
+	chosen, err := security.SelectIKESAProposal(ikesa.config.IKEPolicy, sa, ke.DiffieHellmanGroup)
+	if err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitResponse()")
+	}
+	if ke.DiffieHellmanGroup != ikesa.dhType.TransformID() {
+		return nil, EventFailed, errors.Errorf("handleIKESAInitResponse(): Unexpected Diffie-Hellman group %d",
+			ke.DiffieHellmanGroup)
+	}
+
+	if ikesa.Key, err = security.NewIKESAKeyByProposal(chosen); err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitResponse()")
+	}
+	if ikesa.natDetection() {
+		if ikesa.NAT, err = nat.CheckDetection(response.Payloads, response.InitiatorSPI, response.ResponderSPI,
+			ikesa.LocalAddr, ikesa.RemoteAddr); err != nil {
+			return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitResponse()")
+		}
+		// IKE_AUTH is sent between the NAT-T ports (RFC 7296 - 2.23)
+		if ikesa.NAT.Detected() {
+			ikesa.LocalAddr = netip.AddrPortFrom(ikesa.LocalAddr.Addr(), nat.NATTPort)
+			ikesa.RemoteAddr = netip.AddrPortFrom(ikesa.RemoteAddr.Addr(), nat.NATTPort)
+		}
+	}
+	ikesa.ResponderSPI = response.ResponderSPI
+	ikesa.NonceResponder = append([]byte{}, nonce.NonceData...)
+	ikesa.setFragmentation(response.Payloads)
+
+	sharedKey, err := ikesa.dhType.GetSharedKey(ikesa.dhSecret, ke.KeyExchangeData)
+	if err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitResponse()")
+	}
+	ikesa.dhSecret = nil
+	err = ikesa.Key.GenerateKeyForIKESAByNonces(ikesa.NonceInitiator, ikesa.NonceResponder,
+		sharedKey, ikesa.InitiatorSPI, ikesa.ResponderSPI)
+	if err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitResponse()")
+	}
+
+	request, err := ikesa.buildIKEAuthRequest()
+	if err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "handleIKESAInitResponse()")
+	}
+	ikesa.State = StateIKEAuthSent
+	return request, EventNone, nil
+}
+
+// retryIKESAInit sends IKE_SA_INIT again with the group asked for by the
+// responder (RFC 7296 - 1.2)
+func (ikesa *IKESA) retryIKESAInit(notification *message.Notification) (*message.IKEMessage, Event, error) {
+	if len(notification.NotificationData) != 2 {
+		return nil, EventFailed, errors.Errorf("retryIKESAInit(): Invalid INVALID_KE_PAYLOAD notification")
+	}
+	group := binary.BigEndian.Uint16(notification.NotificationData)
+	if group == ikesa.dhType.TransformID() {
+		return nil, EventFailed, errors.Errorf("retryIKESAInit(): Group %d is asked for again", group)
+	}
+
+	for _, suite := range ikesa.config.IKEPolicy {
+		if suite.DhInfo.TransformID() != group {
+			continue
+		}
+		request, err := ikesa.buildIKESAInitRequest(suite.DhInfo)
+		if err != nil {
+			return nil, EventFailed, errors.Wrapf(err, "retryIKESAInit()")
+		}
+		return request, EventNone, nil
+	}
+	return nil, EventFailed, errors.Errorf("retryIKESAInit(): Group %d is not acceptable", group)
+}
+
+// retryIKESAInitWithCookie sends IKE_SA_INIT again with the cookie of the
+// responder as the first payload, and the other payloads unchanged
+// (RFC 7296 - 2.6)
+func (ikesa *IKESA) retryIKESAInitWithCookie(
+	notification *message.Notification,
+) (*message.IKEMessage, Event, error) {
+	previous := new(message.IKEMessage)
+	if err := previous.Decode(ikesa.initRequest); err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "retryIKESAInitWithCookie()")
+	}
+	payloads, err := cookie.WithCookie(previous.Payloads, notification.NotificationData)
+	if err != nil {
+		return nil, EventFailed, errors.Wrapf(err, "retryIKESAInitWithCookie()")
+	}
+
+	ikesa.cookie = append([]byte{}, notification.NotificationData...)
+	ikesa.localMessageID = 0
+	return ikesa.newRequest(message.IKE_SA_INIT, payloads), EventNone, nil
+}
+
+// natDetection reports whether the addresses of the IKE SA are known for NAT
+// detection
+func (ikesa *IKESA) natDetection() bool {
+	return ikesa.LocalAddr.IsValid() && ikesa.RemoteAddr.IsValid()
+}
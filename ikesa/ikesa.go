@@ -0,0 +1,573 @@
+package ikesa
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net/netip"
+
+	"github.com/pkg/errors"
+
+	ike "github.com/guoweifk/n3iwue_ike_gw"
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/nat"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+	"github.com/guoweifk/n3iwue_ike_gw/security/dh"
+)
+
+// Length of the nonces sent by this implementation, which covers half of the
+// key size of every supported PRF (RFC 7296 - 2.10)
+const nonceLength = 32
+
+type State int
+
+const (
+	StateIdle          State = iota
+	StateIKESAInitSent       // initiator: waiting for the IKE_SA_INIT response
+	StateIKESAInitDone       // responder: waiting for the first IKE_AUTH request
+	StateIKEAuthSent         // initiator: waiting for an IKE_AUTH response
+	StateEAP                 // responder: EAP rounds of IKE_AUTH
+	StateEstablished
+	StateRekeyed // replaced by its Successor, or redundant, waiting for its deletion
+	StateDeleted
+)
+
+var stateString = map[State]string{
+	StateIdle:          "Idle",
+	StateIKESAInitSent: "IKE_SA_INIT sent",
+	StateIKESAInitDone: "IKE_SA_INIT done",
+	StateIKEAuthSent:   "IKE_AUTH sent",
+	StateEAP:           "EAP",
+	StateEstablished:   "Established",
+	StateRekeyed:       "Rekeyed",
+	StateDeleted:       "Deleted",
+}
+
+func (s State) String() string {
+	if str, ok := stateString[s]; ok {
+		return str
+	}
+	return "Unknown"
+}
+
+// Event reports what a handled message changed in the IKE SA
+type Event int
+
+const (
+	EventNone           Event = iota
+	EventEAP                  // an EAP round has been done
+	EventEstablished          // the IKE SA and the Child SA of IKE_AUTH are set up
+	EventDeleted              // the IKE SA is deleted
+	EventFailed               // the IKE SA can not be set up, see the returned error
+	EventChildSACreated       // a Child SA is created, the last of ChildSAs
+	EventChildSARekeyed       // a Child SA is rekeyed, the new one is the last of ChildSAs
+	EventIKESARekeyed         // the IKE SA is replaced by its Successor
+	EventChildSADeleted       // Child SAs are deleted, see DeletedChildSAs
+)
+
+var eventString = map[Event]string{
+	EventNone:           "None",
+	EventEAP:            "EAP",
+	EventEstablished:    "Established",
+	EventDeleted:        "Deleted",
+	EventFailed:         "Failed",
+	EventChildSACreated: "Child SA created",
+	EventChildSARekeyed: "Child SA rekeyed",
+	EventIKESARekeyed:   "IKE SA rekeyed",
+	EventChildSADeleted: "Child SA deleted",
+}
+
+func (e Event) String() string {
+	if str, ok := eventString[e]; ok {
+		return str
+	}
+	return "Unknown"
+}
+
+// EAPPeer runs the EAP method of the initiator
+type EAPPeer interface {
+	// HandleRequest returns the EAP response to an EAP request
+	HandleRequest(request *eap_message.EAP) (*eap_message.EAP, error)
+	// MSK returns the master session key after EAP success, or nil if the
+	// method does not generate one
+	MSK() []byte
+}
+
+// EAPServer runs the EAP method of the responder
+type EAPServer interface {
+	// Start returns the first EAP request to the initiator
+	Start(identity *message.IdentificationInitiator) (*eap_message.EAP, error)
+	// HandleResponse returns the next EAP request, or the EAP Success or EAP
+	// Failure ending the method
+	HandleResponse(response *eap_message.EAP) (*eap_message.EAP, error)
+	// MSK returns the master session key after EAP success, or nil if the
+	// method does not generate one
+	MSK() []byte
+}
+
+type Config struct {
+	// Acceptable transforms, in order of preference
+	IKEPolicy   []*security.IKESASuite
+	ChildPolicy []*security.ChildSASuite
+
+	LocalIDType uint8
+	LocalID     []byte
+	// Expected identity of the peer, any identity is accepted if empty
+	RemoteIDType uint8
+	RemoteID     []byte
+
+	// Pre-shared key used for the AUTH payloads not covered by EAP
+	PSK []byte
+
+	// Initiator: authenticate with EAP instead of the PSK
+	EAPPeer EAPPeer
+	// Responder: ask for EAP if the initiator omits the AUTH payload
+	EAPServer EAPServer
+
+	// Initiator: traffic selectors proposed for the Child SA of IKE_AUTH. The
+	// responder accepts the proposed ones.
+	TSi message.IndividualTrafficSelectorContainer
+	TSr message.IndividualTrafficSelectorContainer
+
+	// Requests of the peer handled at a time, whose responses are cached for
+	// their retransmissions. It is advertised with SET_WINDOW_SIZE in IKE_AUTH
+	// if larger than the default of 1 (RFC 7296 - 2.3).
+	WindowSize uint32
+
+	// Largest message sent as is once both sides support IKE fragmentation,
+	// beyond which the messages after IKE_SA_INIT are sent in Encrypted
+	// Fragment messages of at most this length (RFC 7383). Defaults to the
+	// IPv6 minimum MTU less the IPv6 and UDP headers and the non-ESP marker.
+	// IKE fragmentation is not offered if negative.
+	FragmentLength int
+
+	// Return the local SPI of the IKE SAs and the inbound SPI of the Child SAs
+	// created, random ones if nil. Set to the methods of SAManager for the SAs
+	// of a manager.
+	AllocateSPI      func() (uint64, error)
+	AllocateChildSPI func() (uint32, error)
+	// Frees the local SPI of an IKE SA discarded before it is set up, such as
+	// the one of a failed rekey. Set to SAManager.ReleaseSPI for a manager.
+	ReleaseSPI func(spi uint64)
+}
+
+type ChildSA struct {
+	InboundSPI  uint32
+	OutboundSPI uint32
+	Key         *security.ChildSAKey
+	TSi         message.IndividualTrafficSelectorContainer
+	TSr         message.IndividualTrafficSelectorContainer
+	// ESP is encapsulated in UDP between the NAT-T ports of the IKE SA
+	EnableEncapsulate bool
+	// Role in the exchange which has created the Child SA, the initiator of
+	// the exchange uses the InitiatorToResponder keys outbound
+	Role message.Role
+}
+
+type IKESA struct {
+	Role   message.Role
+	State  State
+	config *Config
+
+	InitiatorSPI uint64
+	ResponderSPI uint64
+
+	// Addresses the messages of the IKE SA are sent from and to, NAT detection
+	// is done in IKE_SA_INIT if both are set. Once a NAT is detected, the
+	// initiator moves both to the NAT-T port. Once the peer is found behind a
+	// NAT, RemoteAddr follows the address its authenticated messages passed to
+	// HandleMessageFrom come from (RFC 7296 - 2.23).
+	LocalAddr  netip.AddrPort
+	RemoteAddr netip.AddrPort
+	NAT        nat.Result
+	// Both sides support IKE fragmentation, negotiated in IKE_SA_INIT
+	// (RFC 7383 - 2.3)
+	Fragmentation bool
+
+	// Message ID of our next request, and of the next request of the peer
+	localMessageID  uint32
+	remoteMessageID uint32
+	// Requests of the peer in its window handled before remoteMessageID
+	remoteHandled map[uint32]bool
+	// Requests of this side the peer accepts at a time, from its
+	// SET_WINDOW_SIZE notification. This side sends one request at a time.
+	PeerWindowSize uint32
+	// Last request of this side, until its response is handled, with its
+	// fragments if it is fragmented, and the responses to the last requests
+	// of the peer
+	outstanding          []byte
+	outstandingFragments [][]byte
+	responses            []cachedResponse
+	// Fragments of the messages of the peer being reassembled
+	reassembler *ike.Reassembler
+
+	NonceInitiator []byte
+	NonceResponder []byte
+
+	Key      *security.IKESAKey
+	ChildSAs []*ChildSA
+	// Child SAs removed by the last message handled, with EventChildSADeleted
+	DeletedChildSAs []*ChildSA
+	// IKE SA replacing this one after a rekey, which takes over its Child SAs
+	Successor *IKESA
+
+	// Messages of IKE_SA_INIT, signed in the AUTH payloads
+	initRequest  []byte
+	initResponse []byte
+
+	// Initiator: Diffie-Hellman secret of the KE payload sent
+	dhSecret dh.Secret
+	dhType   dh.DHType
+	// Initiator: cookie of the responder, returned in IKE_SA_INIT
+	cookie []byte
+	// Child SA proposed or requested in the first IKE_AUTH, set up at the end
+	// of IKE_AUTH
+	childSARequest *childSARequest
+	// Identification payload body of the peer, signed in its AUTH payloads
+	peerIDType uint8
+	peerID     []byte
+	eapSuccess bool
+	msk        []byte
+
+	// Established: CREATE_CHILD_SA or INFORMATIONAL request of this side
+	// waiting for its response
+	pending       *createChildSARequest
+	informational *informationalRequest
+	// Redundant IKE SA of a rekey collision, waiting for its deletion by the
+	// side which has created it. It sends the Delete of that side with its
+	// own keys, and is added to the SAManager with the Successor.
+	redundant *IKESA
+}
+
+// NewInitiator returns an IKE SA to be started by Initiate()
+func NewInitiator(config *Config) (*IKESA, error) {
+	if config == nil || len(config.IKEPolicy) == 0 {
+		return nil, errors.Errorf("NewInitiator(): No IKE SA policy")
+	}
+	spi, err := config.newSPI()
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewInitiator()")
+	}
+	return &IKESA{
+		Role:           message.Role_Initiator,
+		State:          StateIdle,
+		config:         config,
+		InitiatorSPI:   spi,
+		PeerWindowSize: 1,
+	}, nil
+}
+
+// NewResponder returns an IKE SA handling the IKE_SA_INIT request of a peer
+func NewResponder(config *Config) (*IKESA, error) {
+	if config == nil || len(config.IKEPolicy) == 0 {
+		return nil, errors.Errorf("NewResponder(): No IKE SA policy")
+	}
+	return &IKESA{
+		Role:           message.Role_Responder,
+		State:          StateIdle,
+		config:         config,
+		PeerWindowSize: 1,
+	}, nil
+}
+
+type transition struct {
+	state        State
+	exchangeType uint8
+	response     bool
+}
+
+type handler func(ikesa *IKESA, ikeMsg *message.IKEMessage) (*message.IKEMessage, Event, error)
+
+var transitions = map[message.Role]map[transition]handler{
+	message.Role_Initiator: {
+		{StateIKESAInitSent, message.IKE_SA_INIT, true}:    (*IKESA).handleIKESAInitResponse,
+		{StateIKEAuthSent, message.IKE_AUTH, true}:         (*IKESA).handleIKEAuthResponse,
+		{StateEstablished, message.CREATE_CHILD_SA, false}: (*IKESA).handleCreateChildSARequest,
+		{StateEstablished, message.CREATE_CHILD_SA, true}:  (*IKESA).handleCreateChildSAResponse,
+		{StateEstablished, message.INFORMATIONAL, false}:   (*IKESA).handleInformationalRequest,
+		{StateEstablished, message.INFORMATIONAL, true}:    (*IKESA).handleInformationalResponse,
+		{StateRekeyed, message.CREATE_CHILD_SA, false}:     (*IKESA).handleCreateChildSARequest,
+		{StateRekeyed, message.INFORMATIONAL, false}:       (*IKESA).handleInformationalRequest,
+		{StateRekeyed, message.INFORMATIONAL, true}:        (*IKESA).handleInformationalResponse,
+	},
+	message.Role_Responder: {
+		{StateIdle, message.IKE_SA_INIT, false}:            (*IKESA).handleIKESAInitRequest,
+		{StateIKESAInitDone, message.IKE_AUTH, false}:      (*IKESA).handleIKEAuthRequest,
+		{StateEAP, message.IKE_AUTH, false}:                (*IKESA).handleIKEAuthEAPRequest,
+		{StateEstablished, message.CREATE_CHILD_SA, false}: (*IKESA).handleCreateChildSARequest,
+		{StateEstablished, message.CREATE_CHILD_SA, true}:  (*IKESA).handleCreateChildSAResponse,
+		{StateEstablished, message.INFORMATIONAL, false}:   (*IKESA).handleInformationalRequest,
+		{StateEstablished, message.INFORMATIONAL, true}:    (*IKESA).handleInformationalResponse,
+		{StateRekeyed, message.CREATE_CHILD_SA, false}:     (*IKESA).handleCreateChildSARequest,
+		{StateRekeyed, message.INFORMATIONAL, false}:       (*IKESA).handleInformationalRequest,
+		{StateRekeyed, message.INFORMATIONAL, true}:        (*IKESA).handleInformationalResponse,
+	},
+}
+
+// Initiate returns the IKE_SA_INIT request of an initiator
+func (ikesa *IKESA) Initiate() ([]byte, error) {
+	if ikesa.Role != message.Role_Initiator || ikesa.State != StateIdle {
+		return nil, errors.Errorf("Initiate(): IKE SA is not an idle initiator")
+	}
+
+	request, err := ikesa.buildIKESAInitRequest(ikesa.config.IKEPolicy[0].DhInfo)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Initiate()")
+	}
+	msg, err := ikesa.encode(request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Initiate()")
+	}
+	ikesa.State = StateIKESAInitSent
+	return msg, nil
+}
+
+// HandleMessage processes a received IKE message, and returns the message to
+// be sent back, which is the response to a request, or the next request of
+// this side. It is sent in the datagrams returned by Datagrams. The fragments
+// of a message are handled once all are received. The returned message, if
+// not nil, is to be sent even with an error, since it notifies the peer of
+// the error. A retransmitted request is answered with the response already
+// sent.
+func (ikesa *IKESA) HandleMessage(msg []byte) ([]byte, Event, error) {
+	return ikesa.HandleMessageFrom(msg, netip.AddrPort{})
+}
+
+// HandleMessageFrom is HandleMessage for a message received from remote. Once
+// the peer is found behind a NAT, RemoteAddr is set to remote if the message
+// passes the integrity check, so that the IKE SA follows the changes of the
+// NAT mapping.
+func (ikesa *IKESA) HandleMessageFrom(msg []byte, remote netip.AddrPort) ([]byte, Event, error) {
+	ikeHeader, err := message.ParseHeader(msg)
+	if err != nil {
+		return nil, EventNone, errors.Wrapf(err, "HandleMessage()")
+	}
+	if response, ok, retransmitErr := ikesa.retransmittedRequest(ikeHeader, msg); ok {
+		if retransmitErr != nil {
+			return nil, EventNone, errors.Wrapf(retransmitErr, "HandleMessage()")
+		}
+		return response, EventNone, nil
+	}
+	if err = ikesa.checkHeader(ikeHeader); err != nil {
+		return nil, EventNone, errors.Wrapf(err, "HandleMessage()")
+	}
+
+	handle, ok := transitions[ikesa.Role][transition{
+		state:        ikesa.State,
+		exchangeType: ikeHeader.ExchangeType,
+		response:     ikeHeader.IsResponse(),
+	}]
+	if !ok && ikesa.answersUnexpected(ikeHeader) {
+		handle, ok = (*IKESA).handleUnexpectedRequest, true
+	}
+	if !ok {
+		return nil, EventNone, errors.Errorf("HandleMessage(): Unexpected exchange type %d (response: %v) in state %s",
+			ikeHeader.ExchangeType, ikeHeader.IsResponse(), ikesa.State)
+	}
+
+	var ikeMsg *message.IKEMessage
+	switch {
+	case ikeHeader.ExchangeType == message.IKE_SA_INIT:
+		ikeMsg, err = ike.DecodeDecrypt(msg, ikeHeader, nil, ikesa.Role)
+	case message.IkePayloadType(ikeHeader.NextPayload) == message.TypeSK:
+		ikeMsg, err = ike.DecodeDecrypt(msg, ikeHeader, ikesa.Key, ikesa.Role)
+	case message.IkePayloadType(ikeHeader.NextPayload) == message.TypeSKF:
+		if ikeMsg, err = ikesa.reassemble(msg, ikeHeader); err == nil && ikeMsg == nil {
+			// Waiting for the other fragments
+			return nil, EventNone, nil
+		}
+	default:
+		// Every payload after IKE_SA_INIT is protected by the SK payload
+		return nil, EventNone, errors.Errorf("HandleMessage(): Unprotected %d exchange", ikeHeader.ExchangeType)
+	}
+	if err != nil {
+		return nil, EventNone, errors.Wrapf(err, "HandleMessage()")
+	}
+	// IKE_SA_INIT is not protected, and its source is the one of the NAT
+	// detection
+	if ikeHeader.ExchangeType != message.IKE_SA_INIT && remote.IsValid() && ikesa.NAT.RemoteBehindNAT {
+		ikesa.RemoteAddr = remote
+	}
+	if ikeHeader.ExchangeType == message.IKE_SA_INIT {
+		if ikesa.Role == message.Role_Initiator {
+			ikesa.initResponse = append([]byte{}, msg...)
+		} else {
+			ikesa.initRequest = append([]byte{}, msg...)
+		}
+	}
+
+	if ikeHeader.IsResponse() {
+		ikesa.localMessageID++
+		ikesa.outstanding, ikesa.outstandingFragments = nil, nil
+	} else {
+		ikesa.acceptRequest(ikeHeader.MessageID)
+	}
+
+	ikesa.DeletedChildSAs = nil
+	reply, event, err := handle(ikesa, ikeMsg)
+	if event == EventFailed {
+		ikesa.State = StateDeleted
+	}
+	if reply == nil {
+		return nil, event, err
+	}
+
+	// The deletion of a redundant IKE SA is sent with its own keys
+	sender := ikesa
+	if r := ikesa.redundant; r != nil &&
+		reply.InitiatorSPI == r.InitiatorSPI && reply.ResponderSPI == r.ResponderSPI {
+		sender = r
+	}
+	replyData, fragments, encodeErr := sender.encodeDatagrams(reply)
+	if encodeErr != nil {
+		return nil, EventFailed, errors.Wrapf(encodeErr, "HandleMessage()")
+	}
+	if !ikeHeader.IsResponse() {
+		ikesa.cacheResponse(ikeHeader.MessageID, msg, replyData, fragments)
+	}
+	return replyData, event, err
+}
+
+func (ikesa *IKESA) checkHeader(ikeHeader *message.IKEHeader) error {
+	if ikeHeader.MajorVersion != 2 {
+		return errors.Errorf("Unsupported IKE major version %d", ikeHeader.MajorVersion)
+	}
+
+	// The I flag tells which side has sent the message
+	peerIsInitiator := ikesa.Role == message.Role_Responder
+	if ikeHeader.IsInitiator() != peerIsInitiator {
+		return errors.Errorf("Unexpected Initiator flag")
+	}
+
+	if ikesa.State == StateIdle {
+		if ikeHeader.ResponderSPI != 0 || ikeHeader.MessageID != 0 {
+			return errors.Errorf("Unexpected IKE_SA_INIT request")
+		}
+		return nil
+	}
+	if ikeHeader.InitiatorSPI != ikesa.InitiatorSPI {
+		return errors.Errorf("Unexpected initiator SPI %016x", ikeHeader.InitiatorSPI)
+	}
+	// The responder SPI is unknown until the IKE_SA_INIT response
+	if ikesa.State != StateIKESAInitSent && ikeHeader.ResponderSPI != ikesa.ResponderSPI {
+		return errors.Errorf("Unexpected responder SPI %016x", ikeHeader.ResponderSPI)
+	}
+	return ikesa.checkMessageID(ikeHeader)
+}
+
+// newRequest returns a request with the next message ID of this side
+func (ikesa *IKESA) newRequest(exchangeType uint8, payloads message.IKEPayloadContainer) *message.IKEMessage {
+	return message.NewMessage(ikesa.InitiatorSPI, ikesa.ResponderSPI, exchangeType,
+		false, ikesa.Role == message.Role_Initiator, ikesa.localMessageID, payloads)
+}
+
+// newResponse returns the response to request
+func (ikesa *IKESA) newResponse(
+	request *message.IKEMessage, payloads message.IKEPayloadContainer,
+) *message.IKEMessage {
+	return message.NewMessage(ikesa.InitiatorSPI, ikesa.ResponderSPI, request.ExchangeType,
+		true, ikesa.Role == message.Role_Initiator, request.MessageID, payloads)
+}
+
+// encode returns the message, whose datagrams are given by Datagrams
+func (ikesa *IKESA) encode(ikeMsg *message.IKEMessage) ([]byte, error) {
+	msg, _, err := ikesa.encodeDatagrams(ikeMsg)
+	return msg, err
+}
+
+// answersUnexpected reports whether the request of an exchange not expected in
+// the state of the IKE SA is answered with an error, which is the case once
+// the requests are protected
+func (ikesa *IKESA) answersUnexpected(ikeHeader *message.IKEHeader) bool {
+	return !ikeHeader.IsResponse() && ikeHeader.ExchangeType != message.IKE_SA_INIT &&
+		(ikesa.State == StateEstablished || ikesa.State == StateRekeyed)
+}
+
+func (ikesa *IKESA) handleUnexpectedRequest(request *message.IKEMessage) (*message.IKEMessage, Event, error) {
+	return ikesa.errorNotify(request, message.INVALID_SYNTAX), EventNone,
+		errors.Errorf("handleUnexpectedRequest(): Unexpected exchange type %d in state %s",
+			request.ExchangeType, ikesa.State)
+}
+
+// busy reports whether a request of this side is waiting for its response
+func (ikesa *IKESA) busy() bool {
+	return ikesa.pending != nil || ikesa.informational != nil
+}
+
+// errorNotify returns the response notifying the peer of an error in request
+func (ikesa *IKESA) errorNotify(request *message.IKEMessage, notifyMessageType uint16) *message.IKEMessage {
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNotification(message.TypeNone, notifyMessageType, nil, nil)
+	return ikesa.newResponse(request, payloads)
+}
+
+// errorRequest returns the INFORMATIONAL request notifying the peer of an
+// error in its response. The IKE SA is deleted without waiting for the
+// response (RFC 7296 - 2.21.2).
+func (ikesa *IKESA) errorRequest(notifyMessageType uint16) *message.IKEMessage {
+	var payloads message.IKEPayloadContainer
+	payloads.BuildNotification(message.TypeNone, notifyMessageType, nil, nil)
+	return ikesa.newRequest(message.INFORMATIONAL, payloads)
+}
+
+func (ikesa *IKESA) concatenatedNonce() []byte {
+	return append(append([]byte{}, ikesa.NonceInitiator...), ikesa.NonceResponder...)
+}
+
+// newSPI returns a local IKE SPI from the allocator of the config
+func (config *Config) newSPI() (uint64, error) {
+	if config.AllocateSPI != nil {
+		return config.AllocateSPI()
+	}
+	return randomSPI()
+}
+
+// releaseSPI returns a local IKE SPI which is not used to the allocator of the
+// config
+func (config *Config) releaseSPI(spi uint64) {
+	if config.ReleaseSPI != nil {
+		config.ReleaseSPI(spi)
+	}
+}
+
+func randomSPI() (uint64, error) {
+	b := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return 0, errors.Wrapf(err, "randomSPI()")
+		}
+		if spi := binary.BigEndian.Uint64(b); spi != 0 {
+			return spi, nil
+		}
+	}
+}
+
+// newChildSPI returns an inbound ESP SPI from the allocator of the config
+func (config *Config) newChildSPI() (uint32, error) {
+	if config.AllocateChildSPI != nil {
+		return config.AllocateChildSPI()
+	}
+	return randomChildSPI()
+}
+
+func randomChildSPI() (uint32, error) {
+	b := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return 0, errors.Wrapf(err, "randomChildSPI()")
+		}
+		// SPI values 1 to 255 are reserved (RFC 4303 - 2.1)
+		if spi := binary.BigEndian.Uint32(b); spi > 255 {
+			return spi, nil
+		}
+	}
+}
+
+func randomNonce() ([]byte, error) {
+	nonce := make([]byte, nonceLength)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrapf(err, "randomNonce()")
+	}
+	return nonce, nil
+}
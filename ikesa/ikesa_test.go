@@ -0,0 +1,576 @@
+package ikesa
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	ike "github.com/guoweifk/n3iwue_ike_gw"
+	"github.com/guoweifk/n3iwue_ike_gw/cookie"
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/nat"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+	"github.com/guoweifk/n3iwue_ike_gw/security/dh"
+	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
+	"github.com/guoweifk/n3iwue_ike_gw/security/esn"
+	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+	"github.com/guoweifk/n3iwue_ike_gw/security/prf"
+)
+
+// fakeEAPMethod authenticates the peer by its EAP identity, and derives a
+// fixed MSK
+type fakeEAPMethod struct {
+	identity []byte
+	msk      []byte
+	rounds   int
+}
+
+func (m *fakeEAPMethod) HandleRequest(request *eap_message.EAP) (*eap_message.EAP, error) {
+	m.rounds++
+	return &eap_message.EAP{
+		Code:        eap_message.EapCodeResponse,
+		Identifier:  request.Identifier,
+		EapTypeData: &eap_message.EapIdentity{IdentityData: m.identity},
+	}, nil
+}
+
+func (m *fakeEAPMethod) Start(identity *message.IdentificationInitiator) (*eap_message.EAP, error) {
+	m.rounds++
+	return &eap_message.EAP{
+		Code:        eap_message.EapCodeRequest,
+		Identifier:  1,
+		EapTypeData: &eap_message.EapIdentity{IdentityData: []byte("identity")},
+	}, nil
+}
+
+func (m *fakeEAPMethod) HandleResponse(response *eap_message.EAP) (*eap_message.EAP, error) {
+	m.rounds++
+	identity, ok := response.EapTypeData.(*eap_message.EapIdentity)
+	if !ok {
+		return nil, errors.Errorf("Unexpected EAP response")
+	}
+	code := eap_message.EapCodeSuccess
+	if !bytes.Equal(identity.IdentityData, m.identity) {
+		code = eap_message.EapCodeFailure
+	}
+	return &eap_message.EAP{Code: code, Identifier: response.Identifier}, nil
+}
+
+func (m *fakeEAPMethod) MSK() []byte {
+	return m.msk
+}
+
+func mustIKESASuite(t *testing.T, encrName, integName, prfName, dhName string) *security.IKESASuite {
+	suite, err := security.NewIKESASuite(encrName, integName, prfName, dhName)
+	require.NoError(t, err)
+	return suite
+}
+
+func mustChildSASuite(t *testing.T, encrName, integName string) *security.ChildSASuite {
+	suite, err := security.NewChildSASuite(encrName, integName, dh.DH_2048_BIT_MODP, esn.String_ESN_DISABLE)
+	require.NoError(t, err)
+	return suite
+}
+
+func newTestConfigs(t *testing.T) (*Config, *Config) {
+	ikePolicy := []*security.IKESASuite{
+		mustIKESASuite(t, encr.ENCR_AES_CBC_256, integ.AUTH_HMAC_SHA2_256_128, prf.PRF_HMAC_SHA2_256,
+			dh.DH_256_BIT_RANDOM_ECP),
+	}
+	childPolicy := []*security.ChildSASuite{
+		mustChildSASuite(t, encr.ENCR_AES_CBC_128, integ.AUTH_HMAC_SHA1_96),
+	}
+
+	var tsi, tsr message.IndividualTrafficSelectorContainer
+	tsi.BuildIndividualTrafficSelector(message.TS_IPV4_ADDR_RANGE, 0, 0, 65535,
+		[]byte{10, 0, 0, 1}, []byte{10, 0, 0, 1})
+	tsr.BuildIndividualTrafficSelector(message.TS_IPV4_ADDR_RANGE, 0, 0, 65535,
+		[]byte{0, 0, 0, 0}, []byte{255, 255, 255, 255})
+
+	psk := []byte("pre-shared key")
+	initiator := &Config{
+		IKEPolicy:    ikePolicy,
+		ChildPolicy:  childPolicy,
+		LocalIDType:  message.ID_FQDN,
+		LocalID:      []byte("ue.example.com"),
+		RemoteIDType: message.ID_FQDN,
+		RemoteID:     []byte("gw.example.com"),
+		PSK:          psk,
+		TSi:          tsi,
+		TSr:          tsr,
+	}
+	responder := &Config{
+		IKEPolicy:    ikePolicy,
+		ChildPolicy:  childPolicy,
+		LocalIDType:  message.ID_FQDN,
+		LocalID:      []byte("gw.example.com"),
+		RemoteIDType: message.ID_FQDN,
+		RemoteID:     []byte("ue.example.com"),
+		PSK:          psk,
+	}
+	return initiator, responder
+}
+
+// runExchanges passes the messages between the initiator and the responder
+// until one side has nothing to send, and returns the last events
+func runExchanges(t *testing.T, initiator, responder *IKESA) (Event, Event, error) {
+	msg, err := initiator.Initiate()
+	require.NoError(t, err)
+	return continueExchanges(msg, initiator, responder)
+}
+
+// continueExchanges passes the messages from the request msg of the initiator
+func continueExchanges(msg []byte, initiator, responder *IKESA) (Event, Event, error) {
+	var err error
+	var initiatorEvent, responderEvent Event
+	for msg != nil {
+		msg, responderEvent, err = responder.HandleMessage(msg)
+		if msg == nil || err != nil && responderEvent == EventFailed {
+			if msg != nil {
+				_, initiatorEvent, _ = initiator.HandleMessage(msg)
+			}
+			return initiatorEvent, responderEvent, err
+		}
+		msg, initiatorEvent, err = initiator.HandleMessage(msg)
+		if err != nil {
+			return initiatorEvent, responderEvent, err
+		}
+	}
+	return initiatorEvent, responderEvent, nil
+}
+
+func requireChildSAPaired(t *testing.T, initiator, responder *IKESA) {
+	require.Len(t, initiator.ChildSAs, 1)
+	require.Len(t, responder.ChildSAs, 1)
+	requireChildSAsPaired(t, initiator.ChildSAs[0], responder.ChildSAs[0])
+}
+
+// requireChildSAsPaired checks that the Child SAs of each side are the same
+func requireChildSAsPaired(t *testing.T, i, r *ChildSA) {
+	require.Equal(t, i.InboundSPI, r.OutboundSPI)
+	require.Equal(t, i.OutboundSPI, r.InboundSPI)
+	require.Equal(t, i.Key.InitiatorToResponderEncryptionKey, r.Key.InitiatorToResponderEncryptionKey)
+	require.Equal(t, i.Key.ResponderToInitiatorEncryptionKey, r.Key.ResponderToInitiatorEncryptionKey)
+	require.Equal(t, i.Key.InitiatorToResponderIntegrityKey, r.Key.InitiatorToResponderIntegrityKey)
+	require.Equal(t, i.Key.ResponderToInitiatorIntegrityKey, r.Key.ResponderToInitiatorIntegrityKey)
+	require.Equal(t, i.TSi, r.TSi)
+	require.Equal(t, i.TSr, r.TSr)
+}
+
+func TestIKESAEstablish(t *testing.T) {
+	testcases := []struct {
+		description string
+		suite       *security.IKESASuite
+	}{
+		{
+			description: "HMAC integrity",
+		},
+		{
+			description: "AEAD with AES-XCBC PRF",
+			suite: mustIKESASuite(t, encr.ENCR_AES_GCM_16_128, "", prf.PRF_AES128_XCBC,
+				dh.DH_CURVE25519),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			initiatorConfig, responderConfig := newTestConfigs(t)
+			if tc.suite != nil {
+				initiatorConfig.IKEPolicy = []*security.IKESASuite{tc.suite}
+				responderConfig.IKEPolicy = []*security.IKESASuite{tc.suite}
+			}
+
+			initiator, err := NewInitiator(initiatorConfig)
+			require.NoError(t, err)
+			responder, err := NewResponder(responderConfig)
+			require.NoError(t, err)
+
+			initiatorEvent, responderEvent, err := runExchanges(t, initiator, responder)
+			require.NoError(t, err)
+			require.Equal(t, EventEstablished, initiatorEvent)
+			require.Equal(t, EventEstablished, responderEvent)
+			require.Equal(t, StateEstablished, initiator.State)
+			require.Equal(t, StateEstablished, responder.State)
+
+			require.Equal(t, initiator.InitiatorSPI, responder.InitiatorSPI)
+			require.Equal(t, initiator.ResponderSPI, responder.ResponderSPI)
+			require.Equal(t, initiator.Key.SK_d, responder.Key.SK_d)
+			requireChildSAPaired(t, initiator, responder)
+		})
+	}
+}
+
+func TestIKESAInitRetry(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	// The initiator prefers another group than the responder
+	initiatorConfig.IKEPolicy = append([]*security.IKESASuite{
+		mustIKESASuite(t, encr.ENCR_AES_CBC_256, integ.AUTH_HMAC_SHA2_256_128, prf.PRF_HMAC_SHA2_256,
+			dh.DH_CURVE25519),
+	}, initiatorConfig.IKEPolicy...)
+
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+
+	request, err := initiator.Initiate()
+	require.NoError(t, err)
+	response, event, err := responder.HandleMessage(request)
+	require.Error(t, err)
+	require.Equal(t, EventFailed, event)
+	require.NotNil(t, response)
+
+	// The responder keeps no state, and the initiator sends IKE_SA_INIT again
+	// with the group asked for
+	request, event, err = initiator.HandleMessage(response)
+	require.NoError(t, err)
+	require.Equal(t, EventNone, event)
+	require.Equal(t, StateIKESAInitSent, initiator.State)
+	require.Equal(t, dh.StrToType(dh.DH_256_BIT_RANDOM_ECP), initiator.dhType)
+
+	responder, err = NewResponder(responderConfig)
+	require.NoError(t, err)
+	for request != nil {
+		response, event, err = responder.HandleMessage(request)
+		require.NoError(t, err)
+		request, _, err = initiator.HandleMessage(response)
+		require.NoError(t, err)
+	}
+	require.Equal(t, EventEstablished, event)
+	require.Equal(t, StateEstablished, initiator.State)
+	requireChildSAPaired(t, initiator, responder)
+}
+
+func TestIKESAEstablishEAP(t *testing.T) {
+	msk := bytes.Repeat([]byte{0x5a}, 64)
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	peer := &fakeEAPMethod{identity: []byte("user"), msk: msk}
+	server := &fakeEAPMethod{identity: []byte("user"), msk: msk}
+	initiatorConfig.EAPPeer = peer
+	responderConfig.EAPServer = server
+
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+
+	initiatorEvent, responderEvent, err := runExchanges(t, initiator, responder)
+	require.NoError(t, err)
+	require.Equal(t, EventEstablished, initiatorEvent)
+	require.Equal(t, EventEstablished, responderEvent)
+	require.Equal(t, 1, peer.rounds)
+	require.Equal(t, 2, server.rounds)
+	requireChildSAPaired(t, initiator, responder)
+
+	// EAP failure
+	initiatorConfig.EAPPeer = &fakeEAPMethod{identity: []byte("stranger")}
+	initiator, err = NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	responder, err = NewResponder(responderConfig)
+	require.NoError(t, err)
+
+	initiatorEvent, responderEvent, err = runExchanges(t, initiator, responder)
+	require.Error(t, err)
+	require.Equal(t, EventFailed, initiatorEvent)
+	require.Equal(t, EventFailed, responderEvent)
+	require.Equal(t, StateDeleted, initiator.State)
+	require.Equal(t, StateDeleted, responder.State)
+}
+
+func TestIKESAFailure(t *testing.T) {
+	testcases := []struct {
+		description          string
+		modify               func(initiatorConfig, responderConfig *Config)
+		initiatorState       State
+		responderState       State
+		responderChildSAs    int
+		initiatorEstablished bool
+	}{
+		{
+			description: "No IKE SA proposal chosen",
+			modify: func(initiatorConfig, responderConfig *Config) {
+				responderConfig.IKEPolicy = []*security.IKESASuite{
+					mustIKESASuite(t, encr.ENCR_AES_CBC_128, integ.AUTH_HMAC_SHA1_96, prf.PRF_HMAC_SHA1,
+						dh.DH_256_BIT_RANDOM_ECP),
+				}
+			},
+			initiatorState: StateDeleted,
+			responderState: StateDeleted,
+		},
+		{
+			description: "Wrong pre-shared key",
+			modify: func(initiatorConfig, responderConfig *Config) {
+				initiatorConfig.PSK = []byte("wrong key")
+			},
+			initiatorState: StateDeleted,
+			responderState: StateDeleted,
+		},
+		{
+			description: "Unexpected identity",
+			modify: func(initiatorConfig, responderConfig *Config) {
+				responderConfig.RemoteID = []byte("other.example.com")
+			},
+			initiatorState: StateDeleted,
+			responderState: StateDeleted,
+		},
+		{
+			description: "No Child SA proposal chosen",
+			modify: func(initiatorConfig, responderConfig *Config) {
+				responderConfig.ChildPolicy = []*security.ChildSASuite{
+					mustChildSASuite(t, encr.ENCR_AES_CBC_256, integ.AUTH_HMAC_SHA2_256_128),
+				}
+			},
+			initiatorState:       StateEstablished,
+			responderState:       StateEstablished,
+			initiatorEstablished: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			initiatorConfig, responderConfig := newTestConfigs(t)
+			tc.modify(initiatorConfig, responderConfig)
+
+			initiator, err := NewInitiator(initiatorConfig)
+			require.NoError(t, err)
+			responder, err := NewResponder(responderConfig)
+			require.NoError(t, err)
+
+			initiatorEvent, _, err := runExchanges(t, initiator, responder)
+			require.Error(t, err)
+			require.Equal(t, tc.initiatorState, initiator.State)
+			require.Equal(t, tc.responderState, responder.State)
+			require.Len(t, responder.ChildSAs, tc.responderChildSAs)
+			require.Empty(t, initiator.ChildSAs)
+			if tc.initiatorEstablished {
+				require.Equal(t, EventEstablished, initiatorEvent)
+			} else {
+				require.Equal(t, EventFailed, initiatorEvent)
+			}
+		})
+	}
+}
+
+func TestIKESAInformational(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+	_, _, err = runExchanges(t, initiator, responder)
+	require.NoError(t, err)
+
+	// Liveness check from the responder
+	request := responder.newRequest(message.INFORMATIONAL, nil)
+	msg, err := responder.encode(request)
+	require.NoError(t, err)
+	reply, event, err := initiator.HandleMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, EventNone, event)
+	response, err := ike.DecodeDecrypt(reply, nil, responder.Key, responder.Role)
+	require.NoError(t, err)
+	require.True(t, response.IsResponse())
+	require.Empty(t, response.Payloads)
+
+	// Retransmitted request, answered with the same response
+	replayed, event, err := initiator.HandleMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, EventNone, event)
+	require.Equal(t, reply, replayed)
+
+	// Unprotected request
+	plain, err := message.NewMessage(responder.InitiatorSPI, responder.ResponderSPI, message.INFORMATIONAL,
+		false, false, 1, nil).Encode()
+	require.NoError(t, err)
+	_, _, err = initiator.HandleMessage(plain)
+	require.Error(t, err)
+
+	// Deletion of the IKE SA
+	var payloads message.IKEPayloadContainer
+	payloads.BuildDeleteIKESA()
+	request = initiator.newRequest(message.INFORMATIONAL, payloads)
+	msg, err = initiator.encode(request)
+	require.NoError(t, err)
+	_, event, err = responder.HandleMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, EventDeleted, event)
+	require.Equal(t, StateDeleted, responder.State)
+}
+
+func TestIKESANATDetection(t *testing.T) {
+	ue := netip.MustParseAddrPort("10.0.0.1:500")
+	gw := netip.MustParseAddrPort("198.51.100.1:500")
+	natUE := netip.MustParseAddrPort("203.0.113.7:41000")
+
+	testcases := []struct {
+		description string
+		// Addresses of the initiator, and of the initiator seen by the responder
+		initiatorLocal, initiatorRemote netip.AddrPort
+		responderRemote                 netip.AddrPort
+		expected                        nat.Result
+		expectRemoteAddr                netip.AddrPort
+	}{
+		{
+			description:      "No NAT",
+			initiatorLocal:   ue,
+			initiatorRemote:  gw,
+			responderRemote:  ue,
+			expected:         nat.Result{Supported: true},
+			expectRemoteAddr: gw,
+		},
+		{
+			description:      "Initiator behind NAT",
+			initiatorLocal:   ue,
+			initiatorRemote:  gw,
+			responderRemote:  natUE,
+			expected:         nat.Result{Supported: true, LocalBehindNAT: true},
+			expectRemoteAddr: netip.AddrPortFrom(gw.Addr(), nat.NATTPort),
+		},
+		{
+			description:     "Initiator without NAT detection",
+			responderRemote: ue,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			initiatorConfig, responderConfig := newTestConfigs(t)
+			initiator, err := NewInitiator(initiatorConfig)
+			require.NoError(t, err)
+			initiator.LocalAddr, initiator.RemoteAddr = tc.initiatorLocal, tc.initiatorRemote
+			responder, err := NewResponder(responderConfig)
+			require.NoError(t, err)
+			responder.LocalAddr, responder.RemoteAddr = gw, tc.responderRemote
+
+			initiatorEvent, responderEvent, err := runExchanges(t, initiator, responder)
+			require.NoError(t, err)
+			require.Equal(t, EventEstablished, initiatorEvent)
+			require.Equal(t, EventEstablished, responderEvent)
+
+			require.Equal(t, tc.expected, initiator.NAT)
+			require.Equal(t, tc.expected.Supported, responder.NAT.Supported)
+			require.Equal(t, tc.expected.LocalBehindNAT, responder.NAT.RemoteBehindNAT)
+			require.Equal(t, tc.expectRemoteAddr, initiator.RemoteAddr)
+			requireChildSAPaired(t, initiator, responder)
+			require.Equal(t, tc.expected.Detected(), initiator.ChildSAs[0].EnableEncapsulate)
+			require.Equal(t, tc.expected.Detected(), responder.ChildSAs[0].EnableEncapsulate)
+		})
+	}
+}
+
+func TestIKESANATMappingChange(t *testing.T) {
+	ue := netip.MustParseAddrPort("10.0.0.1:500")
+	gw := netip.MustParseAddrPort("198.51.100.1:500")
+	natUE := netip.MustParseAddrPort("203.0.113.7:41000")
+	newNATUE := netip.MustParseAddrPort("203.0.113.7:41001")
+
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	initiator.LocalAddr, initiator.RemoteAddr = ue, gw
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+	responder.LocalAddr, responder.RemoteAddr = gw, natUE
+
+	_, _, err = runExchanges(t, initiator, responder)
+	require.NoError(t, err)
+	require.True(t, responder.NAT.RemoteBehindNAT)
+
+	// A message failing the integrity check does not move the IKE SA
+	request, err := initiator.LivenessCheck()
+	require.NoError(t, err)
+	tampered := append([]byte{}, request...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, _, err = responder.HandleMessageFrom(tampered, netip.MustParseAddrPort("192.0.2.66:4500"))
+	require.Error(t, err)
+	require.Equal(t, natUE, responder.RemoteAddr)
+
+	response, _, err := responder.HandleMessageFrom(request, newNATUE)
+	require.NoError(t, err)
+	require.Equal(t, newNATUE, responder.RemoteAddr)
+	_, _, err = initiator.HandleMessageFrom(response, netip.AddrPortFrom(gw.Addr(), nat.NATTPort))
+	require.NoError(t, err)
+	// The responder is not behind a NAT
+	require.Equal(t, netip.AddrPortFrom(gw.Addr(), nat.NATTPort), initiator.RemoteAddr)
+}
+
+func TestIKESACookie(t *testing.T) {
+	generator, err := cookie.NewGenerator(1, time.Minute, 10*time.Second)
+	require.NoError(t, err)
+	ipi := netip.MustParseAddr("203.0.113.7")
+
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	// The responder asks for another group after the cookie
+	initiatorConfig.IKEPolicy = append([]*security.IKESASuite{
+		mustIKESASuite(t, encr.ENCR_AES_CBC_256, integ.AUTH_HMAC_SHA2_256_128, prf.PRF_HMAC_SHA2_256,
+			dh.DH_CURVE25519),
+	}, initiatorConfig.IKEPolicy...)
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+
+	// checkCookie answers the request without state if its cookie is not valid
+	checkCookie := func(msg []byte) []byte {
+		request := new(message.IKEMessage)
+		require.NoError(t, request.Decode(msg))
+		response, checkErr := generator.CheckRequest(request, ipi, 1)
+		require.NoError(t, checkErr)
+		if response == nil {
+			return nil
+		}
+		responseMsg, encodeErr := response.Encode()
+		require.NoError(t, encodeErr)
+		return responseMsg
+	}
+
+	msg, err := initiator.Initiate()
+	require.NoError(t, err)
+	response := checkCookie(msg)
+	require.NotNil(t, response)
+	retry, event, err := initiator.HandleMessage(response)
+	require.NoError(t, err)
+	require.Equal(t, EventNone, event)
+	require.Nil(t, checkCookie(retry))
+
+	// Same payloads after the cookie
+	request, retried := new(message.IKEMessage), new(message.IKEMessage)
+	require.NoError(t, request.Decode(msg))
+	require.NoError(t, retried.Decode(retry))
+	notification, ok := retried.Payloads[0].(*message.Notification)
+	require.True(t, ok)
+	require.Equal(t, uint16(message.COOKIE), notification.NotifyMessageType)
+	require.Equal(t, request.Payloads, retried.Payloads[1:])
+
+	// The cookie is still sent after INVALID_KE_PAYLOAD
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+	response, _, err = responder.HandleMessage(retry)
+	require.Error(t, err)
+	retry, _, err = initiator.HandleMessage(response)
+	require.NoError(t, err)
+	require.Nil(t, checkCookie(retry))
+
+	responder, err = NewResponder(responderConfig)
+	require.NoError(t, err)
+	initiatorEvent, responderEvent, err := continueExchanges(retry, initiator, responder)
+	require.NoError(t, err)
+	require.Equal(t, EventEstablished, initiatorEvent)
+	require.Equal(t, EventEstablished, responderEvent)
+	requireChildSAPaired(t, initiator, responder)
+
+	// A cookie asked for again is not sent twice
+	initiator, err = NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	msg, err = initiator.Initiate()
+	require.NoError(t, err)
+	response = checkCookie(msg)
+	_, _, err = initiator.HandleMessage(response)
+	require.NoError(t, err)
+	_, event, err = initiator.HandleMessage(response)
+	require.Error(t, err)
+	require.Equal(t, EventFailed, event)
+}
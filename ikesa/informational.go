@@ -0,0 +1,210 @@
+package ikesa
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// informationalRequest is the INFORMATIONAL request of this side waiting for
+// its response, a liveness check if it deletes nothing
+type informationalRequest struct {
+	ikeSA    bool
+	childSAs []*ChildSA
+}
+
+// Error notifications of the peer after which it deletes the IKE SA
+// (RFC 7296 - 2.21.2)
+var fatalErrors = map[uint16]bool{
+	message.INVALID_SYNTAX:        true,
+	message.AUTHENTICATION_FAILED: true,
+}
+
+// DeleteIKESA returns the INFORMATIONAL request deleting the IKE SA, with its
+// Child SAs. The IKE SA is deleted once the response is handled.
+func (ikesa *IKESA) DeleteIKESA() ([]byte, error) {
+	if ikesa.State != StateEstablished && ikesa.State != StateRekeyed {
+		return nil, errors.Errorf("DeleteIKESA(): IKE SA is not established")
+	}
+	return ikesa.startInformational(ikesa.newDeleteIKESARequest)
+}
+
+// DeleteChildSAs returns the INFORMATIONAL request deleting the Child SAs.
+// They are removed from ChildSAs once the response is handled.
+func (ikesa *IKESA) DeleteChildSAs(childSAs ...*ChildSA) ([]byte, error) {
+	if ikesa.State != StateEstablished {
+		return nil, errors.Errorf("DeleteChildSAs(): IKE SA is not established")
+	}
+	if len(childSAs) == 0 {
+		return nil, errors.Errorf("DeleteChildSAs(): No Child SA to delete")
+	}
+	for _, childSA := range childSAs {
+		if ikesa.findChildSA(childSA.OutboundSPI) != childSA {
+			return nil, errors.Errorf("DeleteChildSAs(): Child SA is not part of the IKE SA")
+		}
+	}
+	return ikesa.startInformational(func() *message.IKEMessage {
+		return ikesa.newDeleteChildSARequest(childSAs...)
+	})
+}
+
+// LivenessCheck returns an empty INFORMATIONAL request, which the peer answers
+// if it is alive (RFC 7296 - 1.4)
+func (ikesa *IKESA) LivenessCheck() ([]byte, error) {
+	if ikesa.State != StateEstablished && ikesa.State != StateRekeyed {
+		return nil, errors.Errorf("LivenessCheck(): IKE SA is not established")
+	}
+	return ikesa.startInformational(ikesa.newLivenessCheckRequest)
+}
+
+// startInformational encodes the INFORMATIONAL request built by newRequest
+func (ikesa *IKESA) startInformational(newRequest func() *message.IKEMessage) ([]byte, error) {
+	if ikesa.busy() {
+		return nil, errors.Errorf("startInformational(): A request is waiting for its response")
+	}
+	msg, err := ikesa.encode(newRequest())
+	if err != nil {
+		ikesa.informational = nil
+		return nil, errors.Wrapf(err, "startInformational()")
+	}
+	return msg, nil
+}
+
+// handleInformationalRequest answers liveness checks, deletes the SAs the
+// peer asks for, and reports its error notifications. The Child SAs deleted
+// are paired with a Delete payload in the response (RFC 7296 - 1.4.1).
+func (ikesa *IKESA) handleInformationalRequest(request *message.IKEMessage) (*message.IKEMessage, Event, error) {
+	var deletes []*message.Delete
+	for _, payload := range request.Payloads {
+		switch payload := payload.(type) {
+		case *message.Delete:
+			deletes = append(deletes, payload)
+		case *message.Notification:
+			if payload.NotifyMessageType >= message.INITIAL_CONTACT {
+				continue
+			}
+			// The IKE SA is already deleted by the peer, which expects no response
+			if fatalErrors[payload.NotifyMessageType] {
+				return nil, EventFailed, errors.Errorf("handleInformationalRequest(): Error notification %d",
+					payload.NotifyMessageType)
+			}
+			return ikesa.newResponse(request, nil), EventNone,
+				errors.Errorf("handleInformationalRequest(): Error notification %d", payload.NotifyMessageType)
+		}
+	}
+
+	var inboundSPIs []uint32
+	for _, d := range deletes {
+		switch d.ProtocolID {
+		case message.TypeIKE:
+			// The peer has completed the rekey this side has answered before
+			// the response to the colliding request of this side
+			if pending := ikesa.pending; pending != nil && pending.collisionIKESA != nil {
+				ikesa.pending = nil
+				ikesa.config.releaseSPI(pending.spi)
+				ikesa.succeed(pending.collisionIKESA)
+			}
+			// The IKE SA deleted is the one of the message
+			ikesa.State = StateDeleted
+			return ikesa.newResponse(request, nil), EventDeleted, nil
+		case message.TypeAH:
+			// No AH SA is set up, its SPIs are unknown
+		case message.TypeESP:
+			for _, spi := range d.SPIs {
+				// SPIs of Child SAs already deleted are ignored
+				childSA := ikesa.findChildSA(binary.BigEndian.Uint32(spi))
+				if childSA == nil {
+					continue
+				}
+				// Both sides delete the Child SA at the same time, it is removed
+				// with the response of this side and not paired
+				if ikesa.informational != nil && ikesa.informational.deletes(childSA) {
+					continue
+				}
+				ikesa.removeChildSA(childSA)
+				ikesa.DeletedChildSAs = append(ikesa.DeletedChildSAs, childSA)
+				inboundSPIs = append(inboundSPIs, childSA.InboundSPI)
+			}
+		}
+	}
+
+	if len(inboundSPIs) == 0 {
+		return ikesa.newResponse(request, nil), EventNone, nil
+	}
+	var payloads message.IKEPayloadContainer
+	payloads.BuildDeleteChildSAs(message.TypeESP, inboundSPIs)
+	return ikesa.newResponse(request, payloads), EventChildSADeleted, nil
+}
+
+// handleInformationalResponse completes the deletion or the liveness check
+// requested by this side
+func (ikesa *IKESA) handleInformationalResponse(response *message.IKEMessage) (*message.IKEMessage, Event, error) {
+	request := ikesa.informational
+	if request == nil {
+		return nil, EventNone, errors.Errorf("handleInformationalResponse(): No INFORMATIONAL request sent")
+	}
+	ikesa.informational = nil
+
+	if request.ikeSA {
+		ikesa.State = StateDeleted
+		return nil, EventDeleted, nil
+	}
+	// The SAs are deleted even if the peer reports an error
+	for _, childSA := range request.childSAs {
+		if ikesa.removeChildSA(childSA) {
+			ikesa.DeletedChildSAs = append(ikesa.DeletedChildSAs, childSA)
+		}
+	}
+	if len(ikesa.DeletedChildSAs) != 0 {
+		return nil, EventChildSADeleted, nil
+	}
+	return nil, EventNone, nil
+}
+
+// newDeleteIKESARequest returns the request deleting this IKE SA
+func (ikesa *IKESA) newDeleteIKESARequest() *message.IKEMessage {
+	var payloads message.IKEPayloadContainer
+	payloads.BuildDeleteIKESA()
+	ikesa.informational = &informationalRequest{ikeSA: true}
+	return ikesa.newRequest(message.INFORMATIONAL, payloads)
+}
+
+// newDeleteChildSARequest returns the request deleting the Child SAs, which
+// are identified by their inbound SPI (RFC 7296 - 3.11)
+func (ikesa *IKESA) newDeleteChildSARequest(childSAs ...*ChildSA) *message.IKEMessage {
+	spis := make([]uint32, 0, len(childSAs))
+	for _, childSA := range childSAs {
+		spis = append(spis, childSA.InboundSPI)
+	}
+	var payloads message.IKEPayloadContainer
+	payloads.BuildDeleteChildSAs(message.TypeESP, spis)
+	ikesa.informational = &informationalRequest{childSAs: childSAs}
+	return ikesa.newRequest(message.INFORMATIONAL, payloads)
+}
+
+func (ikesa *IKESA) newLivenessCheckRequest() *message.IKEMessage {
+	ikesa.informational = &informationalRequest{}
+	return ikesa.newRequest(message.INFORMATIONAL, nil)
+}
+
+func (request *informationalRequest) deletes(childSA *ChildSA) bool {
+	for _, c := range request.childSAs {
+		if c == childSA {
+			return true
+		}
+	}
+	return false
+}
+
+// removeChildSA reports whether the Child SA was part of the IKE SA
+func (ikesa *IKESA) removeChildSA(childSA *ChildSA) bool {
+	for i, c := range ikesa.ChildSAs {
+		if c == childSA {
+			ikesa.ChildSAs = append(ikesa.ChildSAs[:i], ikesa.ChildSAs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package ikesa
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// deletePayloads returns the Delete payloads of msg, received by the IKE SA
+func deletePayloads(t *testing.T, msg []byte, receiver *IKESA) []*message.Delete {
+	var deletes []*message.Delete
+	for _, payload := range decodeMessage(t, msg, receiver).Payloads {
+		if d, ok := payload.(*message.Delete); ok {
+			deletes = append(deletes, d)
+		}
+	}
+	return deletes
+}
+
+func TestIKESADeleteChildSA(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+	request, err := initiator.CreateChildSA(initiatorConfig.TSi, initiatorConfig.TSr)
+	require.NoError(t, err)
+	exchange(t, initiator, responder, request)
+	first, second := initiator.ChildSAs[0], initiator.ChildSAs[1]
+
+	_, err = initiator.DeleteChildSAs()
+	require.Error(t, err)
+	_, err = initiator.DeleteChildSAs(responder.ChildSAs[0])
+	require.Error(t, err)
+
+	// The responder deletes the paired SAs in its response
+	request, err = initiator.DeleteChildSAs(first)
+	require.NoError(t, err)
+	_, err = initiator.LivenessCheck()
+	require.Error(t, err)
+	response, event, err := responder.HandleMessage(request)
+	require.NoError(t, err)
+	require.Equal(t, EventChildSADeleted, event)
+	require.Len(t, responder.DeletedChildSAs, 1)
+	require.Equal(t, first.OutboundSPI, responder.DeletedChildSAs[0].InboundSPI)
+	deletes := deletePayloads(t, response, initiator)
+	require.Len(t, deletes, 1)
+	require.Equal(t, uint8(message.TypeESP), deletes[0].ProtocolID)
+	require.Equal(t, [][]byte{childSPI(first.OutboundSPI)}, deletes[0].SPIs)
+	_, event, err = initiator.HandleMessage(response)
+	require.NoError(t, err)
+	require.Equal(t, EventChildSADeleted, event)
+	require.Equal(t, []*ChildSA{first}, initiator.DeletedChildSAs)
+	require.Equal(t, []*ChildSA{second}, initiator.ChildSAs)
+	requireChildSAPaired(t, initiator, responder)
+
+	// Unknown SPIs are ignored
+	request, err = responder.DeleteChildSAs(responder.ChildSAs[0])
+	require.NoError(t, err)
+	initiator.ChildSAs = nil
+	response, event, err = initiator.HandleMessage(request)
+	require.NoError(t, err)
+	require.Equal(t, EventNone, event)
+	require.Empty(t, deletePayloads(t, response, responder))
+	_, event, err = responder.HandleMessage(response)
+	require.NoError(t, err)
+	require.Equal(t, EventChildSADeleted, event)
+	require.Empty(t, responder.ChildSAs)
+}
+
+func TestIKESADeleteChildSASimultaneously(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+	initiatorRequest, err := initiator.DeleteChildSAs(initiator.ChildSAs[0])
+	require.NoError(t, err)
+	responderRequest, err := responder.DeleteChildSAs(responder.ChildSAs[0])
+	require.NoError(t, err)
+
+	// The requests cross, and the SAs are deleted with the responses
+	initiatorResponse, event, err := responder.HandleMessage(initiatorRequest)
+	require.NoError(t, err)
+	require.Equal(t, EventNone, event)
+	require.Empty(t, deletePayloads(t, initiatorResponse, initiator))
+	responderResponse, event, err := initiator.HandleMessage(responderRequest)
+	require.NoError(t, err)
+	require.Equal(t, EventNone, event)
+	require.Len(t, initiator.ChildSAs, 1)
+
+	_, event, err = initiator.HandleMessage(initiatorResponse)
+	require.NoError(t, err)
+	require.Equal(t, EventChildSADeleted, event)
+	_, event, err = responder.HandleMessage(responderResponse)
+	require.NoError(t, err)
+	require.Equal(t, EventChildSADeleted, event)
+	require.Empty(t, initiator.ChildSAs)
+	require.Empty(t, responder.ChildSAs)
+}
+
+func TestIKESADeleteIKESA(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+	request, err := responder.DeleteIKESA()
+	require.NoError(t, err)
+	responderEvent, initiatorEvent, next := exchange(t, responder, initiator, request)
+	require.Nil(t, next)
+	require.Equal(t, EventDeleted, responderEvent)
+	require.Equal(t, EventDeleted, initiatorEvent)
+	require.Equal(t, StateDeleted, initiator.State)
+	require.Equal(t, StateDeleted, responder.State)
+
+	_, err = responder.DeleteIKESA()
+	require.Error(t, err)
+
+	t.Run("With the SPIs", func(t *testing.T) {
+		initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+		spi := make([]byte, 8)
+		binary.BigEndian.PutUint64(spi, initiator.InitiatorSPI)
+		request, err := initiator.startInformational(func() *message.IKEMessage {
+			var payloads message.IKEPayloadContainer
+			payloads.BuildDeletePayload(message.TypeIKE, 8, [][]byte{spi})
+			initiator.informational = &informationalRequest{ikeSA: true}
+			return initiator.newRequest(message.INFORMATIONAL, payloads)
+		})
+		require.NoError(t, err)
+		initiatorEvent, responderEvent, _ := exchange(t, initiator, responder, request)
+		require.Equal(t, EventDeleted, initiatorEvent)
+		require.Equal(t, EventDeleted, responderEvent)
+	})
+}
+
+func TestIKESALivenessCheck(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+	for i := 0; i < 2; i++ {
+		request, err := initiator.LivenessCheck()
+		require.NoError(t, err)
+		initiatorEvent, responderEvent, next := exchange(t, initiator, responder, request)
+		require.Nil(t, next)
+		require.Equal(t, EventNone, initiatorEvent)
+		require.Equal(t, EventNone, responderEvent)
+	}
+	require.Equal(t, StateEstablished, initiator.State)
+	require.Equal(t, uint32(4), initiator.localMessageID)
+	requireChildSAPaired(t, initiator, responder)
+}
+
+func TestIKESAInformationalErrors(t *testing.T) {
+	t.Run("Unexpected exchange", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+		request, err := initiator.encode(initiator.newRequest(message.IKE_AUTH, nil))
+		require.NoError(t, err)
+		response, event, err := responder.HandleMessage(request)
+		require.Error(t, err)
+		require.Equal(t, EventNone, event)
+		requireNotification(t, response, initiator, message.INVALID_SYNTAX)
+		header, err := message.ParseHeader(response)
+		require.NoError(t, err)
+		require.True(t, header.IsResponse())
+		require.Equal(t, uint32(2), header.MessageID)
+
+		// The request is answered, the next one is expected
+		require.Equal(t, uint32(3), responder.remoteMessageID)
+	})
+
+	t.Run("Authentication failure of the responder", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiatorConfig.RemoteID = []byte("other.example.com")
+		initiator, err := NewInitiator(initiatorConfig)
+		require.NoError(t, err)
+		responder, err := NewResponder(responderConfig)
+		require.NoError(t, err)
+
+		// IKE_SA_INIT and IKE_AUTH
+		msg, err := initiator.Initiate()
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			msg, _, err = responder.HandleMessage(msg)
+			require.NoError(t, err)
+			msg, _, err = initiator.HandleMessage(msg)
+		}
+		require.Error(t, err)
+		require.Equal(t, StateDeleted, initiator.State)
+		require.Equal(t, StateEstablished, responder.State)
+
+		// The error is notified in a protected request with the next message ID
+		header, err := message.ParseHeader(msg)
+		require.NoError(t, err)
+		require.False(t, header.IsResponse())
+		require.Equal(t, uint8(message.INFORMATIONAL), header.ExchangeType)
+		require.Equal(t, uint32(2), header.MessageID)
+		requireNotification(t, msg, responder, message.AUTHENTICATION_FAILED)
+
+		reply, event, err := responder.HandleMessage(msg)
+		require.Error(t, err)
+		require.Nil(t, reply)
+		require.Equal(t, EventFailed, event)
+		require.Equal(t, StateDeleted, responder.State)
+	})
+}
+
+func requireNotification(t *testing.T, msg []byte, receiver *IKESA, notifyMessageType uint16) {
+	ikeMsg := decodeMessage(t, msg, receiver)
+	require.Len(t, ikeMsg.Payloads, 1)
+	notification, ok := ikeMsg.Payloads[0].(*message.Notification)
+	require.True(t, ok)
+	require.Equal(t, notifyMessageType, notification.NotifyMessageType)
+}
@@ -0,0 +1,427 @@
+package ikesa
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// SAManagerConfig sets how long the SAs of a manager are kept
+type SAManagerConfig struct {
+	// Time an IKE SA may stay half-open, before IKE_AUTH completes, after
+	// which Expire removes it. Half-open SAs do not expire if zero.
+	HalfOpenTimeout time.Duration
+}
+
+// SAManagerMetrics is a snapshot of the SAs of a manager
+type SAManagerMetrics struct {
+	IKESAs   int // IKE SAs added and not removed, half-open ones included
+	HalfOpen int
+	ChildSAs int
+
+	Added   uint64
+	Removed uint64 // by Remove or Expire
+	Expired uint64 // by Expire only
+	// Random SPIs drawn again since they were in use
+	SPICollisions uint64
+}
+
+type spiPair struct {
+	initiatorSPI uint64
+	responderSPI uint64
+}
+
+// halfOpenKey identifies the IKE SA set up by an IKE_SA_INIT request before
+// the responder SPI is known to the peer
+type halfOpenKey struct {
+	initiatorSPI uint64
+	remote       netip.AddrPort
+}
+
+// saEntry is an IKE SA of the manager, with the keys it is indexed by when
+// last added or updated
+type saEntry struct {
+	ikesa   *IKESA
+	role    message.Role
+	remote  netip.AddrPort
+	created time.Time
+
+	localSPI  uint64
+	pair      spiPair
+	indexed   bool // by pair
+	halfOpen  bool
+	deleted   bool
+	childSPIs map[uint32]*ChildSA
+}
+
+type childEntry struct {
+	entry   *saEntry
+	childSA *ChildSA
+}
+
+// SAManager indexes the IKE SAs of many peers, and allocates their SPIs. It is
+// safe for concurrent use, while each IKE SA is to be handled by one goroutine
+// at a time, which also calls Update once a message is handled.
+type SAManager struct {
+	config SAManagerConfig
+
+	mu       sync.RWMutex
+	entries  map[*IKESA]*saEntry
+	bySPIs   map[spiPair]*saEntry
+	halfOpen map[halfOpenKey]*saEntry
+	childSAs map[uint32]childEntry
+	// Local IKE SPIs and inbound ESP SPIs allocated or in use
+	spis      map[uint64]struct{}
+	childSPIs map[uint32]struct{}
+
+	halfOpenCount int
+	added         uint64
+	removed       uint64
+	expired       uint64
+	collisions    uint64
+}
+
+// NewSAManager returns a manager without SA
+func NewSAManager(config SAManagerConfig) (*SAManager, error) {
+	if config.HalfOpenTimeout < 0 {
+		return nil, errors.Errorf("NewSAManager(): Invalid half-open timeout %s", config.HalfOpenTimeout)
+	}
+	return &SAManager{
+		config:    config,
+		entries:   make(map[*IKESA]*saEntry),
+		bySPIs:    make(map[spiPair]*saEntry),
+		halfOpen:  make(map[halfOpenKey]*saEntry),
+		childSAs:  make(map[uint32]childEntry),
+		spis:      make(map[uint64]struct{}),
+		childSPIs: make(map[uint32]struct{}),
+	}, nil
+}
+
+// AllocateSPI returns a random local IKE SPI not in use by another IKE SA of
+// the manager. The SPI is reserved until the IKE SA using it is removed, or
+// ReleaseSPI if no IKE SA uses it.
+func (m *SAManager) AllocateSPI() (uint64, error) {
+	for {
+		spi, err := randomSPI()
+		if err != nil {
+			return 0, errors.Wrapf(err, "AllocateSPI()")
+		}
+		m.mu.Lock()
+		if _, ok := m.spis[spi]; !ok {
+			m.spis[spi] = struct{}{}
+			m.mu.Unlock()
+			return spi, nil
+		}
+		m.collisions++
+		m.mu.Unlock()
+	}
+}
+
+// AllocateChildSPI returns a random inbound ESP SPI not in use by another
+// Child SA of the manager. The SPI is reserved until the Child SA using it is
+// removed, or ReleaseChildSPI if no Child SA uses it.
+func (m *SAManager) AllocateChildSPI() (uint32, error) {
+	for {
+		spi, err := randomChildSPI()
+		if err != nil {
+			return 0, errors.Wrapf(err, "AllocateChildSPI()")
+		}
+		m.mu.Lock()
+		if _, ok := m.childSPIs[spi]; !ok {
+			m.childSPIs[spi] = struct{}{}
+			m.mu.Unlock()
+			return spi, nil
+		}
+		m.collisions++
+		m.mu.Unlock()
+	}
+}
+
+// ReleaseSPI frees a local IKE SPI allocated for an IKE SA which is not added
+func (m *SAManager) ReleaseSPI(spi uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range m.entries {
+		if entry.localSPI == spi {
+			return
+		}
+	}
+	delete(m.spis, spi)
+}
+
+// ReleaseChildSPI frees an inbound ESP SPI allocated for a Child SA which is
+// not created
+func (m *SAManager) ReleaseChildSPI(spi uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.childSAs[spi]; !ok {
+		delete(m.childSPIs, spi)
+	}
+}
+
+// Add indexes a new IKE SA, whose peer sends from remote. A responder is added
+// once it has handled the IKE_SA_INIT request, and is also indexed by the
+// initiator SPI and remote while half-open, so that the retransmissions of
+// IKE_SA_INIT, without responder SPI, are found.
+func (m *SAManager) Add(ikesa *IKESA, remote netip.AddrPort, now time.Time) error {
+	if ikesa == nil {
+		return errors.Errorf("Add(): IKE SA is nil")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[ikesa]; ok {
+		return errors.Errorf("Add(): IKE SA is already added")
+	}
+	entry := &saEntry{
+		ikesa:   ikesa,
+		role:    ikesa.Role,
+		remote:  remote,
+		created: now,
+	}
+	if err := m.index(entry); err != nil {
+		return errors.Wrapf(err, "Add()")
+	}
+	m.entries[ikesa] = entry
+	m.added++
+	return nil
+}
+
+// Update indexes the IKE SA again after a message is handled, since it may
+// have changed its SPIs, Child SAs or state. The Successor of a rekeyed IKE
+// SA is added, and the redundant IKE SA of a rekey collision until it is
+// deleted.
+func (m *SAManager) Update(ikesa *IKESA) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[ikesa]
+	if !ok {
+		return errors.Errorf("Update(): IKE SA is not added")
+	}
+	if err := m.index(entry); err != nil {
+		return errors.Wrapf(err, "Update()")
+	}
+
+	for _, other := range []*IKESA{ikesa.Successor, ikesa.redundant} {
+		// An IKE SA deleted may already be removed
+		if other == nil || other.State == StateDeleted {
+			continue
+		}
+		if _, ok = m.entries[other]; ok {
+			continue
+		}
+		otherEntry := &saEntry{
+			ikesa:   other,
+			role:    other.Role,
+			remote:  entry.remote,
+			created: entry.created,
+		}
+		if err := m.index(otherEntry); err != nil {
+			return errors.Wrapf(err, "Update(): Successor or redundant IKE SA")
+		}
+		m.entries[other] = otherEntry
+		m.added++
+	}
+	return nil
+}
+
+// Remove drops the IKE SA and its Child SAs, and frees their SPIs. It reports
+// whether the IKE SA was added.
+func (m *SAManager) Remove(ikesa *IKESA) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[ikesa]
+	if !ok {
+		return false
+	}
+	m.remove(entry)
+	return true
+}
+
+// Lookup returns the IKE SA of the SPIs of a received message, or nil. An
+// initiator is found by its SPI alone until it learns the responder SPI from
+// the IKE_SA_INIT response.
+func (m *SAManager) Lookup(initiatorSPI, responderSPI uint64) *IKESA {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if entry, ok := m.bySPIs[spiPair{initiatorSPI, responderSPI}]; ok {
+		return entry.ikesa
+	}
+	if entry, ok := m.bySPIs[spiPair{initiatorSPI, 0}]; ok && entry.role == message.Role_Initiator {
+		return entry.ikesa
+	}
+	return nil
+}
+
+// LookupHalfOpen returns the half-open responder IKE SA set up by the
+// IKE_SA_INIT request of initiatorSPI from remote, or nil
+func (m *SAManager) LookupHalfOpen(initiatorSPI uint64, remote netip.AddrPort) *IKESA {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if entry, ok := m.halfOpen[halfOpenKey{initiatorSPI, remote}]; ok {
+		return entry.ikesa
+	}
+	return nil
+}
+
+// LookupChildSA returns the Child SA of an inbound ESP SPI, and its IKE SA
+func (m *SAManager) LookupChildSA(inboundSPI uint32) (*IKESA, *ChildSA) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if child, ok := m.childSAs[inboundSPI]; ok {
+		return child.entry.ikesa, child.childSA
+	}
+	return nil, nil
+}
+
+// Range calls f for each IKE SA until it returns false. The IKE SAs are the
+// ones added when Range is called, and f may add or remove IKE SAs.
+func (m *SAManager) Range(f func(ikesa *IKESA) bool) {
+	m.mu.RLock()
+	ikesas := make([]*IKESA, 0, len(m.entries))
+	for ikesa := range m.entries {
+		ikesas = append(ikesas, ikesa)
+	}
+	m.mu.RUnlock()
+
+	for _, ikesa := range ikesas {
+		if !f(ikesa) {
+			return
+		}
+	}
+}
+
+// Expire removes the IKE SAs deleted when last updated, and the ones staying
+// half-open longer than the timeout at now, and returns them
+func (m *SAManager) Expire(now time.Time) []*IKESA {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var expired []*IKESA
+	for ikesa, entry := range m.entries {
+		timedOut := entry.halfOpen && m.config.HalfOpenTimeout != 0 &&
+			!now.Before(entry.created.Add(m.config.HalfOpenTimeout))
+		if !entry.deleted && !timedOut {
+			continue
+		}
+		m.remove(entry)
+		m.expired++
+		expired = append(expired, ikesa)
+	}
+	return expired
+}
+
+// Metrics returns the current numbers of SAs and the counters of the manager
+func (m *SAManager) Metrics() SAManagerMetrics {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return SAManagerMetrics{
+		IKESAs:        len(m.entries),
+		HalfOpen:      m.halfOpenCount,
+		ChildSAs:      len(m.childSAs),
+		Added:         m.added,
+		Removed:       m.removed,
+		Expired:       m.expired,
+		SPICollisions: m.collisions,
+	}
+}
+
+// index replaces the keys of the entry by the current ones of its IKE SA,
+// unless one of them is used by another IKE SA
+func (m *SAManager) index(entry *saEntry) error {
+	ikesa := entry.ikesa
+	localSPI := ikesa.InitiatorSPI
+	if entry.role == message.Role_Responder {
+		localSPI = ikesa.ResponderSPI
+	}
+	pair := spiPair{ikesa.InitiatorSPI, ikesa.ResponderSPI}
+	// The initiator SPI alone does not identify the IKE SA of a responder
+	indexed := entry.role == message.Role_Initiator || ikesa.ResponderSPI != 0
+	halfOpen := ikesa.State < StateEstablished
+	key := halfOpenKey{ikesa.InitiatorSPI, entry.remote}
+
+	if indexed {
+		if other, ok := m.bySPIs[pair]; ok && other != entry {
+			return errors.Errorf("index(): SPIs %016x/%016x are in use", pair.initiatorSPI, pair.responderSPI)
+		}
+	}
+	if halfOpen && entry.role == message.Role_Responder {
+		if other, ok := m.halfOpen[key]; ok && other != entry {
+			return errors.Errorf("index(): Half-open IKE SA %016x from %s exists", key.initiatorSPI, key.remote)
+		}
+	}
+	childSPIs := make(map[uint32]*ChildSA, len(ikesa.ChildSAs))
+	for _, childSA := range ikesa.ChildSAs {
+		if other, ok := m.childSAs[childSA.InboundSPI]; ok && other.entry != entry {
+			return errors.Errorf("index(): Inbound SPI %08x is in use", childSA.InboundSPI)
+		}
+		childSPIs[childSA.InboundSPI] = childSA
+	}
+
+	m.unindex(entry)
+	for spi := range entry.childSPIs {
+		if _, ok := childSPIs[spi]; !ok {
+			delete(m.childSPIs, spi)
+		}
+	}
+	if entry.localSPI != 0 && entry.localSPI != localSPI {
+		delete(m.spis, entry.localSPI)
+	}
+
+	entry.localSPI, entry.pair, entry.indexed = localSPI, pair, indexed
+	entry.halfOpen, entry.childSPIs = halfOpen, childSPIs
+	entry.deleted = ikesa.State == StateDeleted
+	if localSPI != 0 {
+		m.spis[localSPI] = struct{}{}
+	}
+	if indexed {
+		m.bySPIs[pair] = entry
+	}
+	if halfOpen {
+		m.halfOpenCount++
+		if entry.role == message.Role_Responder {
+			m.halfOpen[key] = entry
+		}
+	}
+	for spi, childSA := range childSPIs {
+		m.childSAs[spi] = childEntry{entry: entry, childSA: childSA}
+		m.childSPIs[spi] = struct{}{}
+	}
+	return nil
+}
+
+// unindex drops the keys of the entry, and keeps its SPIs reserved
+func (m *SAManager) unindex(entry *saEntry) {
+	if entry.indexed && m.bySPIs[entry.pair] == entry {
+		delete(m.bySPIs, entry.pair)
+	}
+	if entry.halfOpen {
+		m.halfOpenCount--
+		key := halfOpenKey{entry.pair.initiatorSPI, entry.remote}
+		if m.halfOpen[key] == entry {
+			delete(m.halfOpen, key)
+		}
+	}
+	for spi := range entry.childSPIs {
+		if m.childSAs[spi].entry == entry {
+			delete(m.childSAs, spi)
+		}
+	}
+	entry.indexed, entry.halfOpen = false, false
+}
+
+func (m *SAManager) remove(entry *saEntry) {
+	m.unindex(entry)
+	for spi := range entry.childSPIs {
+		if _, ok := m.childSAs[spi]; !ok {
+			delete(m.childSPIs, spi)
+		}
+	}
+	if entry.localSPI != 0 {
+		delete(m.spis, entry.localSPI)
+	}
+	delete(m.entries, entry.ikesa)
+	m.removed++
+}
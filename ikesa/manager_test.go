@@ -0,0 +1,359 @@
+package ikesa
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// newManagedConfigs returns configs allocating the SPIs of the managers
+func newManagedConfigs(t *testing.T, initiatorManager, responderManager *SAManager) (*Config, *Config) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiatorConfig.AllocateSPI = initiatorManager.AllocateSPI
+	initiatorConfig.AllocateChildSPI = initiatorManager.AllocateChildSPI
+	initiatorConfig.ReleaseSPI = initiatorManager.ReleaseSPI
+	responderConfig.AllocateSPI = responderManager.AllocateSPI
+	responderConfig.AllocateChildSPI = responderManager.AllocateChildSPI
+	responderConfig.ReleaseSPI = responderManager.ReleaseSPI
+	return initiatorConfig, responderConfig
+}
+
+func newTestManager(t testing.TB, halfOpenTimeout time.Duration) *SAManager {
+	m, err := NewSAManager(SAManagerConfig{HalfOpenTimeout: halfOpenTimeout})
+	require.NoError(t, err)
+	return m
+}
+
+func TestSAManager(t *testing.T) {
+	initiatorManager, responderManager := newTestManager(t, 0), newTestManager(t, 0)
+	initiatorConfig, responderConfig := newManagedConfigs(t, initiatorManager, responderManager)
+	initiatorAddr := netip.MustParseAddrPort("10.0.0.1:500")
+	responderAddr := netip.MustParseAddrPort("192.0.2.1:500")
+	now := time.Unix(1700000000, 0)
+
+	initiator, err := NewInitiator(initiatorConfig)
+	require.NoError(t, err)
+	require.NoError(t, initiatorManager.Add(initiator, responderAddr, now))
+	require.Error(t, initiatorManager.Add(initiator, responderAddr, now))
+
+	request, err := initiator.Initiate()
+	require.NoError(t, err)
+	responder, err := NewResponder(responderConfig)
+	require.NoError(t, err)
+	response, _, err := responder.HandleMessage(request)
+	require.NoError(t, err)
+	require.NoError(t, responderManager.Add(responder, initiatorAddr, now))
+	require.Equal(t, responder, responderManager.LookupHalfOpen(responder.InitiatorSPI, initiatorAddr))
+	require.Nil(t, responderManager.LookupHalfOpen(responder.InitiatorSPI, responderAddr))
+	require.Equal(t, responder, responderManager.Lookup(responder.InitiatorSPI, responder.ResponderSPI))
+	require.Nil(t, responderManager.Lookup(responder.InitiatorSPI, 0))
+
+	// The initiator is found before it learns the responder SPI
+	require.Equal(t, initiator, initiatorManager.Lookup(initiator.InitiatorSPI, responder.ResponderSPI))
+	request, _, err = initiator.HandleMessage(response)
+	require.NoError(t, err)
+	require.NoError(t, initiatorManager.Update(initiator))
+
+	response, _, err = responder.HandleMessage(request)
+	require.NoError(t, err)
+	require.NoError(t, responderManager.Update(responder))
+	_, event, err := initiator.HandleMessage(response)
+	require.NoError(t, err)
+	require.Equal(t, EventEstablished, event)
+	require.NoError(t, initiatorManager.Update(initiator))
+
+	require.Nil(t, responderManager.LookupHalfOpen(responder.InitiatorSPI, initiatorAddr))
+	require.Equal(t, SAManagerMetrics{IKESAs: 1, ChildSAs: 1, Added: 1}, responderManager.Metrics())
+	ikesa, childSA := responderManager.LookupChildSA(responder.ChildSAs[0].InboundSPI)
+	require.Equal(t, responder, ikesa)
+	require.Equal(t, responder.ChildSAs[0], childSA)
+	ikesa, childSA = initiatorManager.LookupChildSA(initiator.ChildSAs[0].InboundSPI)
+	require.Equal(t, initiator, ikesa)
+	require.Equal(t, initiator.ChildSAs[0], childSA)
+
+	// The Successor of the rekeyed IKE SA takes over the Child SAs
+	request, err = initiator.RekeyIKESA()
+	require.NoError(t, err)
+	_, _, deletion := exchange(t, initiator, responder, request)
+	require.NoError(t, initiatorManager.Update(initiator))
+	require.NoError(t, responderManager.Update(responder))
+	successor := responder.Successor
+	require.NotNil(t, successor)
+	require.Equal(t, successor, responderManager.Lookup(successor.InitiatorSPI, successor.ResponderSPI))
+	ikesa, _ = responderManager.LookupChildSA(successor.ChildSAs[0].InboundSPI)
+	require.Equal(t, successor, ikesa)
+
+	_, event, err = responder.HandleMessage(deletion)
+	require.NoError(t, err)
+	require.Equal(t, EventDeleted, event)
+	require.NoError(t, responderManager.Update(responder))
+	require.Equal(t, []*IKESA{responder}, responderManager.Expire(now))
+	require.Nil(t, responderManager.Lookup(responder.InitiatorSPI, responder.ResponderSPI))
+	ikesa, _ = responderManager.LookupChildSA(successor.ChildSAs[0].InboundSPI)
+	require.Equal(t, successor, ikesa)
+	require.Equal(t, SAManagerMetrics{IKESAs: 1, ChildSAs: 1, Added: 2, Removed: 1, Expired: 1},
+		responderManager.Metrics())
+
+	require.True(t, responderManager.Remove(successor))
+	require.False(t, responderManager.Remove(successor))
+	ikesa, childSA = responderManager.LookupChildSA(successor.ChildSAs[0].InboundSPI)
+	require.Nil(t, ikesa)
+	require.Nil(t, childSA)
+	require.Empty(t, responderManager.spis)
+	require.Empty(t, responderManager.childSPIs)
+}
+
+func TestSAManagerHalfOpenExpiry(t *testing.T) {
+	m := newTestManager(t, 10*time.Second)
+	now := time.Unix(1700000000, 0)
+	remote := netip.MustParseAddrPort("10.0.0.1:500")
+
+	halfOpen := &IKESA{Role: message.Role_Responder, State: StateIKESAInitDone, InitiatorSPI: 1, ResponderSPI: 2}
+	established := &IKESA{Role: message.Role_Responder, State: StateEstablished, InitiatorSPI: 3, ResponderSPI: 4}
+	require.NoError(t, m.Add(halfOpen, remote, now))
+	require.NoError(t, m.Add(established, remote, now))
+
+	// Another IKE_SA_INIT of the same initiator SPI and address
+	duplicate := &IKESA{Role: message.Role_Responder, State: StateIKESAInitDone, InitiatorSPI: 1, ResponderSPI: 5}
+	require.Error(t, m.Add(duplicate, remote, now))
+	require.Equal(t, 1, m.Metrics().HalfOpen)
+
+	require.Empty(t, m.Expire(now.Add(9*time.Second)))
+	require.Equal(t, []*IKESA{halfOpen}, m.Expire(now.Add(10*time.Second)))
+	require.Nil(t, m.LookupHalfOpen(1, remote))
+	require.Equal(t, established, m.Lookup(3, 4))
+	require.Equal(t, SAManagerMetrics{IKESAs: 1, Added: 2, Removed: 1, Expired: 1}, m.Metrics())
+}
+
+func TestSAManagerSPICollision(t *testing.T) {
+	m := newTestManager(t, 0)
+	remote := netip.MustParseAddrPort("10.0.0.1:500")
+	now := time.Unix(1700000000, 0)
+
+	first := &IKESA{Role: message.Role_Responder, State: StateEstablished, InitiatorSPI: 1, ResponderSPI: 2,
+		ChildSAs: []*ChildSA{{InboundSPI: 1000}}}
+	require.NoError(t, m.Add(first, remote, now))
+	second := &IKESA{Role: message.Role_Responder, State: StateEstablished, InitiatorSPI: 1, ResponderSPI: 2}
+	require.Error(t, m.Add(second, remote, now))
+	second = &IKESA{Role: message.Role_Responder, State: StateEstablished, InitiatorSPI: 3, ResponderSPI: 4,
+		ChildSAs: []*ChildSA{{InboundSPI: 1000}}}
+	require.Error(t, m.Add(second, remote, now))
+
+	// Released SPIs stay reserved while in use
+	m.ReleaseSPI(2)
+	m.ReleaseChildSPI(1000)
+	require.Contains(t, m.spis, uint64(2))
+	require.Contains(t, m.childSPIs, uint32(1000))
+	spi, err := m.AllocateSPI()
+	require.NoError(t, err)
+	m.ReleaseSPI(spi)
+	require.NotContains(t, m.spis, spi)
+}
+
+func TestSAManagerRekeyCollision(t *testing.T) {
+	initiatorManager, responderManager := newTestManager(t, 0), newTestManager(t, 0)
+	initiatorConfig, responderConfig := newManagedConfigs(t, initiatorManager, responderManager)
+	remote := netip.MustParseAddrPort("10.0.0.1:500")
+	now := time.Unix(1700000000, 0)
+	initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+	require.NoError(t, initiatorManager.Add(initiator, remote, now))
+	require.NoError(t, responderManager.Add(responder, remote, now))
+
+	// handle passes the message to the IKE SA of its SPIs in the manager
+	handle := func(m *SAManager, msg []byte) ([]byte, Event) {
+		header, err := message.ParseHeader(msg)
+		require.NoError(t, err)
+		ikesa := m.Lookup(header.InitiatorSPI, header.ResponderSPI)
+		require.NotNil(t, ikesa)
+		reply, event, err := ikesa.HandleMessage(msg)
+		require.NoError(t, err)
+		require.NoError(t, m.Update(ikesa))
+		return reply, event
+	}
+
+	responderRequest, err := responder.RekeyIKESA()
+	require.NoError(t, err)
+	initiatorRequest, err := initiator.RekeyIKESA()
+	require.NoError(t, err)
+	initiatorResponse, _ := handle(responderManager, initiatorRequest)
+	responderResponse, _ := handle(initiatorManager, responderRequest)
+	initiatorDelete, event := handle(initiatorManager, initiatorResponse)
+	require.Equal(t, EventIKESARekeyed, event)
+	responderDelete, event := handle(responderManager, responderResponse)
+	require.Equal(t, EventIKESARekeyed, event)
+
+	// The redundant IKE SA is found on both sides until the side which has
+	// created it has deleted it
+	sides := []struct {
+		ikesa *IKESA
+		m     *SAManager
+	}{{initiator, initiatorManager}, {responder, responderManager}}
+	for _, side := range sides {
+		redundant := side.ikesa.redundant
+		require.NotNil(t, redundant)
+		require.Equal(t, redundant, side.m.Lookup(redundant.InitiatorSPI, redundant.ResponderSPI))
+		require.Equal(t, 3, side.m.Metrics().IKESAs)
+	}
+	for _, deletion := range []struct {
+		from, to *SAManager
+		request  []byte
+	}{{initiatorManager, responderManager, initiatorDelete}, {responderManager, initiatorManager, responderDelete}} {
+		response, event := handle(deletion.to, deletion.request)
+		require.Equal(t, EventDeleted, event)
+		_, event = handle(deletion.from, response)
+		require.Equal(t, EventDeleted, event)
+	}
+
+	// Only the Successor is left, with its SPI
+	for _, side := range sides {
+		require.ElementsMatch(t, []*IKESA{side.ikesa, side.ikesa.redundant}, side.m.Expire(now))
+		require.Equal(t, 1, side.m.Metrics().IKESAs)
+		require.Len(t, side.m.spis, 1)
+	}
+
+	// The SPI of a rejected rekey is released
+	initiator, responder = initiator.Successor, responder.Successor
+	request, err := responder.CreateChildSA(initiatorConfig.TSi, initiatorConfig.TSr)
+	require.NoError(t, err)
+	_, err = initiator.RekeyIKESA()
+	require.NoError(t, err)
+	require.Len(t, initiatorManager.spis, 2)
+	rejection, _, err := responder.HandleMessage(initiator.outstanding)
+	require.Error(t, err)
+	_, event, err = initiator.HandleMessage(rejection)
+	require.Error(t, err)
+	require.Equal(t, EventNone, event)
+	require.Len(t, initiatorManager.spis, 1)
+	_, _, next := exchange(t, responder, initiator, request)
+	require.Nil(t, next)
+}
+
+func TestSAManagerConcurrency(t *testing.T) {
+	m := newTestManager(t, 0)
+	now := time.Unix(1700000000, 0)
+	const workers, perWorker = 8, 500
+
+	ikesas := make([][]*IKESA, workers)
+	for w := range ikesas {
+		for i := 0; i < perWorker; i++ {
+			ikesas[w] = append(ikesas[w], newManagedIKESA(t, m, uint64(w*perWorker+i+1)))
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*perWorker)
+	for w := range ikesas {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			remote := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(w)}), 500)
+			for i, ikesa := range ikesas[w] {
+				if err := m.Add(ikesa, remote, now); err != nil {
+					errs <- err
+					continue
+				}
+				if m.Lookup(ikesa.InitiatorSPI, ikesa.ResponderSPI) != ikesa {
+					errs <- fmt.Errorf("IKE SA %016x not found", ikesa.InitiatorSPI)
+				}
+				if i%2 == 0 && !m.Remove(ikesa) {
+					errs <- fmt.Errorf("IKE SA %016x not removed", ikesa.InitiatorSPI)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	metrics := m.Metrics()
+	require.Equal(t, workers*perWorker/2, metrics.IKESAs)
+	require.Equal(t, workers*perWorker/2, metrics.ChildSAs)
+	count := 0
+	m.Range(func(*IKESA) bool {
+		count++
+		return true
+	})
+	require.Equal(t, metrics.IKESAs, count)
+}
+
+// newManagedIKESA returns an established responder IKE SA with a Child SA,
+// whose SPIs are allocated by the manager
+func newManagedIKESA(t testing.TB, m *SAManager, initiatorSPI uint64) *IKESA {
+	responderSPI, err := m.AllocateSPI()
+	require.NoError(t, err)
+	inboundSPI, err := m.AllocateChildSPI()
+	require.NoError(t, err)
+	return &IKESA{
+		Role:         message.Role_Responder,
+		State:        StateEstablished,
+		InitiatorSPI: initiatorSPI,
+		ResponderSPI: responderSPI,
+		ChildSAs:     []*ChildSA{{InboundSPI: inboundSPI}},
+	}
+}
+
+func BenchmarkSAManager(b *testing.B) {
+	for _, ues := range []int{10000, 50000} {
+		m := newTestManager(b, 0)
+		now := time.Unix(1700000000, 0)
+		remote := netip.MustParseAddrPort("10.0.0.1:500")
+		ikesas := make([]*IKESA, ues)
+		for i := range ikesas {
+			ikesas[i] = newManagedIKESA(b, m, uint64(i+1))
+			require.NoError(b, m.Add(ikesas[i], remote, now))
+		}
+
+		b.Run(fmt.Sprintf("Lookup/%d", ues), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					ikesa := ikesas[i%ues]
+					if m.Lookup(ikesa.InitiatorSPI, ikesa.ResponderSPI) != ikesa {
+						b.Error("IKE SA not found")
+					}
+					i++
+				}
+			})
+		})
+
+		b.Run(fmt.Sprintf("LookupChildSA/%d", ues), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					ikesa := ikesas[i%ues]
+					if found, _ := m.LookupChildSA(ikesa.ChildSAs[0].InboundSPI); found != ikesa {
+						b.Error("Child SA not found")
+					}
+					i++
+				}
+			})
+		})
+
+		b.Run(fmt.Sprintf("AddRemove/%d", ues), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					spi, err := m.AllocateSPI()
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					ikesa := &IKESA{Role: message.Role_Responder, State: StateEstablished,
+						InitiatorSPI: spi, ResponderSPI: spi}
+					if err = m.Add(ikesa, remote, now); err != nil {
+						b.Error(err)
+						return
+					}
+					m.Remove(ikesa)
+				}
+			})
+		})
+	}
+}
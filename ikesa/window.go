@@ -0,0 +1,255 @@
+package ikesa
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// ErrOutOfWindow is returned for a message whose message ID is outside the
+// window of the IKE SA (RFC 7296 - 2.3)
+var ErrOutOfWindow = errors.New("Message ID is out of window")
+
+// ErrNoResponse is returned by Retransmitter once a request stays unanswered
+var ErrNoResponse = errors.New("No response to the request")
+
+// cachedResponse is the response to a request of the peer, sent again when
+// the request is retransmitted (RFC 7296 - 2.1)
+type cachedResponse struct {
+	messageID uint32
+	request   [sha256.Size]byte
+	response  []byte
+	// Encrypted Fragment messages the response is sent in, if fragmented
+	fragments [][]byte
+}
+
+// windowSize returns the number of requests of the peer this side accepts
+// without their responses being acknowledged, which is also the number of
+// responses cached
+func (ikesa *IKESA) windowSize() uint32 {
+	if ikesa.config == nil || ikesa.config.WindowSize == 0 {
+		return 1
+	}
+	return ikesa.config.WindowSize
+}
+
+// buildWindowSize appends the SET_WINDOW_SIZE notification if the window of
+// this side is larger than the default one
+func (ikesa *IKESA) buildWindowSize(payloads *message.IKEPayloadContainer) {
+	if size := ikesa.windowSize(); size > 1 {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, size)
+		payloads.BuildNotification(message.TypeNone, message.SET_WINDOW_SIZE, nil, data)
+	}
+}
+
+// setPeerWindowSize takes the window of the peer from its SET_WINDOW_SIZE
+// notification, if any
+func (ikesa *IKESA) setPeerWindowSize(notifications []*message.Notification) error {
+	for _, notification := range notifications {
+		if notification.NotifyMessageType != message.SET_WINDOW_SIZE {
+			continue
+		}
+		if len(notification.NotificationData) != 4 {
+			return errors.Errorf("setPeerWindowSize(): Invalid SET_WINDOW_SIZE length %d",
+				len(notification.NotificationData))
+		}
+		size := binary.BigEndian.Uint32(notification.NotificationData)
+		if size == 0 {
+			return errors.Errorf("setPeerWindowSize(): Invalid window size 0")
+		}
+		ikesa.PeerWindowSize = size
+	}
+	return nil
+}
+
+// retransmittedRequest returns the cached response to a request of the peer
+// which has already been handled, and reports whether the message is such a
+// request. The retransmission must be identical to the request handled,
+// unless it is fragmented.
+func (ikesa *IKESA) retransmittedRequest(ikeHeader *message.IKEHeader, msg []byte) ([]byte, bool, error) {
+	if ikeHeader.IsResponse() || ikesa.State == StateIdle || !ikesa.handledRequest(ikeHeader.MessageID) {
+		return nil, false, nil
+	}
+	if ikeHeader.InitiatorSPI != ikesa.InitiatorSPI {
+		return nil, false, nil
+	}
+	// The responder SPI is still zero in a retransmitted IKE_SA_INIT request
+	if ikeHeader.ResponderSPI != ikesa.ResponderSPI &&
+		(ikeHeader.ExchangeType != message.IKE_SA_INIT || ikeHeader.ResponderSPI != 0) {
+		return nil, false, nil
+	}
+
+	if ikeHeader.MessageID < ikesa.remoteMessageID &&
+		ikesa.remoteMessageID-ikeHeader.MessageID > ikesa.windowSize() {
+		return nil, true, errors.Wrapf(ErrOutOfWindow, "Request message ID %d, expect %d",
+			ikeHeader.MessageID, ikesa.remoteMessageID)
+	}
+	// The response to a fragmented request is sent again for its first
+	// fragment only, whose length may differ from the one handled
+	// (RFC 7383 - 2.6.1)
+	fragmented := message.IkePayloadType(ikeHeader.NextPayload) == message.TypeSKF
+	if fragmented && fragmentNumber(msg) != 1 {
+		return nil, true, nil
+	}
+	for _, cached := range ikesa.responses {
+		if cached.messageID != ikeHeader.MessageID {
+			continue
+		}
+		if !fragmented && cached.request != sha256.Sum256(msg) {
+			return nil, true, errors.Errorf("Request message ID %d differs from the one handled",
+				ikeHeader.MessageID)
+		}
+		return cached.response, true, nil
+	}
+	// The request has been handled without a response, or the IKE SA was
+	// deleted by it
+	return nil, true, errors.Errorf("No response to request message ID %d", ikeHeader.MessageID)
+}
+
+// checkMessageID checks that a response answers the outstanding request, and
+// that a request is in the window following the next one of the peer. The
+// requests in the window are handled as they come, since the peer does not
+// wait for the previous responses to send them (RFC 7296 - 2.3).
+func (ikesa *IKESA) checkMessageID(ikeHeader *message.IKEHeader) error {
+	if ikeHeader.IsResponse() {
+		if ikeHeader.MessageID != ikesa.localMessageID {
+			return errors.Wrapf(ErrOutOfWindow, "Response message ID %d, expect %d",
+				ikeHeader.MessageID, ikesa.localMessageID)
+		}
+		return nil
+	}
+	if ikeHeader.MessageID >= ikesa.remoteMessageID &&
+		ikeHeader.MessageID-ikesa.remoteMessageID < ikesa.windowSize() {
+		return nil
+	}
+	return errors.Wrapf(ErrOutOfWindow, "Request message ID %d, expect %d",
+		ikeHeader.MessageID, ikesa.remoteMessageID)
+}
+
+// handledRequest reports whether the request of the peer with the message ID
+// has been handled
+func (ikesa *IKESA) handledRequest(messageID uint32) bool {
+	return messageID < ikesa.remoteMessageID || ikesa.remoteHandled[messageID]
+}
+
+// acceptRequest records a handled request of the peer. The next request
+// expected moves past the requests handled ahead of it.
+func (ikesa *IKESA) acceptRequest(messageID uint32) {
+	if messageID != ikesa.remoteMessageID {
+		if ikesa.remoteHandled == nil {
+			ikesa.remoteHandled = make(map[uint32]bool)
+		}
+		ikesa.remoteHandled[messageID] = true
+		return
+	}
+	ikesa.remoteMessageID++
+	for ikesa.remoteHandled[ikesa.remoteMessageID] {
+		delete(ikesa.remoteHandled, ikesa.remoteMessageID)
+		ikesa.remoteMessageID++
+	}
+}
+
+// cacheResponse keeps the response to the request of the peer, and drops the
+// responses to the requests which have left the window
+func (ikesa *IKESA) cacheResponse(messageID uint32, request, response []byte, fragments [][]byte) {
+	size := ikesa.windowSize()
+	kept := ikesa.responses[:0]
+	for _, cached := range ikesa.responses {
+		if cached.messageID >= ikesa.remoteMessageID || ikesa.remoteMessageID-cached.messageID <= size {
+			kept = append(kept, cached)
+		}
+	}
+	ikesa.responses = append(kept, cachedResponse{
+		messageID: messageID,
+		request:   sha256.Sum256(request),
+		response:  response,
+		fragments: fragments,
+	})
+}
+
+// RetransmitConfig sets when the requests of an IKE SA are sent again
+type RetransmitConfig struct {
+	// Time to wait for the response before the first retransmission, doubled
+	// after each retransmission
+	Timeout time.Duration
+	// Upper bound of the doubled timeout, unbounded if zero
+	MaxTimeout time.Duration
+	// Retransmissions of an unanswered request before giving up
+	Retries int
+}
+
+// Retransmitter sends the requests of an IKE SA again until they are answered,
+// with an exponential backoff (RFC 7296 - 2.1). It does no I/O: Poll is called
+// once a request is sent by the IKE SA, and then at the time returned by Next.
+// The liveness checks of a DPD are retransmitted by the DPD itself.
+type Retransmitter struct {
+	ikesa  *IKESA
+	config RetransmitConfig
+
+	// Request waiting for its response, how many times it is sent, and the
+	// timeout of its last transmission
+	request []byte
+	sent    int
+	timeout time.Duration
+	next    time.Time
+}
+
+// NewRetransmitter returns the retransmissions of the requests of the IKE SA
+func NewRetransmitter(ikesa *IKESA, config RetransmitConfig) (*Retransmitter, error) {
+	if ikesa == nil {
+		return nil, errors.Errorf("NewRetransmitter(): IKE SA is nil")
+	}
+	if config.Timeout <= 0 || config.MaxTimeout < 0 || config.Retries < 0 {
+		return nil, errors.Errorf("NewRetransmitter(): Invalid timeout %s, max timeout %s or retries %d",
+			config.Timeout, config.MaxTimeout, config.Retries)
+	}
+	return &Retransmitter{
+		ikesa:  ikesa,
+		config: config,
+	}, nil
+}
+
+// Next returns the time Poll is to be called at, or the zero time if no
+// request is waiting for its response
+func (r *Retransmitter) Next() time.Time {
+	return r.next
+}
+
+// Poll returns the request to send again at now, in the datagrams returned by
+// IKESA.Datagrams. A request newly sent by the IKE SA is scheduled for its
+// first retransmission a timeout after now. Once the retransmissions are
+// exhausted, the IKE SA is deleted and ErrNoResponse is returned.
+func (r *Retransmitter) Poll(now time.Time) ([]byte, error) {
+	outstanding := r.ikesa.outstanding
+	if outstanding == nil || r.ikesa.State == StateDeleted {
+		r.request, r.next = nil, time.Time{}
+		return nil, nil
+	}
+	if !bytes.Equal(outstanding, r.request) {
+		r.request, r.sent, r.timeout = outstanding, 1, r.config.Timeout
+		r.next = now.Add(r.timeout)
+		return nil, nil
+	}
+	if now.Before(r.next) {
+		return nil, nil
+	}
+
+	if r.sent > r.config.Retries {
+		r.request, r.next = nil, time.Time{}
+		r.ikesa.State = StateDeleted
+		return nil, ErrNoResponse
+	}
+	r.sent++
+	r.timeout *= 2
+	if r.config.MaxTimeout != 0 && r.timeout > r.config.MaxTimeout {
+		r.timeout = r.config.MaxTimeout
+	}
+	r.next = now.Add(r.timeout)
+	return r.request, nil
+}
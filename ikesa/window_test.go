@@ -0,0 +1,252 @@
+package ikesa
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+func TestIKESARetransmittedRequest(t *testing.T) {
+	t.Run("IKE_SA_INIT and IKE_AUTH", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, err := NewInitiator(initiatorConfig)
+		require.NoError(t, err)
+		responder, err := NewResponder(responderConfig)
+		require.NoError(t, err)
+
+		initRequest, err := initiator.Initiate()
+		require.NoError(t, err)
+		initResponse, _, err := responder.HandleMessage(initRequest)
+		require.NoError(t, err)
+		replayed, event, err := responder.HandleMessage(initRequest)
+		require.NoError(t, err)
+		require.Equal(t, EventNone, event)
+		require.Equal(t, initResponse, replayed)
+		require.Equal(t, StateIKESAInitDone, responder.State)
+
+		authRequest, _, err := initiator.HandleMessage(initResponse)
+		require.NoError(t, err)
+		authResponse, event, err := responder.HandleMessage(authRequest)
+		require.NoError(t, err)
+		require.Equal(t, EventEstablished, event)
+		replayed, event, err = responder.HandleMessage(authRequest)
+		require.NoError(t, err)
+		require.Equal(t, EventNone, event)
+		require.Equal(t, authResponse, replayed)
+		require.Len(t, responder.ChildSAs, 1)
+
+		_, event, err = initiator.HandleMessage(authResponse)
+		require.NoError(t, err)
+		require.Equal(t, EventEstablished, event)
+		requireChildSAPaired(t, initiator, responder)
+
+		// The response is handled once
+		_, _, err = initiator.HandleMessage(authResponse)
+		require.ErrorIs(t, err, ErrOutOfWindow)
+	})
+
+	t.Run("Modified request", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+		request, err := initiator.LivenessCheck()
+		require.NoError(t, err)
+		_, _, err = responder.HandleMessage(request)
+		require.NoError(t, err)
+
+		modified := append([]byte{}, request...)
+		modified[len(modified)-1] ^= 0xff
+		_, _, err = responder.HandleMessage(modified)
+		require.Error(t, err)
+	})
+
+	t.Run("Out of window", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+
+		first, err := initiator.LivenessCheck()
+		require.NoError(t, err)
+		exchange(t, initiator, responder, first)
+		second, err := initiator.LivenessCheck()
+		require.NoError(t, err)
+		exchange(t, initiator, responder, second)
+
+		// Only the last response is cached with the default window
+		_, _, err = responder.HandleMessage(first)
+		require.ErrorIs(t, err, ErrOutOfWindow)
+
+		// A request ahead of the window
+		request := initiator.newRequest(message.INFORMATIONAL, nil)
+		request.MessageID += 2
+		ahead, err := initiator.encode(request)
+		require.NoError(t, err)
+		_, _, err = responder.HandleMessage(ahead)
+		require.ErrorIs(t, err, ErrOutOfWindow)
+	})
+}
+
+func TestIKESAWindowSize(t *testing.T) {
+	initiatorConfig, responderConfig := newTestConfigs(t)
+	initiatorConfig.WindowSize = 3
+	responderConfig.WindowSize = 4
+	initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+	require.Equal(t, uint32(4), initiator.PeerWindowSize)
+	require.Equal(t, uint32(3), responder.PeerWindowSize)
+
+	var requests, responses [][]byte
+	for i := 0; i < 5; i++ {
+		request, err := initiator.LivenessCheck()
+		require.NoError(t, err)
+		response, _, err := responder.HandleMessage(request)
+		require.NoError(t, err)
+		_, _, err = initiator.HandleMessage(response)
+		require.NoError(t, err)
+		requests, responses = append(requests, request), append(responses, response)
+	}
+
+	// The responses to the last four requests are cached
+	for i := 1; i < 5; i++ {
+		replayed, _, err := responder.HandleMessage(requests[i])
+		require.NoError(t, err)
+		require.Equal(t, responses[i], replayed)
+	}
+	_, _, err := responder.HandleMessage(requests[0])
+	require.ErrorIs(t, err, ErrOutOfWindow)
+
+	// The requests in the window are handled as they come
+	next := responder.remoteMessageID
+	var ahead [][]byte
+	for i := 0; i < 4; i++ {
+		request := initiator.newRequest(message.INFORMATIONAL, nil)
+		request.MessageID += uint32(i)
+		msg, encodeErr := initiator.encode(request)
+		require.NoError(t, encodeErr)
+		ahead = append(ahead, msg)
+	}
+	var aheadResponses [][]byte
+	for _, i := range []int{2, 0, 3, 1} {
+		response, _, handleErr := responder.HandleMessage(ahead[i])
+		require.NoError(t, handleErr)
+		require.NotNil(t, response)
+		aheadResponses = append(aheadResponses, response)
+	}
+	require.Equal(t, next+4, responder.remoteMessageID)
+	require.Empty(t, responder.remoteHandled)
+	replayed, _, err := responder.HandleMessage(ahead[2])
+	require.NoError(t, err)
+	require.Equal(t, aheadResponses[0], replayed)
+
+	// Beyond the window
+	request := initiator.newRequest(message.INFORMATIONAL, nil)
+	request.MessageID += 8
+	beyond, err := initiator.encode(request)
+	require.NoError(t, err)
+	_, _, err = responder.HandleMessage(beyond)
+	require.ErrorIs(t, err, ErrOutOfWindow)
+}
+
+func TestNewRetransmitter(t *testing.T) {
+	testcases := []struct {
+		description string
+		config      RetransmitConfig
+		expectErr   bool
+	}{
+		{
+			description: "Valid",
+			config:      RetransmitConfig{Timeout: time.Second, MaxTimeout: 8 * time.Second, Retries: 5},
+		},
+		{
+			description: "Unbounded timeout",
+			config:      RetransmitConfig{Timeout: time.Second, Retries: 5},
+		},
+		{
+			description: "No timeout",
+			config:      RetransmitConfig{Retries: 5},
+			expectErr:   true,
+		},
+		{
+			description: "Negative retries",
+			config:      RetransmitConfig{Timeout: time.Second, Retries: -1},
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := NewRetransmitter(&IKESA{}, tc.config)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRetransmitter(t *testing.T) {
+	config := RetransmitConfig{Timeout: time.Second, MaxTimeout: 4 * time.Second, Retries: 4}
+	start := time.Unix(1700000000, 0)
+
+	t.Run("Answered", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, responder := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+		r, err := NewRetransmitter(initiator, config)
+		require.NoError(t, err)
+
+		msg, err := r.Poll(start)
+		require.NoError(t, err)
+		require.Nil(t, msg)
+		require.True(t, r.Next().IsZero())
+
+		request, err := initiator.CreateChildSA(initiatorConfig.TSi, initiatorConfig.TSr)
+		require.NoError(t, err)
+		msg, err = r.Poll(start)
+		require.NoError(t, err)
+		require.Nil(t, msg)
+		require.Equal(t, start.Add(time.Second), r.Next())
+
+		// The request is lost, and the retransmission answered
+		msg, err = r.Poll(r.Next())
+		require.NoError(t, err)
+		require.Equal(t, request, msg)
+		fromEvent, _, _ := exchange(t, initiator, responder, msg)
+		require.Equal(t, EventChildSACreated, fromEvent)
+
+		msg, err = r.Poll(r.Next())
+		require.NoError(t, err)
+		require.Nil(t, msg)
+		require.True(t, r.Next().IsZero())
+	})
+
+	t.Run("Exponential backoff", func(t *testing.T) {
+		initiatorConfig, responderConfig := newTestConfigs(t)
+		initiator, _ := newEstablishedIKESAs(t, initiatorConfig, responderConfig)
+		r, err := NewRetransmitter(initiator, config)
+		require.NoError(t, err)
+
+		request, err := initiator.DeleteIKESA()
+		require.NoError(t, err)
+		_, err = r.Poll(start)
+		require.NoError(t, err)
+
+		now := start
+		for _, timeout := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+			now = now.Add(timeout)
+			require.Equal(t, now, r.Next())
+			msg, pollErr := r.Poll(now.Add(-time.Millisecond))
+			require.NoError(t, pollErr)
+			require.Nil(t, msg)
+			msg, pollErr = r.Poll(now)
+			require.NoError(t, pollErr)
+			require.Equal(t, request, msg)
+		}
+
+		_, err = r.Poll(r.Next())
+		require.ErrorIs(t, err, ErrNoResponse)
+		require.Equal(t, StateDeleted, initiator.State)
+		require.True(t, r.Next().IsZero())
+	})
+}
@@ -44,6 +44,25 @@ func (container *IKEPayloadContainer) BuildEncrypted(nextPayload IkePayloadType,
 	return encrypted
 }
 
+func (container *IKEPayloadContainer) BuildEncryptedFragment(nextPayload IkePayloadType,
+	fragmentNumber uint16, totalFragments uint16, encryptedData []byte,
+) *EncryptedFragment {
+	fragment := new(EncryptedFragment)
+	fragment.NextPayload = uint8(nextPayload)
+	fragment.FragmentNumber = fragmentNumber
+	fragment.TotalFragments = totalFragments
+	fragment.EncryptedData = append(fragment.EncryptedData, encryptedData...)
+	*container = append(*container, fragment)
+	return fragment
+}
+
+// BuildNotifyIKEV2_FRAGMENTATION_SUPPORTED appends the notification of
+// IKE_SA_INIT telling the peer that IKE fragmentation is supported, which has
+// no data (RFC 7383 - 2.3)
+func (container *IKEPayloadContainer) BuildNotifyIKEV2_FRAGMENTATION_SUPPORTED() {
+	container.BuildNotification(TypeNone, IKEV2_FRAGMENTATION_SUPPORTED, nil, nil)
+}
+
 func (container *IKEPayloadContainer) BuildKeyExchange(diffiehellmanGroup uint16, keyExchangeData []byte) {
 	keyExchange := new(KeyExchange)
 	keyExchange.DiffieHellmanGroup = diffiehellmanGroup
@@ -152,17 +171,31 @@ func (container *ProposalContainer) BuildProposal(proposalNumber uint8, protocol
 	return proposal
 }
 
-func (container *IKEPayloadContainer) BuildDeletePayload(
-	protocolID uint8, spiSize uint8, numberOfSPI uint16, spis []uint32,
-) {
+func (container *IKEPayloadContainer) BuildDeletePayload(protocolID uint8, spiSize uint8, spis [][]byte) {
 	deletePayload := new(Delete)
 	deletePayload.ProtocolID = protocolID
 	deletePayload.SPISize = spiSize
-	deletePayload.NumberOfSPI = numberOfSPI
 	deletePayload.SPIs = spis
 	*container = append(*container, deletePayload)
 }
 
+// BuildDeleteIKESA builds the Delete payload of the IKE SA of the message
+func (container *IKEPayloadContainer) BuildDeleteIKESA() {
+	container.BuildDeletePayload(TypeIKE, 0, nil)
+}
+
+// BuildDeleteChildSAs builds the Delete payload of Child SAs of protocolID,
+// ESP or AH, identified by the SPIs of their inbound packets
+func (container *IKEPayloadContainer) BuildDeleteChildSAs(protocolID uint8, spis []uint32) {
+	spiBytes := make([][]byte, 0, len(spis))
+	for _, spi := range spis {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, spi)
+		spiBytes = append(spiBytes, b)
+	}
+	container.BuildDeletePayload(protocolID, 4, spiBytes)
+}
+
 func (container *TransformContainer) Reset() {
 	*container = nil
 }
@@ -209,104 +242,39 @@ func (container *IKEPayloadContainer) BuildEAP(code eap_message.EapCode, identif
 	return eap
 }
 
-func BuildEAPAKAEapTypeData(subtype eap_message.EapAkaSubtype, attributeMap map[eap_message.EapAkaAttrType]*eap_message.EapAkaAttr) *eap_message.EapAka {
-
-	eapAka := new(eap_message.EapAka)
-	eapAka.SubType = subtype
-	eapAka.Attributes = attributeMap
-
-	return eapAka
-}
-func pad4(b []byte) []byte {
-	if m := len(b) % 4; m != 0 {
-		return append(b, make([]byte, 4-m)...)
+// BuildEAPAKAEapTypeData builds the EAP-AKA type data with the attributes,
+// each validated by EapAka.SetAttr
+func BuildEAPAKAEapTypeData(
+	subtype eap_message.EapAkaSubtype, attributes map[eap_message.EapAkaAttrType][]byte,
+) (*eap_message.EapAka, error) {
+	eapAka := eap_message.NewEapAka(subtype)
+	for attrType, value := range attributes {
+		if err := eapAka.SetAttr(attrType, value); err != nil {
+			return nil, errors.Wrapf(err, "BuildEAPAKAEapTypeData()")
+		}
 	}
-	return b
-}
-func akaAttrLen(valuePaddedLen int) uint8 {
-	total := 4 + valuePaddedLen // 头(4B) + 对齐后的 Value
-	return uint8(total / 4)
+	return eapAka, nil
 }
 
+// BuildEapAkaAttr returns the attribute validated by EapAka.SetAttr, whose
+// value is vStr for AT_IDENTITY and vBytes otherwise, or nil if the value is
+// invalid.
+//
+// Deprecated: Use EapAka.SetAttr, or BuildEAPAKAEapTypeData.
 func BuildEapAkaAttr(attrType eap_message.EapAkaAttrType, vStr string, vBytes []byte) *eap_message.EapAkaAttr {
-
-	switch attrType {
-	case eap_message.AKA_AT_IDENTITY: // AT_IDENTITY
-		idBytes := []byte(vStr)
-		pad := (4 - (len(idBytes) % 4)) % 4
-		paddedLen := len(idBytes) + pad // Value 长度(含padding)
-		l := uint8((4 + paddedLen) / 4) // 头4B + Value，再除以4
-
-		return &eap_message.EapAkaAttr{
-			AttrType:            attrType,            // 14
-			Length:              l,                   // 例如 60/4=15
-			Identity_actual_len: uint8(len(idBytes)), // 54
-			Identity:            vStr,                // "0505030000000001@nai.epc.mnc003.mcc505.3gppnetwork.org"
-			Padding:             "0000",
-		}
-
-	case eap_message.AKA_AT_RES: // AT_RES
-		// resBytes 是你算出来的 8B RES（不是 hex 字符串）
-		resBytes := vBytes
-
-		// Value = 2B 位长(大端) + RES
-		val := make([]byte, 2+len(resBytes))
-		binary.BigEndian.PutUint16(val[:2], uint16(len(resBytes)*8)) // 8B -> 64 -> 0x0040
-		copy(val[2:], resBytes)
-
-		// 计算 Length（单位4字节：Type+Len=2B，剩下是 val，再补零对齐）
-		total := 2 + len(val)
-		if pad := (4 - (total % 4)) % 4; pad > 0 {
-			val = append(val, make([]byte, pad)...)
-			total += pad
-		}
-		l := uint8(total / 4)
-
-		return &eap_message.EapAkaAttr{
-			AttrType: eap_message.AKA_AT_RES,
-			Length:   l,
-			Value:    val, // 已含“位长+RES(+pad)”
-		}
-
-	//case eap_message.AKA_AT_MAC:
-	//	// 如果传进来的是十六进制字符串（例如 "0000ecb1be7e..."），要先 decode
-	//
-	//	l := akaAttrLen(len(vBytes))
-	//
-	//	return &eap_message.EapAkaAttr{
-	//		AttrType: attrType,
-	//		Length:   l,
-	//		Value:    vBytes,
-	//	}
-	case eap_message.AKA_AT_MAC:
-		// vBytes 是你算出来的 16B MAC
-		//if len(vBytes) != 16 {
-		//	return nil, fmt.Errorf("AT_MAC: expect 16-byte MAC, got %d", len(vBytes))
-		//}
-
-		// 2B Reserved(0x0000) + MAC(16B)
-		val := make([]byte, 2+len(vBytes))
-		// Reserved 默认 0x0000
-		copy(val[2:], vBytes)
-
-		// 计算 Length (单位 4B)
-		total := 2 /*Type+Len*/ + len(val)
-		if pad := (4 - (total % 4)) % 4; pad > 0 {
-			val = append(val, make([]byte, pad)...)
-			total += pad
-		}
-		l := uint8(total / 4)
-
-		return &eap_message.EapAkaAttr{
-			AttrType: attrType,
-			Length:   l,
-			Value:    val, // 已含 reserved+mac(+pad)
-		}
-
-	default:
+	value := vBytes
+	if attrType == eap_message.AKA_AT_IDENTITY {
+		value = []byte(vStr)
+	}
+	eapAka := eap_message.NewEapAka(eap_message.SubtypeAkaChallenge)
+	if err := eapAka.SetAttr(attrType, value); err != nil {
 		return nil
 	}
-
+	attr, err := eapAka.GetAttr(attrType)
+	if err != nil {
+		return nil
+	}
+	return &attr
 }
 
 func (container *IKEPayloadContainer) BuildEAPSuccess(identifier uint8) {
@@ -431,6 +399,24 @@ func (container *IKEPayloadContainer) BuildNotifyUP_IP4_ADDRESS(upIPAddr string)
 	}
 }
 
+func (container *IKEPayloadContainer) BuildNotifyNAS_IP6_ADDRESS(nasIPAddr string) {
+	if nasIPAddr == "" {
+		return
+	} else {
+		ipAddrByte := net.ParseIP(nasIPAddr).To16()
+		container.BuildNotification(TypeNone, Vendor3GPPNotifyTypeNAS_IP6_ADDRESS, nil, ipAddrByte)
+	}
+}
+
+func (container *IKEPayloadContainer) BuildNotifyUP_IP6_ADDRESS(upIPAddr string) {
+	if upIPAddr == "" {
+		return
+	} else {
+		ipAddrByte := net.ParseIP(upIPAddr).To16()
+		container.BuildNotification(TypeNone, Vendor3GPPNotifyTypeUP_IP6_ADDRESS, nil, ipAddrByte)
+	}
+}
+
 func (container *IKEPayloadContainer) BuildNotifyNAS_TCP_PORT(port uint16) {
 	if port == 0 {
 		return
@@ -0,0 +1,501 @@
+package message
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+)
+
+// Length of the Message-Id and Spare fields heading every EAP-5G message, and
+// of the length fields of the AN-parameters and the NAS-PDU
+const (
+	eap5GHeaderLen       = 2
+	eap5GLengthFieldLen  = 2
+	anParameterHeaderLen = 2
+)
+
+// EAP5GMessage is the vendor data of an EAP-5G message (3GPP TS 24.502 -
+// 9.3.2), carried in an EAP expanded type
+type EAP5GMessage interface {
+	MessageID() uint8
+	Marshal() (*eap_message.EapExpanded, error)
+	Unmarshal(eapExpanded *eap_message.EapExpanded) error
+}
+
+var (
+	_ EAP5GMessage = &EAP5GStart{}
+	_ EAP5GMessage = &EAP5GNASRequest{}
+	_ EAP5GMessage = &EAP5GNASResponse{}
+	_ EAP5GMessage = &EAP5GNotificationRequest{}
+	_ EAP5GMessage = &EAP5GNotificationResponse{}
+	_ EAP5GMessage = &EAP5GStop{}
+)
+
+// EAP5GStart is the EAP-Request/5G-Start starting EAP-5G
+type EAP5GStart struct {
+	Extensions []byte
+}
+
+// EAP5GNASRequest is the EAP-Request/5G-NAS carrying a NAS message of the AMF
+type EAP5GNASRequest struct {
+	NASPDU     []byte
+	Extensions []byte
+}
+
+// EAP5GNASResponse is the EAP-Response/5G-NAS carrying a NAS message of the
+// UE, and the AN-parameters the N3IWF selects the AMF with
+type EAP5GNASResponse struct {
+	ANParameters *ANParameters
+	NASPDU       []byte
+	Extensions   []byte
+}
+
+// EAP5GNotificationRequest is the EAP-Request/5G-Notification, whose content
+// following the message header is kept as encoded
+type EAP5GNotificationRequest struct {
+	Data []byte
+}
+
+// EAP5GNotificationResponse is the EAP-Response/5G-Notification acknowledging
+// the notification
+type EAP5GNotificationResponse struct {
+	Extensions []byte
+}
+
+// EAP5GStop is the EAP-Response/5G-Stop ending EAP-5G
+type EAP5GStop struct {
+	Extensions []byte
+}
+
+// ParseEAP5G decodes the EAP-5G message of an EAP request or response
+func ParseEAP5G(eap *eap_message.EAP) (EAP5GMessage, error) {
+	if eap == nil {
+		return nil, errors.Errorf("ParseEAP5G(): EAP is nil")
+	}
+	eapExpanded, ok := eap.EapTypeData.(*eap_message.EapExpanded)
+	if !ok {
+		return nil, errors.Errorf("ParseEAP5G(): Not an EAP expanded type")
+	}
+	if err := checkEAP5GVendorData(eapExpanded, 0); err != nil {
+		return nil, errors.Wrapf(err, "ParseEAP5G()")
+	}
+
+	var msg EAP5GMessage
+	switch messageID := eapExpanded.VendorData[0]; {
+	case messageID == EAP5GType5GStart && eap.Code == eap_message.EapCodeRequest:
+		msg = new(EAP5GStart)
+	case messageID == EAP5GType5GNAS && eap.Code == eap_message.EapCodeRequest:
+		msg = new(EAP5GNASRequest)
+	case messageID == EAP5GType5GNAS && eap.Code == eap_message.EapCodeResponse:
+		msg = new(EAP5GNASResponse)
+	case messageID == EAP5GType5GNotification && eap.Code == eap_message.EapCodeRequest:
+		msg = new(EAP5GNotificationRequest)
+	case messageID == EAP5GType5GNotification && eap.Code == eap_message.EapCodeResponse:
+		msg = new(EAP5GNotificationResponse)
+	case messageID == EAP5GType5GStop && eap.Code == eap_message.EapCodeResponse:
+		msg = new(EAP5GStop)
+	default:
+		return nil, errors.Errorf("ParseEAP5G(): Unexpected message ID %d in EAP code %d", messageID, eap.Code)
+	}
+	if err := msg.Unmarshal(eapExpanded); err != nil {
+		return nil, errors.Wrapf(err, "ParseEAP5G()")
+	}
+	return msg, nil
+}
+
+func (start *EAP5GStart) MessageID() uint8 { return EAP5GType5GStart }
+
+func (start *EAP5GStart) Marshal() (*eap_message.EapExpanded, error) {
+	return buildEAP5G(EAP5GType5GStart, start.Extensions), nil
+}
+
+func (start *EAP5GStart) Unmarshal(eapExpanded *eap_message.EapExpanded) error {
+	if err := checkEAP5GVendorData(eapExpanded, EAP5GType5GStart); err != nil {
+		return errors.Wrapf(err, "EAP5GStart")
+	}
+	start.Extensions = cloneBytes(eapExpanded.VendorData[eap5GHeaderLen:])
+	return nil
+}
+
+func (request *EAP5GNASRequest) MessageID() uint8 { return EAP5GType5GNAS }
+
+func (request *EAP5GNASRequest) Marshal() (*eap_message.EapExpanded, error) {
+	if len(request.NASPDU) == 0 {
+		return nil, errors.Errorf("EAP5GNASRequest: NAS-PDU is empty")
+	}
+	data, err := appendLengthValue(nil, request.NASPDU)
+	if err != nil {
+		return nil, errors.Wrapf(err, "EAP5GNASRequest: NAS-PDU")
+	}
+	return buildEAP5G(EAP5GType5GNAS, append(data, request.Extensions...)), nil
+}
+
+func (request *EAP5GNASRequest) Unmarshal(eapExpanded *eap_message.EapExpanded) error {
+	if err := checkEAP5GVendorData(eapExpanded, EAP5GType5GNAS); err != nil {
+		return errors.Wrapf(err, "EAP5GNASRequest")
+	}
+	nasPDU, rest, err := parseLengthValue(eapExpanded.VendorData[eap5GHeaderLen:])
+	if err != nil {
+		return errors.Wrapf(err, "EAP5GNASRequest: NAS-PDU")
+	}
+	if len(nasPDU) == 0 {
+		return errors.Errorf("EAP5GNASRequest: NAS-PDU is empty")
+	}
+	request.NASPDU, request.Extensions = cloneBytes(nasPDU), cloneBytes(rest)
+	return nil
+}
+
+func (response *EAP5GNASResponse) MessageID() uint8 { return EAP5GType5GNAS }
+
+func (response *EAP5GNASResponse) Marshal() (*eap_message.EapExpanded, error) {
+	if len(response.NASPDU) == 0 {
+		return nil, errors.Errorf("EAP5GNASResponse: NAS-PDU is empty")
+	}
+	var anParameters []byte
+	if response.ANParameters != nil {
+		var err error
+		if anParameters, err = response.ANParameters.Marshal(); err != nil {
+			return nil, errors.Wrapf(err, "EAP5GNASResponse")
+		}
+	}
+	data, err := appendLengthValue(nil, anParameters)
+	if err != nil {
+		return nil, errors.Wrapf(err, "EAP5GNASResponse: AN-parameters")
+	}
+	if data, err = appendLengthValue(data, response.NASPDU); err != nil {
+		return nil, errors.Wrapf(err, "EAP5GNASResponse: NAS-PDU")
+	}
+	return buildEAP5G(EAP5GType5GNAS, append(data, response.Extensions...)), nil
+}
+
+func (response *EAP5GNASResponse) Unmarshal(eapExpanded *eap_message.EapExpanded) error {
+	if err := checkEAP5GVendorData(eapExpanded, EAP5GType5GNAS); err != nil {
+		return errors.Wrapf(err, "EAP5GNASResponse")
+	}
+	anParameters, rest, err := parseLengthValue(eapExpanded.VendorData[eap5GHeaderLen:])
+	if err != nil {
+		return errors.Wrapf(err, "EAP5GNASResponse: AN-parameters")
+	}
+	nasPDU, rest, err := parseLengthValue(rest)
+	if err != nil {
+		return errors.Wrapf(err, "EAP5GNASResponse: NAS-PDU")
+	}
+	if len(nasPDU) == 0 {
+		return errors.Errorf("EAP5GNASResponse: NAS-PDU is empty")
+	}
+
+	response.ANParameters = nil
+	if len(anParameters) != 0 {
+		response.ANParameters = new(ANParameters)
+		if err = response.ANParameters.Unmarshal(anParameters); err != nil {
+			return errors.Wrapf(err, "EAP5GNASResponse")
+		}
+	}
+	response.NASPDU, response.Extensions = cloneBytes(nasPDU), cloneBytes(rest)
+	return nil
+}
+
+func (request *EAP5GNotificationRequest) MessageID() uint8 { return EAP5GType5GNotification }
+
+func (request *EAP5GNotificationRequest) Marshal() (*eap_message.EapExpanded, error) {
+	return buildEAP5G(EAP5GType5GNotification, request.Data), nil
+}
+
+func (request *EAP5GNotificationRequest) Unmarshal(eapExpanded *eap_message.EapExpanded) error {
+	if err := checkEAP5GVendorData(eapExpanded, EAP5GType5GNotification); err != nil {
+		return errors.Wrapf(err, "EAP5GNotificationRequest")
+	}
+	request.Data = cloneBytes(eapExpanded.VendorData[eap5GHeaderLen:])
+	return nil
+}
+
+func (response *EAP5GNotificationResponse) MessageID() uint8 { return EAP5GType5GNotification }
+
+func (response *EAP5GNotificationResponse) Marshal() (*eap_message.EapExpanded, error) {
+	return buildEAP5G(EAP5GType5GNotification, response.Extensions), nil
+}
+
+func (response *EAP5GNotificationResponse) Unmarshal(eapExpanded *eap_message.EapExpanded) error {
+	if err := checkEAP5GVendorData(eapExpanded, EAP5GType5GNotification); err != nil {
+		return errors.Wrapf(err, "EAP5GNotificationResponse")
+	}
+	response.Extensions = cloneBytes(eapExpanded.VendorData[eap5GHeaderLen:])
+	return nil
+}
+
+func (stop *EAP5GStop) MessageID() uint8 { return EAP5GType5GStop }
+
+func (stop *EAP5GStop) Marshal() (*eap_message.EapExpanded, error) {
+	return buildEAP5G(EAP5GType5GStop, stop.Extensions), nil
+}
+
+func (stop *EAP5GStop) Unmarshal(eapExpanded *eap_message.EapExpanded) error {
+	if err := checkEAP5GVendorData(eapExpanded, EAP5GType5GStop); err != nil {
+		return errors.Wrapf(err, "EAP5GStop")
+	}
+	stop.Extensions = cloneBytes(eapExpanded.VendorData[eap5GHeaderLen:])
+	return nil
+}
+
+// GUAMI identifies the AMF the UE is registered with (3GPP TS 23.003 - 2.10.1)
+type GUAMI struct {
+	PLMNID      [ANParametersLenPLMNID]byte
+	AMFRegionID uint8
+	AMFSetID    uint16 // 10 bits
+	AMFPointer  uint8  // 6 bits
+}
+
+// SNSSAI is an S-NSSAI of the requested NSSAI, coded as the S-NSSAI IE
+// without its type (3GPP TS 24.501 - 9.11.2.8)
+type SNSSAI struct {
+	SST uint8
+	SD  []byte // 3 octets, nil if absent
+	// S-NSSAI of the HPLMN the S-NSSAI is mapped to, MappedSD needs SD
+	MappedSST *uint8
+	MappedSD  []byte
+}
+
+// ANParameters are the AN-parameters of an EAP-Response/5G-NAS (3GPP TS
+// 24.502 - 9.3.2.2.2). Unset parameters are nil.
+type ANParameters struct {
+	GUAMI              *GUAMI
+	SelectedPLMNID     []byte // 3 octets
+	RequestedNSSAI     []SNSSAI
+	EstablishmentCause *uint8
+	SelectedNID        []byte // 6 octets
+	// 5GS mobile identity IE contents
+	UEIdentity []byte
+}
+
+// anParameterLengths are the lengths of the fixed size AN-parameters
+var anParameterLengths = map[uint8]int{
+	ANParametersTypeGUAMI:              ANParametersLenGUAMI,
+	ANParametersTypeSelectedPLMNID:     ANParametersLenPLMNID,
+	ANParametersTypeEstablishmentCause: ANParametersLenEstCause,
+	ANParametersTypeSelectedNID:        ANParametersLenNID,
+}
+
+func (p *ANParameters) Marshal() ([]byte, error) {
+	var data []byte
+	var err error
+	appendParameter := func(parameterType uint8, value []byte) {
+		if err != nil {
+			return
+		}
+		if length, ok := anParameterLengths[parameterType]; ok && len(value) != length {
+			err = errors.Errorf("ANParameters: Invalid length %d of type %d", len(value), parameterType)
+			return
+		}
+		if len(value) == 0 || len(value) > 0xFF {
+			err = errors.Errorf("ANParameters: Invalid length %d of type %d", len(value), parameterType)
+			return
+		}
+		data = append(data, parameterType, uint8(len(value)))
+		data = append(data, value...)
+	}
+
+	if p.GUAMI != nil {
+		if p.GUAMI.AMFSetID > 0x3FF || p.GUAMI.AMFPointer > 0x3F {
+			return nil, errors.Errorf("ANParameters: Invalid AMF set ID %d or pointer %d",
+				p.GUAMI.AMFSetID, p.GUAMI.AMFPointer)
+		}
+		guami := make([]byte, ANParametersLenGUAMI)
+		copy(guami, p.GUAMI.PLMNID[:])
+		guami[3] = p.GUAMI.AMFRegionID
+		binary.BigEndian.PutUint16(guami[4:6], p.GUAMI.AMFSetID<<6|uint16(p.GUAMI.AMFPointer))
+		appendParameter(ANParametersTypeGUAMI, guami)
+	}
+	if p.SelectedPLMNID != nil {
+		appendParameter(ANParametersTypeSelectedPLMNID, p.SelectedPLMNID)
+	}
+	if p.RequestedNSSAI != nil {
+		var nssai []byte
+		for i := range p.RequestedNSSAI {
+			snssai, snssaiErr := p.RequestedNSSAI[i].marshal()
+			if snssaiErr != nil {
+				return nil, errors.Wrapf(snssaiErr, "ANParameters")
+			}
+			nssai = append(nssai, uint8(len(snssai)))
+			nssai = append(nssai, snssai...)
+		}
+		appendParameter(ANParametersTypeRequestedNSSAI, nssai)
+	}
+	if p.EstablishmentCause != nil {
+		appendParameter(ANParametersTypeEstablishmentCause, []byte{*p.EstablishmentCause})
+	}
+	if p.SelectedNID != nil {
+		appendParameter(ANParametersTypeSelectedNID, p.SelectedNID)
+	}
+	if p.UEIdentity != nil {
+		appendParameter(ANParametersTypeUEIdentity, p.UEIdentity)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Unmarshal decodes the AN-parameters, and skips the ones of unknown types
+func (p *ANParameters) Unmarshal(b []byte) error {
+	*p = ANParameters{}
+	seen := make(map[uint8]bool)
+	for len(b) > 0 {
+		if len(b) < anParameterHeaderLen {
+			return errors.Errorf("ANParameters: No sufficient bytes to decode the AN-parameter header")
+		}
+		parameterType, length := b[0], int(b[1])
+		if len(b) < anParameterHeaderLen+length {
+			return errors.Errorf("ANParameters: No sufficient bytes to decode type %d of length %d",
+				parameterType, length)
+		}
+		value := b[anParameterHeaderLen : anParameterHeaderLen+length]
+		b = b[anParameterHeaderLen+length:]
+
+		if seen[parameterType] {
+			return errors.Errorf("ANParameters: Type %d is repeated", parameterType)
+		}
+		seen[parameterType] = true
+		if expected, ok := anParameterLengths[parameterType]; ok && length != expected {
+			return errors.Errorf("ANParameters: Invalid length %d of type %d, expect %d",
+				length, parameterType, expected)
+		}
+
+		switch parameterType {
+		case ANParametersTypeGUAMI:
+			p.GUAMI = &GUAMI{
+				AMFRegionID: value[3],
+				AMFSetID:    binary.BigEndian.Uint16(value[4:6]) >> 6,
+				AMFPointer:  value[5] & 0x3F,
+			}
+			copy(p.GUAMI.PLMNID[:], value[:3])
+		case ANParametersTypeSelectedPLMNID:
+			p.SelectedPLMNID = cloneBytes(value)
+		case ANParametersTypeRequestedNSSAI:
+			nssai, err := parseNSSAI(value)
+			if err != nil {
+				return errors.Wrapf(err, "ANParameters")
+			}
+			p.RequestedNSSAI = nssai
+		case ANParametersTypeEstablishmentCause:
+			cause := value[0] & 0x0F
+			p.EstablishmentCause = &cause
+		case ANParametersTypeSelectedNID:
+			p.SelectedNID = cloneBytes(value)
+		case ANParametersTypeUEIdentity:
+			if length == 0 {
+				return errors.Errorf("ANParameters: Empty UE identity")
+			}
+			p.UEIdentity = cloneBytes(value)
+		}
+	}
+	return nil
+}
+
+func (snssai *SNSSAI) marshal() ([]byte, error) {
+	if snssai.SD != nil && len(snssai.SD) != 3 || snssai.MappedSD != nil && len(snssai.MappedSD) != 3 {
+		return nil, errors.Errorf("SNSSAI: SD is not 3 octets")
+	}
+	if snssai.MappedSD != nil && (snssai.SD == nil || snssai.MappedSST == nil) {
+		return nil, errors.Errorf("SNSSAI: Mapped SD without SD or mapped SST")
+	}
+	data := append([]byte{snssai.SST}, snssai.SD...)
+	if snssai.MappedSST != nil {
+		data = append(data, *snssai.MappedSST)
+	}
+	return append(data, snssai.MappedSD...), nil
+}
+
+// parseNSSAI decodes a list of S-NSSAI IEs, whose length tells their fields
+func parseNSSAI(b []byte) ([]SNSSAI, error) {
+	if len(b) == 0 {
+		return nil, errors.Errorf("parseNSSAI(): Empty NSSAI")
+	}
+	var nssai []SNSSAI
+	for len(b) > 0 {
+		length := int(b[0])
+		if len(b) < 1+length {
+			return nil, errors.Errorf("parseNSSAI(): No sufficient bytes to decode S-NSSAI of length %d", length)
+		}
+		value := b[1 : 1+length]
+		b = b[1+length:]
+
+		snssai := SNSSAI{}
+		switch length {
+		case 1: // SST
+		case 2: // SST and mapped SST
+			snssai.MappedSST = &value[1]
+		case 4: // SST and SD
+			snssai.SD = value[1:4]
+		case 5: // SST, SD and mapped SST
+			snssai.SD, snssai.MappedSST = value[1:4], &value[4]
+		case 8: // SST, SD, mapped SST and mapped SD
+			snssai.SD, snssai.MappedSST, snssai.MappedSD = value[1:4], &value[4], value[5:8]
+		default:
+			return nil, errors.Errorf("parseNSSAI(): Invalid S-NSSAI length %d", length)
+		}
+		snssai.SST = value[0]
+		snssai.SD, snssai.MappedSD = cloneBytes(snssai.SD), cloneBytes(snssai.MappedSD)
+		if snssai.MappedSST != nil {
+			mappedSST := *snssai.MappedSST
+			snssai.MappedSST = &mappedSST
+		}
+		nssai = append(nssai, snssai)
+	}
+	return nssai, nil
+}
+
+// checkEAP5GVendorData checks that the expanded type is EAP-5G with a message
+// header, of the message ID if not zero
+func checkEAP5GVendorData(eapExpanded *eap_message.EapExpanded, messageID uint8) error {
+	if eapExpanded == nil {
+		return errors.Errorf("EAP expanded type is nil")
+	}
+	if eapExpanded.VendorID != eap_message.VendorId3GPP || eapExpanded.VendorType != eap_message.VendorTypeEAP5G {
+		return errors.Errorf("Not EAP-5G: vendor ID %d, vendor type %d", eapExpanded.VendorID,
+			eapExpanded.VendorType)
+	}
+	if len(eapExpanded.VendorData) < eap5GHeaderLen {
+		return errors.Errorf("No sufficient bytes to decode the EAP-5G header")
+	}
+	if messageID != 0 && eapExpanded.VendorData[0] != messageID {
+		return errors.Errorf("Unexpected EAP-5G message ID %d, expect %d", eapExpanded.VendorData[0], messageID)
+	}
+	return nil
+}
+
+func buildEAP5G(messageID uint8, data []byte) *eap_message.EapExpanded {
+	vendorData := make([]byte, 0, eap5GHeaderLen+len(data))
+	vendorData = append(vendorData, messageID, EAP5GSpareValue)
+	return BuildEapExpanded(eap_message.VendorId3GPP, eap_message.VendorTypeEAP5G, append(vendorData, data...))
+}
+
+// appendLengthValue appends the value with its 2 octets length
+func appendLengthValue(b, value []byte) ([]byte, error) {
+	if len(value) > 0xFFFF {
+		return nil, errors.Errorf("Length exceeds uint16 limit: %d", len(value))
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...), nil
+}
+
+// parseLengthValue returns the value of the 2 octets length at the head of b,
+// and the bytes following it
+func parseLengthValue(b []byte) ([]byte, []byte, error) {
+	if len(b) < eap5GLengthFieldLen {
+		return nil, nil, errors.Errorf("No sufficient bytes to decode the length")
+	}
+	length := int(binary.BigEndian.Uint16(b))
+	if len(b) < eap5GLengthFieldLen+length {
+		return nil, nil, errors.Errorf("No sufficient bytes to decode %d octets", length)
+	}
+	return b[eap5GLengthFieldLen : eap5GLengthFieldLen+length], b[eap5GLengthFieldLen+length:], nil
+}
+
+func cloneBytes(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,323 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+)
+
+var (
+	establishmentCause = uint8(EstablishmentCauseMO_Signaling)
+	mappedSST          = uint8(0x02)
+
+	validANParameters = ANParameters{
+		GUAMI: &GUAMI{
+			PLMNID:      [3]byte{0x02, 0xf8, 0x39},
+			AMFRegionID: 0xca,
+			AMFSetID:    0x3f8,
+			AMFPointer:  0x01,
+		},
+		SelectedPLMNID: []byte{0x02, 0xf8, 0x39},
+		RequestedNSSAI: []SNSSAI{
+			{SST: 0x01, SD: []byte{0x01, 0x02, 0x03}},
+			{SST: 0x01, SD: []byte{0x11, 0x22, 0x33}, MappedSST: &mappedSST, MappedSD: []byte{0x44, 0x55, 0x66}},
+			{SST: 0x03},
+		},
+		EstablishmentCause: &establishmentCause,
+		SelectedNID:        []byte{0x10, 0x20, 0x30, 0x40, 0x50, 0x60},
+		UEIdentity:         []byte{0xf2, 0x02, 0xf8, 0x39, 0xca, 0xfe, 0x01, 0x12, 0x34, 0x56, 0x78},
+	}
+
+	validANParametersByte = []byte{
+		// GUAMI
+		0x01, 0x06, 0x02, 0xf8, 0x39, 0xca, 0xfe, 0x01,
+		// Selected PLMN ID
+		0x02, 0x03, 0x02, 0xf8, 0x39,
+		// Requested NSSAI
+		0x03, 0x10, 0x04, 0x01, 0x01, 0x02, 0x03, 0x08,
+		0x01, 0x11, 0x22, 0x33, 0x02, 0x44, 0x55, 0x66,
+		0x01, 0x03,
+		// Establishment cause
+		0x04, 0x01, 0x03,
+		// Selected NID
+		0x05, 0x06, 0x10, 0x20, 0x30, 0x40, 0x50, 0x60,
+		// UE identity
+		0x06, 0x0b, 0xf2, 0x02, 0xf8, 0x39, 0xca, 0xfe,
+		0x01, 0x12, 0x34, 0x56, 0x78,
+	}
+)
+
+func TestANParameters(t *testing.T) {
+	result, err := validANParameters.Marshal()
+	require.NoError(t, err)
+	require.Equal(t, validANParametersByte, result)
+
+	var p ANParameters
+	require.NoError(t, p.Unmarshal(validANParametersByte))
+	require.Equal(t, validANParameters, p)
+
+	testcasesUnmarshal := []struct {
+		description string
+		b           []byte
+		expErr      bool
+		exp         ANParameters
+	}{
+		{
+			description: "Unknown type is skipped",
+			b:           []byte{0x7f, 0x02, 0xaa, 0xbb, 0x04, 0x01, 0x03},
+			exp:         ANParameters{EstablishmentCause: &establishmentCause},
+		},
+		{
+			description: "No sufficient bytes to decode the header",
+			b:           []byte{0x01},
+			expErr:      true,
+		},
+		{
+			description: "No sufficient bytes to decode the value",
+			b:           []byte{0x02, 0x03, 0x02, 0xf8},
+			expErr:      true,
+		},
+		{
+			description: "Invalid GUAMI length",
+			b:           []byte{0x01, 0x05, 0x02, 0xf8, 0x39, 0xca, 0xfe},
+			expErr:      true,
+		},
+		{
+			description: "Invalid selected NID length",
+			b:           []byte{0x05, 0x03, 0x10, 0x20, 0x30},
+			expErr:      true,
+		},
+		{
+			description: "Repeated type",
+			b:           []byte{0x04, 0x01, 0x03, 0x04, 0x01, 0x02},
+			expErr:      true,
+		},
+		{
+			description: "Invalid S-NSSAI length",
+			b:           []byte{0x03, 0x04, 0x03, 0x01, 0x02, 0x03},
+			expErr:      true,
+		},
+		{
+			description: "Empty requested NSSAI",
+			b:           []byte{0x03, 0x00},
+			expErr:      true,
+		},
+		{
+			description: "Empty UE identity",
+			b:           []byte{0x06, 0x00},
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testcasesUnmarshal {
+		t.Run(tc.description, func(t *testing.T) {
+			var p ANParameters
+			err := p.Unmarshal(tc.b)
+			if tc.expErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.exp, p)
+			}
+		})
+	}
+
+	testcasesMarshal := []struct {
+		description string
+		p           ANParameters
+	}{
+		{
+			description: "Invalid selected PLMN ID length",
+			p:           ANParameters{SelectedPLMNID: []byte{0x02, 0xf8}},
+		},
+		{
+			description: "Invalid AMF set ID",
+			p:           ANParameters{GUAMI: &GUAMI{AMFSetID: 0x400}},
+		},
+		{
+			description: "Invalid SD length",
+			p:           ANParameters{RequestedNSSAI: []SNSSAI{{SST: 1, SD: []byte{1, 2}}}},
+		},
+		{
+			description: "Mapped SD without SD",
+			p:           ANParameters{RequestedNSSAI: []SNSSAI{{SST: 1, MappedSST: &mappedSST, MappedSD: []byte{1, 2, 3}}}},
+		},
+		{
+			description: "Empty UE identity",
+			p:           ANParameters{UEIdentity: []byte{}},
+		},
+	}
+
+	for _, tc := range testcasesMarshal {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := tc.p.Marshal()
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestEAP5G(t *testing.T) {
+	nasPDU := []byte{0x7e, 0x00, 0x41, 0x79}
+
+	testcases := []struct {
+		description string
+		code        eap_message.EapCode
+		msg         EAP5GMessage
+		vendorData  []byte
+	}{
+		{
+			description: "5G-Start",
+			code:        eap_message.EapCodeRequest,
+			msg:         &EAP5GStart{},
+			vendorData:  []byte{EAP5GType5GStart, EAP5GSpareValue},
+		},
+		{
+			description: "5G-NAS request",
+			code:        eap_message.EapCodeRequest,
+			msg:         &EAP5GNASRequest{NASPDU: nasPDU},
+			vendorData:  []byte{EAP5GType5GNAS, EAP5GSpareValue, 0x00, 0x04, 0x7e, 0x00, 0x41, 0x79},
+		},
+		{
+			description: "5G-NAS response with AN-parameters",
+			code:        eap_message.EapCodeResponse,
+			msg: &EAP5GNASResponse{
+				ANParameters: &ANParameters{EstablishmentCause: &establishmentCause},
+				NASPDU:       nasPDU,
+			},
+			vendorData: []byte{
+				EAP5GType5GNAS, EAP5GSpareValue, 0x00, 0x03, 0x04, 0x01, 0x03,
+				0x00, 0x04, 0x7e, 0x00, 0x41, 0x79,
+			},
+		},
+		{
+			description: "5G-NAS response without AN-parameters",
+			code:        eap_message.EapCodeResponse,
+			msg:         &EAP5GNASResponse{NASPDU: nasPDU, Extensions: []byte{0xee}},
+			vendorData: []byte{
+				EAP5GType5GNAS, EAP5GSpareValue, 0x00, 0x00,
+				0x00, 0x04, 0x7e, 0x00, 0x41, 0x79, 0xee,
+			},
+		},
+		{
+			description: "5G-Notification request",
+			code:        eap_message.EapCodeRequest,
+			msg:         &EAP5GNotificationRequest{Data: []byte{0x00, 0x04, 0xc0, 0x00, 0x02, 0x01}},
+			vendorData: []byte{
+				EAP5GType5GNotification, EAP5GSpareValue, 0x00, 0x04, 0xc0, 0x00, 0x02, 0x01,
+			},
+		},
+		{
+			description: "5G-Notification response",
+			code:        eap_message.EapCodeResponse,
+			msg:         &EAP5GNotificationResponse{},
+			vendorData:  []byte{EAP5GType5GNotification, EAP5GSpareValue},
+		},
+		{
+			description: "5G-Stop",
+			code:        eap_message.EapCodeResponse,
+			msg:         &EAP5GStop{},
+			vendorData:  []byte{EAP5GType5GStop, EAP5GSpareValue},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			eapExpanded, err := tc.msg.Marshal()
+			require.NoError(t, err)
+			require.Equal(t, uint32(eap_message.VendorId3GPP), eapExpanded.VendorID)
+			require.Equal(t, uint32(eap_message.VendorTypeEAP5G), eapExpanded.VendorType)
+			require.Equal(t, tc.vendorData, eapExpanded.VendorData)
+
+			msg, err := ParseEAP5G(&eap_message.EAP{Code: tc.code, EapTypeData: eapExpanded})
+			require.NoError(t, err)
+			require.Equal(t, tc.msg, msg)
+		})
+	}
+}
+
+func TestEAP5GBuild(t *testing.T) {
+	nasPDU := []byte{0x7e, 0x00, 0x41, 0x79}
+	container := new(IKEPayloadContainer)
+	container.BuildEAP5GStart(1)
+	require.NoError(t, container.BuildEAP5GNAS(2, nasPDU))
+
+	msg, err := ParseEAP5G((*container)[0].(*PayloadEap).EAP)
+	require.NoError(t, err)
+	require.Equal(t, &EAP5GStart{}, msg)
+	msg, err = ParseEAP5G((*container)[1].(*PayloadEap).EAP)
+	require.NoError(t, err)
+	require.Equal(t, &EAP5GNASRequest{NASPDU: nasPDU}, msg)
+}
+
+func TestEAP5GUnmarshal(t *testing.T) {
+	testcases := []struct {
+		description string
+		code        eap_message.EapCode
+		eapTypeData eap_message.EapTypeData
+	}{
+		{
+			description: "Not an expanded type",
+			code:        eap_message.EapCodeRequest,
+			eapTypeData: &eap_message.EapIdentity{},
+		},
+		{
+			description: "Not EAP-5G",
+			code:        eap_message.EapCodeRequest,
+			eapTypeData: BuildEapExpanded(eap_message.VendorId3GPP, 1, []byte{EAP5GType5GStart, 0}),
+		},
+		{
+			description: "No sufficient bytes to decode the header",
+			code:        eap_message.EapCodeRequest,
+			eapTypeData: BuildEapExpanded(eap_message.VendorId3GPP, eap_message.VendorTypeEAP5G,
+				[]byte{EAP5GType5GStart}),
+		},
+		{
+			description: "5G-Stop in a request",
+			code:        eap_message.EapCodeRequest,
+			eapTypeData: BuildEapExpanded(eap_message.VendorId3GPP, eap_message.VendorTypeEAP5G,
+				[]byte{EAP5GType5GStop, 0}),
+		},
+		{
+			description: "Unknown message ID",
+			code:        eap_message.EapCodeResponse,
+			eapTypeData: BuildEapExpanded(eap_message.VendorId3GPP, eap_message.VendorTypeEAP5G,
+				[]byte{5, 0}),
+		},
+		{
+			description: "Truncated NAS-PDU",
+			code:        eap_message.EapCodeRequest,
+			eapTypeData: BuildEapExpanded(eap_message.VendorId3GPP, eap_message.VendorTypeEAP5G,
+				[]byte{EAP5GType5GNAS, 0, 0x00, 0x04, 0x7e}),
+		},
+		{
+			description: "Empty NAS-PDU",
+			code:        eap_message.EapCodeRequest,
+			eapTypeData: BuildEapExpanded(eap_message.VendorId3GPP, eap_message.VendorTypeEAP5G,
+				[]byte{EAP5GType5GNAS, 0, 0x00, 0x00}),
+		},
+		{
+			description: "Truncated AN-parameters",
+			code:        eap_message.EapCodeResponse,
+			eapTypeData: BuildEapExpanded(eap_message.VendorId3GPP, eap_message.VendorTypeEAP5G,
+				[]byte{EAP5GType5GNAS, 0, 0x00, 0x05, 0x04, 0x01, 0x03}),
+		},
+		{
+			description: "Invalid AN-parameters",
+			code:        eap_message.EapCodeResponse,
+			eapTypeData: BuildEapExpanded(eap_message.VendorId3GPP, eap_message.VendorTypeEAP5G,
+				[]byte{EAP5GType5GNAS, 0, 0x00, 0x02, 0x04, 0x02, 0x00, 0x01, 0x7e}),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := ParseEAP5G(&eap_message.EAP{Code: tc.code, EapTypeData: tc.eapTypeData})
+			require.Error(t, err)
+		})
+	}
+
+	require.Error(t, new(EAP5GStop).Unmarshal(
+		BuildEapExpanded(eap_message.VendorId3GPP, eap_message.VendorTypeEAP5G, []byte{EAP5GType5GStart, 0})))
+}
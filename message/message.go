@@ -73,9 +73,12 @@ func (container *IKEPayloadContainer) Encode() ([]byte, error) {
 		if (index + 1) < len(*container) { // if it has next payload
 			payloadData[0] = uint8((*container)[index+1].Type())
 		} else {
-			if payload.Type() == TypeSK {
-				payloadData[0] = payload.(*Encrypted).NextPayload
-			} else {
+			switch payload := payload.(type) {
+			case *Encrypted:
+				payloadData[0] = payload.NextPayload
+			case *EncryptedFragment:
+				payloadData[0] = payload.NextPayload
+			default:
 				payloadData[0] = byte(NoNext)
 			}
 		}
@@ -148,6 +151,10 @@ func (container *IKEPayloadContainer) Decode(nextPayload uint8, b []byte) error
 			encryptedPayload := new(Encrypted)
 			encryptedPayload.NextPayload = b[0]
 			payload = encryptedPayload
+		case TypeSKF:
+			fragmentPayload := new(EncryptedFragment)
+			fragmentPayload.NextPayload = b[0]
+			payload = fragmentPayload
 		case TypeCP:
 			payload = new(Configuration)
 		case TypeEAP:
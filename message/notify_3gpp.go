@@ -0,0 +1,167 @@
+package message
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// QoSInfo5G is the data of a 5G_QOS_INFO notify, which maps the QoS flows of
+// a PDU session to the Child SA being created (3GPP TS 24.502 - 9.3.1.2.1)
+type QoSInfo5G struct {
+	PDUSessionID uint8
+	QFIList      []uint8
+	// The Child SA is the default one of the PDU session
+	IsDefault bool
+	// DSCP of the packets sent on the Child SA, if DSCPSpecified
+	DSCPSpecified bool
+	DSCP          uint8
+}
+
+// FindNotifications returns the notifies of the type, in their order in the
+// container
+func (container *IKEPayloadContainer) FindNotifications(notifyType uint16) []*Notification {
+	var notifications []*Notification
+	for _, payload := range *container {
+		if notification, ok := payload.(*Notification); ok && notification.NotifyMessageType == notifyType {
+			notifications = append(notifications, notification)
+		}
+	}
+	return notifications
+}
+
+// FindNotification returns the first notify of the type, or nil
+func (container *IKEPayloadContainer) FindNotification(notifyType uint16) *Notification {
+	for _, payload := range *container {
+		if notification, ok := payload.(*Notification); ok && notification.NotifyMessageType == notifyType {
+			return notification
+		}
+	}
+	return nil
+}
+
+// ParseNotify5G_QOS_INFO decodes the data written by BuildNotify5G_QOS_INFO.
+// The length octet must cover exactly the notify data.
+func ParseNotify5G_QOS_INFO(notification *Notification) (*QoSInfo5G, error) {
+	data, err := vendor3GPPNotifyData(notification, Vendor3GPPNotifyType5G_QOS_INFO)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ParseNotify5G_QOS_INFO()")
+	}
+	// Length, PDU session ID, QFI list length and flags
+	if len(data) < 4 {
+		return nil, errors.Errorf("ParseNotify5G_QOS_INFO(): No sufficient bytes to decode: %d", len(data))
+	}
+	if int(data[0]) != len(data) {
+		return nil, errors.Errorf("ParseNotify5G_QOS_INFO(): Length %d mismatches notify data length %d",
+			data[0], len(data))
+	}
+
+	qosInfo := &QoSInfo5G{PDUSessionID: data[1]}
+	qfiListLen := int(data[2])
+	if len(data) < 4+qfiListLen {
+		return nil, errors.Errorf("ParseNotify5G_QOS_INFO(): No sufficient bytes to decode QFI list of length %d",
+			qfiListLen)
+	}
+	if qfiListLen > 0 {
+		qosInfo.QFIList = append([]uint8{}, data[3:3+qfiListLen]...)
+	}
+
+	flags := data[3+qfiListLen]
+	qosInfo.IsDefault = flags&NotifyType5G_QOS_INFOBitDCSICheck != 0
+	qosInfo.DSCPSpecified = flags&NotifyType5G_QOS_INFOBitDSCPICheck != 0
+	rest := data[4+qfiListLen:]
+	if qosInfo.DSCPSpecified {
+		if len(rest) < 1 {
+			return nil, errors.Errorf("ParseNotify5G_QOS_INFO(): DSCP is missing")
+		}
+		qosInfo.DSCP, rest = rest[0], rest[1:]
+	}
+	if len(rest) != 0 {
+		return nil, errors.Errorf("ParseNotify5G_QOS_INFO(): %d trailing bytes", len(rest))
+	}
+	return qosInfo, nil
+}
+
+// ParseNotifyNAS_IP4_ADDRESS returns the IPv4 address of the N3IWF to send
+// the NAS messages to
+func ParseNotifyNAS_IP4_ADDRESS(notification *Notification) (net.IP, error) {
+	ip, err := parseNotifyIPAddress(notification, Vendor3GPPNotifyTypeNAS_IP4_ADDRESS, net.IPv4len)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ParseNotifyNAS_IP4_ADDRESS()")
+	}
+	return ip, nil
+}
+
+// ParseNotifyNAS_IP6_ADDRESS returns the IPv6 address of the N3IWF to send
+// the NAS messages to
+func ParseNotifyNAS_IP6_ADDRESS(notification *Notification) (net.IP, error) {
+	ip, err := parseNotifyIPAddress(notification, Vendor3GPPNotifyTypeNAS_IP6_ADDRESS, net.IPv6len)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ParseNotifyNAS_IP6_ADDRESS()")
+	}
+	return ip, nil
+}
+
+// ParseNotifyUP_IP4_ADDRESS returns the IPv4 address of the N3IWF to send the
+// user plane packets to
+func ParseNotifyUP_IP4_ADDRESS(notification *Notification) (net.IP, error) {
+	ip, err := parseNotifyIPAddress(notification, Vendor3GPPNotifyTypeUP_IP4_ADDRESS, net.IPv4len)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ParseNotifyUP_IP4_ADDRESS()")
+	}
+	return ip, nil
+}
+
+// ParseNotifyUP_IP6_ADDRESS returns the IPv6 address of the N3IWF to send the
+// user plane packets to
+func ParseNotifyUP_IP6_ADDRESS(notification *Notification) (net.IP, error) {
+	ip, err := parseNotifyIPAddress(notification, Vendor3GPPNotifyTypeUP_IP6_ADDRESS, net.IPv6len)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ParseNotifyUP_IP6_ADDRESS()")
+	}
+	return ip, nil
+}
+
+// ParseNotifyNAS_TCP_PORT returns the TCP port of the N3IWF to send the NAS
+// messages to
+func ParseNotifyNAS_TCP_PORT(notification *Notification) (uint16, error) {
+	data, err := vendor3GPPNotifyData(notification, Vendor3GPPNotifyTypeNAS_TCP_PORT)
+	if err != nil {
+		return 0, errors.Wrapf(err, "ParseNotifyNAS_TCP_PORT()")
+	}
+	if len(data) != 2 {
+		return 0, errors.Errorf("ParseNotifyNAS_TCP_PORT(): Invalid length %d", len(data))
+	}
+	port := binary.BigEndian.Uint16(data)
+	if port == 0 {
+		return 0, errors.Errorf("ParseNotifyNAS_TCP_PORT(): Port is zero")
+	}
+	return port, nil
+}
+
+func parseNotifyIPAddress(notification *Notification, notifyType uint16, length int) (net.IP, error) {
+	data, err := vendor3GPPNotifyData(notification, notifyType)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != length {
+		return nil, errors.Errorf("Invalid IP address length %d, expect %d", len(data), length)
+	}
+	return append(net.IP{}, data...), nil
+}
+
+// vendor3GPPNotifyData checks the notify type, and that the notify is not
+// about an SA
+func vendor3GPPNotifyData(notification *Notification, notifyType uint16) ([]byte, error) {
+	if notification == nil {
+		return nil, errors.Errorf("Notification is nil")
+	}
+	if notification.NotifyMessageType != notifyType {
+		return nil, errors.Errorf("Unexpected notify type %d, expect %d", notification.NotifyMessageType, notifyType)
+	}
+	if notification.ProtocolID != TypeNone || len(notification.SPI) != 0 {
+		return nil, errors.Errorf("Unexpected protocol ID %d or SPI", notification.ProtocolID)
+	}
+	return notification.NotificationData, nil
+}
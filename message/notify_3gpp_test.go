@@ -0,0 +1,158 @@
+package message
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindNotifications(t *testing.T) {
+	container := new(IKEPayloadContainer)
+	container.BuildNonce([]byte{0x01})
+	container.BuildNotifyNAS_TCP_PORT(20000)
+	require.NoError(t, container.BuildNotify5G_QOS_INFO(1, []uint8{1}, true, false, 0))
+	require.NoError(t, container.BuildNotify5G_QOS_INFO(2, []uint8{2}, false, false, 0))
+
+	require.Equal(t, (*container)[1], container.FindNotification(Vendor3GPPNotifyTypeNAS_TCP_PORT))
+	require.Nil(t, container.FindNotification(Vendor3GPPNotifyTypeUP_IP4_ADDRESS))
+	require.Equal(t, []*Notification{(*container)[2].(*Notification), (*container)[3].(*Notification)},
+		container.FindNotifications(Vendor3GPPNotifyType5G_QOS_INFO))
+	require.Empty(t, container.FindNotifications(Vendor3GPPNotifyTypeUP_IP4_ADDRESS))
+}
+
+func TestParseNotify5G_QOS_INFO(t *testing.T) {
+	testcasesBuild := []struct {
+		description string
+		qosInfo     QoSInfo5G
+	}{
+		{
+			description: "Default Child SA",
+			qosInfo:     QoSInfo5G{PDUSessionID: 1, QFIList: []uint8{1, 2, 3}, IsDefault: true},
+		},
+		{
+			description: "DSCP specified",
+			qosInfo:     QoSInfo5G{PDUSessionID: 2, QFIList: []uint8{5}, DSCPSpecified: true, DSCP: 46},
+		},
+		{
+			description: "Empty QFI list",
+			qosInfo:     QoSInfo5G{PDUSessionID: 3},
+		},
+	}
+
+	for _, tc := range testcasesBuild {
+		t.Run(tc.description, func(t *testing.T) {
+			container := new(IKEPayloadContainer)
+			require.NoError(t, container.BuildNotify5G_QOS_INFO(tc.qosInfo.PDUSessionID, tc.qosInfo.QFIList,
+				tc.qosInfo.IsDefault, tc.qosInfo.DSCPSpecified, tc.qosInfo.DSCP))
+			qosInfo, err := ParseNotify5G_QOS_INFO(container.FindNotification(Vendor3GPPNotifyType5G_QOS_INFO))
+			require.NoError(t, err)
+			require.Equal(t, &tc.qosInfo, qosInfo)
+		})
+	}
+
+	testcasesParse := []struct {
+		description string
+		data        []byte
+	}{
+		{
+			description: "No sufficient bytes",
+			data:        []byte{0x03, 0x01, 0x00},
+		},
+		{
+			description: "Length exceeds notify data",
+			data:        []byte{0x06, 0x01, 0x01, 0x01, 0x02},
+		},
+		{
+			description: "Length shorter than notify data",
+			data:        []byte{0x04, 0x01, 0x00, 0x02, 0x00},
+		},
+		{
+			description: "QFI list exceeds notify data",
+			data:        []byte{0x05, 0x01, 0x02, 0x01, 0x02},
+		},
+		{
+			description: "DSCP missing",
+			data:        []byte{0x05, 0x01, 0x01, 0x01, NotifyType5G_QOS_INFOBitDSCPICheck},
+		},
+		{
+			description: "Trailing bytes",
+			data:        []byte{0x06, 0x01, 0x01, 0x01, 0x00, 0x2e},
+		},
+	}
+
+	for _, tc := range testcasesParse {
+		t.Run(tc.description, func(t *testing.T) {
+			_, err := ParseNotify5G_QOS_INFO(&Notification{
+				ProtocolID:        TypeNone,
+				NotifyMessageType: Vendor3GPPNotifyType5G_QOS_INFO,
+				NotificationData:  tc.data,
+			})
+			require.Error(t, err)
+		})
+	}
+
+	_, err := ParseNotify5G_QOS_INFO(nil)
+	require.Error(t, err)
+	_, err = ParseNotify5G_QOS_INFO(&Notification{
+		NotifyMessageType: Vendor3GPPNotifyTypeNAS_TCP_PORT,
+		NotificationData:  []byte{0x04, 0x01, 0x00, 0x00},
+	})
+	require.Error(t, err)
+}
+
+func TestParseNotifyAddress(t *testing.T) {
+	container := new(IKEPayloadContainer)
+	container.BuildNotifyNAS_IP4_ADDRESS("10.0.0.1")
+	container.BuildNotifyNAS_IP6_ADDRESS("2001:db8::1")
+	container.BuildNotifyUP_IP4_ADDRESS("10.0.0.2")
+	container.BuildNotifyUP_IP6_ADDRESS("2001:db8::2")
+	container.BuildNotifyNAS_TCP_PORT(20000)
+
+	ip, err := ParseNotifyNAS_IP4_ADDRESS(container.FindNotification(Vendor3GPPNotifyTypeNAS_IP4_ADDRESS))
+	require.NoError(t, err)
+	require.Equal(t, net.IPv4(10, 0, 0, 1).To4(), ip)
+	ip, err = ParseNotifyNAS_IP6_ADDRESS(container.FindNotification(Vendor3GPPNotifyTypeNAS_IP6_ADDRESS))
+	require.NoError(t, err)
+	require.Equal(t, net.ParseIP("2001:db8::1"), ip)
+	ip, err = ParseNotifyUP_IP4_ADDRESS(container.FindNotification(Vendor3GPPNotifyTypeUP_IP4_ADDRESS))
+	require.NoError(t, err)
+	require.Equal(t, net.IPv4(10, 0, 0, 2).To4(), ip)
+	ip, err = ParseNotifyUP_IP6_ADDRESS(container.FindNotification(Vendor3GPPNotifyTypeUP_IP6_ADDRESS))
+	require.NoError(t, err)
+	require.Equal(t, net.ParseIP("2001:db8::2"), ip)
+	port, err := ParseNotifyNAS_TCP_PORT(container.FindNotification(Vendor3GPPNotifyTypeNAS_TCP_PORT))
+	require.NoError(t, err)
+	require.Equal(t, uint16(20000), port)
+
+	// Invalid lengths
+	_, err = ParseNotifyNAS_IP4_ADDRESS(&Notification{
+		NotifyMessageType: Vendor3GPPNotifyTypeNAS_IP4_ADDRESS,
+		NotificationData:  net.ParseIP("10.0.0.1"),
+	})
+	require.Error(t, err)
+	_, err = ParseNotifyUP_IP6_ADDRESS(&Notification{
+		NotifyMessageType: Vendor3GPPNotifyTypeUP_IP6_ADDRESS,
+		NotificationData:  []byte{10, 0, 0, 2},
+	})
+	require.Error(t, err)
+	_, err = ParseNotifyNAS_TCP_PORT(&Notification{
+		NotifyMessageType: Vendor3GPPNotifyTypeNAS_TCP_PORT,
+		NotificationData:  []byte{0x4e},
+	})
+	require.Error(t, err)
+	_, err = ParseNotifyNAS_TCP_PORT(&Notification{
+		NotifyMessageType: Vendor3GPPNotifyTypeNAS_TCP_PORT,
+		NotificationData:  []byte{0x00, 0x00},
+	})
+	require.Error(t, err)
+
+	// Notify about an SA
+	_, err = ParseNotifyUP_IP4_ADDRESS(&Notification{
+		ProtocolID:        TypeESP,
+		NotifyMessageType: Vendor3GPPNotifyTypeUP_IP4_ADDRESS,
+		SPI:               []byte{1, 2, 3, 4},
+		NotificationData:  []byte{10, 0, 0, 2},
+	})
+	require.Error(t, err)
+}
@@ -8,34 +8,38 @@ import (
 
 var _ IKEPayload = &Delete{}
 
+// Delete lists the SPIs of the SAs of one protocol to be deleted. The SPIs of
+// IKE are 0 octets, since the IKE SA is the one of the message, or 8 octets,
+// and the SPIs of ESP and AH are 4 octets.
 type Delete struct {
-	ProtocolID  uint8
-	SPISize     uint8
-	NumberOfSPI uint16
-	SPIs        []uint32
+	ProtocolID uint8
+	SPISize    uint8
+	SPIs       [][]byte
 }
 
 func (d *Delete) Type() IkePayloadType { return TypeD }
 
 func (d *Delete) Marshal() ([]byte, error) {
-	if len(d.SPIs) != int(d.NumberOfSPI) {
-		return nil, errors.Errorf("Number of SPI not correct")
+	if err := checkDeleteSPISize(d.ProtocolID, d.SPISize); err != nil {
+		return nil, err
+	}
+	if d.SPISize == 0 && len(d.SPIs) != 0 {
+		return nil, errors.Errorf("Delete: SPIs without SPI size")
+	}
+	if len(d.SPIs) > 0xFFFF {
+		return nil, errors.Errorf("Delete: Too many SPIs: %d", len(d.SPIs))
 	}
 
-	deleteData := make([]byte, 4)
-
+	deleteData := make([]byte, 4, 4+len(d.SPIs)*int(d.SPISize))
 	deleteData[0] = d.ProtocolID
 	deleteData[1] = d.SPISize
-	binary.BigEndian.PutUint16(deleteData[2:4], d.NumberOfSPI)
-
-	if int(d.NumberOfSPI) > 0 {
-		byteSlice := make([]byte, d.SPISize)
-		for _, v := range d.SPIs {
-			binary.BigEndian.PutUint32(byteSlice, v)
-			deleteData = append(deleteData, byteSlice...)
+	binary.BigEndian.PutUint16(deleteData[2:4], uint16(len(d.SPIs)))
+	for _, spi := range d.SPIs {
+		if len(spi) != int(d.SPISize) {
+			return nil, errors.Errorf("Delete: SPI of %d bytes, expect %d", len(spi), d.SPISize)
 		}
+		deleteData = append(deleteData, spi...)
 	}
-
 	return deleteData, nil
 }
 
@@ -45,23 +49,45 @@ func (d *Delete) Unmarshal(b []byte) error {
 		if len(b) <= 3 {
 			return errors.Errorf("Delete: No sufficient bytes to decode next delete")
 		}
+		protocolID := b[0]
 		spiSize := b[1]
-		numberOfSPI := binary.BigEndian.Uint16(b[2:4])
-		if len(b) < (4 + (int(spiSize) * int(numberOfSPI))) {
-			return errors.Errorf("Delete: No Sufficient bytes to get SPIs according to the length specified in header")
+		numberOfSPI := int(binary.BigEndian.Uint16(b[2:4]))
+		if err := checkDeleteSPISize(protocolID, spiSize); err != nil {
+			return err
+		}
+		if spiSize == 0 && numberOfSPI != 0 {
+			return errors.Errorf("Delete: %d SPIs without SPI size", numberOfSPI)
+		}
+		if len(b) != 4+int(spiSize)*numberOfSPI {
+			return errors.Errorf("Delete: Length %d does not match %d SPIs of %d bytes", len(b), numberOfSPI, spiSize)
 		}
 
-		d.ProtocolID = b[0]
+		d.ProtocolID = protocolID
 		d.SPISize = spiSize
-		d.NumberOfSPI = numberOfSPI
-
+		d.SPIs = nil
 		b = b[4:]
-		var spi uint32
-		for i := 0; i < len(b); i += 4 {
-			spi = binary.BigEndian.Uint32(b[i : i+4])
-			d.SPIs = append(d.SPIs, spi)
+		for i := 0; i < numberOfSPI; i++ {
+			d.SPIs = append(d.SPIs, append([]byte{}, b[i*int(spiSize):(i+1)*int(spiSize)]...))
 		}
 	}
 
 	return nil
 }
+
+// checkDeleteSPISize checks that the SPI size fits the protocol
+// (RFC 7296 - 3.11)
+func checkDeleteSPISize(protocolID, spiSize uint8) error {
+	switch protocolID {
+	case TypeIKE:
+		if spiSize != 0 && spiSize != 8 {
+			return errors.Errorf("Delete: Invalid IKE SPI size %d", spiSize)
+		}
+	case TypeAH, TypeESP:
+		if spiSize != 4 {
+			return errors.Errorf("Delete: Invalid Child SA SPI size %d", spiSize)
+		}
+	default:
+		return errors.Errorf("Delete: Unknown protocol ID %d", protocolID)
+	}
+	return nil
+}
@@ -14,35 +14,82 @@ func TestDeleteMarshal(t *testing.T) {
 		expErr      bool
 	}{
 		{
-			description: "Number of SPI not correct",
+			description: "SPI size not matching the SPIs",
 			delete: Delete{
-				ProtocolID:  TypeESP,
-				SPISize:     4,
-				NumberOfSPI: 1,
-				SPIs:        []uint32{0x01, 0x02, 0x03},
+				ProtocolID: TypeESP,
+				SPISize:    4,
+				SPIs:       [][]byte{{0x00, 0x00, 0x00, 0x01}, {0x02}},
+			},
+			expErr: true,
+		},
+		{
+			description: "Invalid ESP SPI size",
+			delete: Delete{
+				ProtocolID: TypeESP,
+				SPISize:    8,
+				SPIs:       [][]byte{{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}},
+			},
+			expErr: true,
+		},
+		{
+			description: "Invalid IKE SPI size",
+			delete: Delete{
+				ProtocolID: TypeIKE,
+				SPISize:    4,
+				SPIs:       [][]byte{{0x00, 0x00, 0x00, 0x01}},
+			},
+			expErr: true,
+		},
+		{
+			description: "IKE SPIs without SPI size",
+			delete: Delete{
+				ProtocolID: TypeIKE,
+				SPIs:       [][]byte{{}},
+			},
+			expErr: true,
+		},
+		{
+			description: "Unknown protocol",
+			delete: Delete{
+				ProtocolID: 9,
+				SPISize:    4,
 			},
 			expErr: true,
 		},
 		{
 			description: "Delete marshal TypeIKE",
 			delete: Delete{
-				ProtocolID:  TypeIKE,
-				SPISize:     0,
-				NumberOfSPI: 0,
-				SPIs:        nil,
+				ProtocolID: TypeIKE,
+				SPISize:    0,
+				SPIs:       nil,
 			},
 			expMarshal: []byte{
 				0x01, 0x00, 0x00, 0x00,
 			},
 			expErr: false,
 		},
+		{
+			description: "Delete marshal TypeIKE with SPIs",
+			delete: Delete{
+				ProtocolID: TypeIKE,
+				SPISize:    8,
+				SPIs:       [][]byte{{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}},
+			},
+			expMarshal: []byte{
+				0x01, 0x08, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04,
+				0x05, 0x06, 0x07, 0x08,
+			},
+			expErr: false,
+		},
 		{
 			description: "Delete marshal TypeESP",
 			delete: Delete{
-				ProtocolID:  TypeESP,
-				SPISize:     4,
-				NumberOfSPI: 4,
-				SPIs:        []uint32{0x01, 0x02, 0x03, 0x04},
+				ProtocolID: TypeESP,
+				SPISize:    4,
+				SPIs: [][]byte{
+					{0x00, 0x00, 0x00, 0x01}, {0x00, 0x00, 0x00, 0x02},
+					{0x00, 0x00, 0x00, 0x03}, {0x00, 0x00, 0x00, 0x04},
+				},
 			},
 			expMarshal: []byte{
 				0x03, 0x04, 0x00, 0x04, 0x00, 0x00, 0x00, 0x01,
@@ -80,9 +127,48 @@ func TestDeleteUnmarshal(t *testing.T) {
 		},
 		{
 			description: "No Sufficient bytes to get SPIs according to the length specified in header",
-			b:           []byte{0x01, 0x02, 0x03, 0x04, 0x05},
+			b:           []byte{0x03, 0x04, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01},
+			expErr:      true,
+		},
+		{
+			description: "Trailing bytes",
+			b:           []byte{0x01, 0x00, 0x00, 0x00, 0x00},
+			expErr:      true,
+		},
+		{
+			description: "Invalid ESP SPI size",
+			b:           []byte{0x03, 0x02, 0x00, 0x02, 0x00, 0x01, 0x00, 0x02},
+			expErr:      true,
+		},
+		{
+			description: "IKE SPIs without SPI size",
+			b:           []byte{0x01, 0x00, 0x00, 0x01},
 			expErr:      true,
 		},
+		{
+			description: "Unknown protocol",
+			b:           []byte{0x04, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01},
+			expErr:      true,
+		},
+		{
+			description: "Delete Unmarshal TypeIKE",
+			b:           []byte{0x01, 0x00, 0x00, 0x00},
+			expMarshal: Delete{
+				ProtocolID: TypeIKE,
+			},
+		},
+		{
+			description: "Delete Unmarshal TypeIKE with SPIs",
+			b: []byte{
+				0x01, 0x08, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04,
+				0x05, 0x06, 0x07, 0x08,
+			},
+			expMarshal: Delete{
+				ProtocolID: TypeIKE,
+				SPISize:    8,
+				SPIs:       [][]byte{{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}},
+			},
+		},
 		{
 			description: "Delete Unmarshal",
 			b: []byte{
@@ -91,10 +177,12 @@ func TestDeleteUnmarshal(t *testing.T) {
 				0x00, 0x00, 0x00, 0x04,
 			},
 			expMarshal: Delete{
-				ProtocolID:  TypeESP,
-				SPISize:     4,
-				NumberOfSPI: 4,
-				SPIs:        []uint32{0x01, 0x02, 0x03, 0x04},
+				ProtocolID: TypeESP,
+				SPISize:    4,
+				SPIs: [][]byte{
+					{0x00, 0x00, 0x00, 0x01}, {0x00, 0x00, 0x00, 0x02},
+					{0x00, 0x00, 0x00, 0x03}, {0x00, 0x00, 0x00, 0x04},
+				},
 			},
 			expErr: false,
 		},
@@ -113,3 +201,57 @@ func TestDeleteUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestDeleteRoundTrip(t *testing.T) {
+	testcases := []struct {
+		description string
+		build       func(container *IKEPayloadContainer)
+		expDelete   *Delete
+	}{
+		{
+			description: "IKE SA",
+			build: func(container *IKEPayloadContainer) {
+				container.BuildDeleteIKESA()
+			},
+			expDelete: &Delete{ProtocolID: TypeIKE},
+		},
+		{
+			description: "Child SAs",
+			build: func(container *IKEPayloadContainer) {
+				container.BuildDeleteChildSAs(TypeESP, []uint32{0x01020304, 0xaabbccdd})
+			},
+			expDelete: &Delete{
+				ProtocolID: TypeESP,
+				SPISize:    4,
+				SPIs:       [][]byte{{0x01, 0x02, 0x03, 0x04}, {0xaa, 0xbb, 0xcc, 0xdd}},
+			},
+		},
+		{
+			description: "IKE SA and Child SAs",
+			build: func(container *IKEPayloadContainer) {
+				container.BuildDeleteChildSAs(TypeAH, []uint32{0x100})
+				container.BuildDeletePayload(TypeIKE, 8, [][]byte{{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}})
+			},
+			expDelete: &Delete{
+				ProtocolID: TypeAH,
+				SPISize:    4,
+				SPIs:       [][]byte{{0x00, 0x00, 0x01, 0x00}},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var payloads IKEPayloadContainer
+			tc.build(&payloads)
+			b, err := payloads.Encode()
+			require.NoError(t, err)
+
+			var decoded IKEPayloadContainer
+			err = decoded.Decode(uint8(TypeD), b)
+			require.NoError(t, err)
+			require.Equal(t, payloads, decoded)
+			require.Equal(t, tc.expDelete, decoded[0])
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package message
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+var _ IKEPayload = &EncryptedFragment{}
+
+// EncryptedFragment is the Encrypted Fragment payload (RFC 7383 - 2.5). The
+// Next Payload field is only set in the first fragment.
+type EncryptedFragment struct {
+	NextPayload    uint8
+	FragmentNumber uint16
+	TotalFragments uint16
+	EncryptedData  []byte
+}
+
+func (fragment *EncryptedFragment) Type() IkePayloadType { return TypeSKF }
+
+func (fragment *EncryptedFragment) Marshal() ([]byte, error) {
+	if fragment.FragmentNumber == 0 || fragment.FragmentNumber > fragment.TotalFragments {
+		return nil, errors.Errorf("[EncryptedFragment] Invalid fragment number %d of %d",
+			fragment.FragmentNumber, fragment.TotalFragments)
+	}
+	if len(fragment.EncryptedData) == 0 {
+		return nil, errors.Errorf("[EncryptedFragment] The encrypted data is empty")
+	}
+
+	fragmentData := make([]byte, 4, 4+len(fragment.EncryptedData))
+	binary.BigEndian.PutUint16(fragmentData[0:2], fragment.FragmentNumber)
+	binary.BigEndian.PutUint16(fragmentData[2:4], fragment.TotalFragments)
+	fragmentData = append(fragmentData, fragment.EncryptedData...)
+	return fragmentData, nil
+}
+
+func (fragment *EncryptedFragment) Unmarshal(b []byte) error {
+	// bounds checking
+	if len(b) <= 4 {
+		return errors.Errorf("EncryptedFragment: No sufficient bytes to decode next encrypted fragment")
+	}
+
+	fragment.FragmentNumber = binary.BigEndian.Uint16(b[0:2])
+	fragment.TotalFragments = binary.BigEndian.Uint16(b[2:4])
+	if fragment.FragmentNumber == 0 || fragment.FragmentNumber > fragment.TotalFragments {
+		return errors.Errorf("EncryptedFragment: Invalid fragment number %d of %d",
+			fragment.FragmentNumber, fragment.TotalFragments)
+	}
+	fragment.EncryptedData = append(fragment.EncryptedData, b[4:]...)
+	return nil
+}
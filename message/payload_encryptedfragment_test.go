@@ -0,0 +1,121 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	validEncryptedFragment = EncryptedFragment{
+		FragmentNumber: 2,
+		TotalFragments: 3,
+		EncryptedData: []byte{
+			0x7d, 0x09, 0x18, 0x42, 0x60, 0x9c, 0x9e, 0x20,
+		},
+	}
+
+	validEncryptedFragmentByte = []byte{
+		0x00, 0x02, 0x00, 0x03,
+		0x7d, 0x09, 0x18, 0x42, 0x60, 0x9c, 0x9e, 0x20,
+	}
+)
+
+func TestEncryptedFragmentMarshal(t *testing.T) {
+	testcases := []struct {
+		description string
+		fragment    EncryptedFragment
+		expMarshal  []byte
+		expErr      bool
+	}{
+		{
+			description: "The encrypted data is empty",
+			fragment: EncryptedFragment{
+				FragmentNumber: 1,
+				TotalFragments: 1,
+			},
+			expErr: true,
+		},
+		{
+			description: "Fragment number exceeds total fragments",
+			fragment: EncryptedFragment{
+				FragmentNumber: 4,
+				TotalFragments: 3,
+				EncryptedData:  []byte{0x01},
+			},
+			expErr: true,
+		},
+		{
+			description: "EncryptedFragment marshal",
+			fragment:    validEncryptedFragment,
+			expMarshal:  validEncryptedFragmentByte,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			result, err := tc.fragment.Marshal()
+			if tc.expErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expMarshal, result)
+			}
+		})
+	}
+}
+
+func TestEncryptedFragmentUnmarshal(t *testing.T) {
+	testcases := []struct {
+		description string
+		b           []byte
+		expMarshal  EncryptedFragment
+		expErr      bool
+	}{
+		{
+			description: "No sufficient bytes to decode next encrypted fragment",
+			b:           []byte{0x00, 0x01, 0x00, 0x01},
+			expErr:      true,
+		},
+		{
+			description: "Fragment number is zero",
+			b:           []byte{0x00, 0x00, 0x00, 0x01, 0x01},
+			expErr:      true,
+		},
+		{
+			description: "EncryptedFragment Unmarshal",
+			b:           validEncryptedFragmentByte,
+			expMarshal:  validEncryptedFragment,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var fragment EncryptedFragment
+			err := fragment.Unmarshal(tc.b)
+			if tc.expErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tc.expMarshal, fragment)
+			}
+		})
+	}
+}
+
+func TestEncryptedFragmentNextPayload(t *testing.T) {
+	var payloads IKEPayloadContainer
+	payloads.BuildEncryptedFragment(TypeIDi, 1, 2, []byte{0x01, 0x02})
+	b, err := payloads.Encode()
+	require.NoError(t, err)
+	require.Equal(t, uint8(TypeIDi), b[0])
+
+	var decoded IKEPayloadContainer
+	require.NoError(t, decoded.Decode(uint8(TypeSKF), b))
+	require.Len(t, decoded, 1)
+	fragment := decoded[0].(*EncryptedFragment)
+	require.Equal(t, uint8(TypeIDi), fragment.NextPayload)
+	require.Equal(t, uint16(1), fragment.FragmentNumber)
+	require.Equal(t, uint16(2), fragment.TotalFragments)
+	require.Equal(t, []byte{0x01, 0x02}, fragment.EncryptedData)
+}
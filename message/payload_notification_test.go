@@ -84,3 +84,18 @@ func TestNotification(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildNotifyIKEV2_FRAGMENTATION_SUPPORTED(t *testing.T) {
+	var payloads IKEPayloadContainer
+	payloads.BuildNotifyIKEV2_FRAGMENTATION_SUPPORTED()
+
+	result, err := payloads.Encode()
+	require.NoError(t, err)
+	// Generic payload header, then Protocol ID and SPI Size of 0, and the
+	// notify message type 16430 without data
+	require.Equal(t, []byte{0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x40, 0x2e}, result)
+
+	var decoded IKEPayloadContainer
+	require.NoError(t, decoded.Decode(uint8(TypeN), result))
+	require.NotNil(t, decoded.FindNotification(IKEV2_FRAGMENTATION_SUPPORTED))
+}
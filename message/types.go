@@ -23,6 +23,7 @@ const (
 	TypeSK
 	TypeCP
 	TypeEAP
+	TypeSKF IkePayloadType = 53 // RFC 7383
 )
 
 var typeStr map[IkePayloadType]string = map[IkePayloadType]string{
@@ -43,6 +44,7 @@ var typeStr map[IkePayloadType]string = map[IkePayloadType]string{
 	TypeSK:      "SK",
 	TypeCP:      "CP",
 	TypeEAP:     "EAP",
+	TypeSKF:     "SKF",
 }
 
 // RFC 7296: 3.2.  Generic Payload Header
@@ -88,13 +90,22 @@ const (
 	ENCR_NULL     = 11
 	ENCR_AES_CBC  = 12
 	ENCR_AES_CTR  = 13
+
+	// RFC 5282 - AES-GCM with 8, 12 and 16 octet ICV
+	ENCR_AES_GCM_8  = 18
+	ENCR_AES_GCM_12 = 19
+	ENCR_AES_GCM_16 = 20
 )
 
 const (
 	PRF_HMAC_MD5 = iota + 1
 	PRF_HMAC_SHA1
 	PRF_HMAC_TIGER
+	PRF_AES128_XCBC
 	PRF_HMAC_SHA2_256 = 5
+	PRF_HMAC_SHA2_384 = 6
+	PRF_HMAC_SHA2_512 = 7
+	PRF_AES128_CMAC   = 8
 )
 
 const (
@@ -104,7 +115,10 @@ const (
 	AUTH_DES_MAC
 	AUTH_KPDK_MD5
 	AUTH_AES_XCBC_96
+	AUTH_AES_CMAC_96       = 8
 	AUTH_HMAC_SHA2_256_128 = 12
+	AUTH_HMAC_SHA2_384_192 = 13
+	AUTH_HMAC_SHA2_512_256 = 14
 )
 
 const (
@@ -117,6 +131,12 @@ const (
 	DH_4096_BIT_MODP
 	DH_6144_BIT_MODP
 	DH_8192_BIT_MODP
+
+	// RFC 5903 - ECP groups and RFC 8031 - Curve25519
+	DH_256_BIT_RANDOM_ECP = 19
+	DH_384_BIT_RANDOM_ECP = 20
+	DH_521_BIT_RANDOM_ECP = 21
+	DH_CURVE25519         = 31
 )
 
 const (
@@ -178,6 +198,7 @@ const (
 	UPDATE_SA_ADDRESSES           = 16400
 	COOKIE2                       = 16401
 	NO_NATS_ALLOWED               = 16402
+	IKEV2_FRAGMENTATION_SUPPORTED = 16430
 	P_N1_MODE_CAPABILITY          = 51015
 )
 
@@ -220,6 +241,7 @@ const (
 	RSADigitalSignature = iota + 1
 	SharedKeyMesageIntegrityCode
 	DSSDigitalSignature
+	DigitalSignature = 14 // RFC 7427
 )
 
 // Configuration types
@@ -259,9 +281,10 @@ const (
 
 // Used in EAP-5G for message ID
 const (
-	EAP5GType5GStart = 1
-	EAP5GType5GNAS   = 2
-	EAP5GType5GStop  = 4
+	EAP5GType5GStart        = 1
+	EAP5GType5GNAS          = 2
+	EAP5GType5GNotification = 3
+	EAP5GType5GStop         = 4
 )
 
 // Spare
@@ -273,6 +296,8 @@ const (
 	ANParametersTypeSelectedPLMNID     = 2
 	ANParametersTypeRequestedNSSAI     = 3
 	ANParametersTypeEstablishmentCause = 4
+	ANParametersTypeSelectedNID        = 5
+	ANParametersTypeUEIdentity         = 6
 )
 
 // Used for checking if AN-Parameter length field is legal
@@ -280,6 +305,7 @@ const (
 	ANParametersLenGUAMI    = 6
 	ANParametersLenPLMNID   = 3
 	ANParametersLenEstCause = 1
+	ANParametersLenNID      = 6
 )
 
 // Used in IE Establishment Cause field for cause types
@@ -296,7 +322,9 @@ const (
 const (
 	Vendor3GPPNotifyType5G_QOS_INFO     uint16 = 55501
 	Vendor3GPPNotifyTypeNAS_IP4_ADDRESS uint16 = 55502
+	Vendor3GPPNotifyTypeNAS_IP6_ADDRESS uint16 = 55503
 	Vendor3GPPNotifyTypeUP_IP4_ADDRESS  uint16 = 55504
+	Vendor3GPPNotifyTypeUP_IP6_ADDRESS  uint16 = 55505
 	Vendor3GPPNotifyTypeNAS_TCP_PORT    uint16 = 55506
 )
 
@@ -0,0 +1,173 @@
+package nat
+
+import (
+	"bytes"
+	"crypto/sha1" // #nosec G505
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+const (
+	IKEPort  = 500
+	NATTPort = 4500
+)
+
+// Length of the non-ESP marker prepended to IKE messages on the NAT-T port,
+// and of the ESP header up to the Payload Data (RFC 3948 - 2)
+const (
+	nonESPMarkerLength = 4
+	espHeaderLength    = 8
+)
+
+// Octet of a NAT-keepalive packet (RFC 3948 - 2.3)
+const natKeepalive = 0xFF
+
+// DetectionHash returns the data of a NAT_DETECTION_SOURCE_IP or
+// NAT_DETECTION_DESTINATION_IP notification, SHA-1(SPIi | SPIr | IP | Port)
+// (RFC 7296 - 2.23). The SPIs are those of the header of the message.
+func DetectionHash(initiatorSPI, responderSPI uint64, addrPort netip.AddrPort) []byte {
+	// IPv4 addresses of dual-stack sockets are hashed in 4 octets
+	ip := addrPort.Addr().Unmap().AsSlice()
+	data := make([]byte, 16, 16+len(ip)+2)
+	binary.BigEndian.PutUint64(data[0:8], initiatorSPI)
+	binary.BigEndian.PutUint64(data[8:16], responderSPI)
+	data = append(data, ip...)
+	data = binary.BigEndian.AppendUint16(data, addrPort.Port())
+
+	hash := sha1.Sum(data) // #nosec G401
+	return hash[:]
+}
+
+// BuildDetection appends the NAT_DETECTION_SOURCE_IP notification of the local
+// address and the NAT_DETECTION_DESTINATION_IP notification of the remote
+// address to container
+func BuildDetection(
+	container *message.IKEPayloadContainer,
+	initiatorSPI, responderSPI uint64,
+	local, remote netip.AddrPort,
+) {
+	container.BuildNotification(message.TypeNone, message.NAT_DETECTION_SOURCE_IP,
+		nil, DetectionHash(initiatorSPI, responderSPI, local))
+	container.BuildNotification(message.TypeNone, message.NAT_DETECTION_DESTINATION_IP,
+		nil, DetectionHash(initiatorSPI, responderSPI, remote))
+}
+
+// Result is the outcome of the NAT detection of IKE_SA_INIT
+type Result struct {
+	// The peer sent the NAT detection notifications
+	Supported bool
+	// The address of this end is changed on the way to the peer
+	LocalBehindNAT bool
+	// The address the peer sent from is changed on the way here
+	RemoteBehindNAT bool
+}
+
+// Detected reports whether a NAT is found between the peers, in which case
+// IKE moves to the NAT-T port and ESP is encapsulated in UDP
+func (result Result) Detected() bool {
+	return result.LocalBehindNAT || result.RemoteBehindNAT
+}
+
+// CheckDetection compares the NAT detection notifications of the payloads of
+// a received message to the hashes of the addresses it is sent and received
+// on. The SPIs are those of the header of the received message.
+func CheckDetection(
+	payloads message.IKEPayloadContainer,
+	initiatorSPI, responderSPI uint64,
+	local, remote netip.AddrPort,
+) (Result, error) {
+	var sources [][]byte
+	var destination []byte
+	for _, payload := range payloads {
+		notification, ok := payload.(*message.Notification)
+		if !ok {
+			continue
+		}
+		switch notification.NotifyMessageType {
+		case message.NAT_DETECTION_SOURCE_IP:
+			if len(notification.NotificationData) != sha1.Size {
+				return Result{}, errors.Errorf("CheckDetection(): Invalid NAT_DETECTION_SOURCE_IP length %d",
+					len(notification.NotificationData))
+			}
+			// A multihomed peer sends one per address
+			sources = append(sources, notification.NotificationData)
+		case message.NAT_DETECTION_DESTINATION_IP:
+			if len(notification.NotificationData) != sha1.Size {
+				return Result{}, errors.Errorf("CheckDetection(): Invalid NAT_DETECTION_DESTINATION_IP length %d",
+					len(notification.NotificationData))
+			}
+			if destination != nil {
+				return Result{}, errors.Errorf("CheckDetection(): More than one NAT_DETECTION_DESTINATION_IP")
+			}
+			destination = notification.NotificationData
+		}
+	}
+	if sources == nil && destination == nil {
+		return Result{}, nil
+	}
+	if sources == nil || destination == nil {
+		return Result{}, errors.Errorf("CheckDetection(): Missing NAT detection notification")
+	}
+
+	result := Result{
+		Supported:       true,
+		LocalBehindNAT:  !bytes.Equal(destination, DetectionHash(initiatorSPI, responderSPI, local)),
+		RemoteBehindNAT: true,
+	}
+	remoteHash := DetectionHash(initiatorSPI, responderSPI, remote)
+	for _, source := range sources {
+		if bytes.Equal(source, remoteHash) {
+			result.RemoteBehindNAT = false
+			break
+		}
+	}
+	return result, nil
+}
+
+type PacketType int
+
+const (
+	PacketIKE PacketType = iota
+	PacketESP
+	PacketKeepalive
+)
+
+// EncodeIKE prepends the non-ESP marker to an IKE message sent on the NAT-T
+// port
+func EncodeIKE(msg []byte) []byte {
+	packet := make([]byte, nonESPMarkerLength, nonESPMarkerLength+len(msg))
+	return append(packet, msg...)
+}
+
+// Keepalive returns a NAT-keepalive packet, sent to keep the NAT mapping of
+// the NAT-T port open
+func Keepalive() []byte {
+	return []byte{natKeepalive}
+}
+
+// Decode tells the packets received on the NAT-T port apart. The IKE message
+// is returned without the non-ESP marker, and the ESP packet as received.
+func Decode(packet []byte) (PacketType, []byte, error) {
+	if len(packet) == 1 && packet[0] == natKeepalive {
+		return PacketKeepalive, nil, nil
+	}
+	if len(packet) < nonESPMarkerLength {
+		return 0, nil, errors.Errorf("Decode(): Packet too short: %d", len(packet))
+	}
+	// The SPI of an ESP packet is never zero
+	if binary.BigEndian.Uint32(packet[:nonESPMarkerLength]) == 0 {
+		msg := packet[nonESPMarkerLength:]
+		if len(msg) < message.IKE_HEADER_LEN {
+			return 0, nil, errors.Errorf("Decode(): IKE message too short: %d", len(msg))
+		}
+		return PacketIKE, msg, nil
+	}
+	if len(packet) < espHeaderLength {
+		return 0, nil, errors.Errorf("Decode(): ESP packet too short: %d", len(packet))
+	}
+	return PacketESP, packet, nil
+}
@@ -0,0 +1,206 @@
+package nat
+
+import (
+	"crypto/sha1" // #nosec G505
+	"encoding/hex"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+func TestDetectionHash(t *testing.T) {
+	data, err := hex.DecodeString("000000000006f708" + "c9e2e31f8b64053d" + "c0a80102" + "01f4")
+	require.NoError(t, err)
+	expected := sha1.Sum(data) // #nosec G401
+
+	addrPort := netip.MustParseAddrPort("192.168.1.2:500")
+	require.Equal(t, expected[:], DetectionHash(0x000000000006f708, 0xc9e2e31f8b64053d, addrPort))
+
+	// IPv4-mapped address of a dual-stack socket
+	mapped := netip.MustParseAddrPort("[::ffff:192.168.1.2]:500")
+	require.Equal(t, expected[:], DetectionHash(0x000000000006f708, 0xc9e2e31f8b64053d, mapped))
+
+	ipv6 := netip.MustParseAddrPort("[2001:db8::1]:500")
+	require.NotEqual(t, expected[:], DetectionHash(0x000000000006f708, 0xc9e2e31f8b64053d, ipv6))
+}
+
+func TestCheckDetection(t *testing.T) {
+	const spii, spir = 0x000000000006f708, 0xc9e2e31f8b64053d
+	ue := netip.MustParseAddrPort("10.0.0.2:500")
+	natUE := netip.MustParseAddrPort("203.0.113.7:41000")
+	gw := netip.MustParseAddrPort("198.51.100.1:500")
+	// Private address of the gateway forwarded from gw
+	natGW := netip.MustParseAddrPort("192.168.10.1:500")
+
+	testcases := []struct {
+		description string
+		// Addresses seen by the sender, and by the receiver
+		senderLocal, senderRemote     netip.AddrPort
+		receiverLocal, receiverRemote netip.AddrPort
+		payloads                      func(message.IKEPayloadContainer) message.IKEPayloadContainer
+		expected                      Result
+		expectErr                     bool
+	}{
+		{
+			description:    "No NAT",
+			senderLocal:    ue,
+			senderRemote:   gw,
+			receiverLocal:  gw,
+			receiverRemote: ue,
+			expected:       Result{Supported: true},
+		},
+		{
+			description:    "Sender behind NAT",
+			senderLocal:    ue,
+			senderRemote:   gw,
+			receiverLocal:  gw,
+			receiverRemote: natUE,
+			expected:       Result{Supported: true, RemoteBehindNAT: true},
+		},
+		{
+			description:    "Receiver behind NAT",
+			senderLocal:    ue,
+			senderRemote:   gw,
+			receiverLocal:  natGW,
+			receiverRemote: ue,
+			expected:       Result{Supported: true, LocalBehindNAT: true},
+		},
+		{
+			description:    "Multihomed sender",
+			senderLocal:    ue,
+			senderRemote:   gw,
+			receiverLocal:  gw,
+			receiverRemote: natUE,
+			payloads: func(payloads message.IKEPayloadContainer) message.IKEPayloadContainer {
+				payloads.BuildNotification(message.TypeNone, message.NAT_DETECTION_SOURCE_IP,
+					nil, DetectionHash(spii, spir, natUE))
+				return payloads
+			},
+			expected: Result{Supported: true},
+		},
+		{
+			description: "No notification",
+			payloads: func(message.IKEPayloadContainer) message.IKEPayloadContainer {
+				return nil
+			},
+			expected: Result{},
+		},
+		{
+			description:    "Missing destination",
+			senderLocal:    ue,
+			senderRemote:   gw,
+			receiverLocal:  gw,
+			receiverRemote: ue,
+			payloads: func(payloads message.IKEPayloadContainer) message.IKEPayloadContainer {
+				return payloads[:1]
+			},
+			expectErr: true,
+		},
+		{
+			description:    "Two destinations",
+			senderLocal:    ue,
+			senderRemote:   gw,
+			receiverLocal:  gw,
+			receiverRemote: ue,
+			payloads: func(payloads message.IKEPayloadContainer) message.IKEPayloadContainer {
+				return append(payloads, payloads[1])
+			},
+			expectErr: true,
+		},
+		{
+			description:    "Invalid length",
+			senderLocal:    ue,
+			senderRemote:   gw,
+			receiverLocal:  gw,
+			receiverRemote: ue,
+			payloads: func(payloads message.IKEPayloadContainer) message.IKEPayloadContainer {
+				payloads.BuildNotification(message.TypeNone, message.NAT_DETECTION_SOURCE_IP,
+					nil, make([]byte, sha1.Size-1))
+				return payloads
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			var payloads message.IKEPayloadContainer
+			BuildDetection(&payloads, spii, spir, tc.senderLocal, tc.senderRemote)
+			if tc.payloads != nil {
+				payloads = tc.payloads(payloads)
+			}
+
+			result, err := CheckDetection(payloads, spii, spir, tc.receiverLocal, tc.receiverRemote)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, result)
+			require.Equal(t, tc.expected.LocalBehindNAT || tc.expected.RemoteBehindNAT, result.Detected())
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	ikeMsg := make([]byte, message.IKE_HEADER_LEN)
+	ikeMsg[0] = 0x01
+	espPacket := []byte{0x00, 0x00, 0x10, 0x01, 0x00, 0x00, 0x00, 0x01, 0xaa}
+
+	testcases := []struct {
+		description string
+		packet      []byte
+		packetType  PacketType
+		data        []byte
+		expectErr   bool
+	}{
+		{
+			description: "IKE message",
+			packet:      EncodeIKE(ikeMsg),
+			packetType:  PacketIKE,
+			data:        ikeMsg,
+		},
+		{
+			description: "ESP packet",
+			packet:      espPacket,
+			packetType:  PacketESP,
+			data:        espPacket,
+		},
+		{
+			description: "NAT-keepalive",
+			packet:      Keepalive(),
+			packetType:  PacketKeepalive,
+		},
+		{
+			description: "Short IKE message",
+			packet:      EncodeIKE(ikeMsg[:message.IKE_HEADER_LEN-1]),
+			expectErr:   true,
+		},
+		{
+			description: "Short ESP packet",
+			packet:      espPacket[:espHeaderLength-1],
+			expectErr:   true,
+		},
+		{
+			description: "Short packet",
+			packet:      []byte{0x00, 0x00},
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			packetType, data, err := Decode(tc.packet)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.packetType, packetType)
+			require.Equal(t, tc.data, data)
+		})
+	}
+}
@@ -5,3 +5,14 @@ type IKECrypto interface {
 	Encrypt(plainText []byte) ([]byte, error)
 	Decrypt(cipherText []byte) ([]byte, error)
 }
+
+// IKEAEADCrypto is implemented by combined mode ciphers (RFC 5282). The
+// associated data is authenticated but not encrypted, and the ICV is appended
+// to the returned cipher text.
+type IKEAEADCrypto interface {
+	IKECrypto
+	EncryptWithAD(plainText, associatedData []byte) ([]byte, error)
+	DecryptWithAD(cipherText, associatedData []byte) ([]byte, error)
+	// Overhead returns the length of IV and ICV added to the cipher text
+	Overhead() int
+}
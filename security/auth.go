@@ -0,0 +1,337 @@
+package security
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // #nosec G505
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// Key pad of the AUTH data computed with a shared secret (RFC 7296 - 2.15)
+var keyPadForIKEv2 = []byte("Key Pad for IKEv2")
+
+// signatureAlgorithm is a signature scheme of the Digital Signature
+// authentication method (RFC 7427)
+type signatureAlgorithm struct {
+	hash crypto.Hash
+	pss  bool // RSASSA-PSS, or ECDSA otherwise
+	// DER encoded AlgorithmIdentifier of the AUTH data
+	identifier []byte
+}
+
+var (
+	oidRSASSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	oidMGF1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+
+	oidHash = map[crypto.Hash]asn1.ObjectIdentifier{
+		crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+		crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+		crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+	}
+	oidECDSA = map[crypto.Hash]asn1.ObjectIdentifier{
+		crypto.SHA256: {1, 2, 840, 10045, 4, 3, 2},
+		crypto.SHA384: {1, 2, 840, 10045, 4, 3, 3},
+		crypto.SHA512: {1, 2, 840, 10045, 4, 3, 4},
+	}
+
+	signatureAlgorithms []*signatureAlgorithm
+)
+
+// RSASSA-PSS-params (RFC 4055 - 3.1)
+type pssParameters struct {
+	Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+	MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+	SaltLength int                      `asn1:"explicit,tag:2"`
+}
+
+func init() {
+	null := asn1.RawValue{FullBytes: asn1.NullBytes}
+	for _, hash := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		hashIdentifier := pkix.AlgorithmIdentifier{Algorithm: oidHash[hash], Parameters: null}
+		hashIdentifierDER, err := asn1.Marshal(hashIdentifier)
+		if err != nil {
+			panic(err)
+		}
+		params, err := asn1.Marshal(pssParameters{
+			Hash: hashIdentifier,
+			MGF: pkix.AlgorithmIdentifier{
+				Algorithm:  oidMGF1,
+				Parameters: asn1.RawValue{FullBytes: hashIdentifierDER},
+			},
+			SaltLength: hash.Size(),
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		pss, err := asn1.Marshal(pkix.AlgorithmIdentifier{
+			Algorithm:  oidRSASSAPSS,
+			Parameters: asn1.RawValue{FullBytes: params},
+		})
+		if err != nil {
+			panic(err)
+		}
+		ecdsaIdentifier, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: oidECDSA[hash]})
+		if err != nil {
+			panic(err)
+		}
+
+		signatureAlgorithms = append(signatureAlgorithms,
+			&signatureAlgorithm{hash: hash, pss: true, identifier: pss},
+			&signatureAlgorithm{hash: hash, pss: false, identifier: ecdsaIdentifier})
+	}
+}
+
+// SignedOctets returns the octets signed in the AUTH payload of signer
+// (RFC 7296 - 2.15):
+// RealMessage | NoncePeerData | prf(SK_px, IDType | RESERVED | IDData)
+// realMessage is the IKE_SA_INIT message sent by signer, peerNonce is the
+// nonce of the other side, and the identification payload is the one of
+// signer.
+func (ikesaKey *IKESAKey) SignedOctets(
+	signer message.Role,
+	realMessage []byte,
+	peerNonce []byte,
+	idType uint8,
+	idData []byte,
+) ([]byte, error) {
+	prf := ikesaKey.Prf_r
+	if signer == message.Role_Initiator {
+		prf = ikesaKey.Prf_i
+	}
+	if prf == nil {
+		return nil, errors.Errorf("SignedOctets : No authentication key")
+	}
+	if len(realMessage) == 0 || len(peerNonce) == 0 {
+		return nil, errors.Errorf("SignedOctets : Missing message or nonce")
+	}
+
+	prf.Reset()
+	if _, err := prf.Write(append([]byte{idType, 0, 0, 0}, idData...)); err != nil {
+		return nil, errors.Wrapf(err, "SignedOctets")
+	}
+
+	signedOctets := make([]byte, 0, len(realMessage)+len(peerNonce)+prf.Size())
+	signedOctets = append(signedOctets, realMessage...)
+	signedOctets = append(signedOctets, peerNonce...)
+	return prf.Sum(signedOctets), nil
+}
+
+// EAPSharedSecret returns the shared secret of the AUTH payloads following
+// EAP: the MSK, or SK_pi/SK_pr of signer if the EAP method does not generate
+// one (RFC 7296 - 2.16)
+func (ikesaKey *IKESAKey) EAPSharedSecret(signer message.Role, msk []byte) []byte {
+	if len(msk) != 0 {
+		return msk
+	}
+	if signer == message.Role_Initiator {
+		return ikesaKey.SK_pi
+	}
+	return ikesaKey.SK_pr
+}
+
+// PSKAuthentication returns the AUTH payload computed with a shared secret:
+// prf(prf(Shared Secret, "Key Pad for IKEv2"), <SignedOctets>)
+func (ikesaKey *IKESAKey) PSKAuthentication(sharedSecret, signedOctets []byte) (*message.Authentication, error) {
+	authData, err := ikesaKey.pskAuthData(sharedSecret, signedOctets)
+	if err != nil {
+		return nil, errors.Wrapf(err, "PSKAuthentication")
+	}
+	return &message.Authentication{
+		AuthenticationMethod: message.SharedKeyMesageIntegrityCode,
+		AuthenticationData:   authData,
+	}, nil
+}
+
+// VerifyPSKAuthentication checks an AUTH payload computed with a shared secret
+func (ikesaKey *IKESAKey) VerifyPSKAuthentication(
+	authentication *message.Authentication,
+	sharedSecret []byte,
+	signedOctets []byte,
+) error {
+	if authentication == nil {
+		return errors.Errorf("VerifyPSKAuthentication : authentication is nil")
+	}
+	if authentication.AuthenticationMethod != message.SharedKeyMesageIntegrityCode {
+		return errors.Errorf("VerifyPSKAuthentication : Unexpected authentication method %d",
+			authentication.AuthenticationMethod)
+	}
+
+	expected, err := ikesaKey.pskAuthData(sharedSecret, signedOctets)
+	if err != nil {
+		return errors.Wrapf(err, "VerifyPSKAuthentication")
+	}
+	if !hmac.Equal(expected, authentication.AuthenticationData) {
+		return errors.Errorf("VerifyPSKAuthentication : AUTH data mismatch")
+	}
+	return nil
+}
+
+func (ikesaKey *IKESAKey) pskAuthData(sharedSecret, signedOctets []byte) ([]byte, error) {
+	if ikesaKey.PrfInfo == nil {
+		return nil, errors.Errorf("No pseudorandom function specified")
+	}
+	if len(sharedSecret) == 0 {
+		return nil, errors.Errorf("Shared secret is empty")
+	}
+
+	keyPrf := ikesaKey.PrfInfo.Init(sharedSecret)
+	if keyPrf == nil {
+		return nil, errors.Errorf("Invalid shared secret")
+	}
+	if _, err := keyPrf.Write(keyPadForIKEv2); err != nil {
+		return nil, errors.Wrapf(err, "Pseudorandom function write error")
+	}
+	authPrf := ikesaKey.PrfInfo.Init(keyPrf.Sum(nil))
+	if _, err := authPrf.Write(signedOctets); err != nil {
+		return nil, errors.Wrapf(err, "Pseudorandom function write error")
+	}
+	return authPrf.Sum(nil), nil
+}
+
+// RSAAuthentication returns the AUTH payload of the RSA Digital Signature
+// method, signed with RSASSA-PKCS1-v1_5 and SHA-1 (RFC 7296 - 3.8)
+func RSAAuthentication(privateKey *rsa.PrivateKey, signedOctets []byte) (*message.Authentication, error) {
+	digest := sha1.Sum(signedOctets) // #nosec G401
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA1, digest[:])
+	if err != nil {
+		return nil, errors.Wrapf(err, "RSAAuthentication")
+	}
+	return &message.Authentication{
+		AuthenticationMethod: message.RSADigitalSignature,
+		AuthenticationData:   signature,
+	}, nil
+}
+
+// DigitalSignatureAuthentication returns the AUTH payload of the Digital
+// Signature method (RFC 7427). RSA keys sign with RSASSA-PSS and ECDSA keys
+// with ECDSA, over hash which is SHA-256, SHA-384 or SHA-512.
+func DigitalSignatureAuthentication(
+	signer crypto.Signer,
+	hash crypto.Hash,
+	signedOctets []byte,
+) (*message.Authentication, error) {
+	var pss bool
+	var opts crypto.SignerOpts = hash
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		pss = true
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+	case *ecdsa.PublicKey:
+	default:
+		return nil, errors.Errorf("DigitalSignatureAuthentication : Unsupported key type %T", signer.Public())
+	}
+
+	var algorithm *signatureAlgorithm
+	for _, a := range signatureAlgorithms {
+		if a.hash == hash && a.pss == pss {
+			algorithm = a
+			break
+		}
+	}
+	if algorithm == nil {
+		return nil, errors.Errorf("DigitalSignatureAuthentication : Unsupported hash %v", hash)
+	}
+
+	h := hash.New()
+	h.Write(signedOctets)
+	signature, err := signer.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DigitalSignatureAuthentication")
+	}
+
+	// ASN.1 Length | AlgorithmIdentifier ASN.1 object | Signature Value
+	authData := make([]byte, 0, 1+len(algorithm.identifier)+len(signature))
+	authData = append(authData, uint8(len(algorithm.identifier)))
+	authData = append(authData, algorithm.identifier...)
+	authData = append(authData, signature...)
+	return &message.Authentication{
+		AuthenticationMethod: message.DigitalSignature,
+		AuthenticationData:   authData,
+	}, nil
+}
+
+// VerifySignatureAuthentication checks an AUTH payload of the RSA Digital
+// Signature or the Digital Signature method with the public key of the peer
+func VerifySignatureAuthentication(
+	authentication *message.Authentication,
+	publicKey crypto.PublicKey,
+	signedOctets []byte,
+) error {
+	if authentication == nil {
+		return errors.Errorf("VerifySignatureAuthentication : authentication is nil")
+	}
+
+	switch authentication.AuthenticationMethod {
+	case message.RSADigitalSignature:
+		rsaKey, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.Errorf("VerifySignatureAuthentication : RSA Digital Signature with %T key", publicKey)
+		}
+		digest := sha1.Sum(signedOctets) // #nosec G401
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA1, digest[:], authentication.AuthenticationData); err != nil {
+			return errors.Wrapf(err, "VerifySignatureAuthentication")
+		}
+		return nil
+	case message.DigitalSignature:
+		return verifyDigitalSignature(authentication.AuthenticationData, publicKey, signedOctets)
+	default:
+		return errors.Errorf("VerifySignatureAuthentication : Unsupported authentication method %d",
+			authentication.AuthenticationMethod)
+	}
+}
+
+func verifyDigitalSignature(authData []byte, publicKey crypto.PublicKey, signedOctets []byte) error {
+	if len(authData) == 0 || len(authData) < 1+int(authData[0]) {
+		return errors.Errorf("verifyDigitalSignature : AUTH data too short")
+	}
+	identifier := authData[1 : 1+int(authData[0])]
+	signature := authData[1+int(authData[0]):]
+
+	var algorithm *signatureAlgorithm
+	for _, a := range signatureAlgorithms {
+		if bytes.Equal(a.identifier, identifier) {
+			algorithm = a
+			break
+		}
+	}
+	if algorithm == nil {
+		return errors.Errorf("verifyDigitalSignature : Unsupported signature algorithm")
+	}
+
+	h := algorithm.hash.New()
+	h.Write(signedOctets)
+	digest := h.Sum(nil)
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if !algorithm.pss {
+			return errors.Errorf("verifyDigitalSignature : ECDSA signature with RSA key")
+		}
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: algorithm.hash}
+		if err := rsa.VerifyPSS(key, algorithm.hash, digest, signature, opts); err != nil {
+			return errors.Wrapf(err, "verifyDigitalSignature")
+		}
+	case *ecdsa.PublicKey:
+		if algorithm.pss {
+			return errors.Errorf("verifyDigitalSignature : RSASSA-PSS signature with ECDSA key")
+		}
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return errors.Errorf("verifyDigitalSignature : Invalid ECDSA signature")
+		}
+	default:
+		return errors.Errorf("verifyDigitalSignature : Unsupported key type %T", publicKey)
+	}
+	return nil
+}
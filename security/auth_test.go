@@ -0,0 +1,214 @@
+package security
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security/prf"
+)
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func newAuthTestKey() *IKESAKey {
+	prfInfo := prf.StrToType(prf.PRF_HMAC_SHA2_256)
+	ikesaKey := &IKESAKey{
+		PrfInfo: prfInfo,
+		SK_pi:   []byte("0123456789abcdef0123456789abcdef"),
+		SK_pr:   []byte("fedcba9876543210fedcba9876543210"),
+	}
+	ikesaKey.Prf_i = prfInfo.Init(ikesaKey.SK_pi)
+	ikesaKey.Prf_r = prfInfo.Init(ikesaKey.SK_pr)
+	return ikesaKey
+}
+
+func TestSignedOctets(t *testing.T) {
+	ikesaKey := newAuthTestKey()
+	realMessage := []byte("IKE_SA_INIT request")
+	nonce := []byte("responder nonce")
+	idData := []byte("ue.example.com")
+
+	expected := append(append([]byte{}, realMessage...), nonce...)
+	expected = append(expected, hmacSha256(ikesaKey.SK_pi, []byte{message.ID_FQDN, 0, 0, 0}, idData)...)
+
+	// Computed twice, since the PRF is reused
+	for i := 0; i < 2; i++ {
+		signedOctets, err := ikesaKey.SignedOctets(message.Role_Initiator, realMessage, nonce, message.ID_FQDN, idData)
+		require.NoError(t, err)
+		require.Equal(t, expected, signedOctets)
+	}
+
+	signedOctets, err := ikesaKey.SignedOctets(message.Role_Responder, realMessage, nonce, message.ID_FQDN, idData)
+	require.NoError(t, err)
+	require.NotEqual(t, expected, signedOctets)
+
+	_, err = ikesaKey.SignedOctets(message.Role_Initiator, nil, nonce, message.ID_FQDN, idData)
+	require.Error(t, err)
+}
+
+func TestPSKAuthentication(t *testing.T) {
+	ikesaKey := newAuthTestKey()
+	signedOctets := []byte("signed octets")
+	msk := make([]byte, 64)
+
+	testcases := []struct {
+		description  string
+		sharedSecret []byte
+	}{
+		{
+			description:  "Pre-shared key",
+			sharedSecret: []byte("pre-shared key"),
+		},
+		{
+			description:  "EAP MSK",
+			sharedSecret: ikesaKey.EAPSharedSecret(message.Role_Initiator, msk),
+		},
+		{
+			description:  "EAP without MSK",
+			sharedSecret: ikesaKey.EAPSharedSecret(message.Role_Responder, nil),
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			authentication, err := ikesaKey.PSKAuthentication(tc.sharedSecret, signedOctets)
+			require.NoError(t, err)
+			require.Equal(t, uint8(message.SharedKeyMesageIntegrityCode), authentication.AuthenticationMethod)
+			require.Equal(t, hmacSha256(hmacSha256(tc.sharedSecret, []byte("Key Pad for IKEv2")), signedOctets),
+				authentication.AuthenticationData)
+
+			require.NoError(t, ikesaKey.VerifyPSKAuthentication(authentication, tc.sharedSecret, signedOctets))
+			require.Error(t, ikesaKey.VerifyPSKAuthentication(authentication, []byte("wrong"), signedOctets))
+			require.Error(t, ikesaKey.VerifyPSKAuthentication(authentication, tc.sharedSecret, []byte("other")))
+		})
+	}
+
+	require.Equal(t, msk, ikesaKey.EAPSharedSecret(message.Role_Responder, msk))
+	require.Equal(t, ikesaKey.SK_pi, ikesaKey.EAPSharedSecret(message.Role_Initiator, nil))
+	require.Equal(t, ikesaKey.SK_pr, ikesaKey.EAPSharedSecret(message.Role_Responder, nil))
+
+	_, err := ikesaKey.PSKAuthentication(nil, signedOctets)
+	require.Error(t, err)
+}
+
+func TestSignatureAlgorithmIdentifier(t *testing.T) {
+	// RFC 7427 - A.3.1 and A.4.1
+	ecdsaSha256, err := hex.DecodeString("300a06082a8648ce3d040302")
+	require.NoError(t, err)
+	pssSha256, err := hex.DecodeString("3041" +
+		"06092a864886f70d01010a" +
+		"3034" +
+		"a00f300d0609608648016503040201" + "0500" +
+		"a11c301a06092a864886f70d010108" + "300d0609608648016503040201" + "0500" +
+		"a203020120")
+	require.NoError(t, err)
+
+	for _, algorithm := range signatureAlgorithms {
+		if algorithm.hash != crypto.SHA256 {
+			continue
+		}
+		if algorithm.pss {
+			require.Equal(t, pssSha256, algorithm.identifier)
+		} else {
+			require.Equal(t, ecdsaSha256, algorithm.identifier)
+		}
+	}
+}
+
+func TestSignatureAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signedOctets := []byte("signed octets")
+
+	pkcs1, err := RSAAuthentication(rsaKey, signedOctets)
+	require.NoError(t, err)
+	require.Equal(t, uint8(message.RSADigitalSignature), pkcs1.AuthenticationMethod)
+
+	testcases := []struct {
+		description    string
+		authentication func() (*message.Authentication, error)
+		publicKey      crypto.PublicKey
+		wrongKey       crypto.PublicKey
+	}{
+		{
+			description: "RSASSA-PKCS1-v1_5",
+			authentication: func() (*message.Authentication, error) {
+				return RSAAuthentication(rsaKey, signedOctets)
+			},
+			publicKey: &rsaKey.PublicKey,
+			wrongKey:  &otherRSAKey.PublicKey,
+		},
+		{
+			description: "RSASSA-PSS with SHA-256",
+			authentication: func() (*message.Authentication, error) {
+				return DigitalSignatureAuthentication(rsaKey, crypto.SHA256, signedOctets)
+			},
+			publicKey: &rsaKey.PublicKey,
+			wrongKey:  &ecdsaKey.PublicKey,
+		},
+		{
+			description: "RSASSA-PSS with SHA-512",
+			authentication: func() (*message.Authentication, error) {
+				return DigitalSignatureAuthentication(rsaKey, crypto.SHA512, signedOctets)
+			},
+			publicKey: &rsaKey.PublicKey,
+			wrongKey:  &otherRSAKey.PublicKey,
+		},
+		{
+			description: "ECDSA with SHA-256",
+			authentication: func() (*message.Authentication, error) {
+				return DigitalSignatureAuthentication(ecdsaKey, crypto.SHA256, signedOctets)
+			},
+			publicKey: &ecdsaKey.PublicKey,
+			wrongKey:  &rsaKey.PublicKey,
+		},
+		{
+			description: "ECDSA with SHA-384",
+			authentication: func() (*message.Authentication, error) {
+				return DigitalSignatureAuthentication(ecdsaKey, crypto.SHA384, signedOctets)
+			},
+			publicKey: &ecdsaKey.PublicKey,
+			wrongKey:  &rsaKey.PublicKey,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			authentication, err := tc.authentication()
+			require.NoError(t, err)
+			require.NoError(t, VerifySignatureAuthentication(authentication, tc.publicKey, signedOctets))
+			require.Error(t, VerifySignatureAuthentication(authentication, tc.wrongKey, signedOctets))
+			require.Error(t, VerifySignatureAuthentication(authentication, tc.publicKey, []byte("other")))
+
+			// Tampered signature
+			authentication.AuthenticationData[len(authentication.AuthenticationData)-1] ^= 0x01
+			require.Error(t, VerifySignatureAuthentication(authentication, tc.publicKey, signedOctets))
+		})
+	}
+
+	_, err = DigitalSignatureAuthentication(ecdsaKey, crypto.SHA1, signedOctets)
+	require.Error(t, err)
+	require.Error(t, VerifySignatureAuthentication(&message.Authentication{
+		AuthenticationMethod: message.DigitalSignature,
+		AuthenticationData:   []byte{0x20, 0x30},
+	}, &ecdsaKey.PublicKey, signedOctets))
+}
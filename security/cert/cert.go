@@ -0,0 +1,337 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1" // #nosec G505
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// Length of a certification authority hash in CERTREQ (RFC 7296 - 3.7)
+const spkiHashLength = sha1.Size
+
+// SPKIHash returns the SHA-1 hash of the Subject Public Key Info of
+// certificate, which identifies a certification authority in CERTREQ
+func SPKIHash(certificate *x509.Certificate) []byte {
+	hash := sha1.Sum(certificate.RawSubjectPublicKeyInfo) // #nosec G401
+	return hash[:]
+}
+
+// Chain is a local certificate chain, from the end entity certificate to the
+// certificate issued by a trust anchor, optionally followed by the anchor.
+type Chain struct {
+	Certificates []*x509.Certificate
+	PrivateKey   crypto.Signer
+}
+
+// Leaf returns the end entity certificate of the chain
+func (chain *Chain) Leaf() *x509.Certificate {
+	return chain.Certificates[0]
+}
+
+// BuildCertificates appends a CERT payload for each certificate of the chain,
+// leaf first. A self-signed anchor is not sent.
+func (chain *Chain) BuildCertificates(container *message.IKEPayloadContainer) {
+	for _, certificate := range chain.Certificates {
+		if isSelfSigned(certificate) && certificate != chain.Leaf() {
+			continue
+		}
+		container.BuildCertificate(message.X509CertificateSignature, certificate.Raw)
+	}
+}
+
+// issuers returns the certification authorities of the chain: its
+// certificates after the leaf, followed by the issuer of the last one among
+// candidates if the chain ends without its anchor
+func (chain *Chain) issuers(candidates []*x509.Certificate) []*x509.Certificate {
+	issuers := chain.Certificates[1:len(chain.Certificates):len(chain.Certificates)]
+	last := chain.Certificates[len(chain.Certificates)-1]
+	if isSelfSigned(last) {
+		return issuers
+	}
+	for _, candidate := range candidates {
+		if bytes.Equal(last.RawIssuer, candidate.RawSubject) && last.CheckSignatureFrom(candidate) == nil {
+			return append(issuers, candidate)
+		}
+	}
+	return issuers
+}
+
+// issuedBy reports whether a certification authority of the chain, resolved
+// with candidates, is one of the hashes
+func (chain *Chain) issuedBy(hashes [][]byte, candidates []*x509.Certificate) bool {
+	for _, certificate := range chain.issuers(candidates) {
+		spkiHash := SPKIHash(certificate)
+		for _, hash := range hashes {
+			if bytes.Equal(spkiHash, hash) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Store holds the local certificate chains, the trust anchors of the peer
+// certificates, and the CRLs of their issuers
+type Store struct {
+	chains  []*Chain
+	anchors []*x509.Certificate
+	roots   *x509.CertPool
+	crls    []*x509.RevocationList
+
+	// Time of validation, time.Now if nil
+	currentTime func() time.Time
+}
+
+func NewStore() *Store {
+	return &Store{
+		roots: x509.NewCertPool(),
+	}
+}
+
+// AddChain adds a local certificate chain, whose leaf holds the public key of
+// privateKey
+func (store *Store) AddChain(certificates []*x509.Certificate, privateKey crypto.Signer) error {
+	if len(certificates) == 0 {
+		return errors.Errorf("AddChain(): Empty certificate chain")
+	}
+	if privateKey == nil {
+		return errors.Errorf("AddChain(): Private key is nil")
+	}
+	publicKey, ok := privateKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(certificates[0].PublicKey) {
+		return errors.Errorf("AddChain(): Private key does not match the certificate")
+	}
+	for i := 1; i < len(certificates); i++ {
+		if err := certificates[i-1].CheckSignatureFrom(certificates[i]); err != nil {
+			return errors.Wrapf(err, "AddChain(): Certificate %d is not issued by the next one", i-1)
+		}
+	}
+
+	store.chains = append(store.chains, &Chain{
+		Certificates: certificates,
+		PrivateKey:   privateKey,
+	})
+	return nil
+}
+
+// AddTrustAnchor adds a certification authority trusted to issue the
+// certificates of peers
+func (store *Store) AddTrustAnchor(certificate *x509.Certificate) {
+	store.anchors = append(store.anchors, certificate)
+	store.roots.AddCert(certificate)
+}
+
+// AddCRL adds a CRL checked when validating the certificates of its issuer
+func (store *Store) AddCRL(crl *x509.RevocationList) {
+	store.crls = append(store.crls, crl)
+}
+
+// LoadCRLFile adds the CRLs of a PEM or DER encoded file
+func (store *Store) LoadCRLFile(path string) error {
+	data, err := os.ReadFile(path) // #nosec G304
+	if err != nil {
+		return errors.Wrapf(err, "LoadCRLFile()")
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		crl, parseErr := x509.ParseRevocationList(data)
+		if parseErr != nil {
+			return errors.Wrapf(parseErr, "LoadCRLFile()")
+		}
+		store.AddCRL(crl)
+		return nil
+	}
+
+	var found bool
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, parseErr := x509.ParseRevocationList(block.Bytes)
+		if parseErr != nil {
+			return errors.Wrapf(parseErr, "LoadCRLFile()")
+		}
+		store.AddCRL(crl)
+		found = true
+	}
+	if !found {
+		return errors.Errorf("LoadCRLFile(): No CRL in %s", path)
+	}
+	return nil
+}
+
+// BuildCertificateRequest appends a CERTREQ payload with the hashes of the
+// trust anchors
+func (store *Store) BuildCertificateRequest(container *message.IKEPayloadContainer) {
+	if len(store.anchors) == 0 {
+		return
+	}
+	hashes := make([]byte, 0, len(store.anchors)*spkiHashLength)
+	for _, anchor := range store.anchors {
+		hashes = append(hashes, SPKIHash(anchor)...)
+	}
+	*container = append(*container, &message.CertificateRequest{
+		CertificateEncoding:    message.X509CertificateSignature,
+		CertificationAuthority: hashes,
+	})
+}
+
+// SelectChain returns the first local chain issued by a certification
+// authority requested by the peer, or the first chain if the peer sends no
+// X.509 CERTREQ
+func (store *Store) SelectChain(requests []*message.CertificateRequest) (*Chain, error) {
+	if len(store.chains) == 0 {
+		return nil, errors.Errorf("SelectChain(): No local certificate")
+	}
+
+	var hashes [][]byte
+	for _, request := range requests {
+		if request.CertificateEncoding != message.X509CertificateSignature {
+			continue
+		}
+		if len(request.CertificationAuthority)%spkiHashLength != 0 {
+			return nil, errors.Errorf("SelectChain(): Invalid certification authority length %d",
+				len(request.CertificationAuthority))
+		}
+		for i := 0; i < len(request.CertificationAuthority); i += spkiHashLength {
+			hashes = append(hashes, request.CertificationAuthority[i:i+spkiHashLength])
+		}
+	}
+	if len(hashes) == 0 {
+		return store.chains[0], nil
+	}
+
+	// The anchor missing at the end of a chain is looked up in the trust
+	// anchors, and in the certificates of the other chains
+	candidates := append([]*x509.Certificate{}, store.anchors...)
+	for _, chain := range store.chains {
+		candidates = append(candidates, chain.Certificates...)
+	}
+	for _, chain := range store.chains {
+		if chain.issuedBy(hashes, candidates) {
+			return chain, nil
+		}
+	}
+	return nil, errors.Errorf("SelectChain(): No certificate issued by the requested authorities")
+}
+
+// VerifyCertificates validates the chain of the CERT payloads of the peer up
+// to a trust anchor, and returns the end entity certificate, which is the
+// first one
+func (store *Store) VerifyCertificates(certificates []*message.Certificate) (*x509.Certificate, error) {
+	var leaf *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates {
+		if certificate.CertificateEncoding != message.X509CertificateSignature {
+			return nil, errors.Errorf("VerifyCertificates(): Unsupported certificate encoding %d",
+				certificate.CertificateEncoding)
+		}
+		parsed, err := x509.ParseCertificate(certificate.CertificateData)
+		if err != nil {
+			return nil, errors.Wrapf(err, "VerifyCertificates()")
+		}
+		if leaf == nil {
+			leaf = parsed
+		} else {
+			intermediates.AddCert(parsed)
+		}
+	}
+	if leaf == nil {
+		return nil, errors.Errorf("VerifyCertificates(): No certificate")
+	}
+
+	now := time.Now()
+	if store.currentTime != nil {
+		now = store.currentTime()
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         store.roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "VerifyCertificates()")
+	}
+
+	var revocationErr error
+	for _, chain := range chains {
+		if revocationErr = store.checkRevocation(chain, now); revocationErr == nil {
+			return leaf, nil
+		}
+	}
+	return nil, errors.Wrapf(revocationErr, "VerifyCertificates()")
+}
+
+// checkRevocation checks every certificate of a verified chain against the
+// CRLs of its issuer
+func (store *Store) checkRevocation(chain []*x509.Certificate, now time.Time) error {
+	for i := 0; i+1 < len(chain); i++ {
+		certificate, issuer := chain[i], chain[i+1]
+		for _, crl := range store.crls {
+			if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+				continue
+			}
+			if err := crl.CheckSignatureFrom(issuer); err != nil {
+				return errors.Wrapf(err, "CRL of %s", issuer.Subject)
+			}
+			if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+				return errors.Errorf("CRL of %s is expired", issuer.Subject)
+			}
+			for _, revoked := range crl.RevokedCertificateEntries {
+				if revoked.SerialNumber.Cmp(certificate.SerialNumber) == 0 {
+					return errors.Errorf("Certificate %s is revoked", certificate.Subject)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyIdentity checks that the identification payload body of the peer is
+// bound to its verified certificate
+func VerifyIdentity(certificate *x509.Certificate, idType uint8, idData []byte) error {
+	switch idType {
+	case message.ID_DER_ASN1_DN:
+		if bytes.Equal(certificate.RawSubject, idData) {
+			return nil
+		}
+		return errors.Errorf("VerifyIdentity(): Distinguished name does not match the subject %s",
+			certificate.Subject)
+	case message.ID_FQDN:
+		for _, name := range certificate.DNSNames {
+			if strings.EqualFold(name, string(idData)) {
+				return nil
+			}
+		}
+		return errors.Errorf("VerifyIdentity(): FQDN %s is not in subjectAltName", idData)
+	case message.ID_RFC822_ADDR:
+		for _, address := range certificate.EmailAddresses {
+			if strings.EqualFold(address, string(idData)) {
+				return nil
+			}
+		}
+		return errors.Errorf("VerifyIdentity(): RFC 822 address %s is not in subjectAltName", idData)
+	default:
+		return errors.Errorf("VerifyIdentity(): Unsupported identification type %d", idType)
+	}
+}
+
+func isSelfSigned(certificate *x509.Certificate) bool {
+	return bytes.Equal(certificate.RawIssuer, certificate.RawSubject) &&
+		certificate.CheckSignatureFrom(certificate) == nil
+}
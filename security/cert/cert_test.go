@@ -0,0 +1,362 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+var testTime = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+type testAuthority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func issue(t *testing.T, template *x509.Certificate, key crypto.Signer, issuer *testAuthority) *x509.Certificate {
+	template.NotBefore = testTime.Add(-time.Hour)
+	template.NotAfter = testTime.Add(time.Hour)
+	parent, parentKey := template, key
+	if issuer != nil {
+		parent, parentKey = issuer.certificate, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return certificate
+}
+
+func newTestAuthority(t *testing.T, serial int64, name string, issuer *testAuthority) *testAuthority {
+	key := newTestKey(t)
+	return &testAuthority{
+		certificate: issue(t, &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: name},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		}, key, issuer),
+		key: key,
+	}
+}
+
+func newTestLeaf(t *testing.T, serial int64, issuer *testAuthority) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key := newTestKey(t)
+	return issue(t, &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: "gw.example.com", Organization: []string{"Example"}},
+		DNSNames:       []string{"gw.example.com"},
+		EmailAddresses: []string{"ipsec@example.com"},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+	}, key, issuer), key
+}
+
+func certificatePayloads(container message.IKEPayloadContainer) []*message.Certificate {
+	var certificates []*message.Certificate
+	for _, payload := range container {
+		if certificate, ok := payload.(*message.Certificate); ok {
+			certificates = append(certificates, certificate)
+		}
+	}
+	return certificates
+}
+
+func TestSelectChain(t *testing.T) {
+	rootA := newTestAuthority(t, 1, "Root A", nil)
+	intermediateA := newTestAuthority(t, 2, "Intermediate A", rootA)
+	rootB := newTestAuthority(t, 3, "Root B", nil)
+	leafA, keyA := newTestLeaf(t, 10, intermediateA)
+	leafB, keyB := newTestLeaf(t, 11, rootB)
+
+	store := NewStore()
+	require.NoError(t, store.AddChain([]*x509.Certificate{leafA, intermediateA.certificate, rootA.certificate}, keyA))
+	require.NoError(t, store.AddChain([]*x509.Certificate{leafB, rootB.certificate}, keyB))
+	require.Error(t, store.AddChain([]*x509.Certificate{leafB}, keyA))
+	require.Error(t, store.AddChain([]*x509.Certificate{leafA, rootB.certificate}, keyA))
+
+	// Chain without its anchor, which is trusted by the store
+	rootC := newTestAuthority(t, 5, "Root C", nil)
+	intermediateC := newTestAuthority(t, 6, "Intermediate C", rootC)
+	leafC, keyC := newTestLeaf(t, 12, intermediateC)
+	require.NoError(t, store.AddChain([]*x509.Certificate{leafC, intermediateC.certificate}, keyC))
+	store.AddTrustAnchor(rootC.certificate)
+
+	// The peer trusts root B
+	peer := NewStore()
+	peer.AddTrustAnchor(rootB.certificate)
+	var container message.IKEPayloadContainer
+	peer.BuildCertificateRequest(&container)
+	require.Len(t, container, 1)
+	certificateRequest := container[0].(*message.CertificateRequest)
+	require.Equal(t, uint8(message.X509CertificateSignature), certificateRequest.CertificateEncoding)
+	require.Equal(t, SPKIHash(rootB.certificate), certificateRequest.CertificationAuthority)
+
+	testcases := []struct {
+		description string
+		requests    []*message.CertificateRequest
+		leaf        *x509.Certificate
+		expectErr   bool
+	}{
+		{
+			description: "No CERTREQ",
+			leaf:        leafA,
+		},
+		{
+			description: "Root requested",
+			requests:    []*message.CertificateRequest{certificateRequest},
+			leaf:        leafB,
+		},
+		{
+			description: "Intermediate requested among others",
+			requests: []*message.CertificateRequest{{
+				CertificateEncoding: message.X509CertificateSignature,
+				CertificationAuthority: append(SPKIHash(newTestAuthority(t, 4, "Other", nil).certificate),
+					SPKIHash(intermediateA.certificate)...),
+			}},
+			leaf: leafA,
+		},
+		{
+			description: "Trust anchor of a chain without anchor requested",
+			requests: []*message.CertificateRequest{{
+				CertificateEncoding:    message.X509CertificateSignature,
+				CertificationAuthority: SPKIHash(rootC.certificate),
+			}},
+			leaf: leafC,
+		},
+		{
+			description: "Unknown authority",
+			requests: []*message.CertificateRequest{{
+				CertificateEncoding:    message.X509CertificateSignature,
+				CertificationAuthority: make([]byte, spkiHashLength),
+			}},
+			expectErr: true,
+		},
+		{
+			description: "Truncated hash",
+			requests: []*message.CertificateRequest{{
+				CertificateEncoding:    message.X509CertificateSignature,
+				CertificationAuthority: make([]byte, spkiHashLength-1),
+			}},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			chain, err := store.SelectChain(tc.requests)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.leaf, chain.Leaf())
+		})
+	}
+
+	// The anchor of a single certificate is resolved from another chain
+	leafD, keyD := newTestLeaf(t, 13, rootA)
+	other := NewStore()
+	require.NoError(t, other.AddChain([]*x509.Certificate{leafD}, keyD))
+	require.NoError(t, other.AddChain([]*x509.Certificate{leafA, intermediateA.certificate, rootA.certificate}, keyA))
+	chain, err := other.SelectChain([]*message.CertificateRequest{{
+		CertificateEncoding:    message.X509CertificateSignature,
+		CertificationAuthority: SPKIHash(rootA.certificate),
+	}})
+	require.NoError(t, err)
+	require.Equal(t, leafD, chain.Leaf())
+
+	// The self-signed root is not sent
+	container = nil
+	store.chains[0].BuildCertificates(&container)
+	certificates := certificatePayloads(container)
+	require.Len(t, certificates, 2)
+	require.Equal(t, leafA.Raw, certificates[0].CertificateData)
+	require.Equal(t, intermediateA.certificate.Raw, certificates[1].CertificateData)
+}
+
+func TestVerifyCertificates(t *testing.T) {
+	root := newTestAuthority(t, 1, "Root", nil)
+	intermediate := newTestAuthority(t, 2, "Intermediate", root)
+	leaf, key := newTestLeaf(t, 10, intermediate)
+	revokedLeaf, revokedKey := newTestLeaf(t, 11, intermediate)
+	otherRoot := newTestAuthority(t, 3, "Other root", nil)
+
+	local := NewStore()
+	require.NoError(t, local.AddChain([]*x509.Certificate{leaf, intermediate.certificate}, key))
+	require.NoError(t, local.AddChain([]*x509.Certificate{revokedLeaf, intermediate.certificate}, revokedKey))
+	var container message.IKEPayloadContainer
+	local.chains[0].BuildCertificates(&container)
+	certificates := certificatePayloads(container)
+	container = nil
+	local.chains[1].BuildCertificates(&container)
+	revokedCertificates := certificatePayloads(container)
+
+	// CRL of the intermediate authority, loaded from a file
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: testTime.Add(-time.Hour),
+		NextUpdate: testTime.Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: revokedLeaf.SerialNumber, RevocationTime: testTime.Add(-time.Minute)},
+		},
+	}, intermediate.certificate, intermediate.key)
+	require.NoError(t, err)
+	crlPath := filepath.Join(t.TempDir(), "intermediate.crl")
+	require.NoError(t, os.WriteFile(crlPath, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0o600))
+
+	newPeerStore := func(anchor *testAuthority, now time.Time) *Store {
+		store := NewStore()
+		store.AddTrustAnchor(anchor.certificate)
+		require.NoError(t, store.LoadCRLFile(crlPath))
+		store.currentTime = func() time.Time { return now }
+		return store
+	}
+
+	testcases := []struct {
+		description  string
+		store        *Store
+		certificates []*message.Certificate
+		expectErr    bool
+	}{
+		{
+			description:  "Valid chain",
+			store:        newPeerStore(root, testTime),
+			certificates: certificates,
+		},
+		{
+			description:  "Revoked certificate",
+			store:        newPeerStore(root, testTime),
+			certificates: revokedCertificates,
+			expectErr:    true,
+		},
+		{
+			description:  "Untrusted root",
+			store:        newPeerStore(otherRoot, testTime),
+			certificates: certificates,
+			expectErr:    true,
+		},
+		{
+			description:  "Missing intermediate",
+			store:        newPeerStore(root, testTime),
+			certificates: certificates[:1],
+			expectErr:    true,
+		},
+		{
+			description:  "Expired certificate",
+			store:        newPeerStore(root, testTime.Add(2*time.Hour)),
+			certificates: certificates,
+			expectErr:    true,
+		},
+		{
+			description: "Unsupported encoding",
+			store:       newPeerStore(root, testTime),
+			certificates: []*message.Certificate{{
+				CertificateEncoding: message.PKCS7WrappedX509Certificate,
+				CertificateData:     leaf.Raw,
+			}},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			verified, err := tc.store.VerifyCertificates(tc.certificates)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, leaf.Raw, verified.Raw)
+		})
+	}
+
+	// DER encoded CRL file
+	derPath := filepath.Join(t.TempDir(), "intermediate.der")
+	require.NoError(t, os.WriteFile(derPath, crlDER, 0o600))
+	store := NewStore()
+	require.NoError(t, store.LoadCRLFile(derPath))
+	require.Len(t, store.crls, 1)
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	root := newTestAuthority(t, 1, "Root", nil)
+	leaf, _ := newTestLeaf(t, 10, root)
+
+	testcases := []struct {
+		description string
+		idType      uint8
+		idData      []byte
+		expectErr   bool
+	}{
+		{
+			description: "Distinguished name",
+			idType:      message.ID_DER_ASN1_DN,
+			idData:      leaf.RawSubject,
+		},
+		{
+			description: "Other distinguished name",
+			idType:      message.ID_DER_ASN1_DN,
+			idData:      root.certificate.RawSubject,
+			expectErr:   true,
+		},
+		{
+			description: "FQDN",
+			idType:      message.ID_FQDN,
+			idData:      []byte("GW.example.com"),
+		},
+		{
+			description: "Other FQDN",
+			idType:      message.ID_FQDN,
+			idData:      []byte("ue.example.com"),
+			expectErr:   true,
+		},
+		{
+			description: "RFC 822 address",
+			idType:      message.ID_RFC822_ADDR,
+			idData:      []byte("ipsec@example.com"),
+		},
+		{
+			description: "Other RFC 822 address",
+			idType:      message.ID_RFC822_ADDR,
+			idData:      []byte("admin@example.com"),
+			expectErr:   true,
+		},
+		{
+			description: "Unsupported type",
+			idType:      message.ID_KEY_ID,
+			idData:      []byte("key"),
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := VerifyIdentity(leaf, tc.idType, tc.idData)
+			if tc.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
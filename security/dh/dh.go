@@ -1,14 +1,28 @@
 package dh
 
 import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
 	"math/big"
 
+	"github.com/pkg/errors"
+
 	"github.com/guoweifk/n3iwue_ike_gw/message"
 )
 
 const (
-	DH_1024_BIT_MODP string = "DH_1024_BIT_MODP"
-	DH_2048_BIT_MODP string = "DH_2048_BIT_MODP"
+	DH_1024_BIT_MODP      string = "DH_1024_BIT_MODP"
+	DH_1536_BIT_MODP      string = "DH_1536_BIT_MODP"
+	DH_2048_BIT_MODP      string = "DH_2048_BIT_MODP"
+	DH_3072_BIT_MODP      string = "DH_3072_BIT_MODP"
+	DH_4096_BIT_MODP      string = "DH_4096_BIT_MODP"
+	DH_6144_BIT_MODP      string = "DH_6144_BIT_MODP"
+	DH_8192_BIT_MODP      string = "DH_8192_BIT_MODP"
+	DH_256_BIT_RANDOM_ECP string = "DH_256_BIT_RANDOM_ECP"
+	DH_384_BIT_RANDOM_ECP string = "DH_384_BIT_RANDOM_ECP"
+	DH_521_BIT_RANDOM_ECP string = "DH_521_BIT_RANDOM_ECP"
+	DH_CURVE25519         string = "DH_CURVE25519"
 )
 
 var (
@@ -20,7 +34,16 @@ func init() {
 	// DH String
 	dhString = make(map[uint16]func(uint16, uint16, []byte) string)
 	dhString[message.DH_1024_BIT_MODP] = toString_DH_1024_BIT_MODP
+	dhString[message.DH_1536_BIT_MODP] = toString_DH_1536_BIT_MODP
 	dhString[message.DH_2048_BIT_MODP] = toString_DH_2048_BIT_MODP
+	dhString[message.DH_3072_BIT_MODP] = toString_DH_3072_BIT_MODP
+	dhString[message.DH_4096_BIT_MODP] = toString_DH_4096_BIT_MODP
+	dhString[message.DH_6144_BIT_MODP] = toString_DH_6144_BIT_MODP
+	dhString[message.DH_8192_BIT_MODP] = toString_DH_8192_BIT_MODP
+	dhString[message.DH_256_BIT_RANDOM_ECP] = toString_DH_256_BIT_RANDOM_ECP
+	dhString[message.DH_384_BIT_RANDOM_ECP] = toString_DH_384_BIT_RANDOM_ECP
+	dhString[message.DH_521_BIT_RANDOM_ECP] = toString_DH_521_BIT_RANDOM_ECP
+	dhString[message.DH_CURVE25519] = toString_DH_CURVE25519
 
 	// DH Types
 	dhTypes = make(map[string]DHType)
@@ -39,6 +62,18 @@ func init() {
 		factorBytesLength: len(factor.Bytes()),
 	}
 
+	// Group 5: Dh1536BitModp
+	factor, ok = new(big.Int).SetString(Group5PrimeString, 16)
+	if !ok {
+		panic("IKE Diffie Hellman Group failed to init.")
+	}
+	generator = new(big.Int).SetUint64(Group5Generator)
+	dhTypes[DH_1536_BIT_MODP] = &Dh1536BitModp{
+		factor:            factor,
+		generator:         generator,
+		factorBytesLength: len(factor.Bytes()),
+	}
+
 	// Group 14: DH2048BitModp
 	factor, ok = new(big.Int).SetString(Group14PrimeString, 16)
 	if !ok {
@@ -50,6 +85,74 @@ func init() {
 		generator:         generator,
 		factorBytesLength: len(factor.Bytes()),
 	}
+
+	// Group 15: Dh3072BitModp
+	factor, ok = new(big.Int).SetString(Group15PrimeString, 16)
+	if !ok {
+		panic("IKE Diffie Hellman Group failed to init.")
+	}
+	generator = new(big.Int).SetUint64(Group15Generator)
+	dhTypes[DH_3072_BIT_MODP] = &Dh3072BitModp{
+		factor:            factor,
+		generator:         generator,
+		factorBytesLength: len(factor.Bytes()),
+	}
+
+	// Group 16: Dh4096BitModp
+	factor, ok = new(big.Int).SetString(Group16PrimeString, 16)
+	if !ok {
+		panic("IKE Diffie Hellman Group failed to init.")
+	}
+	generator = new(big.Int).SetUint64(Group16Generator)
+	dhTypes[DH_4096_BIT_MODP] = &Dh4096BitModp{
+		factor:            factor,
+		generator:         generator,
+		factorBytesLength: len(factor.Bytes()),
+	}
+
+	// Group 17: Dh6144BitModp
+	factor, ok = new(big.Int).SetString(Group17PrimeString, 16)
+	if !ok {
+		panic("IKE Diffie Hellman Group failed to init.")
+	}
+	generator = new(big.Int).SetUint64(Group17Generator)
+	dhTypes[DH_6144_BIT_MODP] = &Dh6144BitModp{
+		factor:            factor,
+		generator:         generator,
+		factorBytesLength: len(factor.Bytes()),
+	}
+
+	// Group 18: Dh8192BitModp
+	factor, ok = new(big.Int).SetString(Group18PrimeString, 16)
+	if !ok {
+		panic("IKE Diffie Hellman Group failed to init.")
+	}
+	generator = new(big.Int).SetUint64(Group18Generator)
+	dhTypes[DH_8192_BIT_MODP] = &Dh8192BitModp{
+		factor:            factor,
+		generator:         generator,
+		factorBytesLength: len(factor.Bytes()),
+	}
+
+	// Group 19, 20, 21: DhRandomEcp
+	dhTypes[DH_256_BIT_RANDOM_ECP] = &DhRandomEcp{
+		transformID:      message.DH_256_BIT_RANDOM_ECP,
+		curve:            ecdh.P256(),
+		coordinateLength: 32,
+	}
+	dhTypes[DH_384_BIT_RANDOM_ECP] = &DhRandomEcp{
+		transformID:      message.DH_384_BIT_RANDOM_ECP,
+		curve:            ecdh.P384(),
+		coordinateLength: 48,
+	}
+	dhTypes[DH_521_BIT_RANDOM_ECP] = &DhRandomEcp{
+		transformID:      message.DH_521_BIT_RANDOM_ECP,
+		curve:            ecdh.P521(),
+		coordinateLength: 66,
+	}
+
+	// Group 31: DhCurve25519
+	dhTypes[DH_CURVE25519] = &DhCurve25519{}
 }
 
 func StrToType(algo string) DHType {
@@ -88,9 +191,127 @@ func ToTransform(dhType DHType) *message.Transform {
 	return t
 }
 
+// Secret is the local private key of a Diffie-Hellman exchange. It is opaque
+// to callers and only accepted by the DHType of the same group.
+type Secret interface {
+	TransformID() uint16
+}
+
 type DHType interface {
 	TransformID() uint16
 	getAttribute() (bool, uint16, uint16, []byte)
-	GetSharedKey(secret, peerPublicValue *big.Int) []byte
-	GetPublicValue(secret *big.Int) []byte
+	// GenerateSecret generates a new private key from the given random source
+	GenerateSecret(random io.Reader) (Secret, error)
+	// NewSecret imports a private key in the encoding of the group, mostly
+	// used for known answer tests
+	NewSecret(privateKey []byte) (Secret, error)
+	GetSharedKey(secret Secret, peerPublicValue []byte) ([]byte, error)
+	GetPublicValue(secret Secret) ([]byte, error)
+}
+
+// GenerateSecret generates a private key of dhType with crypto/rand
+func GenerateSecret(dhType DHType) (Secret, error) {
+	secret, err := dhType.GenerateSecret(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DH[%d] GenerateSecret", dhType.TransformID())
+	}
+	return secret, nil
+}
+
+// modpSecret is the private exponent of MODP groups
+type modpSecret struct {
+	transformID uint16
+	exponent    *big.Int
+}
+
+func (s *modpSecret) TransformID() uint16 { return s.transformID }
+
+// modpExponentBits returns the private exponent size of a MODP group. The
+// groups 2 and 14 keep the 2048 bits exponents they have always used. For the
+// other groups, RFC 3526 - 8 estimates an exponent of twice the group strength
+// is sufficient, which keeps the exponentiation of the large groups
+// affordable.
+func modpExponentBits(transformID uint16, factor *big.Int) int {
+	switch transformID {
+	case message.DH_1024_BIT_MODP, message.DH_2048_BIT_MODP:
+		return 2048
+	}
+	switch bits := factor.BitLen(); {
+	case bits <= 1536:
+		return 240
+	case bits <= 3072:
+		return 420
+	case bits <= 4096:
+		return 480
+	case bits <= 6144:
+		return 540
+	default:
+		return 620
+	}
+}
+
+func generateModpSecret(random io.Reader, transformID uint16, factor *big.Int) (Secret, error) {
+	// Exponent in [2, 2^n)
+	upper := new(big.Int).Lsh(big.NewInt(1), uint(modpExponentBits(transformID, factor)))
+	upper.Sub(upper, big.NewInt(2))
+	exponent, err := rand.Int(random, upper)
+	if err != nil {
+		return nil, errors.Wrapf(err, "generate MODP secret")
+	}
+	exponent.Add(exponent, big.NewInt(2))
+	return &modpSecret{
+		transformID: transformID,
+		exponent:    exponent,
+	}, nil
+}
+
+func toModpSecret(secret Secret, transformID uint16) (*modpSecret, error) {
+	s, ok := secret.(*modpSecret)
+	if !ok || s.transformID != transformID {
+		return nil, errors.Errorf("DH[%d]: secret is not generated by this group", transformID)
+	}
+	return s, nil
+}
+
+// validateModpPublicValue checks the peer public value y has the length of
+// the prime (RFC 7296 - 3.4), and is in range 1 < y < p-1 (RFC 2631 - 2.1.5,
+// NIST SP 800-56A), which rejects the values forcing the shared key into a
+// small subgroup
+func validateModpPublicValue(publicValue []byte, factor *big.Int, factorBytesLength int) (*big.Int, error) {
+	if len(publicValue) != factorBytesLength {
+		return nil, errors.Errorf("MODP public value length %d differs from prime length %d",
+			len(publicValue), factorBytesLength)
+	}
+	y := new(big.Int).SetBytes(publicValue)
+	upper := new(big.Int).Sub(factor, big.NewInt(1))
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(upper) >= 0 {
+		return nil, errors.Errorf("MODP public value is out of range (1, p-1)")
+	}
+	return y, nil
+}
+
+// leftPad prepends zeros to b to have the fixed length of group encodings
+func leftPad(b []byte, length int) []byte {
+	if len(b) >= length {
+		return b
+	}
+	padded := make([]byte, length)
+	copy(padded[length-len(b):], b)
+	return padded
+}
+
+// ecdhSecret is the private key of elliptic curve groups
+type ecdhSecret struct {
+	transformID uint16
+	privateKey  *ecdh.PrivateKey
+}
+
+func (s *ecdhSecret) TransformID() uint16 { return s.transformID }
+
+func toEcdhSecret(secret Secret, transformID uint16) (*ecdhSecret, error) {
+	s, ok := secret.(*ecdhSecret)
+	if !ok || s.transformID != transformID {
+		return nil, errors.Errorf("DH[%d]: secret is not generated by this group", transformID)
+	}
+	return s, nil
 }
@@ -1,6 +1,7 @@
 package dh
 
 import (
+	"io"
 	"math/big"
 
 	"github.com/guoweifk/n3iwue_ike_gw/message"
@@ -39,16 +40,35 @@ func (t *Dh1024BitModp) getAttribute() (bool, uint16, uint16, []byte) {
 	return false, 0, 0, nil
 }
 
-func (t *Dh1024BitModp) GetSharedKey(secret, peerPublicValue *big.Int) []byte {
-	sharedKey := new(big.Int).Exp(peerPublicValue, secret, t.factor).Bytes()
-	prependZero := make([]byte, t.factorBytesLength-len(sharedKey))
-	sharedKey = append(prependZero, sharedKey...)
-	return sharedKey
+func (t *Dh1024BitModp) GenerateSecret(random io.Reader) (Secret, error) {
+	return generateModpSecret(random, t.TransformID(), t.factor)
 }
 
-func (t *Dh1024BitModp) GetPublicValue(secret *big.Int) []byte {
-	localPublicValue := new(big.Int).Exp(t.generator, secret, t.factor).Bytes()
-	prependZero := make([]byte, t.factorBytesLength-len(localPublicValue))
-	localPublicValue = append(prependZero, localPublicValue...)
-	return localPublicValue
+func (t *Dh1024BitModp) NewSecret(privateKey []byte) (Secret, error) {
+	return &modpSecret{
+		transformID: t.TransformID(),
+		exponent:    new(big.Int).SetBytes(privateKey),
+	}, nil
+}
+
+func (t *Dh1024BitModp) GetSharedKey(secret Secret, peerPublicValue []byte) ([]byte, error) {
+	s, err := toModpSecret(secret, t.TransformID())
+	if err != nil {
+		return nil, err
+	}
+	peerPublicValueBig, err := validateModpPublicValue(peerPublicValue, t.factor, t.factorBytesLength)
+	if err != nil {
+		return nil, err
+	}
+	sharedKey := new(big.Int).Exp(peerPublicValueBig, s.exponent, t.factor).Bytes()
+	return leftPad(sharedKey, t.factorBytesLength), nil
+}
+
+func (t *Dh1024BitModp) GetPublicValue(secret Secret) ([]byte, error) {
+	s, err := toModpSecret(secret, t.TransformID())
+	if err != nil {
+		return nil, err
+	}
+	localPublicValue := new(big.Int).Exp(t.generator, s.exponent, t.factor).Bytes()
+	return leftPad(localPublicValue, t.factorBytesLength), nil
 }
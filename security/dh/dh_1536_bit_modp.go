@@ -0,0 +1,78 @@
+package dh
+
+import (
+	"io"
+	"math/big"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+const (
+	// Parameters
+	Group5PrimeString string = "FFFFFFFFFFFFFFFFC90FDAA22168C234" +
+		"C4C6628B80DC1CD129024E088A67CC74" +
+		"020BBEA63B139B22514A08798E3404DD" +
+		"EF9519B3CD3A431B302B0A6DF25F1437" +
+		"4FE1356D6D51C245E485B576625E7EC6" +
+		"F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+		"EE386BFB5A899FA5AE9F24117C4B1FE6" +
+		"49286651ECE45B3DC2007CB8A163BF05" +
+		"98DA48361C55D39A69163FA8FD24CF5F" +
+		"83655D23DCA3AD961C62F356208552BB" +
+		"9ED529077096966D670C354E4ABC9804" +
+		"F1746C08CA237327FFFFFFFFFFFFFFFF"
+	Group5Generator = 2
+)
+
+func toString_DH_1536_BIT_MODP(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return DH_1536_BIT_MODP
+}
+
+var _ DHType = &Dh1536BitModp{}
+
+type Dh1536BitModp struct {
+	factor            *big.Int
+	generator         *big.Int
+	factorBytesLength int
+}
+
+func (t *Dh1536BitModp) TransformID() uint16 {
+	return message.DH_1536_BIT_MODP
+}
+
+func (t *Dh1536BitModp) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *Dh1536BitModp) GenerateSecret(random io.Reader) (Secret, error) {
+	return generateModpSecret(random, t.TransformID(), t.factor)
+}
+
+func (t *Dh1536BitModp) NewSecret(privateKey []byte) (Secret, error) {
+	return &modpSecret{
+		transformID: t.TransformID(),
+		exponent:    new(big.Int).SetBytes(privateKey),
+	}, nil
+}
+
+func (t *Dh1536BitModp) GetSharedKey(secret Secret, peerPublicValue []byte) ([]byte, error) {
+	s, err := toModpSecret(secret, t.TransformID())
+	if err != nil {
+		return nil, err
+	}
+	peerPublicValueBig, err := validateModpPublicValue(peerPublicValue, t.factor, t.factorBytesLength)
+	if err != nil {
+		return nil, err
+	}
+	sharedKey := new(big.Int).Exp(peerPublicValueBig, s.exponent, t.factor).Bytes()
+	return leftPad(sharedKey, t.factorBytesLength), nil
+}
+
+func (t *Dh1536BitModp) GetPublicValue(secret Secret) ([]byte, error) {
+	s, err := toModpSecret(secret, t.TransformID())
+	if err != nil {
+		return nil, err
+	}
+	localPublicValue := new(big.Int).Exp(t.generator, s.exponent, t.factor).Bytes()
+	return leftPad(localPublicValue, t.factorBytesLength), nil
+}
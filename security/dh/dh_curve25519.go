@@ -0,0 +1,83 @@
+package dh
+
+import (
+	"crypto/ecdh"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+const curve25519KeyLength = 32
+
+func toString_DH_CURVE25519(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return DH_CURVE25519
+}
+
+var _ DHType = &DhCurve25519{}
+
+// DhCurve25519 implements RFC 8031. Public values and the shared key are the
+// 32 octets little-endian u-coordinates of RFC 7748.
+type DhCurve25519 struct{}
+
+func (t *DhCurve25519) TransformID() uint16 {
+	return message.DH_CURVE25519
+}
+
+func (t *DhCurve25519) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *DhCurve25519) GenerateSecret(random io.Reader) (Secret, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(random)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DhCurve25519 GenerateSecret")
+	}
+	return &ecdhSecret{
+		transformID: t.TransformID(),
+		privateKey:  privateKey,
+	}, nil
+}
+
+func (t *DhCurve25519) NewSecret(privateKey []byte) (Secret, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DhCurve25519 NewSecret")
+	}
+	return &ecdhSecret{
+		transformID: t.TransformID(),
+		privateKey:  key,
+	}, nil
+}
+
+func (t *DhCurve25519) GetSharedKey(secret Secret, peerPublicValue []byte) ([]byte, error) {
+	s, err := toEcdhSecret(secret, t.TransformID())
+	if err != nil {
+		return nil, err
+	}
+	if len(peerPublicValue) != curve25519KeyLength {
+		return nil, errors.Errorf("DhCurve25519: peer public value length %d, expect %d",
+			len(peerPublicValue), curve25519KeyLength)
+	}
+
+	peerPublicKey, err := ecdh.X25519().NewPublicKey(peerPublicValue)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DhCurve25519: invalid peer public value")
+	}
+
+	// RFC 8031 - 2.3: the all-zero shared key is rejected by crypto/ecdh
+	sharedKey, err := s.privateKey.ECDH(peerPublicKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DhCurve25519 GetSharedKey")
+	}
+	return sharedKey, nil
+}
+
+func (t *DhCurve25519) GetPublicValue(secret Secret) ([]byte, error) {
+	s, err := toEcdhSecret(secret, t.TransformID())
+	if err != nil {
+		return nil, err
+	}
+	return s.privateKey.PublicKey().Bytes(), nil
+}
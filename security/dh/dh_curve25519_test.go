@@ -0,0 +1,54 @@
+package dh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// RFC 7748 - 6.1. Curve25519, as referenced by RFC 8031
+func TestDhCurve25519KnownAnswer(t *testing.T) {
+	dhType := StrToType(DH_CURVE25519)
+	require.NotNil(t, dhType)
+	require.Equal(t, dhType, DecodeTransform(ToTransform(dhType)))
+
+	alicePrivate := decodeHex(t, "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	alicePublic := decodeHex(t, "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+	bobPrivate := decodeHex(t, "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb")
+	bobPublic := decodeHex(t, "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f")
+	sharedKey := decodeHex(t, "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742")
+
+	aliceSecret, err := dhType.NewSecret(alicePrivate)
+	require.NoError(t, err)
+	publicValue, err := dhType.GetPublicValue(aliceSecret)
+	require.NoError(t, err)
+	require.Equal(t, alicePublic, publicValue)
+
+	bobSecret, err := dhType.NewSecret(bobPrivate)
+	require.NoError(t, err)
+	publicValue, err = dhType.GetPublicValue(bobSecret)
+	require.NoError(t, err)
+	require.Equal(t, bobPublic, publicValue)
+
+	result, err := dhType.GetSharedKey(aliceSecret, bobPublic)
+	require.NoError(t, err)
+	require.Equal(t, sharedKey, result)
+
+	result, err = dhType.GetSharedKey(bobSecret, alicePublic)
+	require.NoError(t, err)
+	require.Equal(t, sharedKey, result)
+}
+
+func TestDhCurve25519LowOrderPoint(t *testing.T) {
+	dhType := StrToType(DH_CURVE25519)
+
+	secret, err := GenerateSecret(dhType)
+	require.NoError(t, err)
+
+	// RFC 8031 - 2.3: the all-zero shared key must be rejected
+	_, err = dhType.GetSharedKey(secret, make([]byte, 32))
+	require.Error(t, err)
+
+	_, err = dhType.GetSharedKey(secret, make([]byte, 31))
+	require.Error(t, err)
+}
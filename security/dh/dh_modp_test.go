@@ -0,0 +1,153 @@
+package dh
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+var modpGroups = []struct {
+	algo        string
+	primeString string
+	primeBits   int
+}{
+	{DH_1024_BIT_MODP, Group2PrimeString, 1024},
+	{DH_1536_BIT_MODP, Group5PrimeString, 1536},
+	{DH_2048_BIT_MODP, Group14PrimeString, 2048},
+	{DH_3072_BIT_MODP, Group15PrimeString, 3072},
+	{DH_4096_BIT_MODP, Group16PrimeString, 4096},
+	{DH_6144_BIT_MODP, Group17PrimeString, 6144},
+	{DH_8192_BIT_MODP, Group18PrimeString, 8192},
+}
+
+func TestModpPrimes(t *testing.T) {
+	for _, group := range modpGroups {
+		t.Run(group.algo, func(t *testing.T) {
+			p, ok := new(big.Int).SetString(group.primeString, 16)
+			require.True(t, ok)
+			require.Equal(t, group.primeBits, p.BitLen())
+
+			// RFC 3526 primes are safe primes: p = 2q + 1
+			q := new(big.Int).Rsh(p, 1)
+			require.True(t, p.ProbablyPrime(1))
+			require.True(t, q.ProbablyPrime(1))
+		})
+	}
+}
+
+func TestDhModp(t *testing.T) {
+	for _, group := range modpGroups {
+		t.Run(group.algo, func(t *testing.T) {
+			dhType := StrToType(group.algo)
+			require.NotNil(t, dhType)
+			require.Equal(t, dhType, DecodeTransform(ToTransform(dhType)))
+
+			secretI, err := dhType.GenerateSecret(rand.Reader)
+			require.NoError(t, err)
+			secretR, err := dhType.GenerateSecret(rand.Reader)
+			require.NoError(t, err)
+
+			publicI, err := dhType.GetPublicValue(secretI)
+			require.NoError(t, err)
+			require.Len(t, publicI, group.primeBits/8)
+			publicR, err := dhType.GetPublicValue(secretR)
+			require.NoError(t, err)
+
+			sharedI, err := dhType.GetSharedKey(secretI, publicR)
+			require.NoError(t, err)
+			sharedR, err := dhType.GetSharedKey(secretR, publicI)
+			require.NoError(t, err)
+			require.Equal(t, sharedI, sharedR)
+			require.Len(t, sharedI, group.primeBits/8)
+
+			// Public value is left padded to the prime length
+			secret, err := dhType.NewSecret([]byte{0x01})
+			require.NoError(t, err)
+			publicValue, err := dhType.GetPublicValue(secret)
+			require.NoError(t, err)
+			require.Len(t, publicValue, group.primeBits/8)
+			require.Equal(t, byte(0x02), publicValue[len(publicValue)-1])
+		})
+	}
+}
+
+func TestDhModpInvalidPublicValue(t *testing.T) {
+	for _, group := range modpGroups {
+		t.Run(group.algo, func(t *testing.T) {
+			dhType := StrToType(group.algo)
+			secret, err := GenerateSecret(dhType)
+			require.NoError(t, err)
+
+			p, ok := new(big.Int).SetString(group.primeString, 16)
+			require.True(t, ok)
+			pMinusOne := new(big.Int).Sub(p, big.NewInt(1))
+
+			for _, value := range [][]byte{
+				nil,
+				{0x00},
+				{0x01},
+				pMinusOne.Bytes(),
+				p.Bytes(),
+				make([]byte, group.primeBits/8+1),
+				// Not padded to the length of the prime
+				{0x02},
+			} {
+				_, err = dhType.GetSharedKey(secret, value)
+				require.Error(t, err)
+			}
+
+			_, err = dhType.GetSharedKey(secret, append(make([]byte, group.primeBits/8-1), 0x02))
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDhModpExponentBits(t *testing.T) {
+	for _, group := range modpGroups {
+		t.Run(group.algo, func(t *testing.T) {
+			dhType := StrToType(group.algo)
+			secret, err := GenerateSecret(dhType)
+			require.NoError(t, err)
+			exponent := secret.(*modpSecret).exponent
+
+			switch dhType.TransformID() {
+			case message.DH_1024_BIT_MODP, message.DH_2048_BIT_MODP:
+				// Up to 2048 bits, shorter than 1024 bits with a
+				// negligible probability
+				require.Greater(t, exponent.BitLen(), 1024)
+				require.LessOrEqual(t, exponent.BitLen(), 2048)
+			default:
+				require.LessOrEqual(t, exponent.BitLen(), 620)
+			}
+		})
+	}
+}
+
+func BenchmarkDhModp(b *testing.B) {
+	for _, group := range modpGroups {
+		dhType := StrToType(group.algo)
+		peerSecret, err := GenerateSecret(dhType)
+		require.NoError(b, err)
+		peerPublicValue, err := dhType.GetPublicValue(peerSecret)
+		require.NoError(b, err)
+
+		b.Run(group.algo, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				secret, err := GenerateSecret(dhType)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = dhType.GetPublicValue(secret); err != nil {
+					b.Fatal(err)
+				}
+				if _, err = dhType.GetSharedKey(secret, peerPublicValue); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package dh
+
+import (
+	"crypto/ecdh"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+func toString_DH_256_BIT_RANDOM_ECP(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return DH_256_BIT_RANDOM_ECP
+}
+
+func toString_DH_384_BIT_RANDOM_ECP(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return DH_384_BIT_RANDOM_ECP
+}
+
+func toString_DH_521_BIT_RANDOM_ECP(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return DH_521_BIT_RANDOM_ECP
+}
+
+var _ DHType = &DhRandomEcp{}
+
+// DhRandomEcp implements the ECP groups of RFC 5903. The public value is the
+// concatenation of the x and y coordinates, and the shared key is the x
+// coordinate of the shared point.
+type DhRandomEcp struct {
+	transformID      uint16
+	curve            ecdh.Curve
+	coordinateLength int
+}
+
+func (t *DhRandomEcp) TransformID() uint16 {
+	return t.transformID
+}
+
+func (t *DhRandomEcp) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *DhRandomEcp) GenerateSecret(random io.Reader) (Secret, error) {
+	privateKey, err := t.curve.GenerateKey(random)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DhRandomEcp GenerateSecret")
+	}
+	return &ecdhSecret{
+		transformID: t.transformID,
+		privateKey:  privateKey,
+	}, nil
+}
+
+func (t *DhRandomEcp) NewSecret(privateKey []byte) (Secret, error) {
+	key, err := t.curve.NewPrivateKey(leftPad(privateKey, t.coordinateLength))
+	if err != nil {
+		return nil, errors.Wrapf(err, "DhRandomEcp NewSecret")
+	}
+	return &ecdhSecret{
+		transformID: t.transformID,
+		privateKey:  key,
+	}, nil
+}
+
+func (t *DhRandomEcp) GetSharedKey(secret Secret, peerPublicValue []byte) ([]byte, error) {
+	s, err := toEcdhSecret(secret, t.transformID)
+	if err != nil {
+		return nil, err
+	}
+	if len(peerPublicValue) != 2*t.coordinateLength {
+		return nil, errors.Errorf("DhRandomEcp: peer public value length %d, expect %d",
+			len(peerPublicValue), 2*t.coordinateLength)
+	}
+
+	// Convert to SEC 1 uncompressed form, the point is validated to be on curve
+	uncompressed := append([]byte{0x04}, peerPublicValue...)
+	peerPublicKey, err := t.curve.NewPublicKey(uncompressed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DhRandomEcp: invalid peer public value")
+	}
+
+	sharedKey, err := s.privateKey.ECDH(peerPublicKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DhRandomEcp GetSharedKey")
+	}
+	return sharedKey, nil
+}
+
+func (t *DhRandomEcp) GetPublicValue(secret Secret) ([]byte, error) {
+	s, err := toEcdhSecret(secret, t.transformID)
+	if err != nil {
+		return nil, err
+	}
+	// Strip the SEC 1 uncompressed point prefix
+	return s.privateKey.PublicKey().Bytes()[1:], nil
+}
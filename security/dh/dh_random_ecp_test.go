@@ -0,0 +1,174 @@
+package dh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+// RFC 5903 - 8. Test Vectors
+func TestDhRandomEcpKnownAnswer(t *testing.T) {
+	testcases := []struct {
+		algo string
+		i    string
+		gi   string
+		r    string
+		gr   string
+		gir  string
+	}{
+		{
+			// 8.1. 256-Bit Random ECP Group
+			algo: DH_256_BIT_RANDOM_ECP,
+			i:    "C88F01F5 10D9AC3F 70A292DA A2316DE5 44E9AAB8 AFE84049 C62A9C57 862D1433",
+			gi: "DAD0B653 94221CF9 B051E1FE CA5787D0 98DFE637 FC90B9EF 945D0C37 72581180" +
+				"5271A046 1CDB8252 D61F1C45 6FA3E59A B1F45B33 ACCF5F58 389E0577 B8990BB3",
+			r: "C6EF9C5D 78AE012A 011164AC B397CE20 88685D8F 06BF9BE0 B283AB46 476BEE53",
+			gr: "D12DFB52 89C8D4F8 1208B702 70398C34 2296970A 0BCCB74C 736FC755 4494BF63" +
+				"56FBF3CA 366CC23E 8157854C 13C58D6A AC23F046 ADA30F83 53E74F33 039872AB",
+			gir: "D6840F6B 42F6EDAF D13116E0 E1256520 2FEF8E9E CE7DCE03 812464D0 4B9442DE",
+		},
+		{
+			// 8.2. 384-Bit Random ECP Group
+			algo: DH_384_BIT_RANDOM_ECP,
+			i: "099F3C70 34D4A2C6 99884D73 A375A67F 7624EF7C 6B3C0F16 0647B674 14DCE655" +
+				"E35B5380 41E649EE 3FAEF896 783AB194",
+			gi: "667842D7 D180AC2C DE6F74F3 7551F557 55C7645C 20EF73E3 1634FE72 B4C55EE6" +
+				"DE3AC808 ACB4BDB4 C88732AE E95F41AA" +
+				"9482ED1F C0EEB9CA FC498462 5CCFC23F 65032149 E0E144AD A0241815 35A0F38E" +
+				"EB9FCFF3 C2C947DA E69B4C63 4573A81C",
+			r: "41CB0779 B4BDB85D 47846725 FBEC3C94 30FAB46C C8DC5060 855CC9BD A0AA2942" +
+				"E0308312 916B8ED2 960E4BD5 5A7448FC",
+			gr: "E558DBEF 53EECDE3 D3FCCFC1 AEA08A89 A987475D 12FD950D 83CFA417 32BC509D" +
+				"0D1AC43A 0336DEF9 6FDA41D0 774A3571" +
+				"DCFBEC7A ACF31964 72169E83 8430367F 66EEBE3C 6E70C416 DD5F0C68 759DD1FF" +
+				"F83FA401 42209DFF 5EAAD96D B9E6386C",
+			gir: "11187331 C279962D 93D60424 3FD592CB 9D0A926F 422E4718 7521287E 7156C5C4" +
+				"D6031355 69B9E9D0 9CF5D4A2 70F59746",
+		},
+		{
+			// 8.3. 521-Bit Random ECP Group
+			algo: DH_521_BIT_RANDOM_ECP,
+			i: "0037ADE9 319A89F4 DABDB3EF 411AACCC A5123C61 ACAB57B5 393DCE47 608172A0" +
+				"95AA85A3 0FE1C295 2C6771D9 37BA9777 F5957B26 39BAB072 462F68C2 7A57382D" +
+				"4A52",
+			gi: "0015417E 84DBF28C 0AD3C278 713349DC 7DF153C8 97A1891B D98BAB43 57C9ECBE" +
+				"E1E3BF42 E00B8E38 0AEAE57C 2D107564 94188594 2AF5A7F4 601723C4 195D176C" +
+				"ED3E" +
+				"017CAE20 B6641D2E EB695786 D8C94614 6239D099 E18E1D5A 514C739D 7CB4A10A" +
+				"D8A78801 5AC405D7 799DC75E 7B7D5B6C F2261A6A 7F150743 8BF01BEB 6CA3926F" +
+				"9582",
+			r: "0145BA99 A847AF43 793FDD0E 872E7CDF A16BE30F DC780F97 BCCC3F07 8380201E" +
+				"9C677D60 0B343757 A3BDBF2A 3163E4C2 F869CCA7 458AA4A4 EFFC311F 5CB15168" +
+				"5EB9",
+			gr: "00D0B397 5AC4B799 F5BEA16D 5E13E9AF 971D5E9B 984C9F39 728B5E57 39735A21" +
+				"9B97C356 436ADC6E 95BB0352 F6BE64A6 C2912D4E F2D0433C ED2B6171 640012D9" +
+				"460F" +
+				"015C6822 6383956E 3BD066E7 97B623C2 7CE0EAC2 F551A10C 2C724D98 52077B87" +
+				"220B6536 C5C408A1 D2AEBB8E 86D678AE 49CB5709 1F473229 6579AB44 FCD17F0F" +
+				"C56A",
+			gir: "01144C7D 79AE6956 BC8EDB8E 7C787C45 21CB086F A64407F9 7894E5E6 B2D79B04" +
+				"D1427E73 CA4BAA24 0A347868 59810C06 B3C715A3 A8CC3151 F2BEE417 996D19F3" +
+				"DDEA",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.algo, func(t *testing.T) {
+			dhType := StrToType(tc.algo)
+			require.NotNil(t, dhType)
+			gi := decodeHex(t, tc.gi)
+			gr := decodeHex(t, tc.gr)
+			gir := decodeHex(t, tc.gir)
+
+			secretI, err := dhType.NewSecret(decodeHex(t, tc.i))
+			require.NoError(t, err)
+			publicI, err := dhType.GetPublicValue(secretI)
+			require.NoError(t, err)
+			require.Equal(t, gi, publicI)
+
+			secretR, err := dhType.NewSecret(decodeHex(t, tc.r))
+			require.NoError(t, err)
+			publicR, err := dhType.GetPublicValue(secretR)
+			require.NoError(t, err)
+			require.Equal(t, gr, publicR)
+
+			sharedI, err := dhType.GetSharedKey(secretI, gr)
+			require.NoError(t, err)
+			require.Equal(t, gir, sharedI)
+
+			sharedR, err := dhType.GetSharedKey(secretR, gi)
+			require.NoError(t, err)
+			require.Equal(t, gir, sharedR)
+		})
+	}
+}
+
+func TestDhRandomEcp(t *testing.T) {
+	testcases := []struct {
+		algo           string
+		transformID    uint16
+		publicValueLen int
+	}{
+		{DH_256_BIT_RANDOM_ECP, message.DH_256_BIT_RANDOM_ECP, 64},
+		{DH_384_BIT_RANDOM_ECP, message.DH_384_BIT_RANDOM_ECP, 96},
+		{DH_521_BIT_RANDOM_ECP, message.DH_521_BIT_RANDOM_ECP, 132},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.algo, func(t *testing.T) {
+			dhType := StrToType(tc.algo)
+			require.NotNil(t, dhType)
+			require.Equal(t, dhType, DecodeTransform(ToTransform(dhType)))
+			require.Equal(t, tc.transformID, dhType.TransformID())
+
+			secretI, err := dhType.GenerateSecret(rand.Reader)
+			require.NoError(t, err)
+			secretR, err := dhType.GenerateSecret(rand.Reader)
+			require.NoError(t, err)
+
+			publicI, err := dhType.GetPublicValue(secretI)
+			require.NoError(t, err)
+			require.Len(t, publicI, tc.publicValueLen)
+			publicR, err := dhType.GetPublicValue(secretR)
+			require.NoError(t, err)
+
+			sharedI, err := dhType.GetSharedKey(secretI, publicR)
+			require.NoError(t, err)
+			sharedR, err := dhType.GetSharedKey(secretR, publicI)
+			require.NoError(t, err)
+			require.Equal(t, sharedI, sharedR)
+			require.Len(t, sharedI, tc.publicValueLen/2)
+
+			// Point not on curve
+			invalid := make([]byte, tc.publicValueLen)
+			invalid[len(invalid)-1] = 0x01
+			_, err = dhType.GetSharedKey(secretI, invalid)
+			require.Error(t, err)
+
+			// Wrong length
+			_, err = dhType.GetSharedKey(secretI, publicR[1:])
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestSecretOfOtherGroup(t *testing.T) {
+	secret, err := GenerateSecret(StrToType(DH_256_BIT_RANDOM_ECP))
+	require.NoError(t, err)
+
+	_, err = StrToType(DH_384_BIT_RANDOM_ECP).GetPublicValue(secret)
+	require.Error(t, err)
+	_, err = StrToType(DH_2048_BIT_MODP).GetPublicValue(secret)
+	require.Error(t, err)
+}
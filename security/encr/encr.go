@@ -18,6 +18,10 @@ func init() {
 	// ENCR String
 	encrString = make(map[uint16]func(uint16, uint16, []byte) string)
 	encrString[message.ENCR_AES_CBC] = toString_ENCR_AES_CBC
+	encrString[message.ENCR_AES_CTR] = toString_ENCR_AES_CTR
+	encrString[message.ENCR_AES_GCM_8] = toString_ENCR_AES_GCM_8
+	encrString[message.ENCR_AES_GCM_12] = toString_ENCR_AES_GCM_12
+	encrString[message.ENCR_AES_GCM_16] = toString_ENCR_AES_GCM_16
 
 	// ENCR Types
 	encrTypes = make(map[string]ENCRType)
@@ -31,6 +35,51 @@ func init() {
 	encrTypes[ENCR_AES_CBC_256] = &EncrAesCbc{
 		keyLength: 32,
 	}
+	encrTypes[ENCR_AES_CTR_128] = &EncrAesCtr{
+		keyLength: 16,
+	}
+	encrTypes[ENCR_AES_CTR_192] = &EncrAesCtr{
+		keyLength: 24,
+	}
+	encrTypes[ENCR_AES_CTR_256] = &EncrAesCtr{
+		keyLength: 32,
+	}
+	encrTypes[ENCR_AES_GCM_8_128] = &EncrAesGcm{
+		keyLength: 16,
+		icvLength: 8,
+	}
+	encrTypes[ENCR_AES_GCM_8_192] = &EncrAesGcm{
+		keyLength: 24,
+		icvLength: 8,
+	}
+	encrTypes[ENCR_AES_GCM_8_256] = &EncrAesGcm{
+		keyLength: 32,
+		icvLength: 8,
+	}
+	encrTypes[ENCR_AES_GCM_12_128] = &EncrAesGcm{
+		keyLength: 16,
+		icvLength: 12,
+	}
+	encrTypes[ENCR_AES_GCM_12_192] = &EncrAesGcm{
+		keyLength: 24,
+		icvLength: 12,
+	}
+	encrTypes[ENCR_AES_GCM_12_256] = &EncrAesGcm{
+		keyLength: 32,
+		icvLength: 12,
+	}
+	encrTypes[ENCR_AES_GCM_16_128] = &EncrAesGcm{
+		keyLength: 16,
+		icvLength: 16,
+	}
+	encrTypes[ENCR_AES_GCM_16_192] = &EncrAesGcm{
+		keyLength: 24,
+		icvLength: 16,
+	}
+	encrTypes[ENCR_AES_GCM_16_256] = &EncrAesGcm{
+		keyLength: 32,
+		icvLength: 16,
+	}
 
 	// ENCR Kernel Types
 	encrKTypes = make(map[string]ENCRKType)
@@ -44,6 +93,51 @@ func init() {
 	encrKTypes[ENCR_AES_CBC_256] = &EncrAesCbc{
 		keyLength: 32,
 	}
+	encrKTypes[ENCR_AES_CTR_128] = &EncrAesCtr{
+		keyLength: 16,
+	}
+	encrKTypes[ENCR_AES_CTR_192] = &EncrAesCtr{
+		keyLength: 24,
+	}
+	encrKTypes[ENCR_AES_CTR_256] = &EncrAesCtr{
+		keyLength: 32,
+	}
+	encrKTypes[ENCR_AES_GCM_8_128] = &EncrAesGcm{
+		keyLength: 16,
+		icvLength: 8,
+	}
+	encrKTypes[ENCR_AES_GCM_8_192] = &EncrAesGcm{
+		keyLength: 24,
+		icvLength: 8,
+	}
+	encrKTypes[ENCR_AES_GCM_8_256] = &EncrAesGcm{
+		keyLength: 32,
+		icvLength: 8,
+	}
+	encrKTypes[ENCR_AES_GCM_12_128] = &EncrAesGcm{
+		keyLength: 16,
+		icvLength: 12,
+	}
+	encrKTypes[ENCR_AES_GCM_12_192] = &EncrAesGcm{
+		keyLength: 24,
+		icvLength: 12,
+	}
+	encrKTypes[ENCR_AES_GCM_12_256] = &EncrAesGcm{
+		keyLength: 32,
+		icvLength: 12,
+	}
+	encrKTypes[ENCR_AES_GCM_16_128] = &EncrAesGcm{
+		keyLength: 16,
+		icvLength: 16,
+	}
+	encrKTypes[ENCR_AES_GCM_16_192] = &EncrAesGcm{
+		keyLength: 24,
+		icvLength: 16,
+	}
+	encrKTypes[ENCR_AES_GCM_16_256] = &EncrAesGcm{
+		keyLength: 32,
+		icvLength: 16,
+	}
 }
 
 func StrToType(algo string) ENCRType {
@@ -132,6 +226,9 @@ type ENCRType interface {
 	TransformID() uint16
 	getAttribute() (bool, uint16, uint16, []byte, error)
 	GetKeyLength() int
+	// IsAEAD reports a combined mode algorithm, which is negotiated
+	// without an integrity transform
+	IsAEAD() bool
 	NewCrypto(key []byte) (ikeCrypto.IKECrypto, error)
 }
 
@@ -139,4 +236,5 @@ type ENCRKType interface {
 	TransformID() uint16
 	getAttribute() (bool, uint16, uint16, []byte, error)
 	GetKeyLength() int
+	IsAEAD() bool
 }
@@ -61,6 +61,10 @@ func (t *EncrAesCbc) GetKeyLength() int {
 	return t.keyLength
 }
 
+func (t *EncrAesCbc) IsAEAD() bool {
+	return false
+}
+
 func (t *EncrAesCbc) NewCrypto(key []byte) (ikeCrypto.IKECrypto, error) {
 	var err error
 	encr := new(EncrAesCbcCrypto)
@@ -0,0 +1,151 @@
+package encr
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	ikeCrypto "github.com/guoweifk/n3iwue_ike_gw/security/IKECrypto"
+)
+
+const (
+	ENCR_AES_CTR_128 string = "ENCR_AES_CTR_128"
+	ENCR_AES_CTR_192 string = "ENCR_AES_CTR_192"
+	ENCR_AES_CTR_256 string = "ENCR_AES_CTR_256"
+)
+
+// RFC 5930 - 2: the keying material for each direction is the AES key
+// followed by a 4 octets nonce. The counter block is the nonce, the 8 octets
+// IV carried in the payload and a 4 octets block counter starting at one.
+const (
+	aesCtrNonceLength = 4
+	aesCtrIVLength    = 8
+)
+
+func toString_ENCR_AES_CTR(attrType uint16, intValue uint16, bytesValue []byte) string {
+	if attrType == message.AttributeTypeKeyLength {
+		switch intValue {
+		case 128:
+			return ENCR_AES_CTR_128
+		case 192:
+			return ENCR_AES_CTR_192
+		case 256:
+			return ENCR_AES_CTR_256
+		default:
+			return ""
+		}
+	} else {
+		return ""
+	}
+}
+
+var (
+	_ ENCRType  = &EncrAesCtr{}
+	_ ENCRKType = &EncrAesCtr{}
+)
+
+type EncrAesCtr struct {
+	keyLength int // AES key length, without nonce
+}
+
+func (t *EncrAesCtr) TransformID() uint16 {
+	return message.ENCR_AES_CTR
+}
+
+func (t *EncrAesCtr) getAttribute() (bool, uint16, uint16, []byte, error) {
+	keyLengthBits := t.keyLength * 8
+	if keyLengthBits < 0 || keyLengthBits > 0xFFFF {
+		return false, 0, 0, nil, errors.Errorf("key length exceeds uint16 maximum value: %v", keyLengthBits)
+	}
+	return true, message.AttributeTypeKeyLength, uint16(keyLengthBits), nil, nil
+}
+
+// GetKeyLength returns the length of keying material, including the nonce
+func (t *EncrAesCtr) GetKeyLength() int {
+	return t.keyLength + aesCtrNonceLength
+}
+
+func (t *EncrAesCtr) IsAEAD() bool {
+	return false
+}
+
+func (t *EncrAesCtr) NewCrypto(key []byte) (ikeCrypto.IKECrypto, error) {
+	var err error
+	encr := new(EncrAesCtrCrypto)
+	if len(key) != t.GetKeyLength() {
+		return nil, errors.Errorf("EncrAesCtr init error: Get unexpected key length")
+	}
+
+	if encr.Block, err = aes.NewCipher(key[:t.keyLength]); err != nil {
+		return nil, errors.Wrapf(err, "EncrAesCtr init: Error occur when create new cipher: ")
+	}
+	encr.Nonce = append(encr.Nonce, key[t.keyLength:]...)
+
+	return encr, nil
+}
+
+var _ ikeCrypto.IKECrypto = &EncrAesCtrCrypto{}
+
+type EncrAesCtrCrypto struct {
+	Block   cipher.Block
+	Nonce   []byte
+	Iv      []byte // explicit 8 octets IV carried in the payload
+	Padding []byte
+}
+
+func (encr *EncrAesCtrCrypto) counterBlock(iv []byte) []byte {
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, encr.Nonce)
+	copy(counter[aesCtrNonceLength:], iv)
+	binary.BigEndian.PutUint32(counter[aesCtrNonceLength+aesCtrIVLength:], 1)
+	return counter
+}
+
+func (encr *EncrAesCtrCrypto) Encrypt(plainText []byte) ([]byte, error) {
+	// CTR needs no block alignment, only the Pad Length octet is appended.
+	// The padded message is copied, not to write behind the caller's slice.
+	padding := encr.Padding
+	if padding == nil {
+		padding = []byte{0}
+	}
+	plainText = append(append(make([]byte, 0, len(plainText)+len(padding)), plainText...), padding...)
+
+	cipherText := make([]byte, aesCtrIVLength+len(plainText))
+	if encr.Iv == nil {
+		_, err := io.ReadFull(rand.Reader, cipherText[:aesCtrIVLength])
+		if err != nil {
+			return nil, errors.Errorf("Read random initialization vector failed")
+		}
+	} else {
+		copy(cipherText[:aesCtrIVLength], encr.Iv)
+	}
+
+	stream := cipher.NewCTR(encr.Block, encr.counterBlock(cipherText[:aesCtrIVLength]))
+	stream.XORKeyStream(cipherText[aesCtrIVLength:], plainText)
+
+	return cipherText, nil
+}
+
+func (encr *EncrAesCtrCrypto) Decrypt(cipherText []byte) ([]byte, error) {
+	if len(cipherText) < aesCtrIVLength+1 {
+		return nil, errors.Errorf("EncrAesCtrCrypto: Length of cipher text is too short to decrypt")
+	}
+
+	plainText := make([]byte, len(cipherText)-aesCtrIVLength)
+	stream := cipher.NewCTR(encr.Block, encr.counterBlock(cipherText[:aesCtrIVLength]))
+	stream.XORKeyStream(plainText, cipherText[aesCtrIVLength:])
+
+	// Remove padding
+	padding := int(plainText[len(plainText)-1]) + 1
+	if padding > len(plainText) {
+		return nil, errors.Errorf("EncrAesCtrCrypto: Pad length exceeds plain text length")
+	}
+	plainText = plainText[:len(plainText)-padding]
+
+	return plainText, nil
+}
@@ -0,0 +1,72 @@
+package encr
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test vector #2 from RFC 3686 section 6
+func TestEncrAesCtr_128(t *testing.T) {
+	key, err := hex.DecodeString("7e24067817fae0d743d6ce1f32539163" + "006cb6db")
+	require.NoError(t, err)
+	iv, err := hex.DecodeString("c0543b59da48d90b")
+	require.NoError(t, err)
+	plainText := make([]byte, 32)
+	for i := range plainText {
+		plainText[i] = byte(i)
+	}
+	expected, err := hex.DecodeString(
+		"5104a106168a72d9790d41ee8edad388eb2e1efc46da57c8fce630df9141be28")
+	require.NoError(t, err)
+
+	encrType := StrToType(ENCR_AES_CTR_128)
+	require.NotNil(t, encrType)
+	require.False(t, encrType.IsAEAD())
+	require.Equal(t, 20, encrType.GetKeyLength())
+
+	transform, err := ToTransform(encrType)
+	require.NoError(t, err)
+	require.Equal(t, encrType, DecodeTransform(transform))
+
+	ikeCrypto, err := encrType.NewCrypto(key)
+	require.NoError(t, err)
+	encr := ikeCrypto.(*EncrAesCtrCrypto)
+	encr.Iv = iv
+	encr.Padding = []byte{}
+
+	cipherText, err := encr.Encrypt(plainText)
+	require.NoError(t, err)
+	require.Equal(t, iv, cipherText[:aesCtrIVLength])
+	require.Equal(t, expected, cipherText[aesCtrIVLength:])
+
+	_, err = encrType.NewCrypto(key[:16])
+	require.Error(t, err)
+}
+
+func TestEncrAesCtrPadding(t *testing.T) {
+	for _, algo := range []string{ENCR_AES_CTR_128, ENCR_AES_CTR_192, ENCR_AES_CTR_256} {
+		t.Run(algo, func(t *testing.T) {
+			encrType := StrToType(algo)
+			require.NotNil(t, encrType)
+			ikeCrypto, err := encrType.NewCrypto(make([]byte, encrType.GetKeyLength()))
+			require.NoError(t, err)
+
+			// The padding is not written in the spare capacity of the plain text
+			buffer := []byte("ENCR_AES_CTR needs no block alignment")
+			plainText := buffer[:len(buffer)-1]
+			cipherText, err := ikeCrypto.Encrypt(plainText)
+			require.NoError(t, err)
+			require.Len(t, cipherText, aesCtrIVLength+len(plainText)+1)
+			require.Equal(t, []byte("ENCR_AES_CTR needs no block alignment"), buffer)
+
+			decrypted, err := ikeCrypto.Decrypt(cipherText)
+			require.NoError(t, err)
+			require.Equal(t, plainText, decrypted)
+
+			_, err = ikeCrypto.Decrypt(cipherText[:aesCtrIVLength])
+			require.Error(t, err)
+		})
+	}
+}
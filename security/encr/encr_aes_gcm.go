@@ -0,0 +1,271 @@
+package encr
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	ikeCrypto "github.com/guoweifk/n3iwue_ike_gw/security/IKECrypto"
+)
+
+const (
+	ENCR_AES_GCM_8_128  string = "ENCR_AES_GCM_8_128"
+	ENCR_AES_GCM_8_192  string = "ENCR_AES_GCM_8_192"
+	ENCR_AES_GCM_8_256  string = "ENCR_AES_GCM_8_256"
+	ENCR_AES_GCM_12_128 string = "ENCR_AES_GCM_12_128"
+	ENCR_AES_GCM_12_192 string = "ENCR_AES_GCM_12_192"
+	ENCR_AES_GCM_12_256 string = "ENCR_AES_GCM_12_256"
+	ENCR_AES_GCM_16_128 string = "ENCR_AES_GCM_16_128"
+	ENCR_AES_GCM_16_192 string = "ENCR_AES_GCM_16_192"
+	ENCR_AES_GCM_16_256 string = "ENCR_AES_GCM_16_256"
+)
+
+// RFC 5282 - 7.1: the keying material for each direction is the AES key
+// followed by a 4 octets salt, which is the fixed part of the GCM nonce.
+const (
+	aesGcmSaltLength = 4
+	aesGcmIVLength   = 8
+)
+
+func toString_ENCR_AES_GCM_8(attrType uint16, intValue uint16, bytesValue []byte) string {
+	if attrType == message.AttributeTypeKeyLength {
+		switch intValue {
+		case 128:
+			return ENCR_AES_GCM_8_128
+		case 192:
+			return ENCR_AES_GCM_8_192
+		case 256:
+			return ENCR_AES_GCM_8_256
+		default:
+			return ""
+		}
+	} else {
+		return ""
+	}
+}
+
+func toString_ENCR_AES_GCM_12(attrType uint16, intValue uint16, bytesValue []byte) string {
+	if attrType == message.AttributeTypeKeyLength {
+		switch intValue {
+		case 128:
+			return ENCR_AES_GCM_12_128
+		case 192:
+			return ENCR_AES_GCM_12_192
+		case 256:
+			return ENCR_AES_GCM_12_256
+		default:
+			return ""
+		}
+	} else {
+		return ""
+	}
+}
+
+func toString_ENCR_AES_GCM_16(attrType uint16, intValue uint16, bytesValue []byte) string {
+	if attrType == message.AttributeTypeKeyLength {
+		switch intValue {
+		case 128:
+			return ENCR_AES_GCM_16_128
+		case 192:
+			return ENCR_AES_GCM_16_192
+		case 256:
+			return ENCR_AES_GCM_16_256
+		default:
+			return ""
+		}
+	} else {
+		return ""
+	}
+}
+
+var (
+	_ ENCRType  = &EncrAesGcm{}
+	_ ENCRKType = &EncrAesGcm{}
+)
+
+type EncrAesGcm struct {
+	keyLength int // AES key length, without salt
+	icvLength int
+}
+
+func (t *EncrAesGcm) TransformID() uint16 {
+	switch t.icvLength {
+	case 8:
+		return message.ENCR_AES_GCM_8
+	case 12:
+		return message.ENCR_AES_GCM_12
+	default:
+		return message.ENCR_AES_GCM_16
+	}
+}
+
+func (t *EncrAesGcm) getAttribute() (bool, uint16, uint16, []byte, error) {
+	keyLengthBits := t.keyLength * 8
+	if keyLengthBits < 0 || keyLengthBits > 0xFFFF {
+		return false, 0, 0, nil, errors.Errorf("key length exceeds uint16 maximum value: %v", keyLengthBits)
+	}
+	return true, message.AttributeTypeKeyLength, uint16(keyLengthBits), nil, nil
+}
+
+// GetKeyLength returns the length of keying material, including the salt
+func (t *EncrAesGcm) GetKeyLength() int {
+	return t.keyLength + aesGcmSaltLength
+}
+
+func (t *EncrAesGcm) GetICVLength() int {
+	return t.icvLength
+}
+
+func (t *EncrAesGcm) IsAEAD() bool {
+	return true
+}
+
+func (t *EncrAesGcm) NewCrypto(key []byte) (ikeCrypto.IKECrypto, error) {
+	if len(key) != t.GetKeyLength() {
+		return nil, errors.Errorf("EncrAesGcm init error: Get unexpected key length")
+	}
+
+	block, err := aes.NewCipher(key[:t.keyLength])
+	if err != nil {
+		return nil, errors.Wrapf(err, "EncrAesGcm init: Error occur when create new cipher: ")
+	}
+
+	encr := new(EncrAesGcmCrypto)
+	if t.icvLength < 12 {
+		encr.Aead, err = newTruncatedGCM(block, t.icvLength)
+	} else {
+		encr.Aead, err = cipher.NewGCMWithTagSize(block, t.icvLength)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "EncrAesGcm init: Error occur when create GCM: ")
+	}
+	encr.Salt = append(encr.Salt, key[t.keyLength:]...)
+
+	return encr, nil
+}
+
+var _ ikeCrypto.IKEAEADCrypto = &EncrAesGcmCrypto{}
+
+type EncrAesGcmCrypto struct {
+	Aead    cipher.AEAD
+	Salt    []byte
+	Iv      []byte // explicit 8 octets IV carried in the payload
+	Padding []byte
+}
+
+func (encr *EncrAesGcmCrypto) Overhead() int {
+	return aesGcmIVLength + encr.Aead.Overhead()
+}
+
+func (encr *EncrAesGcmCrypto) Encrypt(plainText []byte) ([]byte, error) {
+	return encr.EncryptWithAD(plainText, nil)
+}
+
+func (encr *EncrAesGcmCrypto) Decrypt(cipherText []byte) ([]byte, error) {
+	return encr.DecryptWithAD(cipherText, nil)
+}
+
+func (encr *EncrAesGcmCrypto) EncryptWithAD(plainText, associatedData []byte) ([]byte, error) {
+	// GCM needs no block alignment, only the Pad Length octet is appended.
+	// The padded message is copied, not to write behind the caller's slice.
+	padding := encr.Padding
+	if padding == nil {
+		padding = []byte{0}
+	}
+	plainText = append(append(make([]byte, 0, len(plainText)+len(padding)), plainText...), padding...)
+
+	cipherText := make([]byte, aesGcmIVLength, aesGcmIVLength+len(plainText)+encr.Aead.Overhead())
+	if encr.Iv == nil {
+		_, err := io.ReadFull(rand.Reader, cipherText)
+		if err != nil {
+			return nil, errors.Errorf("Read random initialization vector failed")
+		}
+	} else {
+		copy(cipherText, encr.Iv)
+	}
+
+	nonce := append(append([]byte{}, encr.Salt...), cipherText[:aesGcmIVLength]...)
+	return encr.Aead.Seal(cipherText, nonce, plainText, associatedData), nil
+}
+
+func (encr *EncrAesGcmCrypto) DecryptWithAD(cipherText, associatedData []byte) ([]byte, error) {
+	if len(cipherText) < encr.Overhead()+1 {
+		return nil, errors.Errorf("EncrAesGcmCrypto: Length of cipher text is too short to decrypt")
+	}
+
+	nonce := append(append([]byte{}, encr.Salt...), cipherText[:aesGcmIVLength]...)
+	plainText, err := encr.Aead.Open(nil, nonce, cipherText[aesGcmIVLength:], associatedData)
+	if err != nil {
+		return nil, errors.Wrapf(err, "EncrAesGcmCrypto: Decrypt")
+	}
+
+	// Remove padding
+	padding := int(plainText[len(plainText)-1]) + 1
+	if padding > len(plainText) {
+		return nil, errors.Errorf("EncrAesGcmCrypto: Pad length exceeds plain text length")
+	}
+	plainText = plainText[:len(plainText)-padding]
+
+	return plainText, nil
+}
+
+// truncatedGCM provides the 8 octets ICV of ENCR_AES_GCM_8, which is not
+// accepted by crypto/cipher. The ICV is the leading octets of the full tag.
+type truncatedGCM struct {
+	block   cipher.Block
+	gcm     cipher.AEAD
+	tagSize int
+}
+
+var _ cipher.AEAD = &truncatedGCM{}
+
+func newTruncatedGCM(block cipher.Block, tagSize int) (cipher.AEAD, error) {
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &truncatedGCM{
+		block:   block,
+		gcm:     gcm,
+		tagSize: tagSize,
+	}, nil
+}
+
+func (g *truncatedGCM) NonceSize() int { return g.gcm.NonceSize() }
+
+func (g *truncatedGCM) Overhead() int { return g.tagSize }
+
+func (g *truncatedGCM) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	sealed := g.gcm.Seal(dst, nonce, plaintext, additionalData)
+	return sealed[:len(sealed)-g.gcm.Overhead()+g.tagSize]
+}
+
+func (g *truncatedGCM) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != g.gcm.NonceSize() || len(ciphertext) < g.tagSize {
+		return nil, errors.New("cipher: message authentication failed")
+	}
+	tag := ciphertext[len(ciphertext)-g.tagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-g.tagSize]
+
+	// GCM encrypts with CTR mode starting from counter block nonce | 2
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, nonce)
+	binary.BigEndian.PutUint32(counter[12:], 2)
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(g.block, counter).XORKeyStream(plaintext, ciphertext)
+
+	// Recompute the full tag over the recovered plain text
+	sealed := g.gcm.Seal(nil, nonce, plaintext, additionalData)
+	expectTag := sealed[len(ciphertext) : len(ciphertext)+g.tagSize]
+	if subtle.ConstantTimeCompare(tag, expectTag) != 1 {
+		return nil, errors.New("cipher: message authentication failed")
+	}
+
+	return append(dst, plaintext...), nil
+}
@@ -0,0 +1,85 @@
+package encr
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test Case 4 of "The Galois/Counter Mode of Operation (GCM)", with the
+// 12 octets nonce split into the RFC 5282 salt and explicit IV
+func TestEncrAesGcm_128(t *testing.T) {
+	key, err := hex.DecodeString("feffe9928665731c6d6a8f9467308308" + "cafebabe")
+	require.NoError(t, err)
+	iv, err := hex.DecodeString("facedbaddecaf888")
+	require.NoError(t, err)
+	plainText, err := hex.DecodeString(
+		"d9313225f88406e5a55909c5aff5269a" +
+			"86a7a9531534f7da2e4c303d8a318a72" +
+			"1c3c0c95956809532fcf0e2449a6b525" +
+			"b16aedf5aa0de657ba637b39")
+	require.NoError(t, err)
+	associatedData, err := hex.DecodeString(
+		"feedfacedeadbeeffeedfacedeadbeef" +
+			"abaddad2")
+	require.NoError(t, err)
+	expCipherText, err := hex.DecodeString(
+		"42831ec2217774244b7221b784d0d49c" +
+			"e3aa212f2c02a4e035c17e2329aca12e" +
+			"21d514b25466931c7d8f6a5aac84aa05" +
+			"1ba30b396a0aac973d58e091" +
+			"5bc94fbc3221a5db94fae95ae7121a47")
+	require.NoError(t, err)
+
+	encrType := StrToType(ENCR_AES_GCM_16_128)
+	require.NotNil(t, encrType)
+	require.True(t, encrType.IsAEAD())
+	require.Equal(t, 20, encrType.GetKeyLength())
+
+	crypto, err := encrType.NewCrypto(key)
+	require.NoError(t, err)
+	gcm := crypto.(*EncrAesGcmCrypto)
+	gcm.Iv = iv
+	gcm.Padding = []byte{}
+
+	cipherText, err := gcm.EncryptWithAD(plainText, associatedData)
+	require.NoError(t, err)
+	require.Equal(t, append(iv, expCipherText...), cipherText)
+
+	// Tampered associated data must be rejected
+	associatedData[0] ^= 0xff
+	_, err = gcm.DecryptWithAD(cipherText, associatedData)
+	require.Error(t, err)
+}
+
+func TestEncrAesGcmPadding(t *testing.T) {
+	for _, algo := range []string{
+		ENCR_AES_GCM_8_128, ENCR_AES_GCM_12_192, ENCR_AES_GCM_16_256,
+	} {
+		t.Run(algo, func(t *testing.T) {
+			encrType := StrToType(algo)
+			require.NotNil(t, encrType)
+
+			crypto, err := encrType.NewCrypto(make([]byte, encrType.GetKeyLength()))
+			require.NoError(t, err)
+			aead := crypto.(*EncrAesGcmCrypto)
+
+			// The padding is not written in the spare capacity of the plain text
+			buffer := []byte{0x01, 0x02, 0x03, 0xff, 0xff, 0xff, 0xff, 0xff}
+			plainText := buffer[:3]
+			cipherText, err := aead.EncryptWithAD(plainText, []byte{0xaa})
+			require.NoError(t, err)
+			require.Len(t, cipherText, aead.Overhead()+len(plainText)+1)
+			require.Equal(t, []byte{0x01, 0x02, 0x03, 0xff, 0xff, 0xff, 0xff, 0xff}, buffer)
+
+			result, err := aead.DecryptWithAD(cipherText, []byte{0xaa})
+			require.NoError(t, err)
+			require.Equal(t, plainText, result)
+
+			transform, err := ToTransform(encrType)
+			require.NoError(t, err)
+			require.Equal(t, encrType, DecodeTransform(transform))
+		})
+	}
+}
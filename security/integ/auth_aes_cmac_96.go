@@ -0,0 +1,47 @@
+package integ
+
+import (
+	"hash"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security/lib"
+)
+
+func toString_AUTH_AES_CMAC_96(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return AUTH_AES_CMAC_96
+}
+
+var (
+	_ INTEGType  = &AuthAesCmac96{}
+	_ INTEGKType = &AuthAesCmac96{}
+)
+
+type AuthAesCmac96 struct {
+	keyLength    int
+	outputLength int
+}
+
+func (t *AuthAesCmac96) TransformID() uint16 {
+	return message.AUTH_AES_CMAC_96
+}
+
+func (t *AuthAesCmac96) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *AuthAesCmac96) GetKeyLength() int {
+	return t.keyLength
+}
+
+func (t *AuthAesCmac96) GetOutputLength() int {
+	return t.outputLength
+}
+
+func (t *AuthAesCmac96) Init(key []byte) hash.Hash {
+	if len(key) == 16 {
+		if mac, err := lib.NewCMAC(key); err == nil {
+			return mac
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package integ
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test vectors from RFC 3566 section 4.6 and RFC 4493 section 4, truncated
+// to 96 bits
+func TestAuthAes96(t *testing.T) {
+	testCases := []struct {
+		description string
+		algo        string
+		key         string
+		data        string
+		expected    string
+	}{
+		{
+			description: "AUTH_AES_XCBC_96 with 20 octets",
+			algo:        AUTH_AES_XCBC_96,
+			key:         "000102030405060708090a0b0c0d0e0f",
+			data:        "000102030405060708090a0b0c0d0e0f10111213",
+			expected:    "47f51b4564966215b8985c63",
+		},
+		{
+			description: "AUTH_AES_CMAC_96 with 16 octets",
+			algo:        AUTH_AES_CMAC_96,
+			key:         "2b7e151628aed2a6abf7158809cf4f3c",
+			data:        "6bc1bee22e409f96e93d7e117393172a",
+			expected:    "070a16b46b4d4144f79bdd9d",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			key, err := hex.DecodeString(tc.key)
+			require.NoError(t, err)
+			data, err := hex.DecodeString(tc.data)
+			require.NoError(t, err)
+
+			integType := StrToType(tc.algo)
+			require.NotNil(t, integType)
+			require.Equal(t, integType, DecodeTransform(ToTransform(integType)))
+			integKType := StrToKType(tc.algo)
+			require.NotNil(t, integKType)
+			require.Equal(t, integKType, DecodeTransformChildSA(ToTransformChildSA(integKType)))
+
+			require.Nil(t, integType.Init(key[1:]))
+			mac := integType.Init(key)
+			require.NotNil(t, mac)
+			_, err = mac.Write(data)
+			require.NoError(t, err)
+			checksum := mac.Sum(nil)[:integType.GetOutputLength()]
+			require.Equal(t, tc.expected, hex.EncodeToString(checksum))
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package integ
+
+import (
+	"hash"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security/lib"
+)
+
+func toString_AUTH_AES_XCBC_96(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return AUTH_AES_XCBC_96
+}
+
+var (
+	_ INTEGType  = &AuthAesXcbc96{}
+	_ INTEGKType = &AuthAesXcbc96{}
+)
+
+type AuthAesXcbc96 struct {
+	keyLength    int
+	outputLength int
+}
+
+func (t *AuthAesXcbc96) TransformID() uint16 {
+	return message.AUTH_AES_XCBC_96
+}
+
+func (t *AuthAesXcbc96) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *AuthAesXcbc96) GetKeyLength() int {
+	return t.keyLength
+}
+
+func (t *AuthAesXcbc96) GetOutputLength() int {
+	return t.outputLength
+}
+
+func (t *AuthAesXcbc96) Init(key []byte) hash.Hash {
+	if len(key) == 16 {
+		if mac, err := lib.NewXCBC(key); err == nil {
+			return mac
+		}
+	}
+	return nil
+}
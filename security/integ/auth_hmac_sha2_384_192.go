@@ -0,0 +1,47 @@
+package integ
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+func toString_AUTH_HMAC_SHA2_384_192(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return AUTH_HMAC_SHA2_384_192
+}
+
+var (
+	_ INTEGType  = &AuthHmacSha2_384_192{}
+	_ INTEGKType = &AuthHmacSha2_384_192{}
+)
+
+type AuthHmacSha2_384_192 struct {
+	keyLength    int
+	outputLength int
+}
+
+func (t *AuthHmacSha2_384_192) TransformID() uint16 {
+	return message.AUTH_HMAC_SHA2_384_192
+}
+
+func (t *AuthHmacSha2_384_192) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *AuthHmacSha2_384_192) GetKeyLength() int {
+	return t.keyLength
+}
+
+func (t *AuthHmacSha2_384_192) GetOutputLength() int {
+	return t.outputLength
+}
+
+func (t *AuthHmacSha2_384_192) Init(key []byte) hash.Hash {
+	if len(key) == 48 {
+		return hmac.New(sha512.New384, key)
+	} else {
+		return nil
+	}
+}
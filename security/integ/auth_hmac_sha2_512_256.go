@@ -0,0 +1,47 @@
+package integ
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+func toString_AUTH_HMAC_SHA2_512_256(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return AUTH_HMAC_SHA2_512_256
+}
+
+var (
+	_ INTEGType  = &AuthHmacSha2_512_256{}
+	_ INTEGKType = &AuthHmacSha2_512_256{}
+)
+
+type AuthHmacSha2_512_256 struct {
+	keyLength    int
+	outputLength int
+}
+
+func (t *AuthHmacSha2_512_256) TransformID() uint16 {
+	return message.AUTH_HMAC_SHA2_512_256
+}
+
+func (t *AuthHmacSha2_512_256) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *AuthHmacSha2_512_256) GetKeyLength() int {
+	return t.keyLength
+}
+
+func (t *AuthHmacSha2_512_256) GetOutputLength() int {
+	return t.outputLength
+}
+
+func (t *AuthHmacSha2_512_256) Init(key []byte) hash.Hash {
+	if len(key) == 64 {
+		return hmac.New(sha512.New, key)
+	} else {
+		return nil
+	}
+}
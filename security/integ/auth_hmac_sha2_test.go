@@ -0,0 +1,78 @@
+package integ
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// Test vectors from RFC 4868 section 2.7.2
+func TestAuthHmacSha2(t *testing.T) {
+	testCases := []struct {
+		description string
+		algo        string
+		transformID uint16
+		key         []byte
+		data        []byte
+		expected    string
+	}{
+		{
+			description: "AUTH_HMAC_SHA2_384_192 test case 1",
+			algo:        AUTH_HMAC_SHA2_384_192,
+			transformID: message.AUTH_HMAC_SHA2_384_192,
+			key:         bytes.Repeat([]byte{0x0b}, 48),
+			data:        []byte("Hi There"),
+			expected:    "b6a8d5636f5c6a7224f9977dcf7ee6c7fb6d0c48cbdee973",
+		},
+		{
+			description: "AUTH_HMAC_SHA2_384_192 test case 2",
+			algo:        AUTH_HMAC_SHA2_384_192,
+			transformID: message.AUTH_HMAC_SHA2_384_192,
+			key:         bytes.Repeat([]byte("Jefe"), 12),
+			data:        []byte("what do ya want for nothing?"),
+			expected:    "2c7353974f1842fd66d53c452ca42122b28c0b594cfb184d",
+		},
+		{
+			description: "AUTH_HMAC_SHA2_512_256 test case 1",
+			algo:        AUTH_HMAC_SHA2_512_256,
+			transformID: message.AUTH_HMAC_SHA2_512_256,
+			key:         bytes.Repeat([]byte{0x0b}, 64),
+			data:        []byte("Hi There"),
+			expected:    "637edc6e01dce7e6742a99451aae82df23da3e92439e590e43e761b33e910fb8",
+		},
+		{
+			description: "AUTH_HMAC_SHA2_512_256 test case 2",
+			algo:        AUTH_HMAC_SHA2_512_256,
+			transformID: message.AUTH_HMAC_SHA2_512_256,
+			key:         bytes.Repeat([]byte("Jefe"), 16),
+			data:        []byte("what do ya want for nothing?"),
+			expected:    "cb370917ae8a7ce28cfd1d8f4705d6141c173b2a9362c15df235dfb251b15454",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			integType := StrToType(tc.algo)
+			require.NotNil(t, integType)
+			require.Equal(t, tc.transformID, integType.TransformID())
+			require.Equal(t, integType, DecodeTransform(ToTransform(integType)))
+
+			integKType := StrToKType(tc.algo)
+			require.NotNil(t, integKType)
+			require.Equal(t, integType.GetKeyLength(), integKType.GetKeyLength())
+			require.Equal(t, integKType, DecodeTransformChildSA(ToTransformChildSA(integKType)))
+
+			require.Nil(t, integType.Init(tc.key[1:]))
+			mac := integType.Init(tc.key)
+			require.NotNil(t, mac)
+			_, err := mac.Write(tc.data)
+			require.NoError(t, err)
+			checksum := mac.Sum(nil)[:integType.GetOutputLength()]
+			require.Equal(t, tc.expected, hex.EncodeToString(checksum))
+		})
+	}
+}
@@ -9,7 +9,11 @@ import (
 const (
 	AUTH_HMAC_MD5_96       string = "AUTH_HMAC_MD5_96"
 	AUTH_HMAC_SHA1_96      string = "AUTH_HMAC_SHA1_96"
+	AUTH_AES_XCBC_96       string = "AUTH_AES_XCBC_96"
+	AUTH_AES_CMAC_96       string = "AUTH_AES_CMAC_96"
 	AUTH_HMAC_SHA2_256_128 string = "AUTH_HMAC_SHA2_256_128"
+	AUTH_HMAC_SHA2_384_192 string = "AUTH_HMAC_SHA2_384_192"
+	AUTH_HMAC_SHA2_512_256 string = "AUTH_HMAC_SHA2_512_256"
 )
 
 var integString map[uint16]func(uint16, uint16, []byte) string
@@ -24,7 +28,11 @@ func init() {
 	integString = make(map[uint16]func(uint16, uint16, []byte) string)
 	integString[message.AUTH_HMAC_MD5_96] = toString_AUTH_HMAC_MD5_96
 	integString[message.AUTH_HMAC_SHA1_96] = toString_AUTH_HMAC_SHA1_96
+	integString[message.AUTH_AES_XCBC_96] = toString_AUTH_AES_XCBC_96
+	integString[message.AUTH_AES_CMAC_96] = toString_AUTH_AES_CMAC_96
 	integString[message.AUTH_HMAC_SHA2_256_128] = toString_AUTH_HMAC_SHA2_256_128
+	integString[message.AUTH_HMAC_SHA2_384_192] = toString_AUTH_HMAC_SHA2_384_192
+	integString[message.AUTH_HMAC_SHA2_512_256] = toString_AUTH_HMAC_SHA2_512_256
 
 	// INTEG Types
 	integTypes = make(map[string]INTEGType)
@@ -37,10 +45,26 @@ func init() {
 		keyLength:    20,
 		outputLength: 12,
 	}
+	integTypes[AUTH_AES_XCBC_96] = &AuthAesXcbc96{
+		keyLength:    16,
+		outputLength: 12,
+	}
+	integTypes[AUTH_AES_CMAC_96] = &AuthAesCmac96{
+		keyLength:    16,
+		outputLength: 12,
+	}
 	integTypes[AUTH_HMAC_SHA2_256_128] = &AuthHmacSha2_256_128{
 		keyLength:    32,
 		outputLength: 16,
 	}
+	integTypes[AUTH_HMAC_SHA2_384_192] = &AuthHmacSha2_384_192{
+		keyLength:    48,
+		outputLength: 24,
+	}
+	integTypes[AUTH_HMAC_SHA2_512_256] = &AuthHmacSha2_512_256{
+		keyLength:    64,
+		outputLength: 32,
+	}
 
 	// INTEG Kernel Types
 	integKTypes = make(map[string]INTEGKType)
@@ -53,10 +77,26 @@ func init() {
 		keyLength:    20,
 		outputLength: 12,
 	}
+	integKTypes[AUTH_AES_XCBC_96] = &AuthAesXcbc96{
+		keyLength:    16,
+		outputLength: 12,
+	}
+	integKTypes[AUTH_AES_CMAC_96] = &AuthAesCmac96{
+		keyLength:    16,
+		outputLength: 12,
+	}
 	integKTypes[AUTH_HMAC_SHA2_256_128] = &AuthHmacSha2_256_128{
 		keyLength:    32,
 		outputLength: 16,
 	}
+	integKTypes[AUTH_HMAC_SHA2_384_192] = &AuthHmacSha2_384_192{
+		keyLength:    48,
+		outputLength: 24,
+	}
+	integKTypes[AUTH_HMAC_SHA2_512_256] = &AuthHmacSha2_512_256{
+		keyLength:    64,
+		outputLength: 32,
+	}
 }
 
 func StrToType(algo string) INTEGType {
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"hash"
+
+	"github.com/pkg/errors"
+)
+
+// cbcMac is the CBC-MAC construction shared by AES-XCBC-MAC (RFC 3566) and
+// AES-CMAC (RFC 4493). They differ only in the key and subkeys used for the
+// last block.
+type cbcMac struct {
+	block    cipher.Block
+	complete [aes.BlockSize]byte // subkey for a complete last block
+	partial  [aes.BlockSize]byte // subkey for a padded last block
+	state    [aes.BlockSize]byte
+	pending  []byte // last block, kept until Sum() is called
+}
+
+var _ hash.Hash = &cbcMac{}
+
+// NewXCBC returns an AES-XCBC-MAC-128 hash with a 16 octets key (RFC 3566)
+func NewXCBC(key []byte) (hash.Hash, error) {
+	if len(key) != aes.BlockSize {
+		return nil, errors.Errorf("NewXCBC(): Unexpected key length %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewXCBC()")
+	}
+
+	// K1 = E(K, 0x01...), K2 = E(K, 0x02...), K3 = E(K, 0x03...)
+	var k1, constant [aes.BlockSize]byte
+	mac := new(cbcMac)
+	for i := range constant {
+		constant[i] = 0x01
+	}
+	block.Encrypt(k1[:], constant[:])
+	for i := range constant {
+		constant[i] = 0x02
+	}
+	block.Encrypt(mac.complete[:], constant[:])
+	for i := range constant {
+		constant[i] = 0x03
+	}
+	block.Encrypt(mac.partial[:], constant[:])
+
+	if mac.block, err = aes.NewCipher(k1[:]); err != nil {
+		return nil, errors.Wrapf(err, "NewXCBC()")
+	}
+	return mac, nil
+}
+
+// NewCMAC returns an AES-CMAC hash with a 16, 24 or 32 octets key (RFC 4493)
+func NewCMAC(key []byte) (hash.Hash, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewCMAC()")
+	}
+
+	// L = E(K, 0), K1 = double(L), K2 = double(K1)
+	var l [aes.BlockSize]byte
+	block.Encrypt(l[:], l[:])
+	mac := &cbcMac{block: block}
+	mac.complete = cmacDouble(l)
+	mac.partial = cmacDouble(mac.complete)
+	return mac, nil
+}
+
+func cmacDouble(in [aes.BlockSize]byte) [aes.BlockSize]byte {
+	var out [aes.BlockSize]byte
+	carry := in[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		out[i] = in[i]<<1 | in[i+1]>>7
+	}
+	out[aes.BlockSize-1] = in[aes.BlockSize-1]<<1 ^ byte(subtle.ConstantTimeSelect(int(carry), 0x87, 0))
+	return out
+}
+
+func (m *cbcMac) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(m.pending) == aes.BlockSize {
+			// More data follows, so the pending block is not the last one
+			subtle.XORBytes(m.state[:], m.state[:], m.pending)
+			m.block.Encrypt(m.state[:], m.state[:])
+			m.pending = m.pending[:0]
+		}
+		take := aes.BlockSize - len(m.pending)
+		if take > len(p) {
+			take = len(p)
+		}
+		m.pending = append(m.pending, p[:take]...)
+		p = p[take:]
+	}
+	return n, nil
+}
+
+func (m *cbcMac) Sum(b []byte) []byte {
+	var last [aes.BlockSize]byte
+	copy(last[:], m.pending)
+	if len(m.pending) == aes.BlockSize {
+		subtle.XORBytes(last[:], last[:], m.complete[:])
+	} else {
+		last[len(m.pending)] = 0x80
+		subtle.XORBytes(last[:], last[:], m.partial[:])
+	}
+	subtle.XORBytes(last[:], last[:], m.state[:])
+	m.block.Encrypt(last[:], last[:])
+	return append(b, last[:]...)
+}
+
+func (m *cbcMac) Reset() {
+	m.state = [aes.BlockSize]byte{}
+	m.pending = m.pending[:0]
+}
+
+func (m *cbcMac) Size() int {
+	return aes.BlockSize
+}
+
+func (m *cbcMac) BlockSize() int {
+	return aes.BlockSize
+}
@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sequence(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// Test vectors from RFC 3566 section 4.6
+func TestXCBC(t *testing.T) {
+	testCases := []struct {
+		description string
+		length      int
+		expected    string
+	}{
+		{"empty message", 0, "75f0251d528ac01c4573dfd584d79f29"},
+		{"3 octets", 3, "5b376580ae2f19afe7219ceef172756f"},
+		{"16 octets", 16, "d2a246fa349b68a79998a4394ff7a263"},
+		{"20 octets", 20, "47f51b4564966215b8985c63055ed308"},
+		{"32 octets", 32, "f54f0ec8d2b9f3d36807734bd5283fd4"},
+		{"34 octets", 34, "becbb3bccdb518a30677d5481fb6b4d8"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			mac, err := NewXCBC(sequence(16))
+			require.NoError(t, err)
+
+			data := sequence(tc.length)
+			_, err = mac.Write(data)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, hex.EncodeToString(mac.Sum(nil)))
+
+			// Sum does not change the state, and Reset restarts the MAC
+			require.Equal(t, tc.expected, hex.EncodeToString(mac.Sum(nil)))
+			mac.Reset()
+			for i := range data {
+				_, err = mac.Write(data[i : i+1])
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expected, hex.EncodeToString(mac.Sum(nil)))
+		})
+	}
+
+	_, err := NewXCBC(sequence(24))
+	require.Error(t, err)
+}
+
+// Test vectors from RFC 4493 section 4
+func TestCMAC(t *testing.T) {
+	key, err := hex.DecodeString("2b7e151628aed2a6abf7158809cf4f3c")
+	require.NoError(t, err)
+	message, err := hex.DecodeString(
+		"6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e51" +
+			"30c81c46a35ce411e5fbc1191a0a52eff69f2445df4f9b17ad2b417be66c3710")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		description string
+		length      int
+		expected    string
+	}{
+		{"empty message", 0, "bb1d6929e95937287fa37d129b756746"},
+		{"16 octets", 16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{"40 octets", 40, "dfa66747de9ae63030ca32611497c827"},
+		{"64 octets", 64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			mac, err := NewCMAC(key)
+			require.NoError(t, err)
+			_, err = mac.Write(message[:tc.length])
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, hex.EncodeToString(mac.Sum(nil)))
+		})
+	}
+}
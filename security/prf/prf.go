@@ -9,7 +9,11 @@ import (
 const (
 	PRF_HMAC_MD5      string = "PRF_HMAC_MD5"
 	PRF_HMAC_SHA1     string = "PRF_HMAC_SHA1"
+	PRF_AES128_XCBC   string = "PRF_AES128_XCBC"
+	PRF_AES128_CMAC   string = "PRF_AES128_CMAC"
 	PRF_HMAC_SHA2_256 string = "PRF_HMAC_SHA2_256"
+	PRF_HMAC_SHA2_384 string = "PRF_HMAC_SHA2_384"
+	PRF_HMAC_SHA2_512 string = "PRF_HMAC_SHA2_512"
 )
 
 var (
@@ -22,7 +26,11 @@ func init() {
 	prfString = make(map[uint16]func(uint16, uint16, []byte) string)
 	prfString[message.PRF_HMAC_MD5] = toString_PRF_HMAC_MD5
 	prfString[message.PRF_HMAC_SHA1] = toString_PRF_HMAC_SHA1
+	prfString[message.PRF_AES128_XCBC] = toString_PRF_AES128_XCBC
+	prfString[message.PRF_AES128_CMAC] = toString_PRF_AES128_CMAC
 	prfString[message.PRF_HMAC_SHA2_256] = toString_PRF_HMAC_SHA2_256
+	prfString[message.PRF_HMAC_SHA2_384] = toString_PRF_HMAC_SHA2_384
+	prfString[message.PRF_HMAC_SHA2_512] = toString_PRF_HMAC_SHA2_512
 
 	// PRF Types
 	prfTypes = make(map[string]PRFType)
@@ -35,10 +43,26 @@ func init() {
 		keyLength:    20,
 		outputLength: 20,
 	}
+	prfTypes[PRF_AES128_XCBC] = &PrfAes128Xcbc{
+		keyLength:    16,
+		outputLength: 16,
+	}
+	prfTypes[PRF_AES128_CMAC] = &PrfAes128Cmac{
+		keyLength:    16,
+		outputLength: 16,
+	}
 	prfTypes[PRF_HMAC_SHA2_256] = &PrfHmacSha2_256{
 		keyLength:    32,
 		outputLength: 32,
 	}
+	prfTypes[PRF_HMAC_SHA2_384] = &PrfHmacSha2_384{
+		keyLength:    48,
+		outputLength: 48,
+	}
+	prfTypes[PRF_HMAC_SHA2_512] = &PrfHmacSha2_512{
+		keyLength:    64,
+		outputLength: 64,
+	}
 }
 
 func StrToType(algo string) PRFType {
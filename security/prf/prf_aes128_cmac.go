@@ -0,0 +1,49 @@
+package prf
+
+import (
+	"hash"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security/lib"
+)
+
+func toString_PRF_AES128_CMAC(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return PRF_AES128_CMAC
+}
+
+var _ PRFType = &PrfAes128Cmac{}
+
+type PrfAes128Cmac struct {
+	keyLength    int
+	outputLength int
+}
+
+func (t *PrfAes128Cmac) TransformID() uint16 {
+	return message.PRF_AES128_CMAC
+}
+
+func (t *PrfAes128Cmac) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *PrfAes128Cmac) GetKeyLength() int {
+	return t.keyLength
+}
+
+func (t *PrfAes128Cmac) GetOutputLength() int {
+	return t.outputLength
+}
+
+// Init accepts keys of any length as defined in RFC 4615 - 3: a key which is
+// not 16 octets is replaced by its MAC under the all-zero key.
+func (t *PrfAes128Cmac) Init(key []byte) hash.Hash {
+	if len(key) != aesPrfKeyLength {
+		key = macWithZeroKey(lib.NewCMAC, key)
+	}
+
+	mac, err := lib.NewCMAC(key)
+	if err != nil {
+		return nil
+	}
+	return mac
+}
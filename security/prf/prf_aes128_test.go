@@ -0,0 +1,81 @@
+package prf
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Test vectors from RFC 4434 section 4 and RFC 4615 section 4
+func TestPrfAes128(t *testing.T) {
+	message := make([]byte, 20)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	key := []byte{
+		0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+		0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+		0xed, 0xcb,
+	}
+
+	testCases := []struct {
+		description string
+		algo        string
+		key         []byte
+		expected    string
+	}{
+		{
+			description: "PRF_AES128_XCBC with 16 octets key",
+			algo:        PRF_AES128_XCBC,
+			key:         key[:16],
+			expected:    "47f51b4564966215b8985c63055ed308",
+		},
+		{
+			description: "PRF_AES128_XCBC with 10 octets key",
+			algo:        PRF_AES128_XCBC,
+			key:         key[:10],
+			expected:    "0fa087af7d866e7653434e602fdde835",
+		},
+		{
+			description: "PRF_AES128_XCBC with 18 octets key",
+			algo:        PRF_AES128_XCBC,
+			key:         key,
+			expected:    "8cd3c93ae598a9803006ffb67c40e9e4",
+		},
+		{
+			description: "PRF_AES128_CMAC with 16 octets key",
+			algo:        PRF_AES128_CMAC,
+			key:         key[:16],
+			expected:    "980ae87b5f4c9c5214f5b6a8455e4c2d",
+		},
+		{
+			description: "PRF_AES128_CMAC with 10 octets key",
+			algo:        PRF_AES128_CMAC,
+			key:         key[:10],
+			expected:    "290d9e112edb09ee141fcf64c0b72f3d",
+		},
+		{
+			description: "PRF_AES128_CMAC with 18 octets key",
+			algo:        PRF_AES128_CMAC,
+			key:         key,
+			expected:    "84a348a4a45d235babfffc0d2b4da09a",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			prfType := StrToType(tc.algo)
+			require.NotNil(t, prfType)
+			require.Equal(t, prfType, DecodeTransform(ToTransform(prfType)))
+
+			prf := prfType.Init(tc.key)
+			require.NotNil(t, prf)
+			_, err := prf.Write(message)
+			require.NoError(t, err)
+			out := prf.Sum(nil)
+			require.Len(t, out, prfType.GetOutputLength())
+			require.Equal(t, tc.expected, hex.EncodeToString(out))
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package prf
+
+import (
+	"hash"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security/lib"
+)
+
+func toString_PRF_AES128_XCBC(attrType uint16, intValue uint16, bytesValue []byte) string {
+	return PRF_AES128_XCBC
+}
+
+var _ PRFType = &PrfAes128Xcbc{}
+
+type PrfAes128Xcbc struct {
+	keyLength    int
+	outputLength int
+}
+
+func (t *PrfAes128Xcbc) TransformID() uint16 {
+	return message.PRF_AES128_XCBC
+}
+
+func (t *PrfAes128Xcbc) getAttribute() (bool, uint16, uint16, []byte) {
+	return false, 0, 0, nil
+}
+
+func (t *PrfAes128Xcbc) GetKeyLength() int {
+	return t.keyLength
+}
+
+func (t *PrfAes128Xcbc) GetOutputLength() int {
+	return t.outputLength
+}
+
+// Init accepts keys of any length as defined in RFC 4434 - 2: a shorter key is
+// padded with zero octets, and a longer key is replaced by its MAC under the
+// all-zero key.
+func (t *PrfAes128Xcbc) Init(key []byte) hash.Hash {
+	switch {
+	case len(key) < aesPrfKeyLength:
+		key = append(append(make([]byte, 0, aesPrfKeyLength), key...),
+			make([]byte, aesPrfKeyLength-len(key))...)
+	case len(key) > aesPrfKeyLength:
+		key = macWithZeroKey(lib.NewXCBC, key)
+	}
+
+	mac, err := lib.NewXCBC(key)
+	if err != nil {
+		return nil
+	}
+	return mac
+}
+
+const aesPrfKeyLength = 16
+
+func macWithZeroKey(newMac func([]byte) (hash.Hash, error), data []byte) []byte {
+	mac, err := newMac(make([]byte, aesPrfKeyLength))
+	if err != nil {
+		return nil
+	}
+	if _, err = mac.Write(data); err != nil {
+		return nil
+	}
+	return mac.Sum(nil)
+}
@@ -0,0 +1,76 @@
+package prf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// Test vectors from RFC 4231 section 4, as referenced by RFC 4868 section 2.7.1
+func TestPrfHmacSha2(t *testing.T) {
+	testCases := []struct {
+		description string
+		algo        string
+		transformID uint16
+		key         []byte
+		data        []byte
+		expected    string
+	}{
+		{
+			description: "PRF_HMAC_SHA2_384 test case 1",
+			algo:        PRF_HMAC_SHA2_384,
+			transformID: message.PRF_HMAC_SHA2_384,
+			key:         bytes.Repeat([]byte{0x0b}, 20),
+			data:        []byte("Hi There"),
+			expected: "afd03944d84895626b0825f4ab46907f15f9dadbe4101ec6" +
+				"82aa034c7cebc59cfaea9ea9076ede7f4af152e8b2fa9cb6",
+		},
+		{
+			description: "PRF_HMAC_SHA2_384 test case 2",
+			algo:        PRF_HMAC_SHA2_384,
+			transformID: message.PRF_HMAC_SHA2_384,
+			key:         []byte("Jefe"),
+			data:        []byte("what do ya want for nothing?"),
+			expected: "af45d2e376484031617f78d2b58a6b1b9c7ef464f5a01b47" +
+				"e42ec3736322445e8e2240ca5e69e2c78b3239ecfab21649",
+		},
+		{
+			description: "PRF_HMAC_SHA2_512 test case 1",
+			algo:        PRF_HMAC_SHA2_512,
+			transformID: message.PRF_HMAC_SHA2_512,
+			key:         bytes.Repeat([]byte{0x0b}, 20),
+			data:        []byte("Hi There"),
+			expected: "87aa7cdea5ef619d4ff0b4241a1d6cb02379f4e2ce4ec2787ad0b30545e17cde" +
+				"daa833b7d6b8a702038b274eaea3f4e4be9d914eeb61f1702e696c203a126854",
+		},
+		{
+			description: "PRF_HMAC_SHA2_512 test case 2",
+			algo:        PRF_HMAC_SHA2_512,
+			transformID: message.PRF_HMAC_SHA2_512,
+			key:         []byte("Jefe"),
+			data:        []byte("what do ya want for nothing?"),
+			expected: "164b7a7bfcf819e2e395fbe73b56e0a387bd64222e831fd610270cd7ea250554" +
+				"9758bf75c05a994a6d034f65f8f0e6fdcaeab1a34d4a6b4b636e070a38bce737",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			prfType := StrToType(tc.algo)
+			require.NotNil(t, prfType)
+			require.Equal(t, tc.transformID, prfType.TransformID())
+			require.Equal(t, prfType, DecodeTransform(ToTransform(prfType)))
+
+			prf := prfType.Init(tc.key)
+			_, err := prf.Write(tc.data)
+			require.NoError(t, err)
+			out := prf.Sum(nil)
+			require.Len(t, out, prfType.GetOutputLength())
+			require.Equal(t, tc.expected, hex.EncodeToString(out))
+		})
+	}
+}
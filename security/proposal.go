@@ -0,0 +1,319 @@
+package security
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security/dh"
+	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
+	"github.com/guoweifk/n3iwue_ike_gw/security/esn"
+	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+	"github.com/guoweifk/n3iwue_ike_gw/security/prf"
+)
+
+// IKESASuite is one combination of transforms acceptable for an IKE SA. A
+// local policy is a list of suites in order of preference.
+type IKESASuite struct {
+	EncrInfo  encr.ENCRType
+	IntegInfo integ.INTEGType // nil with AEAD EncrInfo
+	PrfInfo   prf.PRFType
+	DhInfo    dh.DHType
+}
+
+// ChildSASuite is one combination of transforms acceptable for a Child SA
+type ChildSASuite struct {
+	DhInfo     dh.DHType // nil if PFS is not used
+	EncrKInfo  encr.ENCRKType
+	IntegKInfo integ.INTEGKType // nil with AEAD EncrKInfo
+	EsnInfo    esn.ESN
+}
+
+// NewIKESASuite builds a suite from the transform names of each package, with
+// an empty integrity name for AEAD algorithms
+func NewIKESASuite(encrName, integName, prfName, dhName string) (*IKESASuite, error) {
+	suite := new(IKESASuite)
+	if suite.EncrInfo = encr.StrToType(encrName); suite.EncrInfo == nil {
+		return nil, errors.Errorf("NewIKESASuite : Unsupported encryption algorithm %q", encrName)
+	}
+	if integName != "" {
+		if suite.IntegInfo = integ.StrToType(integName); suite.IntegInfo == nil {
+			return nil, errors.Errorf("NewIKESASuite : Unsupported integrity algorithm %q", integName)
+		}
+	}
+	if suite.EncrInfo.IsAEAD() != (suite.IntegInfo == nil) {
+		return nil, errors.Errorf("NewIKESASuite : Integrity algorithm must be given with non-AEAD encryption only")
+	}
+	if suite.PrfInfo = prf.StrToType(prfName); suite.PrfInfo == nil {
+		return nil, errors.Errorf("NewIKESASuite : Unsupported pseudorandom function %q", prfName)
+	}
+	if suite.DhInfo = dh.StrToType(dhName); suite.DhInfo == nil {
+		return nil, errors.Errorf("NewIKESASuite : Unsupported Diffie-Hellman group %q", dhName)
+	}
+	return suite, nil
+}
+
+// NewChildSASuite builds a suite from the transform names of each package,
+// with an empty integrity name for AEAD algorithms and an empty Diffie-Hellman
+// group name without PFS
+func NewChildSASuite(encrName, integName, dhName, esnName string) (*ChildSASuite, error) {
+	suite := new(ChildSASuite)
+	if suite.EncrKInfo = encr.StrToKType(encrName); suite.EncrKInfo == nil {
+		return nil, errors.Errorf("NewChildSASuite : Unsupported encryption algorithm %q", encrName)
+	}
+	if integName != "" {
+		if suite.IntegKInfo = integ.StrToKType(integName); suite.IntegKInfo == nil {
+			return nil, errors.Errorf("NewChildSASuite : Unsupported integrity algorithm %q", integName)
+		}
+	}
+	if suite.EncrKInfo.IsAEAD() != (suite.IntegKInfo == nil) {
+		return nil, errors.Errorf("NewChildSASuite : Integrity algorithm must be given with non-AEAD encryption only")
+	}
+	if dhName != "" {
+		if suite.DhInfo = dh.StrToType(dhName); suite.DhInfo == nil {
+			return nil, errors.Errorf("NewChildSASuite : Unsupported Diffie-Hellman group %q", dhName)
+		}
+	}
+	var err error
+	if suite.EsnInfo, err = esn.StrToType(esnName); err != nil {
+		return nil, errors.Wrapf(err, "NewChildSASuite")
+	}
+	return suite, nil
+}
+
+// ProposalError reports a failed negotiation with the notification to be sent
+// to the peer: NO_PROPOSAL_CHOSEN, or INVALID_KE_PAYLOAD with the group the
+// peer should retry with.
+type ProposalError struct {
+	NotifyMessageType uint16
+	DhGroup           uint16 // preferred group of INVALID_KE_PAYLOAD
+}
+
+func (e *ProposalError) Error() string {
+	if e.NotifyMessageType == message.INVALID_KE_PAYLOAD {
+		return fmt.Sprintf("proposal negotiation: INVALID_KE_PAYLOAD, expect Diffie-Hellman group %d", e.DhGroup)
+	}
+	return "proposal negotiation: NO_PROPOSAL_CHOSEN"
+}
+
+// BuildNotification appends the notification of the error to container
+func (e *ProposalError) BuildNotification(container *message.IKEPayloadContainer) {
+	var notificationData []byte
+	if e.NotifyMessageType == message.INVALID_KE_PAYLOAD {
+		notificationData = make([]byte, 2)
+		binary.BigEndian.PutUint16(notificationData, e.DhGroup)
+	}
+	container.BuildNotification(message.TypeNone, e.NotifyMessageType, nil, notificationData)
+}
+
+// SelectIKESAProposal chooses a proposal of the received SA acceptable to the
+// policy. keyExchangeGroup is the group of the received KE payload.
+//
+// The first suite, in policy order, offered by the peer with the group of the
+// KE payload is chosen. If suites are only offered with other groups, a
+// ProposalError with INVALID_KE_PAYLOAD and the group of the most preferred
+// one is returned, otherwise NO_PROPOSAL_CHOSEN.
+//
+// The returned proposal holds one transform of each type, and keeps the
+// proposal number and SPI of the received one.
+func SelectIKESAProposal(
+	policy []*IKESASuite,
+	securityAssociation *message.SecurityAssociation,
+	keyExchangeGroup uint16,
+) (*message.Proposal, error) {
+	if securityAssociation == nil {
+		return nil, errors.Errorf("SelectIKESAProposal : security association is nil")
+	}
+
+	var invalidKE *ProposalError
+	for _, suite := range policy {
+		for _, proposal := range securityAssociation.Proposals {
+			if proposal.ProtocolID != message.TypeIKE || !suite.offeredBy(proposal) {
+				continue
+			}
+			if suite.DhInfo.TransformID() != keyExchangeGroup {
+				if invalidKE == nil {
+					invalidKE = &ProposalError{
+						NotifyMessageType: message.INVALID_KE_PAYLOAD,
+						DhGroup:           suite.DhInfo.TransformID(),
+					}
+				}
+				continue
+			}
+
+			chosen, err := suite.ToProposal(proposal.ProposalNumber, proposal.SPI)
+			if err != nil {
+				return nil, errors.Wrapf(err, "SelectIKESAProposal")
+			}
+			return chosen, nil
+		}
+	}
+
+	if invalidKE != nil {
+		return nil, invalidKE
+	}
+	return nil, &ProposalError{NotifyMessageType: message.NO_PROPOSAL_CHOSEN}
+}
+
+// SelectChildSAProposal chooses an ESP proposal of the received SA acceptable
+// to the policy, in the same way as SelectIKESAProposal. keyExchangeGroup is
+// DH_NONE if the request has no KE payload.
+func SelectChildSAProposal(
+	policy []*ChildSASuite,
+	securityAssociation *message.SecurityAssociation,
+	keyExchangeGroup uint16,
+) (*message.Proposal, error) {
+	if securityAssociation == nil {
+		return nil, errors.Errorf("SelectChildSAProposal : security association is nil")
+	}
+
+	var invalidKE *ProposalError
+	for _, suite := range policy {
+		for _, proposal := range securityAssociation.Proposals {
+			if proposal.ProtocolID != message.TypeESP || len(proposal.SPI) != 4 ||
+				!suite.offeredBy(proposal) {
+				continue
+			}
+			var suiteGroup uint16 = message.DH_NONE
+			if suite.DhInfo != nil {
+				suiteGroup = suite.DhInfo.TransformID()
+			}
+			if suiteGroup != keyExchangeGroup {
+				// Without PFS, the missing KE payload can not be asked for
+				if invalidKE == nil && suiteGroup != message.DH_NONE {
+					invalidKE = &ProposalError{
+						NotifyMessageType: message.INVALID_KE_PAYLOAD,
+						DhGroup:           suiteGroup,
+					}
+				}
+				continue
+			}
+
+			chosen, err := suite.ToProposal(proposal.ProposalNumber, proposal.SPI)
+			if err != nil {
+				return nil, errors.Wrapf(err, "SelectChildSAProposal")
+			}
+			return chosen, nil
+		}
+	}
+
+	if invalidKE != nil {
+		return nil, invalidKE
+	}
+	return nil, &ProposalError{NotifyMessageType: message.NO_PROPOSAL_CHOSEN}
+}
+
+func (suite *IKESASuite) offeredBy(proposal *message.Proposal) bool {
+	if !containsTransform(proposal.EncryptionAlgorithm, func(t *message.Transform) bool {
+		return encr.DecodeTransform(t) == suite.EncrInfo
+	}) {
+		return false
+	}
+	if !containsTransform(proposal.PseudorandomFunction, func(t *message.Transform) bool {
+		return prf.DecodeTransform(t) == suite.PrfInfo
+	}) {
+		return false
+	}
+	if !containsTransform(proposal.DiffieHellmanGroup, func(t *message.Transform) bool {
+		return dh.DecodeTransform(t) == suite.DhInfo
+	}) {
+		return false
+	}
+	if suite.IntegInfo == nil {
+		return noneOrEmpty(proposal.IntegrityAlgorithm, message.AUTH_NONE)
+	}
+	return containsTransform(proposal.IntegrityAlgorithm, func(t *message.Transform) bool {
+		return integ.DecodeTransform(t) == suite.IntegInfo
+	})
+}
+
+// ToProposal returns the suite as a proposal with one transform of each type
+func (suite *IKESASuite) ToProposal(proposalNumber uint8, spi []byte) (*message.Proposal, error) {
+	p := &message.Proposal{
+		ProposalNumber: proposalNumber,
+		ProtocolID:     message.TypeIKE,
+		SPI:            append([]byte{}, spi...),
+	}
+	encrTransform, err := encr.ToTransform(suite.EncrInfo)
+	if err != nil {
+		return nil, err
+	}
+	p.EncryptionAlgorithm = append(p.EncryptionAlgorithm, encrTransform)
+	p.PseudorandomFunction = append(p.PseudorandomFunction, prf.ToTransform(suite.PrfInfo))
+	if suite.IntegInfo != nil {
+		p.IntegrityAlgorithm = append(p.IntegrityAlgorithm, integ.ToTransform(suite.IntegInfo))
+	}
+	p.DiffieHellmanGroup = append(p.DiffieHellmanGroup, dh.ToTransform(suite.DhInfo))
+	return p, nil
+}
+
+func (suite *ChildSASuite) offeredBy(proposal *message.Proposal) bool {
+	if !containsTransform(proposal.EncryptionAlgorithm, func(t *message.Transform) bool {
+		return encr.DecodeTransformChildSA(t) == suite.EncrKInfo
+	}) {
+		return false
+	}
+	if !containsTransform(proposal.ExtendedSequenceNumbers, func(t *message.Transform) bool {
+		esnInfo, err := esn.DecodeTransform(t)
+		return err == nil && esnInfo == suite.EsnInfo
+	}) {
+		return false
+	}
+	if suite.IntegKInfo == nil {
+		if !noneOrEmpty(proposal.IntegrityAlgorithm, message.AUTH_NONE) {
+			return false
+		}
+	} else if !containsTransform(proposal.IntegrityAlgorithm, func(t *message.Transform) bool {
+		return integ.DecodeTransformChildSA(t) == suite.IntegKInfo
+	}) {
+		return false
+	}
+	if suite.DhInfo == nil {
+		return noneOrEmpty(proposal.DiffieHellmanGroup, message.DH_NONE)
+	}
+	return containsTransform(proposal.DiffieHellmanGroup, func(t *message.Transform) bool {
+		return dh.DecodeTransform(t) == suite.DhInfo
+	})
+}
+
+// ToProposal returns the suite as an ESP proposal with one transform of each
+// type
+func (suite *ChildSASuite) ToProposal(proposalNumber uint8, spi []byte) (*message.Proposal, error) {
+	p := &message.Proposal{
+		ProposalNumber: proposalNumber,
+		ProtocolID:     message.TypeESP,
+		SPI:            append([]byte{}, spi...),
+	}
+	encrTransform, err := encr.ToTransformChildSA(suite.EncrKInfo)
+	if err != nil {
+		return nil, err
+	}
+	p.EncryptionAlgorithm = append(p.EncryptionAlgorithm, encrTransform)
+	if suite.IntegKInfo != nil {
+		p.IntegrityAlgorithm = append(p.IntegrityAlgorithm, integ.ToTransformChildSA(suite.IntegKInfo))
+	}
+	if suite.DhInfo != nil {
+		p.DiffieHellmanGroup = append(p.DiffieHellmanGroup, dh.ToTransform(suite.DhInfo))
+	}
+	p.ExtendedSequenceNumbers = append(p.ExtendedSequenceNumbers, esn.ToTransform(suite.EsnInfo))
+	return p, nil
+}
+
+func containsTransform(transforms message.TransformContainer, match func(*message.Transform) bool) bool {
+	for _, t := range transforms {
+		if match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// noneOrEmpty reports whether a transform type is omitted, or offered with
+// the NONE transform ID (RFC 7296 - 3.3.3)
+func noneOrEmpty(transforms message.TransformContainer, noneID uint16) bool {
+	return len(transforms) == 0 || containsTransform(transforms, func(t *message.Transform) bool {
+		return t.TransformID == noneID
+	})
+}
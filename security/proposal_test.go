@@ -0,0 +1,234 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security/dh"
+	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
+	"github.com/guoweifk/n3iwue_ike_gw/security/esn"
+	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+	"github.com/guoweifk/n3iwue_ike_gw/security/prf"
+)
+
+func mustIKESASuite(t *testing.T, encrName, integName, prfName, dhName string) *IKESASuite {
+	suite, err := NewIKESASuite(encrName, integName, prfName, dhName)
+	require.NoError(t, err)
+	return suite
+}
+
+func mustChildSASuite(t *testing.T, encrName, integName, dhName, esnName string) *ChildSASuite {
+	suite, err := NewChildSASuite(encrName, integName, dhName, esnName)
+	require.NoError(t, err)
+	return suite
+}
+
+func buildIKEProposal(t *testing.T, sa *message.SecurityAssociation, number uint8,
+	encrNames, integNames, prfNames, dhNames []string,
+) *message.Proposal {
+	proposal := sa.Proposals.BuildProposal(number, message.TypeIKE, nil)
+	for _, name := range encrNames {
+		transform, err := encr.ToTransform(encr.StrToType(name))
+		require.NoError(t, err)
+		proposal.EncryptionAlgorithm = append(proposal.EncryptionAlgorithm, transform)
+	}
+	for _, name := range integNames {
+		proposal.IntegrityAlgorithm = append(proposal.IntegrityAlgorithm, integ.ToTransform(integ.StrToType(name)))
+	}
+	for _, name := range prfNames {
+		proposal.PseudorandomFunction = append(proposal.PseudorandomFunction, prf.ToTransform(prf.StrToType(name)))
+	}
+	for _, name := range dhNames {
+		proposal.DiffieHellmanGroup = append(proposal.DiffieHellmanGroup, dh.ToTransform(dh.StrToType(name)))
+	}
+	return proposal
+}
+
+func TestSelectIKESAProposal(t *testing.T) {
+	sa := new(message.SecurityAssociation)
+	buildIKEProposal(t, sa, 1,
+		[]string{encr.ENCR_AES_CBC_128, encr.ENCR_AES_CBC_256},
+		[]string{integ.AUTH_HMAC_SHA1_96, integ.AUTH_HMAC_SHA2_256_128},
+		[]string{prf.PRF_HMAC_SHA1},
+		[]string{dh.DH_1024_BIT_MODP})
+	aeadProposal := buildIKEProposal(t, sa, 2,
+		[]string{encr.ENCR_AES_GCM_16_256},
+		nil,
+		[]string{prf.PRF_HMAC_SHA2_256},
+		[]string{dh.DH_2048_BIT_MODP, dh.DH_256_BIT_RANDOM_ECP})
+	aeadProposal.IntegrityAlgorithm.BuildTransform(message.TypeIntegrityAlgorithm, message.AUTH_NONE, nil, nil, nil)
+
+	policy := []*IKESASuite{
+		mustIKESASuite(t, encr.ENCR_AES_GCM_16_256, "", prf.PRF_HMAC_SHA2_256, dh.DH_256_BIT_RANDOM_ECP),
+		mustIKESASuite(t, encr.ENCR_AES_CBC_256, integ.AUTH_HMAC_SHA2_256_128,
+			prf.PRF_HMAC_SHA1, dh.DH_1024_BIT_MODP),
+		mustIKESASuite(t, encr.ENCR_AES_GCM_16_256, "", prf.PRF_HMAC_SHA2_256, dh.DH_2048_BIT_MODP),
+	}
+
+	testCases := []struct {
+		description      string
+		keyExchangeGroup uint16
+		proposalNumber   uint8
+		expected         *IKESASuite
+	}{
+		{
+			description:      "most preferred suite",
+			keyExchangeGroup: message.DH_256_BIT_RANDOM_ECP,
+			proposalNumber:   2,
+			expected:         policy[0],
+		},
+		{
+			description:      "suite matching the KE payload",
+			keyExchangeGroup: message.DH_1024_BIT_MODP,
+			proposalNumber:   1,
+			expected:         policy[1],
+		},
+		{
+			description:      "suite matching the KE payload in the same proposal",
+			keyExchangeGroup: message.DH_2048_BIT_MODP,
+			proposalNumber:   2,
+			expected:         policy[2],
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			chosen, err := SelectIKESAProposal(policy, sa, tc.keyExchangeGroup)
+			require.NoError(t, err)
+			require.Equal(t, tc.proposalNumber, chosen.ProposalNumber)
+
+			expected, err := tc.expected.ToProposal(tc.proposalNumber, nil)
+			require.NoError(t, err)
+			require.Equal(t, expected, chosen)
+
+			// The chosen proposal can be used to set up the IKE SA directly
+			_, peerPublicValue := generatePeerPublicValue(t, tc.expected.DhInfo)
+			ikesaKey, _, err := NewIKESAKey(chosen, peerPublicValue, []byte{0x01, 0x02, 0x03, 0x04}, 0x123, 0x456)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected.EncrInfo, ikesaKey.EncrInfo)
+			require.Equal(t, tc.expected.IntegInfo, ikesaKey.IntegInfo)
+		})
+	}
+
+	// Acceptable suites exist, but with another group than the KE payload
+	_, err := SelectIKESAProposal(policy, sa, message.DH_384_BIT_RANDOM_ECP)
+	var proposalErr *ProposalError
+	require.True(t, errors.As(err, &proposalErr))
+	require.Equal(t, uint16(message.INVALID_KE_PAYLOAD), proposalErr.NotifyMessageType)
+	require.Equal(t, uint16(message.DH_256_BIT_RANDOM_ECP), proposalErr.DhGroup)
+
+	var container message.IKEPayloadContainer
+	proposalErr.BuildNotification(&container)
+	require.Equal(t, message.IKEPayloadContainer{
+		&message.Notification{
+			ProtocolID:        message.TypeNone,
+			NotifyMessageType: message.INVALID_KE_PAYLOAD,
+			NotificationData:  []byte{0x00, 0x13},
+		},
+	}, container)
+
+	// No acceptable suite
+	_, err = SelectIKESAProposal(policy[1:2], &message.SecurityAssociation{
+		Proposals: sa.Proposals[1:],
+	}, message.DH_2048_BIT_MODP)
+	require.True(t, errors.As(err, &proposalErr))
+	require.Equal(t, uint16(message.NO_PROPOSAL_CHOSEN), proposalErr.NotifyMessageType)
+}
+
+func TestSelectIKESAProposalAEADIntegrity(t *testing.T) {
+	sa := new(message.SecurityAssociation)
+	buildIKEProposal(t, sa, 1,
+		[]string{encr.ENCR_AES_GCM_16_128},
+		[]string{integ.AUTH_HMAC_SHA2_256_128},
+		[]string{prf.PRF_HMAC_SHA2_256},
+		[]string{dh.DH_2048_BIT_MODP})
+
+	policy := []*IKESASuite{
+		mustIKESASuite(t, encr.ENCR_AES_GCM_16_128, "", prf.PRF_HMAC_SHA2_256, dh.DH_2048_BIT_MODP),
+	}
+
+	// Combined mode algorithm offered only with an integrity algorithm
+	_, err := SelectIKESAProposal(policy, sa, message.DH_2048_BIT_MODP)
+	var proposalErr *ProposalError
+	require.True(t, errors.As(err, &proposalErr))
+	require.Equal(t, uint16(message.NO_PROPOSAL_CHOSEN), proposalErr.NotifyMessageType)
+}
+
+func TestSelectChildSAProposal(t *testing.T) {
+	sa := new(message.SecurityAssociation)
+	spi := []byte{0xc6, 0x74, 0x91, 0x8a}
+
+	proposal := sa.Proposals.BuildProposal(1, message.TypeESP, spi)
+	for _, name := range []string{encr.ENCR_AES_CBC_128, encr.ENCR_AES_CBC_256} {
+		transform, err := encr.ToTransformChildSA(encr.StrToKType(name))
+		require.NoError(t, err)
+		proposal.EncryptionAlgorithm = append(proposal.EncryptionAlgorithm, transform)
+	}
+	proposal.IntegrityAlgorithm = append(proposal.IntegrityAlgorithm,
+		integ.ToTransformChildSA(integ.StrToKType(integ.AUTH_HMAC_SHA2_256_128)))
+	proposal.DiffieHellmanGroup = append(proposal.DiffieHellmanGroup,
+		dh.ToTransform(dh.StrToType(dh.DH_2048_BIT_MODP)))
+	proposal.DiffieHellmanGroup.BuildTransform(message.TypeDiffieHellmanGroup, message.DH_NONE, nil, nil, nil)
+	esnDisable, err := esn.StrToType(esn.String_ESN_DISABLE)
+	require.NoError(t, err)
+	proposal.ExtendedSequenceNumbers = append(proposal.ExtendedSequenceNumbers, esn.ToTransform(esnDisable))
+
+	noPFS := mustChildSASuite(t, encr.ENCR_AES_CBC_256, integ.AUTH_HMAC_SHA2_256_128, "", esn.String_ESN_DISABLE)
+	pfs := mustChildSASuite(t, encr.ENCR_AES_CBC_256, integ.AUTH_HMAC_SHA2_256_128,
+		dh.DH_2048_BIT_MODP, esn.String_ESN_DISABLE)
+
+	// Without KE payload
+	chosen, err := SelectChildSAProposal([]*ChildSASuite{pfs, noPFS}, sa, message.DH_NONE)
+	require.NoError(t, err)
+	require.Equal(t, uint8(1), chosen.ProposalNumber)
+	require.Equal(t, spi, chosen.SPI)
+	require.Empty(t, chosen.DiffieHellmanGroup)
+
+	childsaKey, err := NewChildSAKeyByProposal(chosen)
+	require.NoError(t, err)
+	require.Equal(t, noPFS.EncrKInfo, childsaKey.EncrKInfo)
+	require.Equal(t, noPFS.IntegKInfo, childsaKey.IntegKInfo)
+
+	// With KE payload
+	chosen, err = SelectChildSAProposal([]*ChildSASuite{noPFS, pfs}, sa, message.DH_2048_BIT_MODP)
+	require.NoError(t, err)
+	require.Len(t, chosen.DiffieHellmanGroup, 1)
+	require.Equal(t, uint16(message.DH_2048_BIT_MODP), chosen.DiffieHellmanGroup[0].TransformID)
+
+	// PFS is required, but the KE payload is missing
+	_, err = SelectChildSAProposal([]*ChildSASuite{pfs}, sa, message.DH_NONE)
+	var proposalErr *ProposalError
+	require.True(t, errors.As(err, &proposalErr))
+	require.Equal(t, uint16(message.INVALID_KE_PAYLOAD), proposalErr.NotifyMessageType)
+	require.Equal(t, uint16(message.DH_2048_BIT_MODP), proposalErr.DhGroup)
+
+	// ESN is not offered
+	esnRequired := mustChildSASuite(t, encr.ENCR_AES_CBC_256, integ.AUTH_HMAC_SHA2_256_128, "", esn.String_ESN_ENABLE)
+	_, err = SelectChildSAProposal([]*ChildSASuite{esnRequired}, sa, message.DH_NONE)
+	require.True(t, errors.As(err, &proposalErr))
+	require.Equal(t, uint16(message.NO_PROPOSAL_CHOSEN), proposalErr.NotifyMessageType)
+}
+
+func TestNewSuite(t *testing.T) {
+	_, err := NewIKESASuite(encr.ENCR_AES_CBC_128, "", prf.PRF_HMAC_SHA1, dh.DH_2048_BIT_MODP)
+	require.Error(t, err)
+	_, err = NewIKESASuite(encr.ENCR_AES_GCM_16_128, integ.AUTH_HMAC_SHA1_96, prf.PRF_HMAC_SHA1, dh.DH_2048_BIT_MODP)
+	require.Error(t, err)
+	_, err = NewIKESASuite(encr.ENCR_AES_CBC_128, integ.AUTH_HMAC_SHA1_96, prf.PRF_HMAC_SHA1, "DH_UNKNOWN")
+	require.Error(t, err)
+	_, err = NewChildSASuite(encr.ENCR_AES_GCM_16_128, "", "", "ESN_UNKNOWN")
+	require.Error(t, err)
+	_, err = NewChildSASuite(encr.ENCR_AES_GCM_16_128, "", "", esn.String_ESN_ENABLE)
+	require.NoError(t, err)
+}
+
+func generatePeerPublicValue(t *testing.T, dhType dh.DHType) (dh.Secret, []byte) {
+	secret, err := dh.GenerateSecret(dhType)
+	require.NoError(t, err)
+	publicValue, err := dhType.GetPublicValue(secret)
+	require.NoError(t, err)
+	return secret, publicValue
+}
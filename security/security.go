@@ -98,12 +98,16 @@ type IKESAKey struct {
 }
 
 func (ikesaKey *IKESAKey) String() string {
+	var integID uint16
+	if ikesaKey.IntegInfo != nil {
+		integID = ikesaKey.IntegInfo.TransformID()
+	}
 	return "\nEncryption Algorithm: " +
 		strconv.FormatUint(uint64(ikesaKey.EncrInfo.TransformID()), 10) +
 		"\nSK_ei: " + hex.EncodeToString(ikesaKey.SK_ei) +
 		"\nSK_er: " + hex.EncodeToString(ikesaKey.SK_er) +
 		"\nIntegrity Algorithm: " +
-		strconv.FormatUint(uint64(ikesaKey.IntegInfo.TransformID()), 10) +
+		strconv.FormatUint(uint64(integID), 10) +
 		"\nSK_ai: " + hex.EncodeToString(ikesaKey.SK_ai) +
 		"\nSK_ar: " + hex.EncodeToString(ikesaKey.SK_ar) +
 		"\nSK_pi: " + hex.EncodeToString(ikesaKey.SK_pi) +
@@ -121,60 +125,84 @@ func (ikesaKey *IKESAKey) ToProposal() (*message.Proposal, error) {
 		return nil, errors.Wrapf(err, "IKESAKey ToProposal")
 	}
 	p.EncryptionAlgorithm = append(p.EncryptionAlgorithm, encrTranform)
-	p.IntegrityAlgorithm = append(p.IntegrityAlgorithm, integ.ToTransform(ikesaKey.IntegInfo))
+	if ikesaKey.IntegInfo != nil {
+		p.IntegrityAlgorithm = append(p.IntegrityAlgorithm, integ.ToTransform(ikesaKey.IntegInfo))
+	}
 	return p, nil
 }
 
-// return IKESAKey and local public value
-func NewIKESAKey(
-	proposal *message.Proposal,
-	keyExchangeData, concatenatedNonce []byte,
-	initiatorSPI, responderSPI uint64,
-) (*IKESAKey, []byte, error) {
+// NewIKESAKeyByProposal sets the transform types of the proposal only. The
+// keys are generated by GenerateKeyForIKESA afterwards.
+func NewIKESAKeyByProposal(proposal *message.Proposal) (*IKESAKey, error) {
 	if proposal == nil {
-		return nil, nil, errors.Errorf("NewIKESAKey : proposal is nil")
+		return nil, errors.Errorf("NewIKESAKeyByProposal : proposal is nil")
 	}
 	if len(proposal.DiffieHellmanGroup) == 0 {
-		return nil, nil, errors.Errorf("NewIKESAKey : DiffieHellmanGroup is nil")
+		return nil, errors.Errorf("NewIKESAKeyByProposal : DiffieHellmanGroup is nil")
 	}
 
 	if len(proposal.EncryptionAlgorithm) == 0 {
-		return nil, nil, errors.Errorf("NewIKESAKey : EncryptionAlgorithm is nil")
-	}
-
-	if len(proposal.IntegrityAlgorithm) == 0 {
-		return nil, nil, errors.Errorf("NewIKESAKey : IntegrityAlgorithm is nil")
+		return nil, errors.Errorf("NewIKESAKeyByProposal : EncryptionAlgorithm is nil")
 	}
 
 	if len(proposal.PseudorandomFunction) == 0 {
-		return nil, nil, errors.Errorf("NewIKESAKey : PseudorandomFunction is nil")
+		return nil, errors.Errorf("NewIKESAKeyByProposal : PseudorandomFunction is nil")
 	}
 
 	ikesaKey := new(IKESAKey)
 	ikesaKey.DhInfo = dh.DecodeTransform(proposal.DiffieHellmanGroup[0])
 	if ikesaKey.DhInfo == nil {
-		return nil, nil, errors.Errorf("NewIKESAKey : Get unsupport DiffieHellmanGroup[%v]",
+		return nil, errors.Errorf("NewIKESAKeyByProposal : Get unsupport DiffieHellmanGroup[%v]",
 			proposal.DiffieHellmanGroup[0].TransformID)
 	}
 
 	ikesaKey.EncrInfo = encr.DecodeTransform(proposal.EncryptionAlgorithm[0])
 	if ikesaKey.EncrInfo == nil {
-		return nil, nil, errors.Errorf("NewIKESAKey : Get unsupport EncryptionAlgorithm[%v]",
+		return nil, errors.Errorf("NewIKESAKeyByProposal : Get unsupport EncryptionAlgorithm[%v]",
 			proposal.EncryptionAlgorithm[0].TransformID)
 	}
 
-	ikesaKey.IntegInfo = integ.DecodeTransform(proposal.IntegrityAlgorithm[0])
-	if ikesaKey.EncrInfo == nil {
-		return nil, nil, errors.Errorf("NewIKESAKey : Get unsupport IntegrityAlgorithm[%v]",
-			proposal.IntegrityAlgorithm[0].TransformID)
+	// RFC 5282 - 8: combined mode algorithms are proposed without integrity
+	// transform, or with AUTH_NONE
+	if ikesaKey.EncrInfo.IsAEAD() {
+		if len(proposal.IntegrityAlgorithm) != 0 &&
+			proposal.IntegrityAlgorithm[0].TransformID != message.AUTH_NONE {
+			return nil, errors.Errorf("NewIKESAKeyByProposal : Get IntegrityAlgorithm[%v] with AEAD EncryptionAlgorithm",
+				proposal.IntegrityAlgorithm[0].TransformID)
+		}
+	} else {
+		if len(proposal.IntegrityAlgorithm) == 0 {
+			return nil, errors.Errorf("NewIKESAKeyByProposal : IntegrityAlgorithm is nil")
+		}
+
+		ikesaKey.IntegInfo = integ.DecodeTransform(proposal.IntegrityAlgorithm[0])
+		if ikesaKey.IntegInfo == nil {
+			return nil, errors.Errorf("NewIKESAKeyByProposal : Get unsupport IntegrityAlgorithm[%v]",
+				proposal.IntegrityAlgorithm[0].TransformID)
+		}
 	}
 
 	ikesaKey.PrfInfo = prf.DecodeTransform(proposal.PseudorandomFunction[0])
 	if ikesaKey.PrfInfo == nil {
-		return nil, nil, errors.Errorf("NewIKESAKey : Get unsupport PseudorandomFunction[%v]",
+		return nil, errors.Errorf("NewIKESAKeyByProposal : Get unsupport PseudorandomFunction[%v]",
 			proposal.PseudorandomFunction[0].TransformID)
 	}
 
+	return ikesaKey, nil
+}
+
+// return IKESAKey and local public value. The first transform of each type is
+// used, so proposal should be the one chosen by SelectIKESAProposal.
+func NewIKESAKey(
+	proposal *message.Proposal,
+	keyExchangeData, concatenatedNonce []byte,
+	initiatorSPI, responderSPI uint64,
+) (*IKESAKey, []byte, error) {
+	ikesaKey, err := NewIKESAKeyByProposal(proposal)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "NewIKESAKey")
+	}
+
 	localPublicValue, sharedKeyData, err := CalculateDiffieHellmanMaterials(
 		ikesaKey, keyExchangeData)
 	if err != nil {
@@ -190,6 +218,33 @@ func NewIKESAKey(
 	return ikesaKey, localPublicValue, nil
 }
 
+// NewIKESAKeyByNonces is NewIKESAKey with the nonces given separately, as
+// needed by the AES based PRFs
+func NewIKESAKeyByNonces(
+	proposal *message.Proposal,
+	keyExchangeData, initiatorNonce, responderNonce []byte,
+	initiatorSPI, responderSPI uint64,
+) (*IKESAKey, []byte, error) {
+	ikesaKey, err := NewIKESAKeyByProposal(proposal)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "NewIKESAKeyByNonces")
+	}
+
+	localPublicValue, sharedKeyData, err := CalculateDiffieHellmanMaterials(
+		ikesaKey, keyExchangeData)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "NewIKESAKeyByNonces")
+	}
+
+	err = ikesaKey.GenerateKeyForIKESAByNonces(initiatorNonce, responderNonce, sharedKeyData,
+		initiatorSPI, responderSPI)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "NewIKESAKeyByNonces")
+	}
+
+	return ikesaKey, localPublicValue, nil
+}
+
 // CalculateDiffieHellmanMaterials generates secret and calculate Diffie-Hellman public key
 // exchange material.
 // Peer public value as parameter, return local public value and shared key.
@@ -197,51 +252,161 @@ func CalculateDiffieHellmanMaterials(
 	ikesaKey *IKESAKey,
 	peerPublicValue []byte,
 ) ([]byte, []byte, error) {
-	secret, err := GenerateRandomNumber()
+	secret, err := dh.GenerateSecret(ikesaKey.DhInfo)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "CalculateDiffieHellmanMaterials()")
+	}
+
+	localPublicValue, err := ikesaKey.DhInfo.GetPublicValue(secret)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "CalculateDiffieHellmanMaterials()")
+	}
+
+	sharedKey, err := ikesaKey.DhInfo.GetSharedKey(secret, peerPublicValue)
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "CalculateDiffieHellmanMaterials()")
 	}
 
-	peerPublicValueBig := new(big.Int).SetBytes(peerPublicValue)
-	return ikesaKey.DhInfo.GetPublicValue(secret), ikesaKey.DhInfo.GetSharedKey(secret, peerPublicValueBig), nil
+	return localPublicValue, sharedKey, nil
 }
 
+// GenerateKeyForIKESA derives the IKE SA keys with Ni | Nr as the key of
+// SKEYSEED. PRFs with a fixed key length use only the first 64 bits of each
+// nonce instead (RFC 7296 - 2.14), which needs GenerateKeyForIKESAByNonces.
 func (ikesaKey *IKESAKey) GenerateKeyForIKESA(
 	concatenatedNonce, diffieHellmanSharedKey []byte,
 	initiatorSPI, responderSPI uint64,
 ) error {
-	// Check parameters
+	return ikesaKey.generateKeyForIKESA(concatenatedNonce, concatenatedNonce,
+		diffieHellmanSharedKey, initiatorSPI, responderSPI)
+}
+
+// GenerateKeyForIKESAByNonces is GenerateKeyForIKESA with the nonces given
+// separately, so that the SKEYSEED key of AES based PRFs can be built
+func (ikesaKey *IKESAKey) GenerateKeyForIKESAByNonces(
+	initiatorNonce, responderNonce, diffieHellmanSharedKey []byte,
+	initiatorSPI, responderSPI uint64,
+) error {
 	if ikesaKey == nil {
 		return errors.Errorf("IKE SA is nil")
 	}
+	if ikesaKey.PrfInfo == nil {
+		return errors.Errorf("No pseudorandom function specified")
+	}
 
-	// Check if the context contain needed data
-	if ikesaKey.EncrInfo == nil {
-		return errors.Errorf("No encryption algorithm specified")
+	concatenatedNonce := append(append([]byte{}, initiatorNonce...), responderNonce...)
+	skeyseedKey := concatenatedNonce
+	if hasFixedKeyLength(ikesaKey.PrfInfo) {
+		const halfKeyLength = 8
+		if len(initiatorNonce) < halfKeyLength || len(responderNonce) < halfKeyLength {
+			return errors.Errorf("Nonce is too short for the pseudorandom function")
+		}
+		skeyseedKey = append(append([]byte{}, initiatorNonce[:halfKeyLength]...),
+			responderNonce[:halfKeyLength]...)
 	}
-	if ikesaKey.IntegInfo == nil {
-		return errors.Errorf("No integrity algorithm specified")
+
+	return ikesaKey.generateKeyForIKESA(skeyseedKey, concatenatedNonce,
+		diffieHellmanSharedKey, initiatorSPI, responderSPI)
+}
+
+// hasFixedKeyLength reports the PRFs keyed with Ni[0:8] | Nr[0:8] for
+// SKEYSEED (RFC 7296 - 2.14)
+func hasFixedKeyLength(prfInfo prf.PRFType) bool {
+	switch prfInfo.TransformID() {
+	case message.PRF_AES128_XCBC, message.PRF_AES128_CMAC:
+		return true
 	}
+	return false
+}
+
+func (ikesaKey *IKESAKey) generateKeyForIKESA(
+	skeyseedKey, concatenatedNonce, diffieHellmanSharedKey []byte,
+	initiatorSPI, responderSPI uint64,
+) error {
+	// Check parameters
+	if ikesaKey == nil {
+		return errors.Errorf("IKE SA is nil")
+	}
+
+	// Check if the context contain needed data
 	if ikesaKey.PrfInfo == nil {
 		return errors.Errorf("No pseudorandom function specified")
 	}
 	if ikesaKey.DhInfo == nil {
 		return errors.Errorf("No Diffie-hellman group algorithm specified")
 	}
+	if len(diffieHellmanSharedKey) == 0 {
+		return errors.Errorf("No Diffie-Hellman shared key")
+	}
 
-	if len(concatenatedNonce) == 0 {
-		return errors.Errorf("No concatenated nonce data")
+	// fmt.Printf("Concatenated nonce:\n%s", hex.Dump(concatenatedNonce))
+	// fmt.Printf("DH shared key:\n%s", hex.Dump(diffieHellmanSharedKey))
+
+	prf := ikesaKey.PrfInfo.Init(skeyseedKey)
+	if prf == nil {
+		return errors.Errorf("Pseudorandom function init failed")
+	}
+	if _, err := prf.Write(diffieHellmanSharedKey); err != nil {
+		return err
+	}
+
+	return ikesaKey.deriveKeys(prf.Sum(nil), concatenatedNonce, initiatorSPI, responderSPI)
+}
+
+// GenerateKeyForRekeyIKESA derives the keys of the IKE SA replacing oldKey,
+// whose SK_d and PRF compute SKEYSEED (RFC 7296 - 2.18)
+func (ikesaKey *IKESAKey) GenerateKeyForRekeyIKESA(
+	oldKey *IKESAKey,
+	initiatorNonce, responderNonce, diffieHellmanSharedKey []byte,
+	initiatorSPI, responderSPI uint64,
+) error {
+	if ikesaKey == nil || oldKey == nil {
+		return errors.Errorf("IKE SA is nil")
+	}
+	if oldKey.PrfInfo == nil || len(oldKey.SK_d) == 0 {
+		return errors.Errorf("No key deriving key")
 	}
 	if len(diffieHellmanSharedKey) == 0 {
 		return errors.Errorf("No Diffie-Hellman shared key")
 	}
 
+	concatenatedNonce := append(append([]byte{}, initiatorNonce...), responderNonce...)
+	prf := oldKey.PrfInfo.Init(oldKey.SK_d)
+	if _, err := prf.Write(append(append([]byte{}, diffieHellmanSharedKey...), concatenatedNonce...)); err != nil {
+		return err
+	}
+
+	return ikesaKey.deriveKeys(prf.Sum(nil), concatenatedNonce, initiatorSPI, responderSPI)
+}
+
+// deriveKeys generates the keys of the IKE SA from SKEYSEED
+func (ikesaKey *IKESAKey) deriveKeys(
+	skeyseed, concatenatedNonce []byte,
+	initiatorSPI, responderSPI uint64,
+) error {
+	// Check if the context contain needed data
+	if ikesaKey.EncrInfo == nil {
+		return errors.Errorf("No encryption algorithm specified")
+	}
+	if ikesaKey.IntegInfo == nil && !ikesaKey.EncrInfo.IsAEAD() {
+		return errors.Errorf("No integrity algorithm specified")
+	}
+	if ikesaKey.PrfInfo == nil {
+		return errors.Errorf("No pseudorandom function specified")
+	}
+	if len(concatenatedNonce) == 0 {
+		return errors.Errorf("No concatenated nonce data")
+	}
+
 	// Get key length of SK_d, SK_ai, SK_ar, SK_ei, SK_er, SK_pi, SK_pr
 	var length_SK_d, length_SK_ai, length_SK_ar, length_SK_ei, length_SK_er, length_SK_pi, length_SK_pr, totalKeyLength int
 
 	length_SK_d = ikesaKey.PrfInfo.GetKeyLength()
-	length_SK_ai = ikesaKey.IntegInfo.GetKeyLength()
+	if ikesaKey.IntegInfo != nil {
+		length_SK_ai = ikesaKey.IntegInfo.GetKeyLength()
+	}
 	length_SK_ar = length_SK_ai
+	// For AEAD algorithms, the key length includes the salt (RFC 5282 - 7.1)
 	length_SK_ei = ikesaKey.EncrInfo.GetKeyLength()
 	length_SK_er = length_SK_ei
 	length_SK_pi, length_SK_pr = length_SK_d, length_SK_d
@@ -249,15 +414,6 @@ func (ikesaKey *IKESAKey) GenerateKeyForIKESA(
 	totalKeyLength = length_SK_d + length_SK_ai + length_SK_ar + length_SK_ei + length_SK_er + length_SK_pi + length_SK_pr
 
 	// Generate IKE SA key as defined in RFC7296 Section 1.3 and Section 1.4
-	// fmt.Printf("Concatenated nonce:\n%s", hex.Dump(concatenatedNonce))
-	// fmt.Printf("DH shared key:\n%s", hex.Dump(diffieHellmanSharedKey))
-
-	prf := ikesaKey.PrfInfo.Init(concatenatedNonce)
-	if _, err := prf.Write(diffieHellmanSharedKey); err != nil {
-		return err
-	}
-
-	skeyseed := prf.Sum(nil)
 	seed := concatenateNonceAndSPI(concatenatedNonce, initiatorSPI, responderSPI)
 
 	// fmt.Printf("SKEYSEED:\n%s", hex.Dump(skeyseed))
@@ -284,8 +440,10 @@ func (ikesaKey *IKESAKey) GenerateKeyForIKESA(
 
 	// Set security objects
 	ikesaKey.Prf_d = ikesaKey.PrfInfo.Init(ikesaKey.SK_d)
-	ikesaKey.Integ_i = ikesaKey.IntegInfo.Init(ikesaKey.SK_ai)
-	ikesaKey.Integ_r = ikesaKey.IntegInfo.Init(ikesaKey.SK_ar)
+	if ikesaKey.IntegInfo != nil {
+		ikesaKey.Integ_i = ikesaKey.IntegInfo.Init(ikesaKey.SK_ai)
+		ikesaKey.Integ_r = ikesaKey.IntegInfo.Init(ikesaKey.SK_ar)
+	}
 
 	var err error
 	ikesaKey.Encr_i, err = ikesaKey.EncrInfo.NewCrypto(ikesaKey.SK_ei)
@@ -339,6 +497,8 @@ func (childsaKey *ChildSAKey) ToProposal() (*message.Proposal, error) {
 	return p, nil
 }
 
+// NewChildSAKeyByProposal uses the first transform of each type, so proposal
+// should be the one chosen by SelectChildSAProposal.
 func NewChildSAKeyByProposal(proposal *message.Proposal) (*ChildSAKey, error) {
 	if proposal == nil {
 		return nil, errors.Errorf("NewChildSAKeyByProposal : proposal is nil")
@@ -348,10 +508,6 @@ func NewChildSAKeyByProposal(proposal *message.Proposal) (*ChildSAKey, error) {
 		return nil, errors.Errorf("NewChildSAKeyByProposal : EncryptionAlgorithm is nil")
 	}
 
-	if len(proposal.IntegrityAlgorithm) == 0 {
-		return nil, errors.Errorf("NewChildSAKeyByProposal : IntegrityAlgorithm is nil")
-	}
-
 	if len(proposal.ExtendedSequenceNumbers) == 0 {
 		return nil, errors.Errorf("NewChildSAKeyByProposal : ExtendedSequenceNumbers is nil")
 	}
@@ -371,7 +527,19 @@ func NewChildSAKeyByProposal(proposal *message.Proposal) (*ChildSAKey, error) {
 			proposal.EncryptionAlgorithm[0].TransformID)
 	}
 
-	if len(proposal.IntegrityAlgorithm) == 1 {
+	// RFC 4106 - 8.1: combined mode algorithms are proposed without
+	// integrity transform, or with AUTH_NONE
+	if childsaKey.EncrKInfo.IsAEAD() {
+		if len(proposal.IntegrityAlgorithm) != 0 &&
+			proposal.IntegrityAlgorithm[0].TransformID != message.AUTH_NONE {
+			return nil, errors.Errorf("NewChildSAKeyByProposal : Get IntegrityAlgorithm[%v] with AEAD EncryptionAlgorithm",
+				proposal.IntegrityAlgorithm[0].TransformID)
+		}
+	} else {
+		if len(proposal.IntegrityAlgorithm) == 0 {
+			return nil, errors.Errorf("NewChildSAKeyByProposal : IntegrityAlgorithm is nil")
+		}
+
 		childsaKey.IntegKInfo = integ.DecodeTransformChildSA(proposal.IntegrityAlgorithm[0])
 		if childsaKey.IntegKInfo == nil {
 			return nil, errors.Errorf("NewChildSAKeyByProposal : Get unsupport IntegrityAlgorithm[%v]",
@@ -392,6 +560,16 @@ func NewChildSAKeyByProposal(proposal *message.Proposal) (*ChildSAKey, error) {
 func (childsaKey *ChildSAKey) GenerateKeyForChildSA(
 	ikeSA *IKESAKey,
 	concatenatedNonce []byte,
+) error {
+	return childsaKey.GenerateKeyForChildSAWithPFS(ikeSA, nil, concatenatedNonce)
+}
+
+// GenerateKeyForChildSAWithPFS derives the keys of a Child SA created by
+// CREATE_CHILD_SA, with the shared key of its KE payloads prepended to the
+// nonces if PFS is used (RFC 7296 - 2.17)
+func (childsaKey *ChildSAKey) GenerateKeyForChildSAWithPFS(
+	ikeSA *IKESAKey,
+	diffieHellmanSharedKey, concatenatedNonce []byte,
 ) error {
 	// Check parameters
 	if ikeSA == nil {
@@ -413,6 +591,8 @@ func (childsaKey *ChildSAKey) GenerateKeyForChildSA(
 	}
 
 	// Get key length for encryption and integrity key for IPSec
+	// For AEAD algorithms, the encryption key includes the salt (RFC 4106 - 8.1)
+	// and no integrity key is derived
 	var lengthEncryptionKeyIPSec, lengthIntegrityKeyIPSec, totalKeyLength int
 
 	lengthEncryptionKeyIPSec = childsaKey.EncrKInfo.GetKeyLength()
@@ -422,7 +602,7 @@ func (childsaKey *ChildSAKey) GenerateKeyForChildSA(
 	totalKeyLength = (lengthEncryptionKeyIPSec + lengthIntegrityKeyIPSec) * 2
 
 	// Generate key for child security association as specified in RFC 7296 section 2.17
-	seed := concatenatedNonce
+	seed := append(append([]byte{}, diffieHellmanSharedKey...), concatenatedNonce...)
 
 	keyStream := lib.PrfPlus(ikeSA.Prf_d, seed, totalKeyLength)
 	if keyStream == nil {
@@ -14,6 +14,7 @@ import (
 	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
 	"github.com/guoweifk/n3iwue_ike_gw/security/esn"
 	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+	"github.com/guoweifk/n3iwue_ike_gw/security/lib"
 	"github.com/guoweifk/n3iwue_ike_gw/security/prf"
 )
 
@@ -108,7 +109,8 @@ func TestIKESetProposal(t *testing.T) {
 	proposal.PseudorandomFunction = append(proposal.PseudorandomFunction, prf.ToTransform(prfType))
 
 	concatenatedNonce := []byte{0x01, 0x02, 0x03, 0x04}
-	keyexChange := []byte{0x05, 0x06, 0x07, 0x08}
+	// Public value of the length of the 1024 bits prime
+	keyexChange := append(make([]byte, 124), 0x05, 0x06, 0x07, 0x08)
 
 	ikesaKey, _, err := NewIKESAKey(proposal, keyexChange, concatenatedNonce,
 		0x123, 0x456)
@@ -122,6 +124,94 @@ func TestIKESetProposal(t *testing.T) {
 	}
 }
 
+func TestIKESetProposalAEAD(t *testing.T) {
+	proposal := new(message.Proposal)
+
+	proposal.DiffieHellmanGroup = append(proposal.DiffieHellmanGroup,
+		dh.ToTransform(dh.StrToType("DH_2048_BIT_MODP")))
+	encrTranform, err := encr.ToTransform(encr.StrToType("ENCR_AES_GCM_16_256"))
+	require.NoError(t, err)
+	proposal.EncryptionAlgorithm = append(proposal.EncryptionAlgorithm, encrTranform)
+	proposal.PseudorandomFunction = append(proposal.PseudorandomFunction,
+		prf.ToTransform(prf.StrToType("PRF_HMAC_SHA2_256")))
+
+	concatenatedNonce := []byte{0x01, 0x02, 0x03, 0x04}
+	// Public value of the length of the 2048 bits prime
+	keyexChange := append(make([]byte, 252), 0x05, 0x06, 0x07, 0x08)
+
+	ikesaKey, _, err := NewIKESAKey(proposal, keyexChange, concatenatedNonce,
+		0x123, 0x456)
+	require.NoError(t, err)
+
+	require.Nil(t, ikesaKey.IntegInfo)
+	require.Nil(t, ikesaKey.Integ_i)
+	require.Empty(t, ikesaKey.SK_ai)
+	// 32 octets AES key followed by 4 octets salt
+	require.Len(t, ikesaKey.SK_ei, 36)
+	require.Len(t, ikesaKey.SK_er, 36)
+
+	newProposal, err := ikesaKey.ToProposal()
+	require.NoError(t, err)
+	require.Empty(t, newProposal.IntegrityAlgorithm)
+
+	// Integrity transform other than NONE is rejected with AEAD
+	proposal.IntegrityAlgorithm = append(proposal.IntegrityAlgorithm,
+		integ.ToTransform(integ.StrToType("AUTH_HMAC_SHA1_96")))
+	_, _, err = NewIKESAKey(proposal, keyexChange, concatenatedNonce,
+		0x123, 0x456)
+	require.Error(t, err)
+
+	// Child SA with AEAD and no integrity transform
+	childProposal := new(message.Proposal)
+	encrKTranform, err := encr.ToTransformChildSA(encr.StrToKType("ENCR_AES_GCM_16_128"))
+	require.NoError(t, err)
+	childProposal.EncryptionAlgorithm = append(childProposal.EncryptionAlgorithm, encrKTranform)
+	esnType, err := esn.StrToType("ESN_DISABLE")
+	require.NoError(t, err)
+	childProposal.ExtendedSequenceNumbers = append(childProposal.ExtendedSequenceNumbers, esn.ToTransform(esnType))
+
+	childsaKey, err := NewChildSAKeyByProposal(childProposal)
+	require.NoError(t, err)
+	require.Nil(t, childsaKey.IntegKInfo)
+
+	err = childsaKey.GenerateKeyForChildSA(ikesaKey, concatenatedNonce)
+	require.NoError(t, err)
+	require.Len(t, childsaKey.InitiatorToResponderEncryptionKey, 20)
+	require.Empty(t, childsaKey.InitiatorToResponderIntegrityKey)
+
+	// Child SA with AEAD and an integrity transform other than NONE
+	childProposal.IntegrityAlgorithm = append(childProposal.IntegrityAlgorithm,
+		integ.ToTransformChildSA(integ.StrToKType("AUTH_HMAC_SHA1_96")))
+	_, err = NewChildSAKeyByProposal(childProposal)
+	require.Error(t, err)
+}
+
+func TestCalculateDiffieHellmanMaterials(t *testing.T) {
+	for _, algo := range []string{
+		dh.DH_2048_BIT_MODP,
+		dh.DH_256_BIT_RANDOM_ECP,
+		dh.DH_384_BIT_RANDOM_ECP,
+		dh.DH_521_BIT_RANDOM_ECP,
+		dh.DH_CURVE25519,
+	} {
+		t.Run(algo, func(t *testing.T) {
+			dhType := dh.StrToType(algo)
+			peerSecret, err := dh.GenerateSecret(dhType)
+			require.NoError(t, err)
+			peerPublicValue, err := dhType.GetPublicValue(peerSecret)
+			require.NoError(t, err)
+
+			ikesaKey := &IKESAKey{DhInfo: dhType}
+			localPublicValue, sharedKey, err := CalculateDiffieHellmanMaterials(ikesaKey, peerPublicValue)
+			require.NoError(t, err)
+
+			peerSharedKey, err := dhType.GetSharedKey(peerSecret, localPublicValue)
+			require.NoError(t, err)
+			require.Equal(t, peerSharedKey, sharedKey)
+		})
+	}
+}
+
 func TestGenerateKeyForIKESA(t *testing.T) {
 	concatenatedNonce := []byte{0x01, 0x02, 0x03, 0x04}
 	diffieHellmanSharedKey := []byte{0x05, 0x06, 0x07, 0x08}
@@ -326,3 +416,172 @@ func TestChildSetProposal(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestGenerateKeyForIKESAByNonces(t *testing.T) {
+	initiatorNonce := []byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+	}
+	responderNonce := []byte{
+		0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18,
+		0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20,
+	}
+	concatenatedNonce := append(append([]byte{}, initiatorNonce...), responderNonce...)
+	diffieHellmanSharedKey := []byte{0x05, 0x06, 0x07, 0x08}
+	initiatorSPI := uint64(0x456)
+	responderSPI := uint64(0x123)
+
+	newIKESAKey := func(prfName string) *IKESAKey {
+		return &IKESAKey{
+			EncrInfo:  encr.StrToType("ENCR_AES_CTR_128"),
+			IntegInfo: integ.StrToType("AUTH_AES_XCBC_96"),
+			PrfInfo:   prf.StrToType(prfName),
+			DhInfo:    dh.StrToType("DH_2048_BIT_MODP"),
+		}
+	}
+
+	// Variable key length PRFs use both nonces as the key of SKEYSEED
+	ikesaKey := newIKESAKey("PRF_HMAC_SHA2_256")
+	err := ikesaKey.GenerateKeyForIKESAByNonces(initiatorNonce, responderNonce,
+		diffieHellmanSharedKey, initiatorSPI, responderSPI)
+	require.NoError(t, err)
+	expectedIKESAKey := newIKESAKey("PRF_HMAC_SHA2_256")
+	err = expectedIKESAKey.GenerateKeyForIKESA(concatenatedNonce,
+		diffieHellmanSharedKey, initiatorSPI, responderSPI)
+	require.NoError(t, err)
+	require.Equal(t, expectedIKESAKey.SK_d, ikesaKey.SK_d)
+
+	// AES based PRFs use the first 64 bits of each nonce (RFC 7296 - 2.14)
+	for _, prfName := range []string{"PRF_AES128_XCBC", "PRF_AES128_CMAC"} {
+		ikesaKey = newIKESAKey(prfName)
+		err = ikesaKey.GenerateKeyForIKESAByNonces(initiatorNonce, responderNonce,
+			diffieHellmanSharedKey, initiatorSPI, responderSPI)
+		require.NoError(t, err)
+
+		skeyseedPrf := ikesaKey.PrfInfo.Init(append(append([]byte{}, initiatorNonce[:8]...),
+			responderNonce[:8]...))
+		_, err = skeyseedPrf.Write(diffieHellmanSharedKey)
+		require.NoError(t, err)
+		keyStream := lib.PrfPlus(ikesaKey.PrfInfo.Init(skeyseedPrf.Sum(nil)),
+			concatenateNonceAndSPI(concatenatedNonce, initiatorSPI, responderSPI), 16)
+		require.Equal(t, keyStream, ikesaKey.SK_d)
+
+		err = ikesaKey.GenerateKeyForIKESAByNonces(initiatorNonce[:4], responderNonce,
+			diffieHellmanSharedKey, initiatorSPI, responderSPI)
+		require.Error(t, err)
+	}
+}
+
+func TestNewIKESAKeyByNonces(t *testing.T) {
+	initiatorNonce := bytes.Repeat([]byte{0x01}, 32)
+	responderNonce := bytes.Repeat([]byte{0x02}, 32)
+	concatenatedNonce := append(append([]byte{}, initiatorNonce...), responderNonce...)
+	initiatorSPI := uint64(0x456)
+	responderSPI := uint64(0x123)
+
+	for _, prfName := range []string{"PRF_AES128_XCBC", "PRF_AES128_CMAC"} {
+		t.Run(prfName, func(t *testing.T) {
+			dhType := dh.StrToType("DH_2048_BIT_MODP")
+			proposal := new(message.Proposal)
+			proposal.DiffieHellmanGroup = append(proposal.DiffieHellmanGroup, dh.ToTransform(dhType))
+			encrTranform, err := encr.ToTransform(encr.StrToType("ENCR_AES_CBC_128"))
+			require.NoError(t, err)
+			proposal.EncryptionAlgorithm = append(proposal.EncryptionAlgorithm, encrTranform)
+			proposal.IntegrityAlgorithm = append(proposal.IntegrityAlgorithm,
+				integ.ToTransform(integ.StrToType("AUTH_AES_XCBC_96")))
+			proposal.PseudorandomFunction = append(proposal.PseudorandomFunction,
+				prf.ToTransform(prf.StrToType(prfName)))
+
+			peerSecret, peerPublicValue := generatePeerPublicValue(t, dhType)
+			ikesaKey, localPublicValue, err := NewIKESAKeyByNonces(proposal, peerPublicValue,
+				initiatorNonce, responderNonce, initiatorSPI, responderSPI)
+			require.NoError(t, err)
+
+			// SKEYSEED = prf(Ni[0:8] | Nr[0:8], g^ir) (RFC 7296 - 2.14)
+			sharedKey, err := dhType.GetSharedKey(peerSecret, localPublicValue)
+			require.NoError(t, err)
+			skeyseedPrf := ikesaKey.PrfInfo.Init(append(append([]byte{}, initiatorNonce[:8]...),
+				responderNonce[:8]...))
+			_, err = skeyseedPrf.Write(sharedKey)
+			require.NoError(t, err)
+			keyStream := lib.PrfPlus(ikesaKey.PrfInfo.Init(skeyseedPrf.Sum(nil)),
+				concatenateNonceAndSPI(concatenatedNonce, initiatorSPI, responderSPI), 16)
+			require.Equal(t, keyStream, ikesaKey.SK_d)
+		})
+	}
+}
+
+func TestGenerateKeyForChildSAWithPFS(t *testing.T) {
+	ikeSAKey := &IKESAKey{PrfInfo: prf.StrToType("PRF_HMAC_SHA2_256")}
+	ikeSAKey.SK_d = bytes.Repeat([]byte{0x27}, ikeSAKey.PrfInfo.GetKeyLength())
+	ikeSAKey.Prf_d = ikeSAKey.PrfInfo.Init(ikeSAKey.SK_d)
+	concatenatedNonce := bytes.Repeat([]byte{0x01}, 64)
+	diffieHellmanSharedKey := bytes.Repeat([]byte{0x05}, 32)
+
+	newChildSAKey := func() *ChildSAKey {
+		return &ChildSAKey{
+			EncrKInfo:  encr.StrToKType("ENCR_AES_CBC_128"),
+			IntegKInfo: integ.StrToKType("AUTH_HMAC_SHA2_256_128"),
+		}
+	}
+
+	// KEYMAT = prf+(SK_d, g^ir (new) | Ni | Nr)
+	childSAKey := newChildSAKey()
+	err := childSAKey.GenerateKeyForChildSAWithPFS(ikeSAKey, diffieHellmanSharedKey, concatenatedNonce)
+	require.NoError(t, err)
+	keyStream := lib.PrfPlus(ikeSAKey.PrfInfo.Init(ikeSAKey.SK_d),
+		append(append([]byte{}, diffieHellmanSharedKey...), concatenatedNonce...), 96)
+	require.Equal(t, keyStream[:16], childSAKey.InitiatorToResponderEncryptionKey)
+	require.Equal(t, keyStream[16:48], childSAKey.InitiatorToResponderIntegrityKey)
+	require.Equal(t, keyStream[48:64], childSAKey.ResponderToInitiatorEncryptionKey)
+	require.Equal(t, keyStream[64:96], childSAKey.ResponderToInitiatorIntegrityKey)
+
+	// Without PFS, the keys are the ones of GenerateKeyForChildSA
+	withoutPFS, expected := newChildSAKey(), newChildSAKey()
+	require.NoError(t, withoutPFS.GenerateKeyForChildSAWithPFS(ikeSAKey, nil, concatenatedNonce))
+	require.NoError(t, expected.GenerateKeyForChildSA(ikeSAKey, concatenatedNonce))
+	require.Equal(t, expected, withoutPFS)
+	require.NotEqual(t, expected.InitiatorToResponderEncryptionKey, childSAKey.InitiatorToResponderEncryptionKey)
+}
+
+func TestGenerateKeyForRekeyIKESA(t *testing.T) {
+	initiatorNonce := bytes.Repeat([]byte{0x01}, 32)
+	responderNonce := bytes.Repeat([]byte{0x02}, 32)
+	diffieHellmanSharedKey := bytes.Repeat([]byte{0x05}, 32)
+	initiatorSPI := uint64(0x456)
+	responderSPI := uint64(0x123)
+
+	oldKey := &IKESAKey{PrfInfo: prf.StrToType("PRF_HMAC_SHA1")}
+	oldKey.SK_d = bytes.Repeat([]byte{0x27}, oldKey.PrfInfo.GetKeyLength())
+
+	// The PRF of the new IKE SA may differ from the one of the old IKE SA
+	ikesaKey := &IKESAKey{
+		EncrInfo: encr.StrToType("ENCR_AES_GCM_16_256"),
+		PrfInfo:  prf.StrToType("PRF_HMAC_SHA2_384"),
+		DhInfo:   dh.StrToType("DH_256_BIT_RANDOM_ECP"),
+	}
+	err := ikesaKey.GenerateKeyForRekeyIKESA(oldKey, initiatorNonce, responderNonce,
+		diffieHellmanSharedKey, initiatorSPI, responderSPI)
+	require.NoError(t, err)
+
+	// SKEYSEED = prf(SK_d (old), g^ir (new) | Ni | Nr)
+	concatenatedNonce := append(append([]byte{}, initiatorNonce...), responderNonce...)
+	skeyseedPrf := oldKey.PrfInfo.Init(oldKey.SK_d)
+	_, err = skeyseedPrf.Write(append(append([]byte{}, diffieHellmanSharedKey...), concatenatedNonce...))
+	require.NoError(t, err)
+	keyStream := lib.PrfPlus(ikesaKey.PrfInfo.Init(skeyseedPrf.Sum(nil)),
+		concatenateNonceAndSPI(concatenatedNonce, initiatorSPI, responderSPI), 48+36)
+	require.Equal(t, keyStream[:48], ikesaKey.SK_d)
+	require.Empty(t, ikesaKey.SK_ai)
+	require.Equal(t, keyStream[48:84], ikesaKey.SK_ei)
+	require.NotNil(t, ikesaKey.Encr_i)
+	require.NotNil(t, ikesaKey.Prf_d)
+
+	// The old IKE SA has no SK_d
+	err = ikesaKey.GenerateKeyForRekeyIKESA(&IKESAKey{PrfInfo: oldKey.PrfInfo}, initiatorNonce, responderNonce,
+		diffieHellmanSharedKey, initiatorSPI, responderSPI)
+	require.Error(t, err)
+	err = ikesaKey.GenerateKeyForRekeyIKESA(oldKey, initiatorNonce, responderNonce,
+		nil, initiatorSPI, responderSPI)
+	require.Error(t, err)
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Space of the control message carrying the largest packet information
+var packetInfoLength = syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+// enablePacketInfo asks for the destination address of the packets received,
+// which is the source address of their responses when the socket is bound to
+// any address
+func enablePacketInfo(c *net.UDPConn) error {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return errors.Wrapf(err, "enablePacketInfo()")
+	}
+	level, option := syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO
+	if c.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		level, option = syscall.IPPROTO_IP, syscall.IP_PKTINFO
+	}
+	var sockErr error
+	if err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, option, 1)
+	}); err != nil {
+		return errors.Wrapf(err, "enablePacketInfo()")
+	}
+	if sockErr != nil {
+		return errors.Wrapf(sockErr, "enablePacketInfo(): setsockopt")
+	}
+	return nil
+}
+
+// parsePacketInfo returns the destination address of a received packet
+func parsePacketInfo(oob []byte) (netip.Addr, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet4Pktinfo:
+			info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			return netip.AddrFrom4(info.Addr), true
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_PKTINFO &&
+			len(msg.Data) >= syscall.SizeofInet6Pktinfo:
+			info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			return netip.AddrFrom16(info.Addr).Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// packetInfo returns the control message sending a packet from local
+func packetInfo(local netip.Addr) []byte {
+	if local.Is4() {
+		oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet4Pktinfo))
+		header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		header.Level, header.Type = syscall.IPPROTO_IP, syscall.IP_PKTINFO
+		header.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+		info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+		info.Spec_dst = local.As4()
+		return oob
+	}
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofInet6Pktinfo))
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level, header.Type = syscall.IPPROTO_IPV6, syscall.IPV6_PKTINFO
+	header.SetLen(syscall.CmsgLen(syscall.SizeofInet6Pktinfo))
+	info := (*syscall.Inet6Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+	info.Addr = local.As16()
+	return oob
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package server
+
+import (
+	"net"
+	"net/netip"
+)
+
+// Packet information is not received, the sockets are to be bound to the
+// addresses the responses are sent from
+const packetInfoLength = 0
+
+func enablePacketInfo(c *net.UDPConn) error {
+	return nil
+}
+
+func parsePacketInfo(oob []byte) (netip.Addr, bool) {
+	return netip.Addr{}, false
+}
+
+func packetInfo(local netip.Addr) []byte {
+	return nil
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/ikesa"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/nat"
+)
+
+const (
+	// Largest UDP payload received
+	maxPacketLength = 65535
+	// Packets waiting for each worker, beyond which they are dropped
+	defaultQueueLength = 256
+)
+
+// Packet is an IKE message, or an ESP packet, received by the server
+type Packet struct {
+	// Address the packet is received on, and the response is sent from
+	LocalAddr  netip.AddrPort
+	RemoteAddr netip.AddrPort
+	// The packet is received on the NAT-T port
+	NATT bool
+	// IKE message without the non-ESP marker, and its parsed header. Header is
+	// nil for ESP packets.
+	Header  *message.IKEHeader
+	Message []byte
+}
+
+// Handler processes the IKE messages received by the server. The messages of
+// an IKE SA are handled by one worker at a time, in the order they are
+// received, so that the handler may call the IKE SA and update the SAManager
+// without more locking. The message is passed to IKESA.HandleMessageFrom with
+// the RemoteAddr of the packet, for the IKE SA to follow a NAT mapping change.
+type Handler interface {
+	// HandleIKE returns the message to send back to the peer, or nil. ikesa
+	// is the IKE SA found for the SPIs of the message, nil for a new
+	// IKE_SA_INIT request or an unknown IKE SA.
+	HandleIKE(ctx context.Context, ikesa *ikesa.IKESA, packet *Packet) []byte
+}
+
+// ESPHandler is implemented by the handlers processing the ESP packets
+// received on the NAT-T port, which are dropped otherwise
+type ESPHandler interface {
+	HandleESP(ctx context.Context, packet *Packet)
+}
+
+type Config struct {
+	// Addresses receiving IKE messages, and IKE messages and ESP packets
+	// encapsulated in UDP. Default to the ports 500 and 4500 of any IPv4
+	// address.
+	IKEAddr  netip.AddrPort
+	NATTAddr netip.AddrPort
+	// Number of workers handling the messages, one per CPU if zero
+	Workers int
+	// Packets waiting for each worker, beyond which they are dropped
+	QueueLength int
+}
+
+// Stats counts the packets of a server
+type Stats struct {
+	Received uint64
+	// Malformed, beyond the queue of their worker, or failing to be sent
+	Dropped uint64
+	Sent    uint64
+}
+
+// Server receives the IKE messages on UDP, finds their IKE SA in the
+// SAManager and dispatches them to the handler
+type Server struct {
+	config  Config
+	manager *ikesa.SAManager
+	handler Handler
+
+	ike  *conn
+	natt *conn
+
+	received atomic.Uint64
+	dropped  atomic.Uint64
+	sent     atomic.Uint64
+}
+
+// conn is a socket of the server
+type conn struct {
+	*net.UDPConn
+	addr netip.AddrPort
+	natt bool
+}
+
+// Listen opens the sockets of the server, which handles their packets once
+// Serve is called
+func Listen(config Config, manager *ikesa.SAManager, handler Handler) (*Server, error) {
+	if manager == nil || handler == nil {
+		return nil, errors.Errorf("Listen(): SA manager or handler is nil")
+	}
+	if config.Workers < 0 || config.QueueLength < 0 {
+		return nil, errors.Errorf("Listen(): Invalid workers %d or queue length %d",
+			config.Workers, config.QueueLength)
+	}
+	if config.Workers == 0 {
+		config.Workers = runtime.NumCPU()
+	}
+	if config.QueueLength == 0 {
+		config.QueueLength = defaultQueueLength
+	}
+	if !config.IKEAddr.IsValid() {
+		config.IKEAddr = netip.AddrPortFrom(netip.IPv4Unspecified(), nat.IKEPort)
+	}
+	if !config.NATTAddr.IsValid() {
+		config.NATTAddr = netip.AddrPortFrom(netip.IPv4Unspecified(), nat.NATTPort)
+	}
+
+	s := &Server{
+		config:  config,
+		manager: manager,
+		handler: handler,
+	}
+	var err error
+	if s.ike, err = listen(config.IKEAddr, false); err != nil {
+		return nil, errors.Wrapf(err, "Listen()")
+	}
+	if s.natt, err = listen(config.NATTAddr, true); err != nil {
+		s.ike.Close()
+		return nil, errors.Wrapf(err, "Listen()")
+	}
+	return s, nil
+}
+
+func listen(addr netip.AddrPort, natt bool) (*conn, error) {
+	network := "udp6"
+	if addr.Addr().Is4() {
+		network = "udp4"
+	}
+	udpConn, err := net.ListenUDP(network, net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen(): %s", addr)
+	}
+	if err = enablePacketInfo(udpConn); err != nil {
+		udpConn.Close()
+		return nil, errors.Wrapf(err, "listen(): %s", addr)
+	}
+	return &conn{
+		UDPConn: udpConn,
+		addr:    udpConn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		natt:    natt,
+	}, nil
+}
+
+// IKEAddr returns the address the IKE messages are received on
+func (s *Server) IKEAddr() netip.AddrPort {
+	return s.ike.addr
+}
+
+// NATTAddr returns the address the messages encapsulated in UDP are received
+// on
+func (s *Server) NATTAddr() netip.AddrPort {
+	return s.natt.addr
+}
+
+// Stats returns the packet counters of the server
+func (s *Server) Stats() Stats {
+	return Stats{
+		Received: s.received.Load(),
+		Dropped:  s.dropped.Load(),
+		Sent:     s.sent.Load(),
+	}
+}
+
+// Serve handles the received packets until ctx is done, and then closes the
+// sockets and waits for the messages being handled
+func (s *Server) Serve(ctx context.Context) error {
+	queues := make([]chan *Packet, s.config.Workers)
+	var workers sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan *Packet, s.config.QueueLength)
+		workers.Add(1)
+		go func(queue chan *Packet) {
+			defer workers.Done()
+			for packet := range queue {
+				s.handle(ctx, packet)
+			}
+		}(queues[i])
+	}
+
+	var readers sync.WaitGroup
+	readErrs := make(chan error, 2)
+	for _, c := range []*conn{s.ike, s.natt} {
+		readers.Add(1)
+		go func(c *conn) {
+			defer readers.Done()
+			if err := s.read(ctx, c, queues); err != nil {
+				readErrs <- err
+			}
+		}(c)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-readErrs:
+	}
+	s.ike.Close()
+	s.natt.Close()
+	readers.Wait()
+	for _, queue := range queues {
+		close(queue)
+	}
+	workers.Wait()
+	return err
+}
+
+// SendTo sends a message of this side, such as a request, from the local
+// address of the IKE SA, which is one of the addresses of the server. A
+// fragmented message is sent with a call for each of its IKESA.Datagrams.
+func (s *Server) SendTo(local, remote netip.AddrPort, msg []byte) error {
+	c := s.ike
+	if local.Port() == s.natt.addr.Port() {
+		c = s.natt
+	} else if local.Port() != s.ike.addr.Port() {
+		return errors.Errorf("SendTo(): No socket on %s", local)
+	}
+	return s.send(c, local.Addr(), remote, msg)
+}
+
+// read receives the packets of the socket until it is closed, and queues them
+// to the worker of their initiator SPI
+func (s *Server) read(ctx context.Context, c *conn, queues []chan *Packet) error {
+	buf := make([]byte, maxPacketLength)
+	oob := make([]byte, packetInfoLength)
+	for {
+		n, oobn, _, remote, err := c.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return errors.Wrapf(err, "read(): %s", c.addr)
+		}
+		s.received.Add(1)
+
+		packet, err := parsePacket(c, buf[:n], remote)
+		if err != nil {
+			s.dropped.Add(1)
+			continue
+		}
+		if local, ok := parsePacketInfo(oob[:oobn]); ok {
+			packet.LocalAddr = netip.AddrPortFrom(local, c.addr.Port())
+		}
+
+		var shard uint64
+		if packet.Header != nil {
+			shard = packet.Header.InitiatorSPI
+		} else {
+			shard = uint64(binary.BigEndian.Uint32(packet.Message[:4]))
+		}
+		select {
+		case queues[shard%uint64(len(queues))] <- packet:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// parsePacket copies the packet received on the socket, without the non-ESP
+// marker of the NAT-T port
+func parsePacket(c *conn, data []byte, remote netip.AddrPort) (*Packet, error) {
+	packet := &Packet{
+		LocalAddr:  c.addr,
+		RemoteAddr: netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port()),
+		NATT:       c.natt,
+	}
+	if c.natt {
+		packetType, msg, err := nat.Decode(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsePacket()")
+		}
+		switch packetType {
+		case nat.PacketKeepalive:
+			return nil, errors.Errorf("parsePacket(): NAT-keepalive")
+		case nat.PacketESP:
+			packet.Message = append([]byte{}, msg...)
+			return packet, nil
+		}
+		data = msg
+	}
+
+	header, err := message.ParseHeader(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsePacket()")
+	}
+	packet.Message = append([]byte{}, data...)
+	// The header refers to the message kept, not to the receive buffer
+	header.PayloadBytes = packet.Message[message.IKE_HEADER_LEN:]
+	packet.Header = header
+	return packet, nil
+}
+
+// handle passes the packet to the handler with its IKE SA, and sends back the
+// response from the address the packet is received on
+func (s *Server) handle(ctx context.Context, packet *Packet) {
+	if packet.Header == nil {
+		if espHandler, ok := s.handler.(ESPHandler); ok {
+			espHandler.HandleESP(ctx, packet)
+		} else {
+			s.dropped.Add(1)
+		}
+		return
+	}
+
+	header := packet.Header
+	var sa *ikesa.IKESA
+	if header.ResponderSPI == 0 && header.ExchangeType == message.IKE_SA_INIT && !header.IsResponse() {
+		sa = s.manager.LookupHalfOpen(header.InitiatorSPI, packet.RemoteAddr)
+	} else {
+		sa = s.manager.Lookup(header.InitiatorSPI, header.ResponderSPI)
+	}
+
+	response := s.handler.HandleIKE(ctx, sa, packet)
+	if response == nil {
+		return
+	}
+	c := s.ike
+	if packet.NATT {
+		c = s.natt
+	}
+	// A fragmented response is sent in its Encrypted Fragment messages
+	datagrams := [][]byte{response}
+	if sa != nil {
+		datagrams = sa.Datagrams(response)
+	}
+	for _, datagram := range datagrams {
+		if err := s.send(c, packet.LocalAddr.Addr(), packet.RemoteAddr, datagram); err != nil {
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// send writes the message from the local address of the socket, which is
+// chosen if the socket is bound to any address
+func (s *Server) send(c *conn, local netip.Addr, remote netip.AddrPort, msg []byte) error {
+	if c.natt {
+		msg = nat.EncodeIKE(msg)
+	}
+	var oob []byte
+	if c.addr.Addr().IsUnspecified() && local.IsValid() && !local.IsUnspecified() {
+		oob = packetInfo(local)
+	}
+	if _, _, err := c.WriteMsgUDPAddrPort(msg, oob, remote); err != nil {
+		return errors.Wrapf(err, "send(): %s", remote)
+	}
+	s.sent.Add(1)
+	return nil
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/ikesa"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/nat"
+)
+
+type handled struct {
+	ikesa  *ikesa.IKESA
+	packet *Packet
+}
+
+// fakeHandler answers each IKE message with its header turned into a
+// response, and adds the IKE SA of new IKE_SA_INIT requests
+type fakeHandler struct {
+	manager *ikesa.SAManager
+	mu      sync.Mutex
+	ike     []handled
+	esp     []*Packet
+	done    chan struct{}
+}
+
+func (h *fakeHandler) HandleIKE(ctx context.Context, sa *ikesa.IKESA, packet *Packet) []byte {
+	defer func() { h.done <- struct{}{} }()
+	h.mu.Lock()
+	h.ike = append(h.ike, handled{ikesa: sa, packet: packet})
+	h.mu.Unlock()
+
+	header := *packet.Header
+	if sa == nil && header.ExchangeType == message.IKE_SA_INIT {
+		sa = &ikesa.IKESA{
+			Role:         message.Role_Responder,
+			State:        ikesa.StateIKESAInitDone,
+			InitiatorSPI: header.InitiatorSPI,
+			ResponderSPI: 0x2222,
+		}
+		if err := h.manager.Add(sa, packet.RemoteAddr, time.Now()); err != nil {
+			return nil
+		}
+	}
+	if sa == nil {
+		return nil
+	}
+	header.ResponderSPI = sa.ResponderSPI
+	header.Flags = message.ResponseBitCheck
+	header.PayloadBytes = nil
+	response, err := header.Marshal()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func (h *fakeHandler) HandleESP(ctx context.Context, packet *Packet) {
+	defer func() { h.done <- struct{}{} }()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.esp = append(h.esp, packet)
+}
+
+func (h *fakeHandler) last() handled {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ike[len(h.ike)-1]
+}
+
+func (h *fakeHandler) wait(t *testing.T) {
+	select {
+	case <-h.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not handled")
+	}
+}
+
+func newTestServer(t *testing.T, addr netip.Addr) (*Server, *fakeHandler, func()) {
+	manager, err := ikesa.NewSAManager(ikesa.SAManagerConfig{})
+	require.NoError(t, err)
+	handler := &fakeHandler{manager: manager, done: make(chan struct{}, 16)}
+	s, err := Listen(Config{
+		IKEAddr:  netip.AddrPortFrom(addr, 0),
+		NATTAddr: netip.AddrPortFrom(addr, 0),
+		Workers:  4,
+	}, manager, handler)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(ctx)
+	}()
+	return s, handler, func() {
+		cancel()
+		require.NoError(t, <-served)
+	}
+}
+
+func newClient(t *testing.T) *net.UDPConn {
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newTestMessage(t *testing.T, exchangeType uint8, initiatorSPI, responderSPI uint64) []byte {
+	msg, err := message.NewMessage(initiatorSPI, responderSPI, exchangeType, false, true, 0, nil).Encode()
+	require.NoError(t, err)
+	return msg
+}
+
+// receive returns the next packet of the client and its source
+func receive(t *testing.T, client *net.UDPConn) ([]byte, netip.AddrPort) {
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 1500)
+	n, from, err := client.ReadFromUDPAddrPort(buf)
+	require.NoError(t, err)
+	return buf[:n], from
+}
+
+func TestServer(t *testing.T) {
+	s, handler, stop := newTestServer(t, netip.MustParseAddr("127.0.0.1"))
+	defer stop()
+	client := newClient(t)
+	clientAddr := client.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	// New IKE SA
+	request := newTestMessage(t, message.IKE_SA_INIT, 0x1111, 0)
+	_, err := client.WriteToUDPAddrPort(request, s.IKEAddr())
+	require.NoError(t, err)
+	handler.wait(t)
+	require.Nil(t, handler.last().ikesa)
+	require.Equal(t, request, handler.last().packet.Message)
+	require.Equal(t, clientAddr, handler.last().packet.RemoteAddr)
+	require.Equal(t, s.IKEAddr(), handler.last().packet.LocalAddr)
+	response, from := receive(t, client)
+	require.Equal(t, s.IKEAddr(), from)
+	header, err := message.ParseHeader(response)
+	require.NoError(t, err)
+	require.True(t, header.IsResponse())
+	require.Equal(t, uint64(0x2222), header.ResponderSPI)
+
+	// Retransmission found as half-open
+	_, err = client.WriteToUDPAddrPort(request, s.IKEAddr())
+	require.NoError(t, err)
+	handler.wait(t)
+	require.NotNil(t, handler.last().ikesa)
+	sa := handler.last().ikesa
+	receive(t, client)
+
+	// Message of the IKE SA on the NAT-T port
+	request = newTestMessage(t, message.IKE_AUTH, 0x1111, 0x2222)
+	_, err = client.WriteToUDPAddrPort(nat.EncodeIKE(request), s.NATTAddr())
+	require.NoError(t, err)
+	handler.wait(t)
+	require.Equal(t, sa, handler.last().ikesa)
+	require.Equal(t, request, handler.last().packet.Message)
+	require.True(t, handler.last().packet.NATT)
+	response, from = receive(t, client)
+	require.Equal(t, s.NATTAddr(), from)
+	packetType, msg, err := nat.Decode(response)
+	require.NoError(t, err)
+	require.Equal(t, nat.PacketIKE, packetType)
+	header, err = message.ParseHeader(msg)
+	require.NoError(t, err)
+	require.Equal(t, uint8(message.IKE_AUTH), header.ExchangeType)
+
+	// Unknown IKE SA, not answered
+	_, err = client.WriteToUDPAddrPort(newTestMessage(t, message.IKE_AUTH, 0x3333, 0x4444), s.IKEAddr())
+	require.NoError(t, err)
+	handler.wait(t)
+	require.Nil(t, handler.last().ikesa)
+
+	// ESP packet
+	esp := []byte{0, 0, 0x10, 0, 0, 0, 0, 1, 0xaa, 0xbb}
+	_, err = client.WriteToUDPAddrPort(esp, s.NATTAddr())
+	require.NoError(t, err)
+	handler.wait(t)
+	handler.mu.Lock()
+	require.Len(t, handler.esp, 1)
+	require.Equal(t, esp, handler.esp[0].Message)
+	require.Nil(t, handler.esp[0].Header)
+	handler.mu.Unlock()
+
+	// Dropped packets
+	for _, packet := range []struct {
+		data []byte
+		to   netip.AddrPort
+	}{
+		{nat.Keepalive(), s.NATTAddr()},
+		{[]byte{1, 2, 3}, s.IKEAddr()},
+		{request, s.NATTAddr()},
+	} {
+		_, err = client.WriteToUDPAddrPort(packet.data, packet.to)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return s.Stats().Dropped == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, Stats{Received: 8, Dropped: 3, Sent: 3}, s.Stats())
+
+	// Request of this side
+	require.NoError(t, s.SendTo(s.NATTAddr(), clientAddr, request))
+	response, _ = receive(t, client)
+	require.Equal(t, nat.EncodeIKE(request), response)
+	require.Error(t, s.SendTo(netip.MustParseAddrPort("127.0.0.1:1"), clientAddr, request))
+}
+
+func TestServerAnyAddress(t *testing.T) {
+	s, handler, stop := newTestServer(t, netip.IPv4Unspecified())
+	defer stop()
+	client := newClient(t)
+
+	// The response is sent from the address the request is received on
+	to := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), s.IKEAddr().Port())
+	_, err := client.WriteToUDPAddrPort(newTestMessage(t, message.IKE_SA_INIT, 0x1111, 0), to)
+	require.NoError(t, err)
+	handler.wait(t)
+	require.Equal(t, to, handler.last().packet.LocalAddr)
+	_, from := receive(t, client)
+	require.Equal(t, to, from)
+}
+
+func TestListen(t *testing.T) {
+	manager, err := ikesa.NewSAManager(ikesa.SAManagerConfig{})
+	require.NoError(t, err)
+	handler := &fakeHandler{manager: manager}
+	loopback := netip.MustParseAddrPort("127.0.0.1:0")
+
+	_, err = Listen(Config{IKEAddr: loopback, NATTAddr: loopback}, nil, handler)
+	require.Error(t, err)
+	_, err = Listen(Config{IKEAddr: loopback, NATTAddr: loopback, Workers: -1}, manager, handler)
+	require.Error(t, err)
+
+	s, err := Listen(Config{IKEAddr: loopback, NATTAddr: loopback}, manager, handler)
+	require.NoError(t, err)
+	defer func() {
+		s.ike.Close()
+		s.natt.Close()
+	}()
+	// The address is in use
+	_, err = Listen(Config{IKEAddr: s.IKEAddr(), NATTAddr: loopback}, manager, handler)
+	require.Error(t, err)
+}
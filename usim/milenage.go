@@ -0,0 +1,147 @@
+package usim
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"github.com/pkg/errors"
+)
+
+var _ Algorithm = &Milenage{}
+
+// Rotations (in bits) and constants of OUT1 to OUT5 (3GPP TS 35.206 - 4.1)
+var (
+	milenageR = [5]int{64, 0, 32, 64, 96}
+	milenageC = [5]byte{0, 1, 2, 4, 8}
+)
+
+// Milenage is the MILENAGE algorithm set (3GPP TS 35.206)
+type Milenage struct {
+	block cipher.Block
+	opc   []byte
+}
+
+// NewMilenage derives OPc from the operator variant OP
+func NewMilenage(k, op []byte) (*Milenage, error) {
+	if len(op) != 16 {
+		return nil, errors.Errorf("NewMilenage(): OP is not 16 bytes")
+	}
+	m, err := NewMilenageOPc(k, make([]byte, 16))
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewMilenage()")
+	}
+	// OPc = OP XOR E[OP]K
+	m.block.Encrypt(m.opc, op)
+	xor(m.opc, op)
+	return m, nil
+}
+
+// NewMilenageOPc uses the OPc stored in the USIM
+func NewMilenageOPc(k, opc []byte) (*Milenage, error) {
+	if len(k) != 16 || len(opc) != 16 {
+		return nil, errors.Errorf("NewMilenageOPc(): K or OPc is not 16 bytes")
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewMilenageOPc()")
+	}
+	return &Milenage{block: block, opc: append([]byte{}, opc...)}, nil
+}
+
+func (m *Milenage) OPc() []byte {
+	return append([]byte{}, m.opc...)
+}
+
+func (m *Milenage) F1(rand, sqn, amf []byte) ([]byte, error) {
+	out1, err := m.out1(rand, sqn, amf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "F1()")
+	}
+	return out1[:8], nil
+}
+
+func (m *Milenage) F1Star(rand, sqn, amf []byte) ([]byte, error) {
+	out1, err := m.out1(rand, sqn, amf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "F1Star()")
+	}
+	return out1[8:], nil
+}
+
+func (m *Milenage) F2345(rand []byte) (res, ck, ik, ak []byte, err error) {
+	temp, err := m.temp(rand)
+	if err != nil {
+		return nil, nil, nil, nil, errors.Wrapf(err, "F2345()")
+	}
+	out2 := m.out(temp, 1)
+	return out2[8:], m.out(temp, 2), m.out(temp, 3), out2[:6], nil
+}
+
+func (m *Milenage) F5Star(rand []byte) ([]byte, error) {
+	temp, err := m.temp(rand)
+	if err != nil {
+		return nil, errors.Wrapf(err, "F5Star()")
+	}
+	return m.out(temp, 4)[:6], nil
+}
+
+// temp returns TEMP = E[RAND XOR OPc]K
+func (m *Milenage) temp(rand []byte) ([]byte, error) {
+	if len(rand) != RANDLen {
+		return nil, errors.Errorf("RAND is not %d bytes", RANDLen)
+	}
+	temp := append([]byte{}, rand...)
+	xor(temp, m.opc)
+	m.block.Encrypt(temp, temp)
+	return temp, nil
+}
+
+// out1 returns OUT1 = E[TEMP XOR rot(IN1 XOR OPc, r1) XOR c1]K XOR OPc
+func (m *Milenage) out1(rand, sqn, amf []byte) ([]byte, error) {
+	if len(sqn) != SQNLen || len(amf) != AMFLen {
+		return nil, errors.Errorf("SQN or AMF length is invalid")
+	}
+	temp, err := m.temp(rand)
+	if err != nil {
+		return nil, err
+	}
+	in1 := make([]byte, 0, 16)
+	for i := 0; i < 2; i++ {
+		in1 = append(append(in1, sqn...), amf...)
+	}
+	xor(in1, m.opc)
+	in1 = rotate(in1, milenageR[0])
+	in1[15] ^= milenageC[0]
+	xor(in1, temp)
+	m.block.Encrypt(in1, in1)
+	xor(in1, m.opc)
+	return in1, nil
+}
+
+// out returns OUTi = E[rot(TEMP XOR OPc, ri) XOR ci]K XOR OPc, for i from 2
+// to 5 at index i-1
+func (m *Milenage) out(temp []byte, index int) []byte {
+	out := append([]byte{}, temp...)
+	xor(out, m.opc)
+	out = rotate(out, milenageR[index])
+	out[15] ^= milenageC[index]
+	m.block.Encrypt(out, out)
+	xor(out, m.opc)
+	return out
+}
+
+// rotate cyclically rotates the 128-bit value by r bits towards the most
+// significant bits. The rotations of MILENAGE are whole bytes.
+func rotate(b []byte, r int) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[i] = b[(i+r/8)%len(b)]
+	}
+	return out
+}
+
+func xor(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,70 @@
+package usim
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+// 3GPP TS 35.207 - 4.3 Test Set 1
+func TestMilenage(t *testing.T) {
+	k := mustHex(t, "465b5ce8b199b49faa5f0a2ee238a6bc")
+	rand := mustHex(t, "23553cbe9637a89d218ae64dae47bf35")
+	sqn := mustHex(t, "ff9bb4d0b607")
+	amf := mustHex(t, "b9b9")
+
+	m, err := NewMilenage(k, mustHex(t, "cdc202d5123e20f62b6d676ac72cb318"))
+	require.NoError(t, err)
+	require.Equal(t, mustHex(t, "cd63cb71954a9f4e48a5994e37a02baf"), m.OPc())
+
+	fromOPc, err := NewMilenageOPc(k, m.OPc())
+	require.NoError(t, err)
+
+	for _, m := range []*Milenage{m, fromOPc} {
+		macA, err := m.F1(rand, sqn, amf)
+		require.NoError(t, err)
+		require.Equal(t, mustHex(t, "4a9ffac354dfafb3"), macA)
+
+		macS, err := m.F1Star(rand, sqn, amf)
+		require.NoError(t, err)
+		require.Equal(t, mustHex(t, "01cfaf9ec4e871e9"), macS)
+
+		res, ck, ik, ak, err := m.F2345(rand)
+		require.NoError(t, err)
+		require.Equal(t, mustHex(t, "a54211d5e3ba50bf"), res)
+		require.Equal(t, mustHex(t, "b40ba9a3c58b2a05bbf0d987b21bf8cb"), ck)
+		require.Equal(t, mustHex(t, "f769bcd751044604127672711c6d3441"), ik)
+		require.Equal(t, mustHex(t, "aa689c648370"), ak)
+
+		akStar, err := m.F5Star(rand)
+		require.NoError(t, err)
+		require.Equal(t, mustHex(t, "451e8beca43b"), akStar)
+	}
+}
+
+func TestMilenageInvalid(t *testing.T) {
+	_, err := NewMilenage(make([]byte, 15), make([]byte, 16))
+	require.Error(t, err)
+	_, err = NewMilenage(make([]byte, 16), make([]byte, 15))
+	require.Error(t, err)
+	_, err = NewMilenageOPc(make([]byte, 16), make([]byte, 17))
+	require.Error(t, err)
+
+	m, err := NewMilenageOPc(make([]byte, 16), make([]byte, 16))
+	require.NoError(t, err)
+	_, err = m.F1(make([]byte, 15), make([]byte, SQNLen), make([]byte, AMFLen))
+	require.Error(t, err)
+	_, err = m.F1Star(make([]byte, RANDLen), make([]byte, 5), make([]byte, AMFLen))
+	require.Error(t, err)
+	_, _, _, _, err = m.F2345(nil)
+	require.Error(t, err)
+	_, err = m.F5Star(make([]byte, 17))
+	require.Error(t, err)
+}
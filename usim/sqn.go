@@ -0,0 +1,141 @@
+package usim
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults of the SQN profile (3GPP TS 33.102 - C.3.1, C.3.2)
+const (
+	DefaultINDLen = 5
+	DefaultDelta  = 1 << 28
+)
+
+const sqnMask = 1<<(8*SQNLen) - 1
+
+// SQNConfig sets the SQN profile of 3GPP TS 33.102 Annex C, where
+// SQN = SEQ || IND. Zero values select the defaults.
+type SQNConfig struct {
+	// Bits of IND, the index of the SQN array (C.1.2)
+	INDLen int
+	// Largest accepted difference between SEQ and the highest SEQ_MS,
+	// protecting against the wrap around of SQN (C.2.2)
+	Delta uint64
+	// Largest accepted age of SEQ, behind the highest SEQ_MS. The ageing
+	// is disabled if zero (C.2.2).
+	L uint64
+}
+
+func (c SQNConfig) withDefaults() (SQNConfig, error) {
+	if c.INDLen == 0 {
+		c.INDLen = DefaultINDLen
+	}
+	if c.Delta == 0 {
+		c.Delta = DefaultDelta
+	}
+	if c.INDLen < 0 || c.INDLen > 16 {
+		return c, errors.Errorf("Invalid IND length %d", c.INDLen)
+	}
+	return c, nil
+}
+
+func (c SQNConfig) split(sqn uint64) (seq, ind uint64) {
+	return sqn >> c.INDLen, sqn & (1<<c.INDLen - 1)
+}
+
+// SQNArray verifies the freshness of SQN on the USIM side, with the
+// highest SEQ_MS accepted for each IND (3GPP TS 33.102 - C.2)
+type SQNArray struct {
+	config SQNConfig
+	seqMS  []uint64
+	// Highest accepted SQN, returned in AUTS
+	sqnMS uint64
+}
+
+func NewSQNArray(config SQNConfig) (*SQNArray, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewSQNArray()")
+	}
+	return &SQNArray{
+		config: config,
+		seqMS:  make([]uint64, 1<<config.INDLen),
+	}, nil
+}
+
+// SQNMS returns the highest accepted SQN
+func (a *SQNArray) SQNMS() uint64 {
+	return a.sqnMS
+}
+
+// Check reports whether SQN is acceptable: SEQ is not too far ahead of the
+// highest SEQ_MS, is above the SEQ_MS of its IND, and is not too old
+func (a *SQNArray) Check(sqn uint64) bool {
+	seq, ind := a.config.split(sqn & sqnMask)
+	highestSEQ, _ := a.config.split(a.sqnMS)
+	if seq > highestSEQ && seq-highestSEQ > a.config.Delta {
+		return false
+	}
+	if seq <= a.seqMS[ind] {
+		return false
+	}
+	if a.config.L != 0 && highestSEQ > seq && highestSEQ-seq > a.config.L {
+		return false
+	}
+	return true
+}
+
+// Accept records the SQN of a successful authentication
+func (a *SQNArray) Accept(sqn uint64) {
+	sqn &= sqnMask
+	seq, ind := a.config.split(sqn)
+	a.seqMS[ind] = seq
+	if sqn > a.sqnMS {
+		a.sqnMS = sqn
+	}
+}
+
+// SQNGenerator generates the SQN of the authentication vectors on the HE
+// side. SEQ_HE is incremented for each vector, and IND cycles through the
+// array (3GPP TS 33.102 - C.1.1, C.3.2).
+type SQNGenerator struct {
+	config SQNConfig
+	seqHE  uint64
+	ind    uint64
+}
+
+// NewSQNGenerator starts after the given SQN
+func NewSQNGenerator(config SQNConfig, sqn uint64) (*SQNGenerator, error) {
+	config, err := config.withDefaults()
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewSQNGenerator()")
+	}
+	seq, ind := config.split(sqn & sqnMask)
+	return &SQNGenerator{config: config, seqHE: seq, ind: ind}, nil
+}
+
+// Next returns the SQN of a new authentication vector
+func (g *SQNGenerator) Next() uint64 {
+	g.seqHE++
+	g.ind = (g.ind + 1) & (1<<g.config.INDLen - 1)
+	return (g.seqHE<<g.config.INDLen | g.ind) & sqnMask
+}
+
+// Resynchronize sets SEQ_HE to the SEQ of SQN_MS received in AUTS
+// (3GPP TS 33.102 - C.3.4)
+func (g *SQNGenerator) Resynchronize(sqnMS uint64) {
+	g.seqHE, _ = g.config.split(sqnMS & sqnMask)
+}
+
+func sqnBytes(sqn uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], sqn)
+	return b[8-SQNLen:]
+}
+
+func sqnUint64(b []byte) uint64 {
+	var sqn [8]byte
+	copy(sqn[8-SQNLen:], b)
+	return binary.BigEndian.Uint64(sqn[:])
+}
@@ -0,0 +1,77 @@
+package usim
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQNArray(t *testing.T) {
+	// SQN = SEQ << 5 | IND
+	sqn := func(seq, ind uint64) uint64 { return seq<<DefaultINDLen | ind }
+
+	testCases := []struct {
+		name     string
+		config   SQNConfig
+		accepted []uint64
+		sqn      uint64
+		fresh    bool
+	}{
+		{"first", SQNConfig{}, nil, sqn(1, 0), true},
+		{"next SEQ", SQNConfig{}, []uint64{sqn(1, 0)}, sqn(2, 0), true},
+		{"replayed", SQNConfig{}, []uint64{sqn(1, 0)}, sqn(1, 0), false},
+		{"older SEQ of the IND", SQNConfig{}, []uint64{sqn(5, 3)}, sqn(4, 3), false},
+		{"older SEQ of another IND", SQNConfig{}, []uint64{sqn(5, 3)}, sqn(4, 2), true},
+		{"within delta", SQNConfig{Delta: 10}, []uint64{sqn(5, 0)}, sqn(15, 1), true},
+		{"beyond delta", SQNConfig{Delta: 10}, []uint64{sqn(5, 0)}, sqn(16, 1), false},
+		{"within ageing", SQNConfig{L: 3}, []uint64{sqn(10, 0)}, sqn(7, 1), true},
+		{"too old", SQNConfig{L: 3}, []uint64{sqn(10, 0)}, sqn(6, 1), false},
+		{"no ageing", SQNConfig{}, []uint64{sqn(1000, 0)}, sqn(1, 1), true},
+		{"IND length", SQNConfig{INDLen: 2}, []uint64{2<<2 | 1}, 2<<2 | 2, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			array, err := NewSQNArray(tc.config)
+			require.NoError(t, err)
+			for _, accepted := range tc.accepted {
+				require.True(t, array.Check(accepted))
+				array.Accept(accepted)
+			}
+			require.Equal(t, tc.fresh, array.Check(tc.sqn))
+		})
+	}
+
+	_, err := NewSQNArray(SQNConfig{INDLen: 17})
+	require.Error(t, err)
+}
+
+func TestSQNArraySQNMS(t *testing.T) {
+	array, err := NewSQNArray(SQNConfig{})
+	require.NoError(t, err)
+	array.Accept(5<<DefaultINDLen | 7)
+	array.Accept(3<<DefaultINDLen | 1)
+	require.Equal(t, uint64(5<<DefaultINDLen|7), array.SQNMS())
+}
+
+func TestSQNGenerator(t *testing.T) {
+	generator, err := NewSQNGenerator(SQNConfig{INDLen: 2}, 4<<2|2)
+	require.NoError(t, err)
+
+	// SEQ_HE is incremented and IND cycles
+	require.Equal(t, uint64(5<<2|3), generator.Next())
+	require.Equal(t, uint64(6<<2|0), generator.Next())
+	require.Equal(t, uint64(7<<2|1), generator.Next())
+
+	// SEQ_HE continues from SEQ_MS, whatever its IND
+	generator.Resynchronize(100<<2 | 3)
+	require.Equal(t, uint64(101<<2|2), generator.Next())
+
+	// Every generated SQN is accepted by the USIM in order
+	array, err := NewSQNArray(SQNConfig{INDLen: 2})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		sqn := generator.Next()
+		require.True(t, array.Check(sqn))
+		array.Accept(sqn)
+	}
+}
@@ -0,0 +1,250 @@
+package usim
+
+import (
+	"encoding/binary"
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+var _ Algorithm = &TUAK{}
+
+const tuakAlgorithmName = "TUAK1.0"
+
+// Bits of the INSTANCE octet (3GPP TS 35.231 - 6.1)
+const (
+	tuakInstanceF1     byte = 0x00
+	tuakInstanceF1Star byte = 0x80
+	tuakInstanceF2345  byte = 0x40
+	tuakInstanceF5Star byte = 0xc0
+	tuakInstanceCK256  byte = 0x04
+	tuakInstanceIK256  byte = 0x02
+	tuakInstanceK256   byte = 0x01
+)
+
+// TUAKConfig sets the output lengths (in bytes) and the Keccak iterations of
+// TUAK. Zero values select the defaults.
+type TUAKConfig struct {
+	MACLen int // 8 (default), 16 or 32
+	RESLen int // 4, 8 (default), 16 or 32
+	CKLen  int // 16 (default) or 32
+	IKLen  int // 16 (default) or 32
+	// Keccak permutations per function, 1 by default
+	Iterations int
+}
+
+// TUAK is the TUAK algorithm set based on Keccak (3GPP TS 35.231)
+type TUAK struct {
+	config TUAKConfig
+	k      []byte
+	topc   []byte
+}
+
+// NewTUAK derives TOPc from the operator variant TOP
+func NewTUAK(k, top []byte, config TUAKConfig) (*TUAK, error) {
+	if len(top) != 32 {
+		return nil, errors.Errorf("NewTUAK(): TOP is not 32 bytes")
+	}
+	t, err := NewTUAKTOPc(k, make([]byte, 32), config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewTUAK()")
+	}
+	t.topc = reversed(t.keccak(top, t.instance(0), nil, nil, nil)[:32])
+	return t, nil
+}
+
+// NewTUAKTOPc uses the TOPc stored in the USIM
+func NewTUAKTOPc(k, topc []byte, config TUAKConfig) (*TUAK, error) {
+	if len(k) != 16 && len(k) != 32 || len(topc) != 32 {
+		return nil, errors.Errorf("NewTUAKTOPc(): Invalid K or TOPc length")
+	}
+	if config.MACLen == 0 {
+		config.MACLen = 8
+	}
+	if config.RESLen == 0 {
+		config.RESLen = 8
+	}
+	if config.CKLen == 0 {
+		config.CKLen = 16
+	}
+	if config.IKLen == 0 {
+		config.IKLen = 16
+	}
+	if config.Iterations == 0 {
+		config.Iterations = 1
+	}
+	if config.MACLen != 8 && config.MACLen != 16 && config.MACLen != 32 ||
+		config.RESLen != 4 && config.RESLen != 8 && config.RESLen != 16 && config.RESLen != 32 ||
+		config.CKLen != 16 && config.CKLen != 32 || config.IKLen != 16 && config.IKLen != 32 ||
+		config.Iterations < 0 {
+		return nil, errors.Errorf("NewTUAKTOPc(): Invalid config %+v", config)
+	}
+	return &TUAK{
+		config: config,
+		k:      append([]byte{}, k...),
+		topc:   append([]byte{}, topc...),
+	}, nil
+}
+
+func (t *TUAK) TOPc() []byte {
+	return append([]byte{}, t.topc...)
+}
+
+func (t *TUAK) F1(rand, sqn, amf []byte) ([]byte, error) {
+	if err := checkF1Input(rand, sqn, amf); err != nil {
+		return nil, errors.Wrapf(err, "F1()")
+	}
+	out := t.keccak(t.topc, t.instance(tuakInstanceF1|tuakLengthBits(t.config.MACLen)<<3), rand, amf, sqn)
+	return reversed(out[:t.config.MACLen]), nil
+}
+
+func (t *TUAK) F1Star(rand, sqn, amf []byte) ([]byte, error) {
+	if err := checkF1Input(rand, sqn, amf); err != nil {
+		return nil, errors.Wrapf(err, "F1Star()")
+	}
+	out := t.keccak(t.topc, t.instance(tuakInstanceF1Star|tuakLengthBits(t.config.MACLen)<<3), rand, amf, sqn)
+	return reversed(out[:t.config.MACLen]), nil
+}
+
+func (t *TUAK) F2345(rand []byte) (res, ck, ik, ak []byte, err error) {
+	if len(rand) != RANDLen {
+		return nil, nil, nil, nil, errors.Errorf("F2345(): RAND is not %d bytes", RANDLen)
+	}
+	instance := tuakInstanceF2345 | tuakLengthBits(t.config.RESLen)<<3
+	if t.config.CKLen == 32 {
+		instance |= tuakInstanceCK256
+	}
+	if t.config.IKLen == 32 {
+		instance |= tuakInstanceIK256
+	}
+	out := t.keccak(t.topc, t.instance(instance), rand, nil, nil)
+	return reversed(out[:t.config.RESLen]), reversed(out[32 : 32+t.config.CKLen]),
+		reversed(out[64 : 64+t.config.IKLen]), reversed(out[96 : 96+SQNLen]), nil
+}
+
+func (t *TUAK) F5Star(rand []byte) ([]byte, error) {
+	if len(rand) != RANDLen {
+		return nil, errors.Errorf("F5Star(): RAND is not %d bytes", RANDLen)
+	}
+	out := t.keccak(t.topc, t.instance(tuakInstanceF5Star), rand, nil, nil)
+	return reversed(out[96 : 96+SQNLen]), nil
+}
+
+// instance sets the key length bit of the INSTANCE octet
+func (t *TUAK) instance(instance byte) byte {
+	if len(t.k) == 32 {
+		instance |= tuakInstanceK256
+	}
+	return instance
+}
+
+// tuakLengthBits encodes the output length in the 3 bits of INSTANCE: 32
+// bits is 0, 64 bits is 1, 128 bits is 2 and 256 bits is 4
+func tuakLengthBits(length int) byte {
+	switch length {
+	case 8:
+		return 1
+	case 16:
+		return 2
+	case 32:
+		return 4
+	}
+	return 0
+}
+
+// keccak fills the 1600-bit INOUT with the inputs, each in reversed byte
+// order, and returns it after the Keccak permutations (3GPP TS 35.231 - 6)
+func (t *TUAK) keccak(top []byte, instance byte, rand, amf, sqn []byte) []byte {
+	inout := make([]byte, 200)
+	copy(inout[0:32], reversed(top))
+	inout[32] = instance
+	copy(inout[33:40], reversed([]byte(tuakAlgorithmName)))
+	if rand != nil {
+		copy(inout[40:56], reversed(rand))
+	}
+	if amf != nil {
+		copy(inout[56:58], reversed(amf))
+		copy(inout[58:64], reversed(sqn))
+	}
+	copy(inout[64:96], reversed(t.k))
+	inout[96] = 0x1f
+	inout[135] = 0x80
+
+	var state [25]uint64
+	for i := range state {
+		state[i] = binary.LittleEndian.Uint64(inout[8*i:])
+	}
+	for i := 0; i < t.config.Iterations; i++ {
+		keccakF1600(&state)
+	}
+	for i := range state {
+		binary.LittleEndian.PutUint64(inout[8*i:], state[i])
+	}
+	return inout
+}
+
+func checkF1Input(rand, sqn, amf []byte) error {
+	if len(rand) != RANDLen || len(sqn) != SQNLen || len(amf) != AMFLen {
+		return errors.Errorf("RAND, SQN or AMF length is invalid")
+	}
+	return nil
+}
+
+func reversed(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+// Round constants and rotation offsets of Keccak-f[1600], indexed by x+5y
+var (
+	keccakRoundConstants = [24]uint64{
+		0x0000000000000001, 0x0000000000008082, 0x800000000000808a, 0x8000000080008000,
+		0x000000000000808b, 0x0000000080000001, 0x8000000080008081, 0x8000000000008009,
+		0x000000000000008a, 0x0000000000000088, 0x0000000080008009, 0x000000008000000a,
+		0x000000008000808b, 0x800000000000008b, 0x8000000000008089, 0x8000000000008003,
+		0x8000000000008002, 0x8000000000000080, 0x000000000000800a, 0x800000008000000a,
+		0x8000000080008081, 0x8000000000008080, 0x0000000080000001, 0x8000000080008008,
+	}
+	keccakRotations = [25]int{
+		0, 1, 62, 28, 27,
+		36, 44, 6, 55, 20,
+		3, 10, 43, 25, 39,
+		41, 45, 15, 21, 8,
+		18, 2, 61, 56, 14,
+	}
+)
+
+// keccakF1600 is the Keccak-f[1600] permutation (FIPS 202 - 3.3)
+func keccakF1600(a *[25]uint64) {
+	var c [5]uint64
+	var b [25]uint64
+	for round := 0; round < 24; round++ {
+		// θ
+		for x := 0; x < 5; x++ {
+			c[x] = a[x] ^ a[x+5] ^ a[x+10] ^ a[x+15] ^ a[x+20]
+		}
+		for x := 0; x < 5; x++ {
+			d := c[(x+4)%5] ^ bits.RotateLeft64(c[(x+1)%5], 1)
+			for y := 0; y < 25; y += 5 {
+				a[x+y] ^= d
+			}
+		}
+		// ρ and π
+		for x := 0; x < 5; x++ {
+			for y := 0; y < 5; y++ {
+				b[y+5*((2*x+3*y)%5)] = bits.RotateLeft64(a[x+5*y], keccakRotations[x+5*y])
+			}
+		}
+		// χ
+		for y := 0; y < 25; y += 5 {
+			for x := 0; x < 5; x++ {
+				a[x+y] = b[x+y] ^ (^b[(x+1)%5+y] & b[(x+2)%5+y])
+			}
+		}
+		// ι
+		a[0] ^= keccakRoundConstants[round]
+	}
+}
@@ -0,0 +1,95 @@
+package usim
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 3GPP TS 35.232 - 6.3 Test Set 1
+func TestTUAK(t *testing.T) {
+	k := bytes.Repeat([]byte{0xab}, 16)
+	rand := bytes.Repeat([]byte{0x42}, RANDLen)
+	sqn := mustHex(t, "111111111111")
+	amf := mustHex(t, "ffff")
+	config := TUAKConfig{MACLen: 8, RESLen: 4, CKLen: 16, IKLen: 16, Iterations: 1}
+
+	tuak, err := NewTUAK(k, bytes.Repeat([]byte{0x55}, 32), config)
+	require.NoError(t, err)
+	require.Equal(t, mustHex(t, "bd04d9530e87513c5d837ac2ad954623a8e2330c115305a73eb45d1f40cccbff"), tuak.TOPc())
+
+	fromTOPc, err := NewTUAKTOPc(k, tuak.TOPc(), config)
+	require.NoError(t, err)
+
+	for _, tuak := range []*TUAK{tuak, fromTOPc} {
+		macA, err := tuak.F1(rand, sqn, amf)
+		require.NoError(t, err)
+		require.Equal(t, mustHex(t, "f9a54e6aeaa8618d"), macA)
+
+		macS, err := tuak.F1Star(rand, sqn, amf)
+		require.NoError(t, err)
+		require.Equal(t, mustHex(t, "e94b4dc6c7297df3"), macS)
+
+		res, ck, ik, ak, err := tuak.F2345(rand)
+		require.NoError(t, err)
+		require.Equal(t, mustHex(t, "657acd64"), res)
+		require.Equal(t, mustHex(t, "d71a1e5c6caffe986a26f783e5c78be1"), ck)
+		require.Equal(t, mustHex(t, "be849fa2564f869aecee6f62d4337e72"), ik)
+		require.Equal(t, mustHex(t, "719f1e9b9054"), ak)
+
+		akStar, err := tuak.F5Star(rand)
+		require.NoError(t, err)
+		require.Equal(t, mustHex(t, "e7af6b3d0e38"), akStar)
+	}
+}
+
+func TestTUAKOutputLengths(t *testing.T) {
+	k := bytes.Repeat([]byte{0xab}, 32)
+	rand := bytes.Repeat([]byte{0x42}, RANDLen)
+	config := TUAKConfig{MACLen: 32, RESLen: 16, CKLen: 32, IKLen: 32, Iterations: 2}
+
+	tuak, err := NewTUAK(k, bytes.Repeat([]byte{0x55}, 32), config)
+	require.NoError(t, err)
+	macA, err := tuak.F1(rand, make([]byte, SQNLen), make([]byte, AMFLen))
+	require.NoError(t, err)
+	require.Len(t, macA, 32)
+	res, ck, ik, ak, err := tuak.F2345(rand)
+	require.NoError(t, err)
+	require.Len(t, res, 16)
+	require.Len(t, ck, 32)
+	require.Len(t, ik, 32)
+	require.Len(t, ak, SQNLen)
+
+	// The lengths are bound into INSTANCE, so shorter outputs are not
+	// truncations
+	short, err := NewTUAK(k, bytes.Repeat([]byte{0x55}, 32), TUAKConfig{Iterations: 2})
+	require.NoError(t, err)
+	shortRES, shortCK, _, _, err := short.F2345(rand)
+	require.NoError(t, err)
+	require.NotEqual(t, res[:8], shortRES)
+	require.NotEqual(t, ck[:16], shortCK)
+}
+
+func TestTUAKInvalid(t *testing.T) {
+	testCases := []struct {
+		name   string
+		k      []byte
+		top    []byte
+		config TUAKConfig
+	}{
+		{"K length", make([]byte, 24), make([]byte, 32), TUAKConfig{}},
+		{"TOP length", make([]byte, 16), make([]byte, 16), TUAKConfig{}},
+		{"MAC length", make([]byte, 16), make([]byte, 32), TUAKConfig{MACLen: 4}},
+		{"RES length", make([]byte, 16), make([]byte, 32), TUAKConfig{RESLen: 6}},
+		{"CK length", make([]byte, 16), make([]byte, 32), TUAKConfig{CKLen: 8}},
+		{"IK length", make([]byte, 16), make([]byte, 32), TUAKConfig{IKLen: 24}},
+		{"iterations", make([]byte, 16), make([]byte, 32), TUAKConfig{Iterations: -1}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewTUAK(tc.k, tc.top, tc.config)
+			require.Error(t, err)
+		})
+	}
+}
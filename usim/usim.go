@@ -0,0 +1,266 @@
+// Package usim simulates the AKA of the USIM and of the AuC, with the
+// MILENAGE and TUAK algorithm sets
+package usim
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/eapaka"
+)
+
+const (
+	RANDLen = 16
+	SQNLen  = 6
+	AMFLen  = 2
+)
+
+// fcCKPrimeIKPrime is the FC of the CK' and IK' derivation (3GPP TS 33.402 - A.2)
+const fcCKPrimeIKPrime byte = 0x20
+
+var (
+	_ eapaka.USIM = &USIM{}
+	_ eapaka.AuC  = &AuC{}
+)
+
+// resyncAMF is the dummy AMF of MAC-S in AUTS (3GPP TS 33.102 - 6.3.3)
+var resyncAMF = make([]byte, AMFLen)
+
+// Algorithm is the set of authentication functions f1 to f5* (3GPP TS
+// 33.102 - 6.3)
+type Algorithm interface {
+	// F1 returns MAC-A
+	F1(rand, sqn, amf []byte) ([]byte, error)
+	// F1Star returns MAC-S
+	F1Star(rand, sqn, amf []byte) ([]byte, error)
+	// F2345 returns RES, CK, IK and AK
+	F2345(rand []byte) (res, ck, ik, ak []byte, err error)
+	// F5Star returns the AK of AUTS
+	F5Star(rand []byte) ([]byte, error)
+}
+
+// DeriveCKPrimeIKPrime derives CK' and IK' for the serving network name, from
+// the SQN XOR AK of AUTN (3GPP TS 33.402 - A.2)
+func DeriveCKPrimeIKPrime(ck, ik []byte, networkName string, sqnXorAK []byte) (ckPrime, ikPrime []byte, err error) {
+	if len(sqnXorAK) != SQNLen {
+		return nil, nil, errors.Errorf("DeriveCKPrimeIKPrime(): SQN XOR AK is not %d bytes", SQNLen)
+	}
+	if networkName == "" || len(networkName) > 0xffff {
+		return nil, nil, errors.Errorf("DeriveCKPrimeIKPrime(): Invalid network name length %d", len(networkName))
+	}
+
+	s := []byte{fcCKPrimeIKPrime}
+	s = append(s, networkName...)
+	s = binary.BigEndian.AppendUint16(s, uint16(len(networkName)))
+	s = append(s, sqnXorAK...)
+	s = binary.BigEndian.AppendUint16(s, SQNLen)
+
+	mac := hmac.New(sha256.New, append(append([]byte{}, ck...), ik...))
+	mac.Write(s)
+	key := mac.Sum(nil)
+	return key[:16], key[16:], nil
+}
+
+// USIM runs AKA on the peer side (3GPP TS 33.102 - 6.3.3)
+type USIM struct {
+	algorithm Algorithm
+	sqn       *SQNArray
+}
+
+func NewUSIM(algorithm Algorithm, config SQNConfig) (*USIM, error) {
+	if algorithm == nil {
+		return nil, errors.Errorf("NewUSIM(): Algorithm is missing")
+	}
+	sqn, err := NewSQNArray(config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewUSIM()")
+	}
+	return &USIM{algorithm: algorithm, sqn: sqn}, nil
+}
+
+// SQNMS returns the highest SQN accepted by the USIM
+func (u *USIM) SQNMS() uint64 {
+	return u.sqn.SQNMS()
+}
+
+// AKA verifies AUTN = SQN XOR AK || AMF || MAC-A, and returns RES, CK and
+// IK. The SQN out of range fails with eapaka.ErrSyncFailure and AUTS.
+func (u *USIM) AKA(rand, autn []byte) (res, ck, ik, auts []byte, err error) {
+	if len(autn) <= SQNLen+AMFLen {
+		return nil, nil, nil, nil, errors.Errorf("AKA(): AUTN is too short")
+	}
+	res, ck, ik, ak, err := u.algorithm.F2345(rand)
+	if err != nil {
+		return nil, nil, nil, nil, errors.Wrapf(err, "AKA()")
+	}
+	sqn := append([]byte{}, autn[:SQNLen]...)
+	xor(sqn, ak)
+	amf := autn[SQNLen : SQNLen+AMFLen]
+
+	xmac, err := u.algorithm.F1(rand, sqn, amf)
+	if err != nil {
+		return nil, nil, nil, nil, errors.Wrapf(err, "AKA()")
+	}
+	if !hmac.Equal(xmac, autn[SQNLen+AMFLen:]) {
+		return nil, nil, nil, nil, eapaka.ErrMACFailure
+	}
+
+	if !u.sqn.Check(sqnUint64(sqn)) {
+		if auts, err = u.auts(rand); err != nil {
+			return nil, nil, nil, nil, errors.Wrapf(err, "AKA()")
+		}
+		return nil, nil, nil, auts, eapaka.ErrSyncFailure
+	}
+	u.sqn.Accept(sqnUint64(sqn))
+	return res, ck, ik, nil, nil
+}
+
+// Authenticate runs AKA, and derives CK' and IK' for the network name
+func (u *USIM) Authenticate(rand, autn []byte, networkName string) (res, ckPrime, ikPrime, auts []byte, err error) {
+	res, ck, ik, auts, err := u.AKA(rand, autn)
+	if err != nil {
+		return nil, nil, nil, auts, err
+	}
+	ckPrime, ikPrime, err = DeriveCKPrimeIKPrime(ck, ik, networkName, autn[:SQNLen])
+	if err != nil {
+		return nil, nil, nil, nil, errors.Wrapf(err, "Authenticate()")
+	}
+	return res, ckPrime, ikPrime, nil, nil
+}
+
+// auts returns AUTS = SQN_MS XOR AK* || MAC-S (3GPP TS 33.102 - 6.3.5)
+func (u *USIM) auts(rand []byte) ([]byte, error) {
+	sqnMS := sqnBytes(u.sqn.SQNMS())
+	macS, err := u.algorithm.F1Star(rand, sqnMS, resyncAMF)
+	if err != nil {
+		return nil, err
+	}
+	akStar, err := u.algorithm.F5Star(rand)
+	if err != nil {
+		return nil, err
+	}
+	xor(sqnMS, akStar)
+	return append(sqnMS, macS...), nil
+}
+
+// Vector is an AKA authentication vector (3GPP TS 33.102 - 6.3.2)
+type Vector struct {
+	RAND []byte
+	XRES []byte
+	CK   []byte
+	IK   []byte
+	AUTN []byte
+}
+
+// AuC generates the authentication vectors of one subscriber, whatever the
+// identity it is asked for
+type AuC struct {
+	algorithm Algorithm
+	amf       []byte
+
+	mu  sync.Mutex
+	sqn *SQNGenerator
+}
+
+// NewAuC generates the vectors with the AMF, and the SQN following sqn
+func NewAuC(algorithm Algorithm, amf []byte, sqn uint64, config SQNConfig) (*AuC, error) {
+	if algorithm == nil {
+		return nil, errors.Errorf("NewAuC(): Algorithm is missing")
+	}
+	if len(amf) != AMFLen {
+		return nil, errors.Errorf("NewAuC(): AMF is not %d bytes", AMFLen)
+	}
+	generator, err := NewSQNGenerator(config, sqn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "NewAuC()")
+	}
+	return &AuC{
+		algorithm: algorithm,
+		amf:       append([]byte{}, amf...),
+		sqn:       generator,
+	}, nil
+}
+
+// Vector returns a new authentication vector with a random RAND
+func (a *AuC) Vector() (*Vector, error) {
+	r := make([]byte, RANDLen)
+	if _, err := rand.Read(r); err != nil {
+		return nil, errors.Wrapf(err, "Vector()")
+	}
+	a.mu.Lock()
+	sqn := sqnBytes(a.sqn.Next())
+	a.mu.Unlock()
+
+	vector, err := a.vector(r, sqn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Vector()")
+	}
+	return vector, nil
+}
+
+func (a *AuC) vector(rand, sqn []byte) (*Vector, error) {
+	macA, err := a.algorithm.F1(rand, sqn, a.amf)
+	if err != nil {
+		return nil, err
+	}
+	xres, ck, ik, ak, err := a.algorithm.F2345(rand)
+	if err != nil {
+		return nil, err
+	}
+	autn := append([]byte{}, sqn...)
+	xor(autn, ak)
+	autn = append(append(autn, a.amf...), macA...)
+	return &Vector{RAND: rand, XRES: xres, CK: ck, IK: ik, AUTN: autn}, nil
+}
+
+// AuthenticationVector returns a new EAP-AKA' authentication vector, whose
+// CK' and IK' are derived for the network name
+func (a *AuC) AuthenticationVector(identity, networkName string) (*eapaka.AuthenticationVector, error) {
+	vector, err := a.Vector()
+	if err != nil {
+		return nil, errors.Wrapf(err, "AuthenticationVector()")
+	}
+	ckPrime, ikPrime, err := DeriveCKPrimeIKPrime(vector.CK, vector.IK, networkName, vector.AUTN[:SQNLen])
+	if err != nil {
+		return nil, errors.Wrapf(err, "AuthenticationVector()")
+	}
+	return &eapaka.AuthenticationVector{
+		RAND:    vector.RAND,
+		AUTN:    vector.AUTN,
+		XRES:    vector.XRES,
+		CKPrime: ckPrime,
+		IKPrime: ikPrime,
+	}, nil
+}
+
+// Resynchronize verifies MAC-S of AUTS, and continues the SQN from SQN_MS
+// (3GPP TS 33.102 - 6.3.5)
+func (a *AuC) Resynchronize(identity string, rand, auts []byte) error {
+	if len(auts) <= SQNLen {
+		return errors.Errorf("Resynchronize(): AUTS is too short")
+	}
+	akStar, err := a.algorithm.F5Star(rand)
+	if err != nil {
+		return errors.Wrapf(err, "Resynchronize()")
+	}
+	sqnMS := append([]byte{}, auts[:SQNLen]...)
+	xor(sqnMS, akStar)
+
+	xmacS, err := a.algorithm.F1Star(rand, sqnMS, resyncAMF)
+	if err != nil {
+		return errors.Wrapf(err, "Resynchronize()")
+	}
+	if !hmac.Equal(xmacS, auts[SQNLen:]) {
+		return errors.Errorf("Resynchronize(): MAC-S mismatch")
+	}
+
+	a.mu.Lock()
+	a.sqn.Resynchronize(sqnUint64(sqnMS))
+	a.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,181 @@
+package usim
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	eap_message "github.com/guoweifk/n3iwue_ike_gw/eap"
+	"github.com/guoweifk/n3iwue_ike_gw/eapaka"
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+const (
+	testIdentity    = "0208930000000001@nai.5gc.mnc093.mcc208.3gppnetwork.org"
+	testNetworkName = "5G:mnc093.mcc208.3gppnetwork.org"
+)
+
+// RFC 5448 - Appendix C, Case 1
+func TestDeriveCKPrimeIKPrime(t *testing.T) {
+	ckPrime, ikPrime, err := DeriveCKPrimeIKPrime(
+		mustHex(t, "5349fbe098649f948f5d2e973a81c00f"),
+		mustHex(t, "9744871ad32bf9bbd1dd5ce54e3e2e5a"),
+		"WLAN", mustHex(t, "bb52e91c747a"))
+	require.NoError(t, err)
+	require.Equal(t, mustHex(t, "0093962d0dd84aa5684b045c9edffa04"), ckPrime)
+	require.Equal(t, mustHex(t, "ccfc230ca74fcc96c0a5d61164f5a76c"), ikPrime)
+
+	_, _, err = DeriveCKPrimeIKPrime(make([]byte, 16), make([]byte, 16), "", make([]byte, SQNLen))
+	require.Error(t, err)
+	_, _, err = DeriveCKPrimeIKPrime(make([]byte, 16), make([]byte, 16), "WLAN", make([]byte, 5))
+	require.Error(t, err)
+}
+
+func testAlgorithms(t *testing.T) map[string]Algorithm {
+	milenage, err := NewMilenage(
+		mustHex(t, "465b5ce8b199b49faa5f0a2ee238a6bc"), mustHex(t, "cdc202d5123e20f62b6d676ac72cb318"))
+	require.NoError(t, err)
+	tuak, err := NewTUAK(
+		mustHex(t, "abababababababababababababababab"), make([]byte, 32), TUAKConfig{})
+	require.NoError(t, err)
+	return map[string]Algorithm{"MILENAGE": milenage, "TUAK": tuak}
+}
+
+func newTestUSIMAuC(t *testing.T, algorithm Algorithm, sqnHE uint64) (*USIM, *AuC) {
+	usim, err := NewUSIM(algorithm, SQNConfig{})
+	require.NoError(t, err)
+	auc, err := NewAuC(algorithm, mustHex(t, "8000"), sqnHE, SQNConfig{})
+	require.NoError(t, err)
+	return usim, auc
+}
+
+func TestAKA(t *testing.T) {
+	for name, algorithm := range testAlgorithms(t) {
+		t.Run(name, func(t *testing.T) {
+			usim, auc := newTestUSIMAuC(t, algorithm, 0)
+
+			for i := 0; i < 3; i++ {
+				vector, err := auc.Vector()
+				require.NoError(t, err)
+				res, ck, ik, auts, err := usim.AKA(vector.RAND, vector.AUTN)
+				require.NoError(t, err)
+				require.Nil(t, auts)
+				require.Equal(t, vector.XRES, res)
+				require.Equal(t, vector.CK, ck)
+				require.Equal(t, vector.IK, ik)
+
+				// A replayed AUTN is not fresh anymore
+				_, _, _, auts, err = usim.AKA(vector.RAND, vector.AUTN)
+				require.True(t, errors.Is(err, eapaka.ErrSyncFailure))
+				require.NotNil(t, auts)
+			}
+
+			// Corrupted MAC
+			vector, err := auc.Vector()
+			require.NoError(t, err)
+			vector.AUTN[len(vector.AUTN)-1] ^= 0x01
+			_, _, _, _, err = usim.AKA(vector.RAND, vector.AUTN)
+			require.True(t, errors.Is(err, eapaka.ErrMACFailure))
+
+			_, _, _, _, err = usim.AKA(vector.RAND, vector.AUTN[:SQNLen+AMFLen])
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestAKAResynchronization(t *testing.T) {
+	for name, algorithm := range testAlgorithms(t) {
+		t.Run(name, func(t *testing.T) {
+			usim, auc := newTestUSIMAuC(t, algorithm, 0)
+			// The USIM has accepted a higher SQN than the AuC
+			_, aucAhead := newTestUSIMAuC(t, algorithm, 1000<<DefaultINDLen)
+			vector, err := aucAhead.Vector()
+			require.NoError(t, err)
+			_, _, _, _, err = usim.AKA(vector.RAND, vector.AUTN)
+			require.NoError(t, err)
+			sqnMS := usim.SQNMS()
+
+			vector, err = auc.Vector()
+			require.NoError(t, err)
+			_, _, _, auts, err := usim.AKA(vector.RAND, vector.AUTN)
+			require.True(t, errors.Is(err, eapaka.ErrSyncFailure))
+
+			// Corrupted MAC-S
+			corrupted := append([]byte{}, auts...)
+			corrupted[len(corrupted)-1] ^= 0x01
+			require.Error(t, auc.Resynchronize(testIdentity, vector.RAND, corrupted))
+			require.Error(t, auc.Resynchronize(testIdentity, vector.RAND, auts[:SQNLen]))
+
+			require.NoError(t, auc.Resynchronize(testIdentity, vector.RAND, auts))
+			vector, err = auc.Vector()
+			require.NoError(t, err)
+			_, _, _, _, err = usim.AKA(vector.RAND, vector.AUTN)
+			require.NoError(t, err)
+			require.Greater(t, usim.SQNMS(), sqnMS)
+		})
+	}
+}
+
+func TestNewUSIMAuC(t *testing.T) {
+	_, err := NewUSIM(nil, SQNConfig{})
+	require.Error(t, err)
+	_, err = NewAuC(nil, make([]byte, AMFLen), 0, SQNConfig{})
+	require.Error(t, err)
+
+	algorithm := testAlgorithms(t)["MILENAGE"]
+	_, err = NewUSIM(algorithm, SQNConfig{INDLen: -1})
+	require.Error(t, err)
+	_, err = NewAuC(algorithm, make([]byte, 3), 0, SQNConfig{})
+	require.Error(t, err)
+}
+
+// runEAPAKAPrime runs EAP-AKA' between the peer and the server until the
+// server ends it
+func runEAPAKAPrime(t *testing.T, usim *USIM, auc *AuC) (*eapaka.Peer, *eapaka.Server) {
+	peer, err := eapaka.NewPeer(eapaka.PeerConfig{
+		Identity: testIdentity, NetworkName: testNetworkName, USIM: usim,
+	})
+	require.NoError(t, err)
+	server, err := eapaka.NewServer(eapaka.ServerConfig{NetworkName: testNetworkName, AuC: auc})
+	require.NoError(t, err)
+
+	request, err := server.Start(&message.IdentificationInitiator{
+		IDType: message.ID_FQDN, IDData: []byte(testIdentity),
+	})
+	require.NoError(t, err)
+	for request.Code == eap_message.EapCodeRequest {
+		response, err := peer.HandleRequest(request)
+		require.NoError(t, err)
+		request, err = server.HandleResponse(response)
+		require.NoError(t, err)
+	}
+	return peer, server
+}
+
+func TestEAPAKAPrime(t *testing.T) {
+	for name, algorithm := range testAlgorithms(t) {
+		t.Run(name, func(t *testing.T) {
+			usim, auc := newTestUSIMAuC(t, algorithm, 0)
+			peer, server := runEAPAKAPrime(t, usim, auc)
+			require.Equal(t, eapaka.StateSuccess, server.State())
+			require.NotNil(t, server.MSK())
+			require.Equal(t, server.MSK(), peer.MSK())
+			require.Equal(t, server.EMSK(), peer.EMSK())
+		})
+	}
+}
+
+func TestEAPAKAPrimeResynchronization(t *testing.T) {
+	algorithm := testAlgorithms(t)["MILENAGE"]
+	usim, auc := newTestUSIMAuC(t, algorithm, 0)
+	_, aucAhead := newTestUSIMAuC(t, algorithm, 1000<<DefaultINDLen)
+	vector, err := aucAhead.Vector()
+	require.NoError(t, err)
+	_, _, _, _, err = usim.AKA(vector.RAND, vector.AUTN)
+	require.NoError(t, err)
+
+	peer, server := runEAPAKAPrime(t, usim, auc)
+	require.Equal(t, eapaka.StateSuccess, server.State())
+	require.Equal(t, server.MSK(), peer.MSK())
+}
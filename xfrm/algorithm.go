@@ -0,0 +1,88 @@
+package xfrm
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+)
+
+// Crypto API names of the encryption transforms. The keys of AES-CTR and
+// AES-GCM include their nonce and salt, as in the keying material.
+var encrAlgorithms = map[uint16]string{
+	message.ENCR_AES_CBC:    "cbc(aes)",
+	message.ENCR_AES_CTR:    "rfc3686(ctr(aes))",
+	message.ENCR_AES_GCM_8:  "rfc4106(gcm(aes))",
+	message.ENCR_AES_GCM_12: "rfc4106(gcm(aes))",
+	message.ENCR_AES_GCM_16: "rfc4106(gcm(aes))",
+}
+
+// ICV length in bits of the combined mode transforms
+var aeadICVLengths = map[uint16]uint32{
+	message.ENCR_AES_GCM_8:  64,
+	message.ENCR_AES_GCM_12: 96,
+	message.ENCR_AES_GCM_16: 128,
+}
+
+type integAlgorithm struct {
+	name string
+	// Truncation length in bits
+	truncation uint32
+}
+
+// Crypto API names of the integrity transforms
+var integAlgorithms = map[uint16]integAlgorithm{
+	message.AUTH_HMAC_MD5_96:       {name: "hmac(md5)", truncation: 96},
+	message.AUTH_HMAC_SHA1_96:      {name: "hmac(sha1)", truncation: 96},
+	message.AUTH_AES_XCBC_96:       {name: "xcbc(aes)", truncation: 96},
+	message.AUTH_AES_CMAC_96:       {name: "cmac(aes)", truncation: 96},
+	message.AUTH_HMAC_SHA2_256_128: {name: "hmac(sha256)", truncation: 128},
+	message.AUTH_HMAC_SHA2_384_192: {name: "hmac(sha384)", truncation: 192},
+	message.AUTH_HMAC_SHA2_512_256: {name: "hmac(sha512)", truncation: 256},
+}
+
+// algorithmAttributes returns the XFRMA_ALG_AEAD attribute of a combined mode
+// transform, or the XFRMA_ALG_CRYPT and XFRMA_ALG_AUTH_TRUNC attributes
+func algorithmAttributes(key *security.ChildSAKey, encKey, integKey []byte) ([][]byte, error) {
+	encrID := key.EncrKInfo.TransformID()
+	encrName, ok := encrAlgorithms[encrID]
+	if !ok {
+		return nil, errors.Errorf("Unsupported encryption transform %d", encrID)
+	}
+
+	if key.EncrKInfo.IsAEAD() {
+		// xfrm_algo_aead
+		alg := make([]byte, algNameLen+8, algNameLen+8+len(encKey))
+		copy(alg, encrName)
+		binary.NativeEndian.PutUint32(alg[algNameLen:algNameLen+4], uint32(len(encKey)*8))
+		binary.NativeEndian.PutUint32(alg[algNameLen+4:algNameLen+8], aeadICVLengths[encrID])
+		alg = append(alg, encKey...)
+		return [][]byte{attribute(attrAlgAEAD, alg)}, nil
+	}
+
+	if key.IntegKInfo == nil {
+		return nil, errors.Errorf("No integrity transform for encryption transform %d", encrID)
+	}
+	integID := key.IntegKInfo.TransformID()
+	integ, ok := integAlgorithms[integID]
+	if !ok {
+		return nil, errors.Errorf("Unsupported integrity transform %d", integID)
+	}
+
+	// xfrm_algo
+	crypt := make([]byte, algNameLen+4, algNameLen+4+len(encKey))
+	copy(crypt, encrName)
+	binary.NativeEndian.PutUint32(crypt[algNameLen:algNameLen+4], uint32(len(encKey)*8))
+	crypt = append(crypt, encKey...)
+
+	// xfrm_algo_auth
+	auth := make([]byte, algNameLen+8, algNameLen+8+len(integKey))
+	copy(auth, integ.name)
+	binary.NativeEndian.PutUint32(auth[algNameLen:algNameLen+4], uint32(len(integKey)*8))
+	binary.NativeEndian.PutUint32(auth[algNameLen+4:algNameLen+8], integ.truncation)
+	auth = append(auth, integKey...)
+
+	return [][]byte{attribute(attrAlgCrypt, crypt), attribute(attrAlgAuthTrunc, auth)}, nil
+}
@@ -0,0 +1,33 @@
+package xfrm
+
+import (
+	"sync"
+)
+
+// FakeConn records the requests instead of sending them to the kernel
+type FakeConn struct {
+	mu       sync.Mutex
+	Messages [][]byte
+	// Err is returned by Execute, if set
+	Err    error
+	Closed bool
+}
+
+var _ Conn = &FakeConn{}
+
+func (c *FakeConn) Execute(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Err != nil {
+		return c.Err
+	}
+	c.Messages = append(c.Messages, append([]byte{}, msg...))
+	return nil
+}
+
+func (c *FakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Closed = true
+	return nil
+}
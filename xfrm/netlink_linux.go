@@ -0,0 +1,81 @@
+//go:build linux
+
+package xfrm
+
+import (
+	"encoding/binary"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// netlinkConn is a NETLINK_XFRM socket
+type netlinkConn struct {
+	mu  sync.Mutex
+	fd  int
+	seq uint32
+	buf []byte
+}
+
+var _ Conn = &netlinkConn{}
+
+// Dial opens a NETLINK_XFRM socket in the network namespace of the process,
+// which needs CAP_NET_ADMIN
+func Dial() (Conn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_XFRM)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Dial(): socket")
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrapf(err, "Dial(): bind")
+	}
+	return &netlinkConn{
+		fd:  fd,
+		buf: make([]byte, syscall.Getpagesize()),
+	}, nil
+}
+
+// Execute sends the request and returns the error of its acknowledgment
+func (c *netlinkConn) Execute(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	binary.NativeEndian.PutUint32(msg[8:12], c.seq)
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return errors.Wrapf(err, "Execute(): sendto")
+	}
+
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, c.buf, 0)
+		if err != nil {
+			return errors.Wrapf(err, "Execute(): recvfrom")
+		}
+		for reply := c.buf[:n]; len(reply) >= nlmsgHeaderLen; {
+			length := int(binary.NativeEndian.Uint32(reply[0:4]))
+			if length < nlmsgHeaderLen || length > len(reply) {
+				return errors.Errorf("Execute(): Invalid netlink message length %d", length)
+			}
+			msgType := binary.NativeEndian.Uint16(reply[4:6])
+			seq := binary.NativeEndian.Uint32(reply[8:12])
+			if seq == c.seq && msgType == nlmsgError {
+				// nlmsgerr, a zero error is the acknowledgment
+				if length < nlmsgHeaderLen+4 {
+					return errors.Errorf("Execute(): Truncated netlink error")
+				}
+				errno := int32(binary.NativeEndian.Uint32(reply[nlmsgHeaderLen : nlmsgHeaderLen+4]))
+				if errno != 0 {
+					return errors.Wrapf(syscall.Errno(-errno), "Execute()")
+				}
+				return nil
+			}
+			reply = reply[(length+3)&^3:]
+		}
+	}
+}
+
+func (c *netlinkConn) Close() error {
+	return syscall.Close(c.fd)
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package xfrm
+
+import (
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
+	"github.com/guoweifk/n3iwue_ike_gw/security/esn"
+	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+)
+
+// TestNetlink installs Child SAs in the kernel. It is run in a network
+// namespace of its own, e.g. with XFRM_TEST=1 unshare -rn go test ./xfrm
+func TestNetlink(t *testing.T) {
+	if os.Getenv("XFRM_TEST") == "" {
+		t.Skip("XFRM_TEST is not set")
+	}
+
+	conn, err := Dial()
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, conn.Close())
+	}()
+
+	testcases := []struct {
+		description string
+		encrName    string
+		integName   string
+		esnName     string
+		mode        Mode
+		encap       *Encap
+	}{
+		{
+			description: "AES-CBC with HMAC-SHA2-256 in tunnel mode with NAT-T",
+			encrName:    encr.ENCR_AES_CBC_128,
+			integName:   integ.AUTH_HMAC_SHA2_256_128,
+			esnName:     esn.String_ESN_DISABLE,
+			mode:        ModeTunnel,
+			encap:       &Encap{LocalPort: 4500, RemotePort: 4500},
+		},
+		{
+			description: "AES-GCM with ESN in transport mode",
+			encrName:    encr.ENCR_AES_GCM_16_256,
+			esnName:     esn.String_ESN_ENABLE,
+			mode:        ModeTransport,
+		},
+	}
+
+	for i, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			childSA := &ChildSA{
+				Key:         newTestChildSAKey(t, tc.encrName, tc.integName, tc.esnName),
+				Role:        message.Role_Responder,
+				InboundSPI:  0x1000 + uint32(i),
+				OutboundSPI: 0x2000 + uint32(i),
+				Local:       netip.MustParseAddr("192.0.2.1"),
+				Remote:      netip.MustParseAddr("198.51.100.7"),
+				TSi:         message.IndividualTrafficSelectorContainer{addressTS("198.51.100.7/32", 0, 0xFFFF)},
+				TSr:         message.IndividualTrafficSelectorContainer{addressTS("192.0.2.1/32", 0, 0xFFFF)},
+				Mode:        tc.mode,
+				ReqID:       uint32(i + 1),
+				IfID:        uint32(i + 1),
+				Mark:        &Mark{Value: uint32(i + 1), Mask: 0xFFFFFFFF},
+				Encap:       tc.encap,
+			}
+			require.NoError(t, Install(conn, childSA))
+			// Already installed
+			require.Error(t, Install(conn, childSA))
+			require.NoError(t, Remove(conn, childSA))
+			require.Error(t, Remove(conn, childSA))
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package xfrm
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+)
+
+// selector is the traffic of a policy, a zero protocol or port matches any
+type selector struct {
+	src, dst         netip.Prefix
+	protocol         uint8
+	srcPort, dstPort uint16
+}
+
+// newSelector returns the selector of the traffic from the local to the remote
+// traffic selector, ok is false if no traffic matches both
+func newSelector(local, remote *message.IndividualTrafficSelector) (sel selector, ok bool, err error) {
+	if local.TSType != remote.TSType {
+		return sel, false, nil
+	}
+	if local.IPProtocolID != 0 && remote.IPProtocolID != 0 && local.IPProtocolID != remote.IPProtocolID {
+		return sel, false, nil
+	}
+	sel.protocol = local.IPProtocolID
+	if sel.protocol == 0 {
+		sel.protocol = remote.IPProtocolID
+	}
+
+	if sel.src, err = rangeToPrefix(local); err != nil {
+		return sel, false, errors.Wrapf(err, "newSelector()")
+	}
+	if sel.dst, err = rangeToPrefix(remote); err != nil {
+		return sel, false, errors.Wrapf(err, "newSelector()")
+	}
+	if sel.srcPort, err = rangeToPort(local); err != nil {
+		return sel, false, errors.Wrapf(err, "newSelector()")
+	}
+	if sel.dstPort, err = rangeToPort(remote); err != nil {
+		return sel, false, errors.Wrapf(err, "newSelector()")
+	}
+	return sel, true, nil
+}
+
+func (sel selector) reverse() selector {
+	return selector{
+		src:      sel.dst,
+		dst:      sel.src,
+		protocol: sel.protocol,
+		srcPort:  sel.dstPort,
+		dstPort:  sel.srcPort,
+	}
+}
+
+// put writes the xfrm_selector
+func (sel selector) put(b []byte) {
+	putAddress(b[0:16], sel.dst.Addr())
+	putAddress(b[16:32], sel.src.Addr())
+	if sel.dstPort != 0 {
+		binary.BigEndian.PutUint16(b[32:34], sel.dstPort)
+		binary.BigEndian.PutUint16(b[34:36], 0xFFFF)
+	}
+	if sel.srcPort != 0 {
+		binary.BigEndian.PutUint16(b[36:38], sel.srcPort)
+		binary.BigEndian.PutUint16(b[38:40], 0xFFFF)
+	}
+	binary.NativeEndian.PutUint16(b[40:42], family(sel.src.Addr()))
+	b[42] = uint8(sel.dst.Bits())
+	b[43] = uint8(sel.src.Bits())
+	b[44] = sel.protocol
+}
+
+// rangeToPrefix returns the prefix of the address range of the traffic
+// selector, which the kernel requires
+func rangeToPrefix(ts *message.IndividualTrafficSelector) (netip.Prefix, error) {
+	var addrLen int
+	switch ts.TSType {
+	case message.TS_IPV4_ADDR_RANGE:
+		addrLen = 4
+	case message.TS_IPV6_ADDR_RANGE:
+		addrLen = 16
+	default:
+		return netip.Prefix{}, errors.Errorf("rangeToPrefix(): Unsupported traffic selector type %d", ts.TSType)
+	}
+	if len(ts.StartAddress) != addrLen || len(ts.EndAddress) != addrLen {
+		return netip.Prefix{}, errors.Errorf("rangeToPrefix(): Invalid address length")
+	}
+
+	start, _ := netip.AddrFromSlice(ts.StartAddress)
+	end, _ := netip.AddrFromSlice(ts.EndAddress)
+	for bits := 0; bits <= addrLen*8; bits++ {
+		prefix := netip.PrefixFrom(start, bits)
+		if prefix.Masked().Addr() != start {
+			continue
+		}
+		// Last address of the prefix
+		last := start.AsSlice()
+		for i := bits; i < addrLen*8; i++ {
+			last[i/8] |= 0x80 >> (i % 8)
+		}
+		if lastAddr, _ := netip.AddrFromSlice(last); lastAddr == end {
+			return prefix, nil
+		}
+	}
+	return netip.Prefix{}, errors.Errorf("rangeToPrefix(): Range %s - %s is not a prefix", start, end)
+}
+
+// rangeToPort returns the port of the traffic selector, 0 for any port. Other
+// port ranges can not be expressed by a port and a mask.
+func rangeToPort(ts *message.IndividualTrafficSelector) (uint16, error) {
+	switch {
+	case ts.StartPort == 0 && ts.EndPort == 0xFFFF:
+		return 0, nil
+	case ts.StartPort == ts.EndPort && ts.StartPort != 0:
+		return ts.StartPort, nil
+	default:
+		return 0, errors.Errorf("rangeToPort(): Port range %d - %d is not supported", ts.StartPort, ts.EndPort)
+	}
+}
@@ -0,0 +1,441 @@
+package xfrm
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/pkg/errors"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+)
+
+// Netlink message types and flags (linux/netlink.h, linux/xfrm.h)
+const (
+	nlmsgHeaderLen = 16
+	nlmsgError     = 2
+
+	nlmFRequest = 0x1
+	nlmFAck     = 0x4
+	nlmFExcl    = 0x200
+	nlmFCreate  = 0x400
+
+	msgNewSA     = 0x10
+	msgDelSA     = 0x11
+	msgNewPolicy = 0x13
+	msgDelPolicy = 0x14
+)
+
+// Netlink attributes of the XFRM messages
+const (
+	attrAlgCrypt     = 2
+	attrEncap        = 4
+	attrTmpl         = 5
+	attrAlgAEAD      = 18
+	attrAlgAuthTrunc = 20
+	attrMark         = 21
+	attrReplayESN    = 23
+	attrIfID         = 31
+)
+
+// Length of the XFRM structures
+const (
+	selectorLen       = 56 // xfrm_selector
+	usersaInfoLen     = 224
+	usersaIDLen       = 24
+	userpolicyInfoLen = 168
+	userpolicyIDLen   = 64
+	userTmplLen       = 64
+	encapTmplLen      = 24
+	algNameLen        = 64
+)
+
+const (
+	afInet  = 2
+	afInet6 = 10
+
+	protoESP         = 50
+	udpEncapESPInUDP = 2
+	stateFlagESN     = 128
+
+	policyIn  = 0
+	policyOut = 1
+	policyFwd = 2
+
+	infinity = ^uint64(0)
+)
+
+// DefaultReplayWindow is the anti-replay window of the SAs installed
+const DefaultReplayWindow = 32
+
+type Mode uint8
+
+const (
+	ModeTransport Mode = 0
+	ModeTunnel    Mode = 1
+)
+
+// Mark selects the packets of the SAs and policies by their mark
+type Mark struct {
+	Value uint32
+	Mask  uint32
+}
+
+// Encap is the UDP encapsulation of ESP between the NAT-T ports of the IKE SA
+// (RFC 3948)
+type Encap struct {
+	LocalPort  uint16
+	RemotePort uint16
+}
+
+// ChildSA holds what is installed in the kernel for a Child SA: an SA for
+// each direction, and a policy for each pair of traffic selectors, inbound,
+// outbound and, in tunnel mode, forwarded
+type ChildSA struct {
+	Key  *security.ChildSAKey
+	Role message.Role
+
+	InboundSPI  uint32
+	OutboundSPI uint32
+	// Addresses of the IKE SA
+	Local  netip.Addr
+	Remote netip.Addr
+	// Traffic selectors of the initiator and of the responder
+	TSi message.IndividualTrafficSelectorContainer
+	TSr message.IndividualTrafficSelectorContainer
+
+	Mode  Mode
+	ReqID uint32
+	// XFRM interface ID, 0 if no interface is used
+	IfID  uint32
+	Mark  *Mark
+	Encap *Encap
+	// DefaultReplayWindow if zero
+	ReplayWindow uint32
+	Priority     uint32
+}
+
+// Conn sends netlink requests to the kernel and waits for their
+// acknowledgment
+type Conn interface {
+	Execute(msg []byte) error
+	Close() error
+}
+
+// Install adds the SAs and then the policies of the Child SA
+func Install(conn Conn, childSA *ChildSA) error {
+	messages, err := installMessages(childSA)
+	if err != nil {
+		return errors.Wrapf(err, "Install()")
+	}
+	for _, msg := range messages {
+		if err = conn.Execute(msg); err != nil {
+			return errors.Wrapf(err, "Install()")
+		}
+	}
+	return nil
+}
+
+// Remove deletes the policies and then the SAs of the Child SA. Every entry
+// is removed even if one fails, and the first error is returned.
+func Remove(conn Conn, childSA *ChildSA) error {
+	messages, err := removeMessages(childSA)
+	if err != nil {
+		return errors.Wrapf(err, "Remove()")
+	}
+	var firstErr error
+	for _, msg := range messages {
+		if err = conn.Execute(msg); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "Remove()")
+		}
+	}
+	return firstErr
+}
+
+// sa is one direction of the Child SA
+type sa struct {
+	src, dst         netip.Addr
+	spi              uint32
+	encKey, integKey []byte
+	srcPort, dstPort uint16
+}
+
+func (childSA *ChildSA) sas() (inbound, outbound sa) {
+	key := childSA.Key
+	inbound = sa{
+		src:      childSA.Remote,
+		dst:      childSA.Local,
+		spi:      childSA.InboundSPI,
+		encKey:   key.ResponderToInitiatorEncryptionKey,
+		integKey: key.ResponderToInitiatorIntegrityKey,
+	}
+	outbound = sa{
+		src:      childSA.Local,
+		dst:      childSA.Remote,
+		spi:      childSA.OutboundSPI,
+		encKey:   key.InitiatorToResponderEncryptionKey,
+		integKey: key.InitiatorToResponderIntegrityKey,
+	}
+	if childSA.Role == message.Role_Responder {
+		inbound.encKey, outbound.encKey = outbound.encKey, inbound.encKey
+		inbound.integKey, outbound.integKey = outbound.integKey, inbound.integKey
+	}
+	if childSA.Encap != nil {
+		inbound.srcPort, inbound.dstPort = childSA.Encap.RemotePort, childSA.Encap.LocalPort
+		outbound.srcPort, outbound.dstPort = childSA.Encap.LocalPort, childSA.Encap.RemotePort
+	}
+	return inbound, outbound
+}
+
+// policy is the traffic of a policy, and the direction it is applied to
+type policy struct {
+	dir      uint8
+	selector selector
+}
+
+func (childSA *ChildSA) policies() ([]policy, error) {
+	localTS, remoteTS := childSA.TSi, childSA.TSr
+	if childSA.Role == message.Role_Responder {
+		localTS, remoteTS = remoteTS, localTS
+	}
+
+	var policies []policy
+	for _, local := range localTS {
+		for _, remote := range remoteTS {
+			out, ok, err := newSelector(local, remote)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			in := out.reverse()
+			policies = append(policies, policy{dir: policyOut, selector: out}, policy{dir: policyIn, selector: in})
+			if childSA.Mode == ModeTunnel {
+				policies = append(policies, policy{dir: policyFwd, selector: in})
+			}
+		}
+	}
+	if len(policies) == 0 {
+		return nil, errors.Errorf("No policy for the traffic selectors")
+	}
+	return policies, nil
+}
+
+func (childSA *ChildSA) check() error {
+	if childSA.Key == nil || childSA.Key.EncrKInfo == nil {
+		return errors.Errorf("No encryption algorithm specified")
+	}
+	if !childSA.Local.IsValid() || !childSA.Remote.IsValid() || childSA.Local.Is4() != childSA.Remote.Is4() {
+		return errors.Errorf("Invalid addresses %s and %s", childSA.Local, childSA.Remote)
+	}
+	return nil
+}
+
+func installMessages(childSA *ChildSA) ([][]byte, error) {
+	if err := childSA.check(); err != nil {
+		return nil, err
+	}
+	policies, err := childSA.policies()
+	if err != nil {
+		return nil, err
+	}
+
+	var messages [][]byte
+	inbound, outbound := childSA.sas()
+	for _, s := range []sa{inbound, outbound} {
+		msg, saErr := newSAMessage(childSA, s)
+		if saErr != nil {
+			return nil, saErr
+		}
+		messages = append(messages, msg)
+	}
+	for _, p := range policies {
+		s := outbound
+		if p.dir != policyOut {
+			s = inbound
+		}
+		messages = append(messages, newPolicyMessage(childSA, p, s))
+	}
+	return messages, nil
+}
+
+func removeMessages(childSA *ChildSA) ([][]byte, error) {
+	if err := childSA.check(); err != nil {
+		return nil, err
+	}
+	policies, err := childSA.policies()
+	if err != nil {
+		return nil, err
+	}
+
+	var messages [][]byte
+	for _, p := range policies {
+		messages = append(messages, delPolicyMessage(childSA, p))
+	}
+	inbound, outbound := childSA.sas()
+	messages = append(messages, delSAMessage(childSA, inbound), delSAMessage(childSA, outbound))
+	return messages, nil
+}
+
+func family(addr netip.Addr) uint16 {
+	if addr.Is4() {
+		return afInet
+	}
+	return afInet6
+}
+
+// putAddress writes an xfrm_address_t, IPv4 addresses use the first 4 octets
+func putAddress(b []byte, addr netip.Addr) {
+	if !addr.IsValid() {
+		return
+	}
+	copy(b[:16], addr.AsSlice())
+}
+
+func newSAMessage(childSA *ChildSA, s sa) ([]byte, error) {
+	window := childSA.ReplayWindow
+	if window == 0 {
+		window = DefaultReplayWindow
+	}
+	esn := childSA.Key.EsnInfo.GetNeedESN()
+
+	// xfrm_usersa_info
+	info := make([]byte, usersaInfoLen)
+	binary.NativeEndian.PutUint16(info[40:42], family(s.dst))
+	putAddress(info[56:72], s.dst)
+	binary.BigEndian.PutUint32(info[72:76], s.spi)
+	info[76] = protoESP
+	putAddress(info[80:96], s.src)
+	for i := 0; i < 4; i++ {
+		binary.NativeEndian.PutUint64(info[96+i*8:104+i*8], infinity)
+	}
+	binary.NativeEndian.PutUint32(info[208:212], childSA.ReqID)
+	binary.NativeEndian.PutUint16(info[212:214], family(s.dst))
+	info[214] = uint8(childSA.Mode)
+
+	var attrs [][]byte
+	// Windows over 255 packets and ESN need the xfrm_replay_state_esn
+	if esn || window > 0xFF {
+		if esn {
+			info[216] = stateFlagESN
+		}
+		attrs = append(attrs, replayESNAttribute(window))
+	} else {
+		info[215] = uint8(window)
+	}
+
+	algAttrs, err := algorithmAttributes(childSA.Key, s.encKey, s.integKey)
+	if err != nil {
+		return nil, err
+	}
+	attrs = append(attrs, algAttrs...)
+	if childSA.Encap != nil {
+		// xfrm_encap_tmpl
+		encap := make([]byte, encapTmplLen)
+		binary.NativeEndian.PutUint16(encap[0:2], udpEncapESPInUDP)
+		binary.BigEndian.PutUint16(encap[2:4], s.srcPort)
+		binary.BigEndian.PutUint16(encap[4:6], s.dstPort)
+		attrs = append(attrs, attribute(attrEncap, encap))
+	}
+	attrs = append(attrs, childSA.commonAttributes()...)
+	return netlinkMessage(msgNewSA, nlmFRequest|nlmFAck|nlmFCreate|nlmFExcl, info, attrs...), nil
+}
+
+func replayESNAttribute(window uint32) []byte {
+	// xfrm_replay_state_esn, with the bitmap of the window
+	bmpLen := (window + 31) / 32
+	replay := make([]byte, 24+bmpLen*4)
+	binary.NativeEndian.PutUint32(replay[0:4], bmpLen)
+	binary.NativeEndian.PutUint32(replay[20:24], window)
+	return attribute(attrReplayESN, replay)
+}
+
+func (childSA *ChildSA) commonAttributes() [][]byte {
+	var attrs [][]byte
+	if childSA.Mark != nil {
+		mark := make([]byte, 8)
+		binary.NativeEndian.PutUint32(mark[0:4], childSA.Mark.Value)
+		binary.NativeEndian.PutUint32(mark[4:8], childSA.Mark.Mask)
+		attrs = append(attrs, attribute(attrMark, mark))
+	}
+	if childSA.IfID != 0 {
+		ifID := make([]byte, 4)
+		binary.NativeEndian.PutUint32(ifID, childSA.IfID)
+		attrs = append(attrs, attribute(attrIfID, ifID))
+	}
+	return attrs
+}
+
+func newPolicyMessage(childSA *ChildSA, p policy, s sa) []byte {
+	// xfrm_userpolicy_info
+	info := make([]byte, userpolicyInfoLen)
+	p.selector.put(info[0:selectorLen])
+	for i := 0; i < 4; i++ {
+		binary.NativeEndian.PutUint64(info[56+i*8:64+i*8], infinity)
+	}
+	binary.NativeEndian.PutUint32(info[152:156], childSA.Priority)
+	info[160] = p.dir
+
+	// xfrm_user_tmpl of the SA applied to the traffic
+	tmpl := make([]byte, userTmplLen)
+	putAddress(tmpl[0:16], s.dst)
+	tmpl[20] = protoESP
+	binary.NativeEndian.PutUint16(tmpl[24:26], family(s.dst))
+	putAddress(tmpl[28:44], s.src)
+	binary.NativeEndian.PutUint32(tmpl[44:48], childSA.ReqID)
+	tmpl[48] = uint8(childSA.Mode)
+	for i := 52; i < userTmplLen; i++ {
+		tmpl[i] = 0xFF
+	}
+
+	attrs := append([][]byte{attribute(attrTmpl, tmpl)}, childSA.commonAttributes()...)
+	return netlinkMessage(msgNewPolicy, nlmFRequest|nlmFAck|nlmFCreate|nlmFExcl, info, attrs...)
+}
+
+func delSAMessage(childSA *ChildSA, s sa) []byte {
+	// xfrm_usersa_id
+	id := make([]byte, usersaIDLen)
+	putAddress(id[0:16], s.dst)
+	binary.BigEndian.PutUint32(id[16:20], s.spi)
+	binary.NativeEndian.PutUint16(id[20:22], family(s.dst))
+	id[22] = protoESP
+
+	var attrs [][]byte
+	if childSA.Mark != nil {
+		attrs = childSA.commonAttributes()[:1]
+	}
+	return netlinkMessage(msgDelSA, nlmFRequest|nlmFAck, id, attrs...)
+}
+
+func delPolicyMessage(childSA *ChildSA, p policy) []byte {
+	// xfrm_userpolicy_id
+	id := make([]byte, userpolicyIDLen)
+	p.selector.put(id[0:selectorLen])
+	id[60] = p.dir
+	return netlinkMessage(msgDelPolicy, nlmFRequest|nlmFAck, id, childSA.commonAttributes()...)
+}
+
+// netlinkMessage returns the message with its netlink header. The sequence
+// number is set by the Conn.
+func netlinkMessage(msgType, flags uint16, body []byte, attrs ...[]byte) []byte {
+	msg := make([]byte, nlmsgHeaderLen, nlmsgHeaderLen+len(body))
+	msg = append(msg, body...)
+	for _, attr := range attrs {
+		msg = append(msg, attr...)
+	}
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], flags)
+	return msg
+}
+
+// attribute returns a netlink attribute padded to 4 octets
+func attribute(attrType uint16, data []byte) []byte {
+	length := 4 + len(data)
+	attr := make([]byte, 4, (length+3)&^3)
+	binary.NativeEndian.PutUint16(attr[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(attr[2:4], attrType)
+	attr = append(attr, data...)
+	return attr[:cap(attr)]
+}
@@ -0,0 +1,328 @@
+package xfrm
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/guoweifk/n3iwue_ike_gw/message"
+	"github.com/guoweifk/n3iwue_ike_gw/security"
+	"github.com/guoweifk/n3iwue_ike_gw/security/encr"
+	"github.com/guoweifk/n3iwue_ike_gw/security/esn"
+	"github.com/guoweifk/n3iwue_ike_gw/security/integ"
+)
+
+func newTestChildSAKey(t *testing.T, encrName, integName, esnName string) *security.ChildSAKey {
+	esnInfo, err := esn.StrToType(esnName)
+	require.NoError(t, err)
+	key := &security.ChildSAKey{
+		EncrKInfo: encr.StrToKType(encrName),
+		EsnInfo:   esnInfo,
+	}
+	key.InitiatorToResponderEncryptionKey = make([]byte, key.EncrKInfo.GetKeyLength())
+	key.ResponderToInitiatorEncryptionKey = make([]byte, key.EncrKInfo.GetKeyLength())
+	for i := range key.InitiatorToResponderEncryptionKey {
+		key.InitiatorToResponderEncryptionKey[i] = 0x11
+		key.ResponderToInitiatorEncryptionKey[i] = 0x22
+	}
+	if integName != "" {
+		key.IntegKInfo = integ.StrToKType(integName)
+		key.InitiatorToResponderIntegrityKey = make([]byte, key.IntegKInfo.GetKeyLength())
+		key.ResponderToInitiatorIntegrityKey = make([]byte, key.IntegKInfo.GetKeyLength())
+	}
+	return key
+}
+
+func addressTS(prefix string, startPort, endPort uint16) *message.IndividualTrafficSelector {
+	p := netip.MustParsePrefix(prefix)
+	start := p.Masked().Addr().AsSlice()
+	end := append([]byte{}, start...)
+	for i := p.Bits(); i < len(end)*8; i++ {
+		end[i/8] |= 0x80 >> (i % 8)
+	}
+	ts := &message.IndividualTrafficSelector{
+		TSType:       message.TS_IPV4_ADDR_RANGE,
+		StartPort:    startPort,
+		EndPort:      endPort,
+		StartAddress: start,
+		EndAddress:   end,
+	}
+	if p.Addr().Is6() {
+		ts.TSType = message.TS_IPV6_ADDR_RANGE
+	}
+	return ts
+}
+
+// attributes returns the netlink attributes following the body of the message
+func attributes(t *testing.T, msg []byte, bodyLen int) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for b := msg[nlmsgHeaderLen+bodyLen:]; len(b) > 0; {
+		require.GreaterOrEqual(t, len(b), 4)
+		length := int(binary.NativeEndian.Uint16(b[0:2]))
+		require.GreaterOrEqual(t, len(b), length)
+		attrs[binary.NativeEndian.Uint16(b[2:4])] = b[4:length]
+		b = b[(length+3)&^3:]
+	}
+	return attrs
+}
+
+func TestInstall(t *testing.T) {
+	newChildSA := func(t *testing.T) *ChildSA {
+		return &ChildSA{
+			Key:          newTestChildSAKey(t, encr.ENCR_AES_CBC_128, integ.AUTH_HMAC_SHA2_256_128, esn.String_ESN_DISABLE),
+			Role:         message.Role_Responder,
+			InboundSPI:   0x1001,
+			OutboundSPI:  0x2002,
+			Local:        netip.MustParseAddr("192.0.2.1"),
+			Remote:       netip.MustParseAddr("198.51.100.7"),
+			TSi:          message.IndividualTrafficSelectorContainer{addressTS("10.60.0.1/32", 0, 0xFFFF)},
+			TSr:          message.IndividualTrafficSelectorContainer{addressTS("0.0.0.0/0", 0, 0xFFFF)},
+			Mode:         ModeTunnel,
+			ReqID:        7,
+			IfID:         3,
+			Mark:         &Mark{Value: 5, Mask: 0xFFFFFFFF},
+			Encap:        &Encap{LocalPort: 4500, RemotePort: 31000},
+			ReplayWindow: 64,
+			Priority:     1000,
+		}
+	}
+
+	t.Run("Tunnel mode with NAT-T", func(t *testing.T) {
+		childSA := newChildSA(t)
+		conn := &FakeConn{}
+		require.NoError(t, Install(conn, childSA))
+		// 2 SAs, then the out, in and fwd policies
+		require.Len(t, conn.Messages, 5)
+		for i, msgType := range []uint16{msgNewSA, msgNewSA, msgNewPolicy, msgNewPolicy, msgNewPolicy} {
+			msg := conn.Messages[i]
+			require.Equal(t, uint32(len(msg)), binary.NativeEndian.Uint32(msg[0:4]))
+			require.Equal(t, msgType, binary.NativeEndian.Uint16(msg[4:6]))
+		}
+
+		// Inbound SA, keyed with the initiator keys as the responder
+		info := conn.Messages[0][nlmsgHeaderLen:]
+		require.Equal(t, childSA.Local.AsSlice(), info[56:60])
+		require.Equal(t, uint32(0x1001), binary.BigEndian.Uint32(info[72:76]))
+		require.Equal(t, uint8(protoESP), info[76])
+		require.Equal(t, childSA.Remote.AsSlice(), info[80:84])
+		require.Equal(t, uint32(7), binary.NativeEndian.Uint32(info[208:212]))
+		require.Equal(t, uint16(afInet), binary.NativeEndian.Uint16(info[212:214]))
+		require.Equal(t, uint8(ModeTunnel), info[214])
+		require.Equal(t, uint8(64), info[215])
+		require.Zero(t, info[216])
+
+		attrs := attributes(t, conn.Messages[0], usersaInfoLen)
+		crypt := attrs[attrAlgCrypt]
+		require.Equal(t, "cbc(aes)", string(crypt[:len("cbc(aes)")]))
+		require.Equal(t, uint32(128), binary.NativeEndian.Uint32(crypt[algNameLen:algNameLen+4]))
+		require.Equal(t, childSA.Key.InitiatorToResponderEncryptionKey, crypt[algNameLen+4:])
+		auth := attrs[attrAlgAuthTrunc]
+		require.Equal(t, "hmac(sha256)", string(auth[:len("hmac(sha256)")]))
+		require.Equal(t, uint32(128), binary.NativeEndian.Uint32(auth[algNameLen+4:algNameLen+8]))
+		encap := attrs[attrEncap]
+		require.Len(t, encap, encapTmplLen)
+		require.Equal(t, uint16(udpEncapESPInUDP), binary.NativeEndian.Uint16(encap[0:2]))
+		require.Equal(t, uint16(31000), binary.BigEndian.Uint16(encap[2:4]))
+		require.Equal(t, uint16(4500), binary.BigEndian.Uint16(encap[4:6]))
+		require.Equal(t, []byte{5, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}, attrs[attrMark])
+		require.Equal(t, uint32(3), binary.NativeEndian.Uint32(attrs[attrIfID]))
+
+		// Outbound SA
+		info = conn.Messages[1][nlmsgHeaderLen:]
+		require.Equal(t, childSA.Remote.AsSlice(), info[56:60])
+		require.Equal(t, uint32(0x2002), binary.BigEndian.Uint32(info[72:76]))
+		attrs = attributes(t, conn.Messages[1], usersaInfoLen)
+		require.Equal(t, childSA.Key.ResponderToInitiatorEncryptionKey, attrs[attrAlgCrypt][algNameLen+4:])
+		require.Equal(t, uint16(4500), binary.BigEndian.Uint16(attrs[attrEncap][2:4]))
+
+		// Outbound policy, from the TSr of the responder to its TSi
+		info = conn.Messages[2][nlmsgHeaderLen:]
+		require.Equal(t, []byte{10, 60, 0, 1}, info[0:4])
+		require.Equal(t, uint8(32), info[42])
+		require.Equal(t, uint8(0), info[43])
+		require.Equal(t, uint32(1000), binary.NativeEndian.Uint32(info[152:156]))
+		require.Equal(t, uint8(policyOut), info[160])
+		attrs = attributes(t, conn.Messages[2], userpolicyInfoLen)
+		tmpl := attrs[attrTmpl]
+		require.Len(t, tmpl, userTmplLen)
+		require.Equal(t, childSA.Remote.AsSlice(), tmpl[0:4])
+		require.Equal(t, childSA.Local.AsSlice(), tmpl[28:32])
+		require.Equal(t, uint32(7), binary.NativeEndian.Uint32(tmpl[44:48]))
+		require.Equal(t, uint8(ModeTunnel), tmpl[48])
+		require.Contains(t, attrs, uint16(attrIfID))
+
+		// Inbound and forwarded policies
+		for i, dir := range []uint8{policyIn, policyFwd} {
+			info = conn.Messages[3+i][nlmsgHeaderLen:]
+			require.Equal(t, []byte{10, 60, 0, 1}, info[16:20])
+			require.Equal(t, uint8(32), info[43])
+			require.Equal(t, dir, info[160])
+			tmpl = attributes(t, conn.Messages[3+i], userpolicyInfoLen)[attrTmpl]
+			require.Equal(t, childSA.Local.AsSlice(), tmpl[0:4])
+		}
+	})
+
+	t.Run("Transport mode with AES-GCM and ESN", func(t *testing.T) {
+		childSA := newChildSA(t)
+		childSA.Key = newTestChildSAKey(t, encr.ENCR_AES_GCM_16_256, "", esn.String_ESN_ENABLE)
+		childSA.Role = message.Role_Initiator
+		childSA.Mode = ModeTransport
+		childSA.TSi = message.IndividualTrafficSelectorContainer{addressTS("192.0.2.1/32", 0, 0xFFFF)}
+		childSA.TSr = message.IndividualTrafficSelectorContainer{addressTS("198.51.100.7/32", 2152, 2152)}
+		childSA.TSr[0].IPProtocolID = 17
+		childSA.Mark, childSA.IfID, childSA.Encap = nil, 0, nil
+
+		conn := &FakeConn{}
+		require.NoError(t, Install(conn, childSA))
+		require.Len(t, conn.Messages, 4)
+
+		info := conn.Messages[0][nlmsgHeaderLen:]
+		require.Zero(t, info[215])
+		require.Equal(t, uint8(stateFlagESN), info[216])
+		attrs := attributes(t, conn.Messages[0], usersaInfoLen)
+		require.NotContains(t, attrs, uint16(attrAlgCrypt))
+		require.NotContains(t, attrs, uint16(attrEncap))
+		require.NotContains(t, attrs, uint16(attrMark))
+		aead := attrs[attrAlgAEAD]
+		require.Equal(t, "rfc4106(gcm(aes))", string(aead[:len("rfc4106(gcm(aes))")]))
+		require.Equal(t, uint32(288), binary.NativeEndian.Uint32(aead[algNameLen:algNameLen+4]))
+		require.Equal(t, uint32(128), binary.NativeEndian.Uint32(aead[algNameLen+4:algNameLen+8]))
+		require.Equal(t, childSA.Key.ResponderToInitiatorEncryptionKey, aead[algNameLen+8:])
+		replay := attrs[attrReplayESN]
+		require.Equal(t, uint32(2), binary.NativeEndian.Uint32(replay[0:4]))
+		require.Equal(t, uint32(64), binary.NativeEndian.Uint32(replay[20:24]))
+		require.Len(t, replay, 24+8)
+
+		// Outbound policy to the GTP-U port of the responder
+		info = conn.Messages[2][nlmsgHeaderLen:]
+		require.Equal(t, uint16(2152), binary.BigEndian.Uint16(info[32:34]))
+		require.Equal(t, uint16(0xFFFF), binary.BigEndian.Uint16(info[34:36]))
+		require.Zero(t, binary.BigEndian.Uint16(info[38:40]))
+		require.Equal(t, uint8(17), info[44])
+		require.Equal(t, uint8(policyOut), info[160])
+		info = conn.Messages[3][nlmsgHeaderLen:]
+		require.Equal(t, uint16(2152), binary.BigEndian.Uint16(info[36:38]))
+		require.Equal(t, uint8(policyIn), info[160])
+	})
+
+	t.Run("Error of the kernel", func(t *testing.T) {
+		conn := &FakeConn{Err: errors.New("file exists")}
+		require.Error(t, Install(conn, newChildSA(t)))
+	})
+
+	t.Run("Invalid Child SA", func(t *testing.T) {
+		childSA := newChildSA(t)
+		childSA.Remote = netip.MustParseAddr("2001:db8::1")
+		require.Error(t, Install(&FakeConn{}, childSA))
+
+		childSA = newChildSA(t)
+		childSA.TSr = message.IndividualTrafficSelectorContainer{addressTS("2001:db8::/32", 0, 0xFFFF)}
+		require.Error(t, Install(&FakeConn{}, childSA))
+	})
+}
+
+func TestRemove(t *testing.T) {
+	childSA := &ChildSA{
+		Key:         newTestChildSAKey(t, encr.ENCR_AES_CBC_256, integ.AUTH_HMAC_SHA1_96, esn.String_ESN_DISABLE),
+		Role:        message.Role_Initiator,
+		InboundSPI:  0x1001,
+		OutboundSPI: 0x2002,
+		Local:       netip.MustParseAddr("2001:db8::1"),
+		Remote:      netip.MustParseAddr("2001:db8::2"),
+		TSi:         message.IndividualTrafficSelectorContainer{addressTS("2001:db8:1::/48", 0, 0xFFFF)},
+		TSr:         message.IndividualTrafficSelectorContainer{addressTS("::/0", 0, 0xFFFF)},
+		Mode:        ModeTunnel,
+		Mark:        &Mark{Value: 9, Mask: 0xFF},
+	}
+
+	conn := &FakeConn{}
+	require.NoError(t, Remove(conn, childSA))
+	require.Len(t, conn.Messages, 5)
+	for i, dir := range []uint8{policyOut, policyIn, policyFwd} {
+		msg := conn.Messages[i]
+		require.Equal(t, uint16(msgDelPolicy), binary.NativeEndian.Uint16(msg[4:6]))
+		id := msg[nlmsgHeaderLen:]
+		require.Equal(t, uint16(afInet6), binary.NativeEndian.Uint16(id[40:42]))
+		require.Equal(t, dir, id[60])
+		require.Contains(t, attributes(t, msg, userpolicyIDLen), uint16(attrMark))
+	}
+	for i, spi := range []uint32{0x1001, 0x2002} {
+		msg := conn.Messages[3+i]
+		require.Equal(t, uint16(msgDelSA), binary.NativeEndian.Uint16(msg[4:6]))
+		id := msg[nlmsgHeaderLen:]
+		require.Equal(t, spi, binary.BigEndian.Uint32(id[16:20]))
+		require.Equal(t, uint8(protoESP), id[22])
+		require.Equal(t, []byte{9, 0, 0, 0, 0xFF, 0, 0, 0}, attributes(t, msg, usersaIDLen)[attrMark])
+	}
+	require.Equal(t, childSA.Local.AsSlice(), conn.Messages[3][nlmsgHeaderLen:nlmsgHeaderLen+16])
+	require.Equal(t, childSA.Remote.AsSlice(), conn.Messages[4][nlmsgHeaderLen:nlmsgHeaderLen+16])
+
+	conn.Err = errors.New("no such process")
+	require.Error(t, Remove(conn, childSA))
+}
+
+func TestRangeToPrefix(t *testing.T) {
+	testcases := []struct {
+		description string
+		start, end  string
+		expected    string
+		expectErr   bool
+	}{
+		{description: "Host", start: "10.0.0.1", end: "10.0.0.1", expected: "10.0.0.1/32"},
+		{description: "Subnet", start: "10.60.0.0", end: "10.60.255.255", expected: "10.60.0.0/16"},
+		{description: "Any", start: "0.0.0.0", end: "255.255.255.255", expected: "0.0.0.0/0"},
+		{description: "IPv6", start: "2001:db8::", end: "2001:db8::ffff", expected: "2001:db8::/112"},
+		{description: "Not aligned", start: "10.0.0.1", end: "10.0.0.2", expectErr: true},
+		{description: "Not a power of two", start: "10.0.0.0", end: "10.0.0.2", expectErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			start, end := netip.MustParseAddr(tc.start), netip.MustParseAddr(tc.end)
+			ts := &message.IndividualTrafficSelector{
+				TSType:       message.TS_IPV4_ADDR_RANGE,
+				StartAddress: start.AsSlice(),
+				EndAddress:   end.AsSlice(),
+			}
+			if start.Is6() {
+				ts.TSType = message.TS_IPV6_ADDR_RANGE
+			}
+			prefix, err := rangeToPrefix(ts)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, netip.MustParsePrefix(tc.expected), prefix)
+		})
+	}
+}
+
+func TestRangeToPort(t *testing.T) {
+	testcases := []struct {
+		description        string
+		startPort, endPort uint16
+		expected           uint16
+		expectErr          bool
+	}{
+		{description: "Any port", startPort: 0, endPort: 0xFFFF, expected: 0},
+		{description: "Single port", startPort: 2152, endPort: 2152, expected: 2152},
+		{description: "Range", startPort: 1000, endPort: 2000, expectErr: true},
+		{description: "Opaque", startPort: 0xFFFF, endPort: 0, expectErr: true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			port, err := rangeToPort(&message.IndividualTrafficSelector{StartPort: tc.startPort, EndPort: tc.endPort})
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, port)
+		})
+	}
+}